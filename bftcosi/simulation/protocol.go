@@ -22,7 +22,6 @@ In the Node-method you can read the files that have been created by the
 import (
 	"errors"
 	//"strconv"
-	"math/rand"
 
 	"github.com/BurntSushi/toml"
 	"github.com/csanti/pbft-experiments/bftcosi/protocol"
@@ -53,6 +52,7 @@ func init() {
 // SimulationProtocol implements onet.Simulation.
 type SimulationProtocol struct {
 	onet.SimulationBFTree
+	blockchain.Workload
 	NSubtrees int
 	FailingSubleaders int
 	FailingLeafs int
@@ -164,9 +164,16 @@ func (s *SimulationProtocol) Run(config *onet.SimulationConfig) error {
 			return err
 		}
 	} else {
-		log.Lvl1("LoadBlock is false, generating random block of size ", s.BlockSize)
-		binaryBlock = make([]byte, s.BlockSize)
-		rand.Read(binaryBlock)
+		log.Lvl1("LoadBlock is false, generating block of size", s.BlockSize)
+		transactions := blockchain.NewGenerator(s.Workload).GenesisBlock(s.BlockSize)
+		block, err := GetBlock(len(transactions), transactions, "0", "0", 0)
+		if err != nil {
+			return err
+		}
+		binaryBlock, err = block.MarshalBinary()
+		if err != nil {
+			return err
+		}
 	}
 
 
@@ -0,0 +1,138 @@
+// Package blocksync lets a replica of the onet protocols, pbft and blsftcosi,
+// that missed blocks, or joined later, fetch them from its peers. It is the
+// sync of cothority/protocols/byzcoin/blocksync for onet. The root of the
+// tree is the lagging replica, it fetches the blocks with the Fetcher of the
+// shared fetch package. All other nodes serve the blocks of their store.
+package blocksync
+
+import (
+	"sync"
+
+	"github.com/csanti/onet"
+	"github.com/csanti/onet/log"
+	"github.com/csanti/onet/network"
+	"github.com/csanti/onet/simul/monitor"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain/blockstore"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blocksync/fetch"
+)
+
+// Name of the protocol
+const Name = "BlockSync"
+
+func init() {
+	for _, msg := range []interface{}{fetch.GetStatus{}, fetch.Status{},
+		fetch.GetBlocks{}, fetch.Blocks{}, fetch.Finish{}} {
+		network.RegisterMessage(msg)
+	}
+	onet.GlobalProtocolRegister(Name, NewSync)
+}
+
+// Sync fetches the missing blocks on the root and serves the blocks of its
+// store on all other nodes. The Store, Verify, OnBlock and limits of the
+// Fetcher are set on the root before Start.
+type Sync struct {
+	*onet.TreeNodeInstance
+	*fetch.Fetcher
+	// Finished gets the result of the sync on the root
+	Finished chan error
+	peers    []*onet.TreeNode
+}
+
+var stores = struct {
+	nodes map[string]*blockstore.Store
+	sync.Mutex
+}{nodes: make(map[string]*blockstore.Store)}
+
+// RegisterStore sets the store the node with the given ID syncs and serves.
+func RegisterStore(node string, s *blockstore.Store) {
+	stores.Lock()
+	defer stores.Unlock()
+	stores.nodes[node] = s
+}
+
+// NewSync returns the protocol of a node with its registered store.
+func NewSync(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	stores.Lock()
+	store := stores.nodes[n.ServerIdentity().ID.String()]
+	stores.Unlock()
+	p := &Sync{
+		TreeNodeInstance: n,
+		Finished:         make(chan error, 1),
+	}
+	for _, tn := range n.List() {
+		if !tn.ID.Equal(n.TreeNode().ID) {
+			p.peers = append(p.peers, tn)
+		}
+	}
+	p.Fetcher = fetch.NewFetcher(store, len(p.peers), p.send)
+	if err := p.RegisterHandlers(p.HandleGetStatus, p.HandleStatus,
+		p.HandleGetBlocks, p.HandleBlocks, p.HandleFinish); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Start starts the sync on the root, the result is sent to Finished.
+func (p *Sync) Start() error {
+	go func() {
+		n, err := p.Fetch()
+		if n > 0 {
+			monitor.NewSingleMeasure("sync_blocks", float64(n)).Record()
+		}
+		for _, tn := range p.peers {
+			if err := p.SendTo(tn, &fetch.Finish{}); err != nil {
+				log.Lvl2("Couldn't finish", tn.ServerIdentity, err)
+			}
+		}
+		p.Done()
+		p.Finished <- err
+	}()
+	return nil
+}
+
+// HandleGetStatus sends the height of the store to the root.
+func (p *Sync) HandleGetStatus(msg StructGetStatus) error {
+	return p.SendTo(msg.TreeNode, fetch.StatusOf(p.Store))
+}
+
+// HandleStatus passes the height of a peer to the Fetcher.
+func (p *Sync) HandleStatus(msg StructStatus) error {
+	if peer := p.peer(msg.TreeNode); peer >= 0 {
+		p.ReceiveStatus(peer, &msg.Status)
+	}
+	return nil
+}
+
+// HandleGetBlocks sends the asked blocks to the root.
+func (p *Sync) HandleGetBlocks(msg StructGetBlocks) error {
+	return p.SendTo(msg.TreeNode, fetch.BlocksOf(p.Store, &msg.GetBlocks))
+}
+
+// HandleBlocks passes the blocks of a peer to the Fetcher.
+func (p *Sync) HandleBlocks(msg StructBlocks) error {
+	if peer := p.peer(msg.TreeNode); peer >= 0 {
+		p.ReceiveBlocks(peer, &msg.Blocks)
+	}
+	return nil
+}
+
+// HandleFinish stops the protocol on a peer.
+func (p *Sync) HandleFinish(msg StructFinish) error {
+	p.Done()
+	return nil
+}
+
+// send sends a message of the Fetcher to a peer.
+func (p *Sync) send(peer int, msg interface{}) error {
+	return p.SendTo(p.peers[peer], msg)
+}
+
+// peer returns the index of the tree node in the peers, or -1.
+func (p *Sync) peer(tn *onet.TreeNode) int {
+	for i, peer := range p.peers {
+		if peer.ID.Equal(tn.ID) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,129 @@
+package blocksync
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/csanti/onet"
+	"github.com/csanti/onet/log"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain/blockstore"
+	"go.dedis.ch/kyber/group/edwards25519"
+)
+
+var tSuite = edwards25519.NewBlakeSHA256Ed25519()
+
+func TestMain(m *testing.M) {
+	log.MainTest(m)
+}
+
+// chain returns n blocks linked by their hashes, with the hash of the hash
+// as signature.
+func chain(n int) []*blockstore.Entry {
+	var entries []*blockstore.Entry
+	var prev []byte
+	for i := 0; i < n; i++ {
+		block := []byte("block " + strconv.Itoa(i))
+		hash := sha256.Sum256(append(prev, block...))
+		sig := sha256.Sum256(hash[:])
+		entries = append(entries, &blockstore.Entry{
+			Height:    uint64(i),
+			Hash:      hash[:],
+			Block:     block,
+			Signature: sig[:],
+		})
+		prev = hash[:]
+	}
+	return entries
+}
+
+func verify(prev, e *blockstore.Entry) error {
+	var parent []byte
+	if prev != nil {
+		parent = prev.Hash
+	}
+	hash := sha256.Sum256(append(append([]byte{}, parent...), e.Block...))
+	sig := sha256.Sum256(hash[:])
+	if !bytes.Equal(hash[:], e.Hash) || !bytes.Equal(sig[:], e.Signature) {
+		return errors.New("wrong block")
+	}
+	return nil
+}
+
+func TestSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blocksync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	hosts, _, tree := local.GenTree(5, true)
+
+	blocks := chain(30)
+	var stores []*blockstore.Store
+	for i, h := range hosts {
+		s, err := blockstore.Open(filepath.Join(dir, strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		n := len(blocks)
+		if i == 0 {
+			// the root missed most blocks
+			n = 3
+		}
+		for j, e := range blocks[:n] {
+			if i == 4 && j >= 3 {
+				// the last node sends wrong blocks
+				bad := *e
+				bad.Block = []byte("bad")
+				e = &bad
+			}
+			if err := s.Append(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		RegisterStore(h.ServerIdentity.ID.String(), s)
+		stores = append(stores, s)
+	}
+
+	pi, err := local.CreateProtocol(Name, tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := pi.(*Sync)
+	root.Verify = verify
+	root.ChunkSize = 4
+	var got int
+	root.OnBlock = func(*blockstore.Entry) { got++ }
+	if err := root.Start(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-root.Finished:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Sync didn't finish")
+	}
+	if stores[0].Len() != uint64(len(blocks)) || got != len(blocks)-3 {
+		t.Fatal("Synced only", stores[0].Len(), "blocks")
+	}
+	for _, e := range blocks {
+		stored, err := stores[0].Get(e.Height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(stored.Block, e.Block) {
+			t.Fatal("Wrong block at height", e.Height)
+		}
+	}
+}
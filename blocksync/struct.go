@@ -0,0 +1,41 @@
+package blocksync
+
+import (
+	"github.com/csanti/onet"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blocksync/fetch"
+)
+
+// StructGetStatus just contains GetStatus and the data necessary to identify
+// and process the message in the onet framework.
+type StructGetStatus struct {
+	*onet.TreeNode
+	fetch.GetStatus
+}
+
+// StructStatus just contains Status and the data necessary to identify and
+// process the message in the onet framework.
+type StructStatus struct {
+	*onet.TreeNode
+	fetch.Status
+}
+
+// StructGetBlocks just contains GetBlocks and the data necessary to identify
+// and process the message in the onet framework.
+type StructGetBlocks struct {
+	*onet.TreeNode
+	fetch.GetBlocks
+}
+
+// StructBlocks just contains Blocks and the data necessary to identify and
+// process the message in the onet framework.
+type StructBlocks struct {
+	*onet.TreeNode
+	fetch.Blocks
+}
+
+// StructFinish just contains Finish and the data necessary to identify and
+// process the message in the onet framework.
+type StructFinish struct {
+	*onet.TreeNode
+	fetch.Finish
+}
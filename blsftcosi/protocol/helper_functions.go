@@ -3,6 +3,7 @@ package protocol
 import (
 	"fmt"
 	"errors"
+	"encoding/json"
 
 	"go.dedis.ch/kyber"
 	"go.dedis.ch/kyber/sign/bls"
@@ -11,6 +12,8 @@ import (
 	"github.com/csanti/onet/log"
 	"github.com/csanti/onet/network"
 	"github.com/csanti/onet/simul/monitor"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain/blockstore"
 
 )
 
@@ -140,6 +143,31 @@ func AppendSigAndMask(signature []byte, mask *Mask) ([]byte) {
 	return append(signature, mask.mask...)
 }
 
+// VerifyEntry returns a function checking the blocks stored by the
+// simulation, e.g. to sync them with blocksync: every block has to follow the
+// previous one and its signature and mask have to fulfill the policy.
+func VerifyEntry(suite pairing.Suite, publics []kyber.Point, policy Policy) func(prev, e *blockstore.Entry) error {
+	return func(prev, e *blockstore.Entry) error {
+		block := &blockchain.TrBlock{}
+		if err := json.Unmarshal(e.Block, block); err != nil {
+			return err
+		}
+		if block.HeaderHash != string(e.Hash) ||
+			block.HeaderHash != blockchain.HashHeader(block.Header) {
+			return errors.New("wrong header hash")
+		}
+		parent := "0"
+		if prev != nil {
+			parent = string(prev.Hash)
+		}
+		if block.Header.Parent != parent {
+			return errors.New("block doesn't follow the previous one")
+		}
+		sig := append(append([]byte{}, e.Signature...), e.Mask...)
+		return Verify(suite, publics, e.Block, sig, policy)
+	}
+}
+
 // Verify checks the given cosignature on the provided message using the list
 // of public keys and cosigning policy.
 func Verify(suite pairing.Suite, publics []kyber.Point, message, sig []byte, policy Policy) error {
@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"crypto/sha512"
 	"fmt"
 	"sync"
 	"time"
@@ -12,7 +13,7 @@ import (
 	"github.com/csanti/onet/log"
 	"go.dedis.ch/kyber/pairing"
 	"go.dedis.ch/kyber/pairing/bn256"
-	
+	"github.com/csanti/pbft-experiments/timeline"
 )
 
 
@@ -24,7 +25,7 @@ type VerificationFn func(msg []byte, data []byte) bool
 // init is done at startup. It defines every messages that is handled by the network
 // and registers the protocols.
 func init() {
-	network.RegisterMessages(Announcement{}, Response{}, Stop{})
+	network.RegisterMessages(Announcement{}, ShardExchange{}, GetTransactions{}, Transactions{}, Response{}, Signed{}, Stop{})
 }
 
 
@@ -40,6 +41,9 @@ type BlsFtCosi struct {
 
 	Timeout        time.Duration // sub-protocol time out
 	FinalSignature chan []byte // final signature that is sent back to client
+	Trace          TraceContext // parent of the round-span, empty for a new trace
+	Erasure        bool // send Msg in Reed-Solomon shards to the subtrees
+	Compact        bool // send Msg as a compact block
 
 	publics         []kyber.Point // list of public keys
 	stoppedOnce     sync.Once 
@@ -135,13 +139,20 @@ func (p *BlsFtCosi) Dispatch() error {
 			return fmt.Errorf("timeout, did you forget to call Start?")
 	}
 
-	log.Lvl3("leader protocol started")
+	digest := sha512.Sum512(p.Msg)
+	tl := timeline.New(p.ServerIdentity().String(), DefaultProtocolName, digest[:])
+	tl.Phase("announcement").Lvl3("Leader protocol started", "subtrees", p.NSubtrees)
+	round := newSpan(p.Trace, "round", p.TreeNodeInstance)
+	round.Tag("subtrees", fmt.Sprint(p.NSubtrees))
+	defer round.Finish()
 
 	// Verification of the data
 	verifyChan := make(chan bool, 1)
 	go func() {
 		log.Lvl3(p.ServerIdentity().Address, "starting verification")
+		verify := newSpan(round.Context(), "verify", p.TreeNodeInstance)
 		verifyChan <- p.verificationFn(p.Msg, p.Data)
+		verify.Finish()
 	}()
 
 	// generate trees
@@ -160,7 +171,7 @@ func (p *BlsFtCosi) Dispatch() error {
 	cosiSubProtocols := make([]*SubBlsFtCosi, len(trees))
 	for i, tree := range trees {
 
-		cosiSubProtocols[i], err = p.startSubProtocol(tree)
+		cosiSubProtocols[i], err = p.startSubProtocol(tree, round.Context())
 		if err != nil {
 			return err
 		}
@@ -169,11 +180,11 @@ func (p *BlsFtCosi) Dispatch() error {
 	log.Lvl3(p.ServerIdentity().Address, "all protocols started")
 
 	// Wait and collect all the signature responses
-	responses, runningSubProtocols, err := p.collectSignatures(trees, cosiSubProtocols)
+	responses, runningSubProtocols, err := p.collectSignatures(trees, cosiSubProtocols, round.Context())
 	if err != nil {
 		return err
 	}
-	log.Lvl3(p.ServerIdentity().Address, "collected all signature responses")
+	tl.Phase("response").Lvl2("Collected the signature responses", "responses", len(responses))
 
 
 	_ = runningSubProtocols
@@ -192,7 +203,9 @@ func (p *BlsFtCosi) Dispatch() error {
 	}
 
 	// generate root signature
+	aggregate := newSpan(round.Context(), "aggregate", p.TreeNodeInstance)
 	signaturePoint, finalMask, err := generateSignature(p.PairingSuite, p.TreeNodeInstance, p.publics, responses, p.Msg, ok)
+	aggregate.Finish()
 	if err != nil {
 		return err
 	}
@@ -204,10 +217,16 @@ func (p *BlsFtCosi) Dispatch() error {
 
 	finalSignature := AppendSigAndMask(signature, finalMask)
 
-	log.Lvl3(p.ServerIdentity().Address, "Created final signature")
+	tl.Phase("signature").Lvl2("Created final signature")
 
+	round.Finish()
 	p.FinalSignature <- finalSignature
 
+	// the nodes of the subtrees store the signed block
+	for _, subProtocol := range runningSubProtocols {
+		subProtocol.HandleSigned(StructSigned{subProtocol.TreeNode(), Signed{finalSignature}})
+	}
+
 	//fmt.Println("xxx 2")
 
 	log.Lvl3("Root-node is done without errors")
@@ -219,7 +238,7 @@ func (p *BlsFtCosi) Dispatch() error {
 
 // Collect signatures from each sub-leader, restart whereever sub-leaders fail to respond.
 // The collected signatures are already aggregated for a particular group
-func (p *BlsFtCosi) collectSignatures(trees []*onet.Tree, cosiSubProtocols []*SubBlsFtCosi) ([]StructResponse, []*SubBlsFtCosi, error) {
+func (p *BlsFtCosi) collectSignatures(trees []*onet.Tree, cosiSubProtocols []*SubBlsFtCosi, trace TraceContext) ([]StructResponse, []*SubBlsFtCosi, error) {
 
 	var mut sync.Mutex
 	var wg sync.WaitGroup
@@ -256,7 +275,7 @@ func (p *BlsFtCosi) collectSignatures(trees []*onet.Tree, cosiSubProtocols []*Su
 					}
 
 					// restart subprotocol
-					subProtocol, err = p.startSubProtocol(trees[i])
+					subProtocol, err = p.startSubProtocol(trees[i], trace)
 					if err != nil {
 						err = fmt.Errorf("(node %v) error in restarting of subprotocol: %s", i, err)
 						errChan <- err
@@ -330,7 +349,7 @@ func (p *BlsFtCosi) Start() error {
 
 // startSubProtocol creates, parametrize and starts a subprotocol on a given tree
 // and returns the started protocol.
-func (p *BlsFtCosi) startSubProtocol(tree *onet.Tree) (*SubBlsFtCosi, error) {
+func (p *BlsFtCosi) startSubProtocol(tree *onet.Tree, trace TraceContext) (*SubBlsFtCosi, error) {
 
 	pi, err := p.CreateProtocol(p.subProtocolName, tree, onet.NilServiceID)
 	if err != nil {
@@ -342,6 +361,9 @@ func (p *BlsFtCosi) startSubProtocol(tree *onet.Tree) (*SubBlsFtCosi, error) {
 	cosiSubProtocol.Msg = p.Msg
 	cosiSubProtocol.Data = p.Data
 	cosiSubProtocol.Timeout = p.Timeout / 2
+	cosiSubProtocol.Trace = trace
+	cosiSubProtocol.Erasure = p.Erasure
+	cosiSubProtocol.Compact = p.Compact
 
 	err = cosiSubProtocol.Start()
 	if err != nil {
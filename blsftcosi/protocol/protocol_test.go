@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"fmt"
+	"math/rand"
 	"sync"
 	"testing"
 	"time"
@@ -119,6 +120,52 @@ func TestProtocol(t *testing.T) {
 
 
 
+// Tests the announcement sent in Reed-Solomon shards
+func TestProtocolErasure(t *testing.T) {
+	nodes := []int{2, 5, 13}
+	subtrees := []int{1, 2}
+	proposal := make([]byte, 10 * 1024)
+	rand.Read(proposal)
+
+	for _, nNodes := range nodes {
+		for _, nSubtrees := range subtrees {
+			local := onet.NewLocalTest(testSuite)
+			_, _, tree := local.GenTree(nNodes, false)
+
+			publics := make([]kyber.Point, tree.Size())
+			for i, node := range tree.List() {
+				publics[i] = node.ServerIdentity.Public
+			}
+
+			pi, err := local.CreateProtocol(DefaultProtocolName, tree)
+			if err != nil {
+				local.CloseAll()
+				t.Fatal("Error in creation of protocol:", err)
+			}
+			cosiProtocol := pi.(*BlsFtCosi)
+			cosiProtocol.CreateProtocol = local.CreateProtocol
+			cosiProtocol.Msg = proposal
+			cosiProtocol.NSubtrees = nSubtrees
+			cosiProtocol.Timeout = defaultTimeout
+			cosiProtocol.Erasure = true
+
+			err = cosiProtocol.Start()
+			if err != nil {
+				local.CloseAll()
+				t.Fatal(err)
+			}
+
+			err = getAndVerifySignature(cosiProtocol, publics, proposal, CompletePolicy{})
+			if err != nil {
+				local.CloseAll()
+				t.Fatal(err)
+			}
+
+			local.CloseAll()
+		}
+	}
+}
+
 // Tests unresponsive leaves in various tree configurations
 func TestUnresponsiveLeafs(t *testing.T) {
 	nodes := []int{3, 13, 24}
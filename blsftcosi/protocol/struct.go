@@ -11,6 +11,7 @@ import (
 	"go.dedis.ch/kyber/pairing"	
 	"go.dedis.ch/kyber"
 	"github.com/csanti/onet"
+	"github.com/csanti/pbft-experiments/erasure"
 )
 
 // DefaultProtocolName can be used from other packages to refer to this protocol.
@@ -41,6 +42,13 @@ type Announcement struct {
 	Data []byte
 	Publics []kyber.Point
 	Timeout time.Duration
+	Trace TraceContext // span of the sender
+	// with erasure coding Msg is empty and a node gets its own shard from
+	// the root
+	Shards *erasure.Header
+	Shard []*erasure.Shard
+	Compact bool // Msg is a compact block
+	Digest []byte // of the block, names the round in the logs
 }
 
 // StructAnnouncement just contains Announcement and the data necessary to identify and
@@ -50,11 +58,51 @@ type StructAnnouncement struct {
 	Announcement
 }
 
+// ShardExchange sends the shard of a node to all other nodes of the subtree.
+type ShardExchange struct {
+	Shard *erasure.Shard
+}
+
+// StructShardExchange just contains ShardExchange and the data necessary to
+// identify and process the message in the onet framework.
+type StructShardExchange struct {
+	*onet.TreeNode
+	ShardExchange
+}
+
+
+// GetTransactions asks the root for the transactions of the compact block
+// that are not in the mempool of the node.
+type GetTransactions struct {
+	Indices []int
+}
+
+// StructGetTransactions just contains GetTransactions and the data necessary
+// to identify and process the message in the onet framework.
+type StructGetTransactions struct {
+	*onet.TreeNode
+	GetTransactions
+}
+
+
+// Transactions holds the requested transactions in JSON.
+type Transactions struct {
+	Txs []byte
+}
+
+// StructTransactions just contains Transactions and the data necessary to
+// identify and process the message in the onet framework.
+type StructTransactions struct {
+	*onet.TreeNode
+	Transactions
+}
+
 
 // Response is the blsftcosi response message
 type Response struct {
 	CoSiReponse []byte
 	Mask        []byte
+	Trace       TraceContext // span of the sender
 }
 
 // StructResponse just contains Response and the data necessary to identify and
@@ -65,6 +113,18 @@ type StructResponse struct {
 }
 
 
+// Signed is sent by the root to all nodes with the final signature, so
+// that they can store the signed block.
+type Signed struct {
+	Signature []byte // signature followed by the mask
+}
+
+// StructSigned is a wrapper around Signed for it to work with onet
+type StructSigned struct {
+	*onet.TreeNode
+	Signed
+}
+
 // Stop is a message used to instruct a node to stop its protocol
 type Stop struct{}
 
@@ -7,10 +7,18 @@ import (
 	"sync"
 	"time"
 	"encoding/json"
+	"encoding/binary"
+	"crypto/sha256"
+	"crypto/sha512"
 
 	"go.dedis.ch/kyber"
 	"github.com/csanti/onet"
 	"github.com/csanti/onet/log"
+	"github.com/csanti/onet/simul/monitor"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain/blkparser"
+	"github.com/csanti/pbft-experiments/erasure"
+	"github.com/csanti/pbft-experiments/timeline"
 	"go.dedis.ch/kyber/pairing"
 	"go.dedis.ch/kyber/pairing/bn256"
 
@@ -28,9 +36,17 @@ type SubBlsFtCosi struct {
 	Data           []byte
 	
 	Timeout        time.Duration
+	Trace          TraceContext // span of the node that started us
+	Erasure        bool // root sends Msg in Reed-Solomon shards
+	Compact        bool // root sends Msg as a compact block
+	block          *blockchain.TrBlock // block of the compact block on the root
 	stoppedOnce    sync.Once
+	created        time.Time
 	verificationFn VerificationFn
 	pairingSuite   pairing.Suite
+	// OnSigned is called on every node but the root with the final
+	// signature of Msg, so that the node can store the signed block
+	OnSigned       func(msg []byte, publics []kyber.Point, signature []byte)
 
 	// protocol/subprotocol channels
 	// these are used to communicate between the subprotocol and the main protocol
@@ -40,6 +56,8 @@ type SubBlsFtCosi struct {
 	// internodes channels
 	ChannelAnnouncement   chan StructAnnouncement
 	ChannelResponse       chan StructResponse
+	ChannelShard          chan StructShardExchange
+	ChannelTransactions   chan StructTransactions
 }
 
 
@@ -71,6 +89,7 @@ func NewSubBlsFtCosi(n *onet.TreeNodeInstance, vf VerificationFn, pairingSuite p
 		TreeNodeInstance: n,
 		verificationFn:   vf,
 		pairingSuite:     pairingSuite,
+		created:          time.Now(),
 	}
 
 	if n.IsRoot() {
@@ -81,16 +100,30 @@ func NewSubBlsFtCosi(n *onet.TreeNodeInstance, vf VerificationFn, pairingSuite p
 	for _, channel := range []interface{}{
 		&c.ChannelAnnouncement,
 		&c.ChannelResponse,
+		&c.ChannelTransactions,
 	} {
 		err := c.RegisterChannel(channel)
 		if err != nil {
 			return nil, errors.New("couldn't register channel: " + err.Error())
 		}
 	}
+	// all nodes of the subtree may send their shard before the announcement
+	c.ChannelShard = make(chan StructShardExchange, n.Tree().Size())
+	if err := c.RegisterChannel(c.ChannelShard); err != nil {
+		return nil, errors.New("couldn't register channel: " + err.Error())
+	}
 	err := c.RegisterHandler(c.HandleStop)
 	if err != nil {
 		return nil, errors.New("couldn't register stop handler: " + err.Error())
 	}
+	err = c.RegisterHandler(c.HandleSigned)
+	if err != nil {
+		return nil, errors.New("couldn't register signed handler: " + err.Error())
+	}
+	err = c.RegisterHandler(c.HandleGetTransactions)
+	if err != nil {
+		return nil, errors.New("couldn't register transactions handler: " + err.Error())
+	}
 	return c, nil
 }
 
@@ -102,6 +135,8 @@ func (p *SubBlsFtCosi) Shutdown() error {
 	p.stoppedOnce.Do(func() {
 		close(p.ChannelAnnouncement)
 		close(p.ChannelResponse)
+		close(p.ChannelShard)
+		close(p.ChannelTransactions)
 	})
 	return nil
 }
@@ -119,34 +154,79 @@ func (p *SubBlsFtCosi) Dispatch() error {
 		return nil
 	}
 
-	log.Lvl3(p.ServerIdentity().Address, "received annoucement ")
+	tl := timeline.New(p.ServerIdentity().String(), DefaultSubProtocolName, announcement.Digest)
+	tl.Phase("announcement").Lvl3("Received announcement", "shards", announcement.Shards != nil, "compact", announcement.Compact)
 	p.Msg = announcement.Msg
 	p.Data = announcement.Data
 	p.Publics = announcement.Publics
 	p.Timeout = announcement.Timeout
+	p.Trace = announcement.Trace
 	//var err error
 
+	receive := newSpanAt(p.Trace, "receive", p.TreeNodeInstance, p.created)
+	receive.Tag("msg", "announcement")
+	receive.Finish()
+
+	if announcement.Shards != nil {
+		if p.IsRoot() {
+			send := newSpan(p.Trace, "send", p.TreeNodeInstance)
+			send.Tag("msg", "shards")
+			announcement.Trace = send.Context()
+			p.sendShards(announcement.Announcement)
+			send.Finish()
+		}
+		if !p.IsRoot() {
+			reconstruct := newSpan(p.Trace, "reconstruct", p.TreeNodeInstance)
+			msg, err := p.reconstruct(announcement.Announcement)
+			reconstruct.Finish()
+			if err != nil {
+				return err
+			}
+			p.Msg = msg
+		}
+	}
+
 	verifyChan := make(chan bool, 1)
 	if !p.IsRoot() {
 		go func() {
-			log.Lvl3(p.ServerIdentity(), "starting verification")
+			if announcement.Compact {
+				fetch := newSpan(p.Trace, "fetch", p.TreeNodeInstance)
+				msg, err := p.expand(p.Msg)
+				fetch.Finish()
+				if err != nil {
+					log.Error(p.ServerIdentity().Address, "couldn't rebuild the compact block:", err)
+					verifyChan <- false
+					return
+				}
+				p.Msg = msg
+			}
+			tl.Phase("verify").Lvl3("Starting verification")
+			verify := newSpan(p.Trace, "verify", p.TreeNodeInstance)
 			verifyChan <- p.verificationFn(p.Msg, p.Data)
+			verify.Finish()
 		}()
 	}
 
-
-	if errs := p.SendToChildrenInParallel(&announcement.Announcement); len(errs) > 0 {
-		log.Lvl3(p.ServerIdentity().Address, "failed to send announcement to all children")
-	}	
+	if !p.IsLeaf() && announcement.Shards == nil {
+		send := newSpan(p.Trace, "send", p.TreeNodeInstance)
+		send.Tag("msg", "announcement")
+		announcement.Trace = send.Context()
+		if errs := p.SendToChildrenInParallel(&announcement.Announcement); len(errs) > 0 {
+			log.Lvl3(p.ServerIdentity().Address, "failed to send announcement to all children")
+		}
+		send.Finish()
+	}
 
 	// Collect all responses from children, store them and wait till all have responded or timed out.
 	responses := make([]StructResponse, 0)
+	collectStart := time.Now()
 	if p.IsRoot() {
 		select { // one commitment expected from super-protocol
 		case response, channelOpen := <-p.ChannelResponse:
 			if !channelOpen {
 				return nil
 			}
+			p.traceResponse(response, collectStart)
 			responses = append(responses, response)
 		case <-time.After(p.Timeout):
 			// the timeout here should be shorter than the main protocol timeout
@@ -165,6 +245,7 @@ loop:
 					if !channelOpen {
 						return nil
 					}
+					p.traceResponse(response, collectStart)
 					responses = append(responses, response)
 				case <-t:
 					break loop
@@ -181,17 +262,20 @@ loop:
 				"root node in subprotocol should have received 1 signature response, but received %v",
 				len(responses))
 		}
+		tl.Phase("response").Lvl3("Got the response of the subleader")
 		p.subResponse <- responses[0]
 	} else {
 
 		ok = <-verifyChan
 		if !ok {
-			log.Lvl2(p.ServerIdentity().Address, "verification failed, unsetting the mask")
+			tl.Phase("verify").Lvl2("Verification failed, unsetting the mask")
 		}
 
 		// unset the mask if the verification failed and remove commitment
 		
 		// Generate own signature and aggregate with all children signatures
+		aggregate := newSpan(p.Trace, "aggregate", p.TreeNodeInstance)
+		aggregate.Tag("responses", fmt.Sprint(len(responses)))
 		signaturePoint, finalMask, err := generateSignature(p.pairingSuite, p.TreeNodeInstance, p.Publics, responses, p.Msg, ok)
 
 		if err != nil {
@@ -199,6 +283,7 @@ loop:
 		}
 
 		tmp, err := PointToByteSlice(p.pairingSuite, signaturePoint)
+		aggregate.Finish()
 
 		var found bool
 		if !ok {
@@ -219,7 +304,11 @@ loop:
 		}
 
 
-		err = p.SendToParent(&Response{CoSiReponse:tmp, Mask:finalMask.mask})
+		tl.Phase("response").Lvl3("Sending response", "responses", len(responses))
+		send := newSpan(p.Trace, "send", p.TreeNodeInstance)
+		send.Tag("msg", "response")
+		err = p.SendToParent(&Response{CoSiReponse:tmp, Mask:finalMask.mask, Trace:send.Context()})
+		send.Finish()
 		if err != nil {
 			return err
 		}
@@ -249,13 +338,219 @@ func (p *SubBlsFtCosi) Start() error {
 
 	annoucement := StructAnnouncement{
 		p.TreeNode(),
-		Announcement{p.Msg, p.Data, p.Publics, p.Timeout},
+		Announcement{Msg:p.Msg, Data:p.Data, Publics:p.Publics, Timeout:p.Timeout, Trace:p.Trace},
+	}
+	digest := sha512.Sum512(p.Msg)
+	annoucement.Digest = digest[:]
+	if p.Compact {
+		block := &blockchain.TrBlock{}
+		if err := json.Unmarshal(p.Msg, block); err != nil {
+			return errors.New("compact mode needs a block: " + err.Error())
+		}
+		p.block = block
+		// the short IDs are salted by the hash of the block
+		salt := sha256.Sum256(p.Msg)
+		compact, err := blockchain.NewCompactBlock(block, binary.LittleEndian.Uint64(salt[:])).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		annoucement.Msg = compact
+		annoucement.Compact = true
+	}
+	if p.Erasure && p.Tree().Size() > 1 {
+		dataShards, parityShards := erasure.Params(p.Tree().Size() - 1)
+		var err error
+		annoucement.Shards, annoucement.Shard, err = erasure.Encode(annoucement.Msg, dataShards, parityShards)
+		if err != nil {
+			return err
+		}
 	}
 	p.ChannelAnnouncement <- annoucement
 	return nil
 }
 
 
+// shardIndices returns the index of the shard of every node of the tree.
+// The nodes get the shards in the order of the tree-list, the root gets no
+// shard.
+func (p *SubBlsFtCosi) shardIndices(shards int) map[onet.TreeNodeID]int {
+	indices := make(map[onet.TreeNodeID]int)
+	for i, node := range p.List()[1:] {
+		indices[node.ID] = i % shards
+	}
+	return indices
+}
+
+// sendShards sends every node of the tree an announcement without the
+// message but with its own shard only, so that no node gets more than one
+// shard from the root. The nodes exchange their shards to reconstruct the
+// message.
+func (p *SubBlsFtCosi) sendShards(announcement Announcement) {
+	byIndex := make(map[int]*erasure.Shard)
+	for _, shard := range announcement.Shard {
+		byIndex[shard.Index] = shard
+	}
+	indices := p.shardIndices(announcement.Shards.Shards())
+
+	var wg sync.WaitGroup
+	for _, node := range p.List()[1:] {
+		nodeAnnouncement := announcement
+		nodeAnnouncement.Msg = nil
+		nodeAnnouncement.Shard = nil
+		if shard, ok := byIndex[indices[node.ID]]; ok {
+			nodeAnnouncement.Shard = []*erasure.Shard{shard}
+		}
+		wg.Add(1)
+		go func(node *onet.TreeNode, a Announcement) {
+			defer wg.Done()
+			if err := p.SendTo(node, &a); err != nil {
+				log.Lvl3(p.ServerIdentity().Address, "failed to send shard to", node.ServerIdentity.Address)
+			}
+		}(node, nodeAnnouncement)
+	}
+	wg.Wait()
+}
+
+// reconstruct sends our own shard to all other nodes of the subtree and
+// collects their shards until the message can be reconstructed.
+func (p *SubBlsFtCosi) reconstruct(announcement Announcement) ([]byte, error) {
+	decoder, err := erasure.NewDecoder(announcement.Shards)
+	if err != nil {
+		return nil, err
+	}
+	own := p.shardIndices(announcement.Shards.Shards())[p.TreeNode().ID]
+	for _, shard := range announcement.Shard {
+		if err := decoder.Add(shard); err != nil {
+			return nil, err
+		}
+		if shard.Index != own {
+			continue
+		}
+		for _, node := range p.List()[1:] {
+			if node.ID.Equal(p.TreeNode().ID) {
+				continue
+			}
+			go func(node *onet.TreeNode, shard *erasure.Shard) {
+				if err := p.SendTo(node, &ShardExchange{shard}); err != nil {
+					log.Lvl3(p.ServerIdentity().Address, "failed to send shard to", node.ServerIdentity.Address)
+				}
+			}(node, shard)
+		}
+	}
+
+	t := time.After(p.Timeout / 2)
+	for !decoder.Done() {
+		select {
+		case shard, channelOpen := <-p.ChannelShard:
+			if !channelOpen {
+				return nil, errors.New("protocol stopped")
+			}
+			if err := decoder.Add(shard.Shard); err != nil {
+				log.Lvl2(p.ServerIdentity().Address, "dropping shard:", err)
+			}
+		case <-t:
+			return nil, errors.New("didn't get enough shards to reconstruct the announcement")
+		}
+	}
+	return decoder.Message()
+}
+
+// expand rebuilds the block from the compact block and the mempool of the
+// node, and fetches the missing transactions from the root.
+func (p *SubBlsFtCosi) expand(compact []byte) ([]byte, error) {
+	cb := &blockchain.CompactBlock{}
+	if err := cb.UnmarshalBinary(compact); err != nil {
+		return nil, err
+	}
+	txs, missing := cb.Reconstruct(blockchain.NodeMempool(p.ServerIdentity().ID.String()))
+	fetched := 0
+	if len(missing) > 0 {
+		log.Lvl3(p.ServerIdentity().Address, "fetching", len(missing), "transactions")
+		if err := p.SendTo(p.Root(), &GetTransactions{missing}); err != nil {
+			return nil, err
+		}
+		select {
+		case reply, channelOpen := <-p.ChannelTransactions:
+			if !channelOpen {
+				return nil, errors.New("protocol stopped")
+			}
+			var got []blkparser.Tx
+			if err := json.Unmarshal(reply.Txs, &got); err != nil {
+				return nil, err
+			}
+			if len(got) != len(missing) {
+				return nil, fmt.Errorf("asked for %d transactions but got %d", len(missing), len(got))
+			}
+			for i, index := range missing {
+				txs[index] = got[i]
+			}
+			fetched = len(reply.Txs)
+		case <-time.After(p.Timeout / 2):
+			return nil, errors.New("didn't get the missing transactions")
+		}
+	}
+	block, err := cb.Block(txs)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := block.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	monitor.RecordSingleMeasure("compact_missing", float64(len(missing)))
+	monitor.RecordSingleMeasure("compact_saved", float64(len(msg) - len(compact) - fetched))
+	return msg, nil
+}
+
+// HandleGetTransactions sends the requested transactions of the compact block
+// to the node. Only the root has the block.
+func (p *SubBlsFtCosi) HandleGetTransactions(msg StructGetTransactions) error {
+	if p.block == nil {
+		return errors.New("got a request for transactions without a block")
+	}
+	txs := make([]blkparser.Tx, len(msg.Indices))
+	for i, index := range msg.Indices {
+		if index < 0 || index >= len(p.block.Txs) {
+			return fmt.Errorf("no transaction %d in block", index)
+		}
+		txs[i] = p.block.Txs[index]
+	}
+	data, err := json.Marshal(txs)
+	if err != nil {
+		return err
+	}
+	return p.SendTo(msg.TreeNode, &Transactions{data})
+}
+
+// traceResponse records the time we waited for the response of a child,
+// linked to the span in which the child sent it.
+func (p *SubBlsFtCosi) traceResponse(response StructResponse, start time.Time) {
+	receive := newSpanAt(response.Trace, "receive", p.TreeNodeInstance, start)
+	if receive == nil {
+		return
+	}
+	receive.Tag("msg", "response")
+	if response.TreeNode != nil {
+		receive.Tag("from", response.ServerIdentity.Address.String())
+	}
+	receive.Finish()
+}
+
+// HandleSigned is called when the final signature is sent to this node. The
+// root broadcasts it to all the nodes in the tree, which stop the protocol
+// once they passed it to OnSigned.
+func (p *SubBlsFtCosi) HandleSigned(signed StructSigned) error {
+	defer p.Done()
+	if p.IsRoot() {
+		p.Broadcast(&signed.Signed)
+		return nil
+	}
+	if p.OnSigned != nil && p.Msg != nil {
+		p.OnSigned(p.Msg, p.Publics, signed.Signature)
+	}
+	return nil
+}
+
 // HandleStop is called when a Stop message is send to this node.
 // It broadcasts the message to all the nodes in tree and each node will stop
 // the protocol by calling p.Done.
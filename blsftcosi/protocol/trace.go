@@ -0,0 +1,170 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/csanti/onet"
+)
+
+// Tracing of the protocol rounds
+//
+// Every message carries a TraceContext, so that the spans recorded by a node
+// can be linked to the span of the node that sent the message. Each node
+// records spans for receiving, verifying, aggregating and sending, and
+// appends them to the collector file given in SetTraceFile, one span per
+// line in the Zipkin v2 JSON format. To look at a round in a trace viewer
+// (Zipkin or Jaeger), gather the files of all nodes and turn them into an
+// array:
+//	cat trace*.json | jq -s . > round.json
+// If no collector file is set, no spans are recorded.
+
+// TraceContext identifies the trace of a round and the span of the sender of
+// a message.
+type TraceContext struct {
+	TraceID string
+	SpanID  string
+}
+
+// Endpoint is the node that recorded a span.
+type Endpoint struct {
+	ServiceName string `json:"serviceName"`
+}
+
+// Span is one timed step of the protocol on one node, as in the Zipkin v2
+// format. Timestamp and Duration are in microseconds.
+type Span struct {
+	TraceID       string            `json:"traceId"`
+	ID            string            `json:"id"`
+	ParentID      string            `json:"parentId,omitempty"`
+	Name          string            `json:"name"`
+	Timestamp     int64             `json:"timestamp"`
+	Duration      int64             `json:"duration"`
+	LocalEndpoint Endpoint          `json:"localEndpoint"`
+	Tags          map[string]string `json:"tags,omitempty"`
+
+	start    time.Time
+	finished bool
+}
+
+var traceMutex sync.Mutex
+var traceFile *os.File
+
+// SetTraceFile sets the collector file where all spans are appended to. An
+// empty name turns off tracing.
+func SetTraceFile(name string) error {
+	traceMutex.Lock()
+	defer traceMutex.Unlock()
+	if traceFile != nil {
+		if err := traceFile.Close(); err != nil {
+			return err
+		}
+		traceFile = nil
+	}
+	if name == "" {
+		return nil
+	}
+	var err error
+	traceFile, err = os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+	return err
+}
+
+// tracing returns whether a collector file is set.
+func tracing() bool {
+	traceMutex.Lock()
+	defer traceMutex.Unlock()
+	return traceFile != nil
+}
+
+// newSpan starts a span with the given name on node n. If parent has no
+// TraceID, a new trace is started. It returns nil if tracing is off - all
+// methods of Span can be called on nil.
+func newSpan(parent TraceContext, name string, n *onet.TreeNodeInstance) *Span {
+	return newSpanAt(parent, name, n, time.Now())
+}
+
+// newSpanAt is like newSpan, but the span started at 'start'.
+func newSpanAt(parent TraceContext, name string, n *onet.TreeNodeInstance, start time.Time) *Span {
+	if !tracing() {
+		return nil
+	}
+	s := &Span{
+		TraceID:       parent.TraceID,
+		ID:            randomID(8),
+		ParentID:      parent.SpanID,
+		Name:          name,
+		Timestamp:     start.UnixNano() / 1000,
+		LocalEndpoint: Endpoint{n.ServerIdentity().Address.String()},
+		Tags: map[string]string{
+			"index": strconv.Itoa(n.TreeNode().RosterIndex),
+			"role":  role(n),
+		},
+		start: start,
+	}
+	if s.TraceID == "" {
+		s.TraceID = randomID(16)
+	}
+	return s
+}
+
+// Context returns the TraceContext to be sent with a message, so that the
+// receiver can link its spans to this one.
+func (s *Span) Context() TraceContext {
+	if s == nil {
+		return TraceContext{}
+	}
+	return TraceContext{TraceID: s.TraceID, SpanID: s.ID}
+}
+
+// Tag adds a key/value pair to the span.
+func (s *Span) Tag(key, value string) {
+	if s == nil {
+		return
+	}
+	s.Tags[key] = value
+}
+
+// Finish sets the duration of the span and writes it to the collector file.
+// Only the first call to Finish is recorded.
+func (s *Span) Finish() {
+	if s == nil || s.finished {
+		return
+	}
+	s.finished = true
+	s.Duration = int64(time.Since(s.start) / time.Microsecond)
+	buf, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	traceMutex.Lock()
+	defer traceMutex.Unlock()
+	if traceFile != nil {
+		// One write per span, so that processes sharing the file don't
+		// mix their lines
+		traceFile.Write(append(buf, '\n'))
+	}
+}
+
+// role returns whether the node is the root, a subleader or a leaf of its
+// tree.
+func role(n *onet.TreeNodeInstance) string {
+	switch {
+	case n.IsRoot():
+		return "root"
+	case n.IsLeaf():
+		return "leaf"
+	default:
+		return "subleader"
+	}
+}
+
+func randomID(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,91 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/csanti/onet"
+	"go.dedis.ch/kyber"
+)
+
+// Runs one round with tracing on and checks that all nodes recorded their
+// spans in the same trace.
+func TestTrace(t *testing.T) {
+	f, err := ioutil.TempFile("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	if err := SetTraceFile(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	defer SetTraceFile("")
+
+	nNodes := 5
+	proposal := []byte("dedis")
+	local := onet.NewLocalTest(testSuite)
+	defer local.CloseAll()
+	_, _, tree := local.GenTree(nNodes, false)
+	publics := make([]kyber.Point, tree.Size())
+	for i, node := range tree.List() {
+		publics[i] = node.ServerIdentity.Public
+	}
+
+	pi, err := local.CreateProtocol(DefaultProtocolName, tree)
+	if err != nil {
+		t.Fatal("Error in creation of protocol:", err)
+	}
+	cosiProtocol := pi.(*BlsFtCosi)
+	cosiProtocol.CreateProtocol = local.CreateProtocol
+	cosiProtocol.Msg = proposal
+	cosiProtocol.NSubtrees = 1
+	cosiProtocol.Timeout = defaultTimeout
+	if err := cosiProtocol.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := getAndVerifySignature(cosiProtocol, publics, proposal, CompletePolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the root finished its round-span
+	local.CloseAll()
+	SetTraceFile("")
+
+	f, err = os.Open(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	names := map[string]int{}
+	nodes := map[string]bool{}
+	traceID := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var s Span
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			t.Fatal(err)
+		}
+		if traceID == "" {
+			traceID = s.TraceID
+		}
+		if s.TraceID != traceID {
+			t.Fatal("All spans should be in the same trace")
+		}
+		names[s.Name]++
+		nodes[s.LocalEndpoint.ServiceName] = true
+	}
+	for _, name := range []string{"round", "receive", "verify", "aggregate", "send"} {
+		if names[name] == 0 {
+			t.Fatal("No span for", name, names)
+		}
+	}
+	if names["round"] != 1 {
+		t.Fatal("There should be exactly one round")
+	}
+	if len(nodes) != nNodes {
+		t.Fatal("Not all nodes recorded spans:", nodes)
+	}
+}
@@ -5,23 +5,31 @@ import (
 	"time"
 	"fmt"
 	"errors"
+	"encoding/json"
 	"math/rand"
+	"sync"
 
 	"github.com/BurntSushi/toml"
 	"github.com/csanti/onet"
 	"github.com/csanti/onet/log"
+	"github.com/csanti/onet/network"
 	"github.com/csanti/onet/simul/monitor"
 	"go.dedis.ch/kyber"
 	"github.com/csanti/pbft-experiments/blsftcosi/protocol"
 	"github.com/dedis/cothority"
 	"go.dedis.ch/kyber/pairing"
 	"go.dedis.ch/kyber/pairing/bn256"
+	"github.com/csanti/pbft-experiments/blocksync"
 	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain"
 	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain/blkparser"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain/blockstore"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/membership"
 )
 
 func init() {
 	onet.SimulationRegister("BlsFtCosiProtocol", NewSimulationProtocol)
+	onet.GlobalProtocolRegister(simulationProtocolName, newSimulationRoot)
+	onet.GlobalProtocolRegister(simulationSubProtocolName, newSimulationNode)
 
 	cothority.Suite = struct{
 	    pairing.Suite
@@ -32,6 +40,151 @@ func init() {
 	}
 }
 
+// simulationProtocolName and simulationSubProtocolName are the BlsFtCosi
+// protocols as run by the nodes of the simulation.
+const simulationProtocolName = "BlsFtCosiSimulationProtocol"
+const simulationSubProtocolName = "SubBlsFtCosiSimulationProtocol"
+
+// stores holds the block store of every node of the simulation.
+var stores = struct {
+	nodes map[network.ServerIdentityID]*blockstore.Store
+	sync.Mutex
+}{nodes: make(map[network.ServerIdentityID]*blockstore.Store)}
+
+// nodeStore returns the block store of the node, or nil if it has none.
+func nodeStore(id network.ServerIdentityID) *blockstore.Store {
+	stores.Lock()
+	defer stores.Unlock()
+	return stores.nodes[id]
+}
+
+// newSimulationRoot returns the BlsFtCosi protocol of the root, which runs
+// the sub-protocols of the simulation.
+func newSimulationRoot(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	vf := func(msg, data []byte) bool { return true }
+	return protocol.NewBlsFtCosi(n, vf, simulationSubProtocolName, protocol.ThePairingSuite)
+}
+
+// followers holds the epochs every node of the simulation learns from the
+// blocks, and the roster of all nodes, which may join.
+var followers = struct {
+	nodes  map[network.ServerIdentityID]*membership.Follower
+	roster *onet.Roster
+	sync.Mutex
+}{nodes: make(map[network.ServerIdentityID]*membership.Follower)}
+
+// nodeFollower returns the epochs of the node, or nil without epochs.
+func nodeFollower(id network.ServerIdentityID) *membership.Follower {
+	followers.Lock()
+	defer followers.Unlock()
+	return followers.nodes[id]
+}
+
+// replicas holds how every node of the simulation with a store and a fixed
+// roster catches up when it misses blocks.
+var replicas = struct {
+	nodes map[network.ServerIdentityID]*replica
+	sync.Mutex
+}{nodes: make(map[network.ServerIdentityID]*replica)}
+
+// replica syncs the store of a node from the stores of the other nodes.
+type replica struct {
+	config  *onet.SimulationConfig
+	verify  func(prev, e *blockstore.Entry) error
+	syncing bool
+	sync.Mutex
+}
+
+// nodeReplica returns the sync of the node, or nil if it can't sync.
+func nodeReplica(id network.ServerIdentityID) *replica {
+	replicas.Lock()
+	defer replicas.Unlock()
+	return replicas.nodes[id]
+}
+
+// catchUp syncs the store of the node in the background, unless a sync is
+// already running. The block that showed the gap is fetched with the others
+// if the nodes that signed it stored it already, else with the next one.
+func catchUp(id network.ServerIdentityID) {
+	r := nodeReplica(id)
+	if r == nil {
+		log.Lvl2(id, "can't sync, the rosters of the stored epochs are unknown")
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	if r.syncing {
+		return
+	}
+	r.syncing = true
+	go func() {
+		roster := r.config.Roster
+		tree := roster.GenerateNaryTreeWithRoot(len(roster.List)-1, r.config.Server.ServerIdentity)
+		if err := syncBlocks(r.config, tree, r.verify); err != nil {
+			log.Error(id, "couldn't catch up:", err)
+		}
+		r.Lock()
+		r.syncing = false
+		r.Unlock()
+	}()
+}
+
+// newSimulationNode returns a sub-protocol whose nodes only sign a block
+// with valid roster changes and that stores the signed blocks in the store
+// of the node, if it has one. The root stores them in Run.
+func newSimulationNode(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	vf := func(msg, data []byte) bool { return true }
+	follower := nodeFollower(n.ServerIdentity().ID)
+	if n.IsRoot() {
+		// the root proposes the changes of its own schedule
+		follower = nil
+	}
+	if follower != nil {
+		vf = func(msg, data []byte) bool {
+			if err := verifyChanges(follower, n.Roster(), msg); err != nil {
+				log.Lvl2(n.ServerIdentity(), "refuses block:", err)
+				return false
+			}
+			return true
+		}
+	}
+	pi, err := protocol.NewSubBlsFtCosi(n, vf, protocol.ThePairingSuite)
+	if err != nil {
+		return nil, err
+	}
+	store := nodeStore(n.ServerIdentity().ID)
+	if store == nil && follower == nil {
+		return pi, nil
+	}
+	pi.(*protocol.SubBlsFtCosi).OnSigned = func(msg []byte, publics []kyber.Point, signature []byte) {
+		policy := protocol.NewThresholdPolicy(len(publics) * 2 / 3)
+		if err := verifySignature(protocol.ThePairingSuite, signature, publics, msg, policy); err != nil {
+			log.Error(n.ServerIdentity(), "got a wrong final signature:", err)
+			return
+		}
+		block := &blockchain.TrBlock{}
+		if err := json.Unmarshal(msg, block); err != nil {
+			log.Error(n.ServerIdentity(), "couldn't read signed block:", err)
+			return
+		}
+		if follower != nil {
+			if err := follower.Commit(block.Header.RosterChanges); err != nil {
+				log.Error(n.ServerIdentity(), "couldn't commit roster changes:", err)
+			}
+		}
+		if store == nil {
+			return
+		}
+		err := storeBlock(store, block, msg, signature)
+		if err == errGap {
+			log.Lvl2(n.ServerIdentity(), "missed blocks before", block.HeaderHash)
+			catchUp(n.ServerIdentity().ID)
+		} else if err != nil {
+			log.Error(n.ServerIdentity(), "couldn't store block:", err)
+		}
+	}
+	return pi, nil
+}
 
 var magicNum = [4]byte{0xF9, 0xBE, 0xB4, 0xD9}
 var blocksPath = "/users/csbenz/blocks" // "/home/christo/.bitcoin/blocks"
@@ -41,12 +194,21 @@ var wantednTxs = 10000
 // SimulationProtocol implements onet.Simulation.
 type SimulationProtocol struct {
 	onet.SimulationBFTree
+	blockchain.Workload
 	NNodes				int
 	NSubtrees			int
 	FailingSubleaders	int
 	FailingLeafs		int
 	LoadBlock           bool
 	BlockSize			int // in bytes
+	TraceFile			string // if set, every node appends its spans to this file
+	Erasure				bool // send the block in Reed-Solomon shards to the subtrees
+	Compact				bool // send a compact block, nodes rebuild it from their mempool
+	CompactMissRate		float64 // fraction of the block's transactions missing in a mempool
+	StorePath			string // every node stores the signed blocks in StorePath.<index>, the root continues its stored chain and nodes that miss blocks catch up
+	EpochLength			int // blocks per epoch, the roster changes at every boundary; 0 keeps the roster
+	StartMembers		int // nodes in the roster of the first epoch, the others join one per epoch
+	Leave				bool // the oldest member after the root leaves every epoch
 }
 
 // NewSimulationProtocol is used internally to register the simulation (see the init()
@@ -107,6 +269,57 @@ func (s *SimulationProtocol) Node(config *onet.SimulationConfig) error {
 		log.Fatal("Didn't find this node in roster")
 	}
 	log.Lvl3("Initializing node-index", index)
+	if s.TraceFile != "" {
+		if err := protocol.SetTraceFile(s.TraceFile); err != nil {
+			return err
+		}
+	}
+	if s.Compact && !s.LoadBlock {
+		// every node generates the transactions of the block, as if it got
+		// them by gossip, but misses some of them
+		mempool := blockchain.NodeMempool(config.Server.ServerIdentity.ID.String())
+		miss := rand.New(rand.NewSource(int64(index)))
+		for _, tx := range blockchain.NewGenerator(s.Workload).GenesisBlock(s.BlockSize) {
+			if miss.Float64() >= s.CompactMissRate {
+				mempool.Add(tx)
+			}
+		}
+		log.Lvl3("Node", index, "has", mempool.Len(), "transactions in its mempool")
+	}
+	if s.StorePath != "" {
+		// the store stays open as long as the node runs
+		store, err := blockstore.Open(fmt.Sprintf("%s.%d", s.StorePath, index))
+		if err != nil {
+			return err
+		}
+		stores.Lock()
+		stores.nodes[config.Server.ServerIdentity.ID] = store
+		stores.Unlock()
+		blocksync.RegisterStore(config.Server.ServerIdentity.ID.String(), store)
+		if s.EpochLength == 0 {
+			// the mask follows the order of the tree
+			var publics []kyber.Point
+			for _, node := range config.Tree.List() {
+				publics = append(publics, node.ServerIdentity.Public)
+			}
+			policy := protocol.NewThresholdPolicy(len(publics) * 2 / 3)
+			replicas.Lock()
+			replicas.nodes[config.Server.ServerIdentity.ID] = &replica{
+				config: config,
+				verify: protocol.VerifyEntry(protocol.ThePairingSuite, publics, policy),
+			}
+			replicas.Unlock()
+		}
+	}
+	if s.EpochLength > 0 {
+		// every node follows the epochs starting like the root
+		id := config.Server.ServerIdentity.ID
+		follower := membership.NewFollower(id.String(), newSchedule(config, s.StartMembers))
+		followers.Lock()
+		followers.nodes[id] = follower
+		followers.roster = config.Roster
+		followers.Unlock()
+	}
 	return s.SimulationBFTree.Node(config)
 }
 
@@ -116,6 +329,7 @@ var proposal = []byte("dedis")
 // Run implements onet.Simulation.
 func (s *SimulationProtocol) Run(config *onet.SimulationConfig) error {
 
+	var block *blockchain.TrBlock
 	var binaryBlock []byte
 
 	if s.LoadBlock {
@@ -127,7 +341,7 @@ func (s *SimulationProtocol) Run(config *onet.SimulationConfig) error {
 
 		log.Lvl1("Run got", len(transactions), "transactions")
 		
-		block, err := GetBlock(3000, transactions, "0", "0", 0)
+		block, err = GetBlock(3000, transactions, "0", "0", 0)
 		if err != nil {
 			return err
 		}
@@ -136,13 +350,38 @@ func (s *SimulationProtocol) Run(config *onet.SimulationConfig) error {
 			return err
 		}
 	} else {
-		log.Lvl1("LoadBlock is false, generating random block of size ", s.BlockSize)
-		binaryBlock = make([]byte, s.BlockSize)
-		rand.Read(binaryBlock)
+		log.Lvl1("LoadBlock is false, generating block of size", s.BlockSize)
+		transactions := blockchain.NewGenerator(s.Workload).GenesisBlock(s.BlockSize)
+		var err error
+		block, err = GetBlock(len(transactions), transactions, "0", "0", 0)
+		if err != nil {
+			return err
+		}
+		binaryBlock, err = block.MarshalBinary()
+		if err != nil {
+			return err
+		}
+	}
+
+	store := nodeStore(config.Server.ServerIdentity.ID)
+	if store != nil {
+		if r := nodeReplica(config.Server.ServerIdentity.ID); r != nil {
+			// catch up with the nodes that stored blocks we missed
+			if err := syncBlocks(config, config.Tree, r.verify); err != nil {
+				return err
+			}
+		} else {
+			log.Lvl1("Not syncing, the rosters of the stored epochs are unknown")
+		}
+		log.Lvl1("Continuing the stored chain at height", store.Len())
+	}
+
+	var schedule *membership.Schedule
+	if s.EpochLength > 0 {
+		schedule = newSchedule(config, s.StartMembers)
 	}
 
 	size := config.Tree.Size()
-	thold := size * 2 / 3
 	log.Lvl1("Size is:", size, "rounds:", s.Rounds)
 	log.Lvl1("Simulating for", s.Hosts, "nodes and", s.NSubtrees, "subtrees in ", s.Rounds, "round")
 	for round := 0; round < s.Rounds; round++ {
@@ -150,13 +389,37 @@ func (s *SimulationProtocol) Run(config *onet.SimulationConfig) error {
 		roundNoVerify := monitor.NewTimeMeasure("roundNoVerify")
 		fullRound := monitor.NewTimeMeasure("fullRound")
 
-		// get public keys
-		publics := make([]kyber.Point, config.Tree.Size())
-		for i, node := range config.Tree.List() {
+		if store != nil {
+			// every round signs a new block on top of the stored ones
+			var err error
+			block, binaryBlock, err = nextBlock(store, block)
+			if err != nil {
+				return err
+			}
+		}
+
+		tree := config.Tree
+		var changes []membership.Change
+		if schedule != nil {
+			var err error
+			tree, changes, err = s.epoch(config, schedule, round)
+			if err != nil {
+				return err
+			}
+			block, binaryBlock, err = epochBlock(block, schedule.Current().Number, changes)
+			if err != nil {
+				return err
+			}
+		}
+
+		// get public keys of the roster of the epoch
+		publics := make([]kyber.Point, tree.Size())
+		for i, node := range tree.List() {
 			publics[i] = node.ServerIdentity.Public
 		}
+		thold := tree.Size() * 2 / 3
 
-		pi, err := config.Overlay.CreateProtocol(protocol.DefaultProtocolName, config.Tree, onet.NilServiceID)
+		pi, err := config.Overlay.CreateProtocol(simulationProtocolName, tree, onet.NilServiceID)
 		if err != nil {
 			return err
 		}
@@ -165,6 +428,8 @@ func (s *SimulationProtocol) Run(config *onet.SimulationConfig) error {
 		cosiProtocol.Msg = binaryBlock
 		cosiProtocol.NSubtrees = s.NSubtrees
 		cosiProtocol.Timeout = defaultTimeout
+		cosiProtocol.Erasure = s.Erasure
+		cosiProtocol.Compact = s.Compact
 
 		err = cosiProtocol.Start()
 		if err != nil {
@@ -189,12 +454,199 @@ func (s *SimulationProtocol) Run(config *onet.SimulationConfig) error {
 		}
 		verificationOnly.Record()
 
+		if store != nil {
+			if err := storeBlock(store, block, binaryBlock, signature); err != nil {
+				return err
+			}
+		}
+
+		if schedule != nil {
+			// the changes are agreed, they take effect at the next boundary
+			if err := schedule.Commit(changes); err != nil {
+				return err
+			}
+		}
+
 		fullRound.Record()
 	}
 
 	return nil
 }
 
+// nextBlock returns the transactions of block in a block following the last
+// stored block.
+func nextBlock(store *blockstore.Store, block *blockchain.TrBlock) (*blockchain.TrBlock, []byte, error) {
+	parent, err := lastHash(store)
+	if err != nil {
+		return nil, nil, err
+	}
+	next := blockchain.NewTrBlock(block.TransactionList, blockchain.NewHeader(block.TransactionList, parent, "0"))
+	data, err := next.MarshalBinary()
+	return next, data, err
+}
+
+// syncBlocks fetches the blocks missing in the store of the root of the tree
+// from the stores of the other nodes.
+func syncBlocks(config *onet.SimulationConfig, tree *onet.Tree, verify func(prev, e *blockstore.Entry) error) error {
+	pi, err := config.Overlay.CreateProtocol(blocksync.Name, tree, onet.NilServiceID)
+	if err != nil {
+		return err
+	}
+	p := pi.(*blocksync.Sync)
+	p.Verify = verify
+	if err := p.Start(); err != nil {
+		return err
+	}
+	return <-p.Finished
+}
+
+// verifyChanges returns an error if the block isn't of the epoch of the
+// node, isn't signed by its members or has roster changes that the node
+// can't accept. Only nodes of the simulation may join.
+func verifyChanges(follower *membership.Follower, roster *onet.Roster, msg []byte) error {
+	block := &blockchain.TrBlock{}
+	if err := json.Unmarshal(msg, block); err != nil {
+		return err
+	}
+	for _, c := range block.Header.RosterChanges {
+		if c.Join && !isNode(c.Member) {
+			return errors.New("unknown node " + c.Member + " joins")
+		}
+	}
+	var signers []string
+	for _, si := range roster.List {
+		signers = append(signers, si.ID.String())
+	}
+	return follower.Verify(block.Header.Epoch, signers, block.Header.RosterChanges)
+}
+
+// isNode returns whether the member is a node of the simulation.
+func isNode(member string) bool {
+	followers.Lock()
+	defer followers.Unlock()
+	if followers.roster == nil {
+		return false
+	}
+	for _, si := range followers.roster.List {
+		if si.ID.String() == member {
+			return true
+		}
+	}
+	return false
+}
+
+// errGap is returned by storeBlock if the block doesn't follow the last
+// stored block.
+var errGap = errors.New("block doesn't follow the stored chain")
+
+// lastHash returns the hash of the last stored block, the parent of the next
+// one, or "0" for an empty store.
+func lastHash(store *blockstore.Store) (string, error) {
+	last, err := store.Last()
+	if err != nil || last == nil {
+		return "0", err
+	}
+	return string(last.Hash), nil
+}
+
+// storeBlock stores the signed block with the signature and the mask of the
+// signers that follows it.
+func storeBlock(store *blockstore.Store, block *blockchain.TrBlock, data, signature []byte) error {
+	parent, err := lastHash(store)
+	if err != nil {
+		return err
+	}
+	if block.Header.Parent != parent {
+		return errGap
+	}
+	lenSig := protocol.ThePairingSuite.G1().PointLen()
+	if len(signature) < lenSig {
+		return errors.New("signature too short")
+	}
+	return store.Append(&blockstore.Entry{
+		Height:    store.Len(),
+		Hash:      []byte(block.HeaderHash),
+		Block:     data,
+		Signature: signature[:lenSig],
+		Mask:      signature[lenSig:],
+	})
+}
+
+// newSchedule returns the epochs starting with the first members of the
+// roster, all of them if members is 0.
+func newSchedule(config *onet.SimulationConfig, members int) *membership.Schedule {
+	if members <= 0 || members > len(config.Roster.List) {
+		members = len(config.Roster.List)
+	}
+	var ids []string
+	for _, si := range config.Roster.List[:members] {
+		ids = append(ids, si.ID.String())
+	}
+	return membership.NewSchedule(ids)
+}
+
+// epoch starts a new epoch at the boundary and returns the tree of the
+// current epoch. At the first block of an epoch the next node of the roster
+// asks to join and, with Leave, the oldest member after the root asks to
+// leave.
+func (s *SimulationProtocol) epoch(config *onet.SimulationConfig, schedule *membership.Schedule, round int) (*onet.Tree, []membership.Change, error) {
+	if round%s.EpochLength != 0 {
+		return s.epochTree(config, schedule.Current()), nil, nil
+	}
+	if round > 0 {
+		e, err := schedule.NewEpoch(uint64(round))
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Lvl1("Starting epoch", e.Number, "with", len(e.Members), "members")
+	}
+	current := schedule.Current()
+	var changes []membership.Change
+	for _, si := range config.Roster.List {
+		if current.Index(si.ID.String()) < 0 {
+			changes = append(changes, membership.Change{Join: true, Member: si.ID.String()})
+			break
+		}
+	}
+	root := config.Tree.Root.ServerIdentity.ID.String()
+	if s.Leave {
+		for _, m := range current.Members {
+			if m != root {
+				changes = append(changes, membership.Change{Join: false, Member: m})
+				break
+			}
+		}
+	}
+	// drop the changes that would leave the roster too small
+	for len(changes) > 0 && schedule.Validate(changes) != nil {
+		changes = changes[:len(changes)-1]
+	}
+	return s.epochTree(config, current), changes, nil
+}
+
+// epochTree returns the tree of the members of the epoch with the root of
+// the simulation.
+func (s *SimulationProtocol) epochTree(config *onet.SimulationConfig, e *membership.Epoch) *onet.Tree {
+	var list []*network.ServerIdentity
+	for _, si := range config.Roster.List {
+		if e.Index(si.ID.String()) >= 0 {
+			list = append(list, si)
+		}
+	}
+	return onet.NewRoster(list).GenerateNaryTreeWithRoot(s.BF, config.Tree.Root.ServerIdentity)
+}
+
+// epochBlock returns the block with the epoch and the roster changes in its
+// header, which the roster agrees on by signing the block.
+func epochBlock(block *blockchain.TrBlock, epoch uint64, changes []membership.Change) (*blockchain.TrBlock, []byte, error) {
+	header := *block.Header
+	header.Epoch = epoch
+	header.RosterChanges = changes
+	next := blockchain.NewTrBlock(block.TransactionList, &header)
+	data, err := next.MarshalBinary()
+	return next, data, err
+}
+
 // GetBlock returns the next block available from the transaction pool.
 func GetBlock(size int, transactions []blkparser.Tx, lastBlock string, lastKeyBlock string, priority int) (*blockchain.TrBlock, error) {
 	log.Lvl1("GetBlock got", len(transactions), "transactions")
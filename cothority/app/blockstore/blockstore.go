@@ -0,0 +1,167 @@
+// Blockstore inspects and compacts the block stores of the nodes. A store
+// holds the committed blocks with their collective signatures, see
+// protocols/byzcoin/blockchain/blockstore.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/csanti/pbft-experiments/cothority/log"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain/blockstore"
+	"gopkg.in/codegangsta/cli.v1"
+)
+
+func main() {
+	app := cli.NewApp()
+	app.Name = "Blockstore"
+	app.Usage = "Inspect and compact stores of committed blocks."
+
+	app.Flags = []cli.Flag{
+		cli.IntFlag{
+			Name:  "debug, d",
+			Value: 0,
+			Usage: "debug-level: `integer`: 1 for terse, 5 for maximal",
+		},
+	}
+	app.Before = func(c *cli.Context) error {
+		log.SetUseColors(false)
+		log.SetDebugVisible(c.GlobalInt("debug"))
+		return nil
+	}
+	app.Commands = []cli.Command{
+		{
+			Name:      "check",
+			Aliases:   []string{"c"},
+			Usage:     "recover the store and print its height and size",
+			ArgsUsage: "store-file",
+			Action:    check,
+		},
+		{
+			Name:      "list",
+			Aliases:   []string{"l"},
+			Usage:     "list the blocks of a range of heights",
+			ArgsUsage: "store-file",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "from, f",
+					Value: 0,
+					Usage: "first `height` to list",
+				},
+				cli.IntFlag{
+					Name:  "to, t",
+					Value: -1,
+					Usage: "list up to, but without, `height`, -1 for all",
+				},
+			},
+			Action: list,
+		},
+		{
+			Name:      "compact",
+			Usage:     "remove the blocks below a height, keeping their hashes and signatures",
+			ArgsUsage: "store-file",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "keep, k",
+					Value: 1000,
+					Usage: "keep the last `number` blocks",
+				},
+				cli.StringFlag{
+					Name:  "utxo, u",
+					Usage: "only prune the blocks in the unspent outputs saved in `file`, as byzcoin_ng replays the others",
+				},
+			},
+			Action: compact,
+		},
+	}
+	app.Run(os.Args)
+}
+
+// check opens the store, which truncates a torn last block, and prints it.
+func check(c *cli.Context) error {
+	s, err := open(c)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	last, err := s.Last()
+	if err != nil {
+		return err
+	}
+	log.Printf("%d blocks in %d bytes", s.Len(), s.Size())
+	if last != nil {
+		log.Printf("Last block: %x", last.Hash)
+	}
+	return nil
+}
+
+// list prints height, hash and sizes of the blocks in the range.
+func list(c *cli.Context) error {
+	s, err := open(c)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	to := s.Len()
+	if c.Int("to") >= 0 {
+		to = uint64(c.Int("to"))
+	}
+	entries, err := s.Range(uint64(c.Int("from")), to)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		block := fmt.Sprintf("%d bytes", len(e.Block))
+		if len(e.Block) == 0 {
+			block = "pruned"
+		}
+		log.Printf("%d: %x block: %s signature: %d bytes mask: %x",
+			e.Height, e.Hash, block, len(e.Signature), e.Mask)
+	}
+	return nil
+}
+
+// compact removes all but the last blocks from the store.
+func compact(c *cli.Context) error {
+	s, err := open(c)
+	if err != nil {
+		return err
+	}
+	height := s.Len()
+	s.Close()
+	keep := uint64(c.Int("keep"))
+	if keep >= height {
+		log.Print("Nothing to compact")
+		return nil
+	}
+	prune := height - keep
+	if c.String("utxo") != "" {
+		_, snapshot, err := blockchain.LoadUTXOSet(c.String("utxo"))
+		if err != nil {
+			return err
+		}
+		if snapshot < prune {
+			prune = snapshot
+		}
+	}
+	saved, err := blockstore.Compact(c.Args().First(), prune)
+	if err != nil {
+		return err
+	}
+	log.Printf("Pruned %d blocks, saved %d bytes", prune, saved)
+	return nil
+}
+
+// open opens the store given as argument, which has to exist.
+func open(c *cli.Context) (*blockstore.Store, error) {
+	if c.NArg() != 1 {
+		return nil, errors.New("Please give the store-file")
+	}
+	path := c.Args().First()
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return blockstore.Open(path)
+}
@@ -35,6 +35,7 @@ func main() {
 		commandConfig,
 		commandKeyvalue,
 		commandSSH,
+		commandFile,
 		commandFollow,
 	}
 	app.Flags = []cli.Flag{
@@ -199,12 +200,28 @@ func kvList(c *cli.Context) error {
 	cfg := loadConfigOrFail(c)
 	log.Infof("config for id %x", cfg.ID)
 	for k, v := range cfg.Config.Data {
+		if identity.IsEncrypted(v) {
+			v = "<encrypted>"
+		}
 		log.Infof("%s: %s", k, v)
 	}
 	return nil
 }
 func kvValue(c *cli.Context) error {
-	log.Fatal("Not yet implemented")
+	cfg := loadConfigOrFail(c)
+	if c.NArg() != 1 {
+		log.Fatal("Please give a key")
+	}
+	value, ok := cfg.Config.Data[c.Args().First()]
+	if !ok {
+		log.Fatal("Didn't find key", c.Args().First(), "in the config")
+	}
+	if identity.IsEncrypted(value) {
+		var err error
+		value, err = cfg.Decrypt(value)
+		log.ErrFatal(err)
+	}
+	log.Info(value)
 	return nil
 }
 func kvAdd(c *cli.Context) error {
@@ -215,6 +232,11 @@ func kvAdd(c *cli.Context) error {
 	key := c.Args().Get(0)
 	value := c.Args().Get(1)
 	prop := cfg.GetProposed()
+	if to := c.String("to"); to != "" {
+		var err error
+		value, err = prop.Encrypt(value, strings.Split(to, ","))
+		log.ErrFatal(err)
+	}
 	prop.Data[key] = value
 	log.ErrFatal(cfg.ProposeSend(prop))
 	return cfg.saveConfig(c)
@@ -330,6 +352,78 @@ func sshSync(c *cli.Context) error {
 	return nil
 }
 
+/*
+ * Commands related to the distribution of files. The content is stored by
+ * the cothority and the identity-sc holds
+ * file:name / hash_of_content
+ * so that the devices vote on the content and the followers can check it.
+ */
+func fileAdd(c *cli.Context) error {
+	cfg := loadConfigOrFail(c)
+	if c.NArg() == 0 {
+		log.Fatal("Please give the file to add")
+	}
+	file := c.Args().First()
+	name := path.Base(file)
+	if c.NArg() == 2 {
+		name = c.Args().Get(1)
+	}
+	if !validFileName(name) {
+		log.Fatal("Name must not contain '/' or ':'")
+	}
+	content, err := ioutil.ReadFile(file)
+	log.ErrFatal(err)
+	if len(content) > identity.MaxFileSize {
+		log.Fatal("File is bigger than", identity.MaxFileSize, "bytes")
+	}
+	hash, err := cfg.StoreFile(content)
+	log.ErrFatal(err)
+	prop := cfg.GetProposed()
+	prop.Data[identity.FilePrefix+":"+name] = hash
+	cfg.proposeSendVoteUpdate(prop)
+	return cfg.saveConfig(c)
+}
+func fileDel(c *cli.Context) error {
+	cfg := loadConfigOrFail(c)
+	if c.NArg() != 1 {
+		log.Fatal("Please give the name of the file to delete")
+	}
+	name := c.Args().First()
+	prop := cfg.GetProposed()
+	key := identity.FilePrefix + ":" + name
+	if _, ok := prop.Data[key]; !ok {
+		log.Fatal("Didn't find file", name, "in the config")
+	}
+	delete(prop.Data, key)
+	cfg.proposeSendVoteUpdate(prop)
+	return cfg.saveConfig(c)
+}
+func fileLs(c *cli.Context) error {
+	cfg := loadConfigOrFail(c)
+	for _, name := range cfg.Config.GetSuffixColumn(identity.FilePrefix) {
+		log.Infof("%s: %s", name, cfg.Config.GetValue(identity.FilePrefix, name))
+	}
+	return nil
+}
+func fileGet(c *cli.Context) error {
+	cfg := loadConfigOrFail(c)
+	if c.NArg() == 0 {
+		log.Fatal("Please give the name of the file")
+	}
+	name := c.Args().First()
+	dest := name
+	if c.NArg() == 2 {
+		dest = c.Args().Get(1)
+	}
+	hash := cfg.Config.GetValue(identity.FilePrefix, name)
+	if hash == "" {
+		log.Fatal("Didn't find file", name, "in the config")
+	}
+	content, err := cfg.GetFile(hash)
+	log.ErrFatal(err)
+	return ioutil.WriteFile(dest, content, 0600)
+}
+
 func followAdd(c *cli.Context) error {
 	if c.NArg() < 2 {
 		log.Fatal("Please give a group-definition, an ID, and optionally a service-name of the skipchain to follow")
@@ -351,6 +445,7 @@ func followAdd(c *cli.Context) error {
 	}
 	cfg.Follow = append(cfg.Follow, newID)
 	cfg.writeAuthorizedKeys(c)
+	cfg.writeFiles(c)
 	// Identity needs to exist, else saving/loading will fail. For
 	// followers it doesn't matter if the identity will be overwritten,
 	// as it is not used.
@@ -392,5 +487,6 @@ func followUpdate(c *cli.Context) error {
 		log.ErrFatal(f.ConfigUpdate())
 	}
 	cfg.writeAuthorizedKeys(c)
+	cfg.writeFiles(c)
 	return cfg.saveConfig(c)
 }
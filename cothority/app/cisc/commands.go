@@ -6,7 +6,8 @@ import "gopkg.in/codegangsta/cli.v1"
 This holds the cli-commands so the main-file is less cluttered.
 */
 
-var commandID, commandConfig, commandKeyvalue, commandSSH, commandFollow cli.Command
+var commandID, commandConfig, commandKeyvalue, commandSSH, commandFile,
+	commandFollow cli.Command
 
 func init() {
 	commandID = cli.Command{
@@ -113,6 +114,12 @@ func init() {
 				Usage:     "add a new key/value pair",
 				ArgsUsage: "key value",
 				Action:    kvAdd,
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "to",
+						Usage: "encrypt the value to the comma-separated devices",
+					},
+				},
 			},
 			{
 				Name:      "del",
@@ -195,6 +202,39 @@ func init() {
 			},
 		},
 	}
+	commandFile = cli.Command{
+		Name:  "file",
+		Usage: "distributing small files",
+		Subcommands: []cli.Command{
+			{
+				Name:      "add",
+				Aliases:   []string{"a"},
+				Usage:     "stores a file and proposes it",
+				ArgsUsage: "file [name]",
+				Action:    fileAdd,
+			},
+			{
+				Name:      "del",
+				Aliases:   []string{"rm"},
+				Usage:     "proposes to remove a file",
+				ArgsUsage: "name",
+				Action:    fileDel,
+			},
+			{
+				Name:    "list",
+				Aliases: []string{"ls"},
+				Usage:   "shows all files",
+				Action:  fileLs,
+			},
+			{
+				Name:      "get",
+				Aliases:   []string{"g"},
+				Usage:     "fetches a file",
+				ArgsUsage: "name [destination]",
+				Action:    fileGet,
+			},
+		},
+	}
 	commandFollow = cli.Command{
 		Name:    "follow",
 		Aliases: []string{"f"},
@@ -230,6 +270,10 @@ func init() {
 						Value: 0,
 						Usage: "poll every n seconds",
 					},
+					cli.StringFlag{
+						Name:  "f,files",
+						Usage: "directory for the files, default is 'files' in the configuration-directory",
+					},
 				},
 				Action: followUpdate,
 			},
@@ -6,6 +6,7 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 
@@ -108,6 +109,42 @@ func (cfg *ciscConfig) writeAuthorizedKeys(c *cli.Context) {
 	log.ErrFatal(err)
 }
 
+// writes the files of every followed identity to its own directory in the
+// files-directory, fetching only the changed ones.
+func (cfg *ciscConfig) writeFiles(c *cli.Context) {
+	dir := filesDir(c)
+	for _, f := range cfg.Follow {
+		idDir := fmt.Sprintf("%s/%x", dir, []byte(f.ID))
+		log.ErrFatal(mkdir(idDir, 0700))
+		names := f.Config.GetSuffixColumn(identity.FilePrefix)
+		for _, name := range names {
+			if !validFileName(name) {
+				log.Warn("Ignoring file with invalid name", name)
+				continue
+			}
+			file := idDir + "/" + name
+			hash := f.Config.GetValue(identity.FilePrefix, name)
+			if b, err := ioutil.ReadFile(file); err == nil &&
+				identity.FileHash(b) == hash {
+				continue
+			}
+			log.Info("Writing file", file)
+			content, err := f.GetFile(hash)
+			log.ErrFatal(err)
+			log.ErrFatal(ioutil.WriteFile(file, content, 0600))
+		}
+		// Remove the files that are not in the config anymore
+		stored, err := ioutil.ReadDir(idDir)
+		log.ErrFatal(err)
+		for _, fi := range stored {
+			if f.Config.GetValue(identity.FilePrefix, fi.Name()) == "" {
+				log.Info("Removing file", idDir+"/"+fi.Name())
+				log.ErrFatal(os.Remove(idDir + "/" + fi.Name()))
+			}
+		}
+	}
+}
+
 // showDifference compares the propose and the config-part
 func (cfg *ciscConfig) showDifference() {
 	if cfg.Proposed == nil {
@@ -170,6 +207,24 @@ func getGroup(c *cli.Context) *config.Group {
 	return groups
 }
 
+// retrieves the directory for the files of the followed identities
+func filesDir(c *cli.Context) string {
+	dir := c.String("files")
+	if dir == "" {
+		dir = config.TildeToHome(c.GlobalString("config")) + "/files"
+	} else {
+		dir = config.TildeToHome(dir)
+	}
+	log.ErrFatal(mkdir(dir, 0700))
+	return dir
+}
+
+// a file-name must not leave its directory nor break the key of the config
+func validFileName(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		!strings.ContainsAny(name, "/:")
+}
+
 // retrieves ssh-config-name and ssh-directory
 func sshDirConfig(c *cli.Context) (string, string) {
 	sshDir := config.TildeToHome(c.GlobalString("cs"))
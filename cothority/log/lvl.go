@@ -39,6 +39,8 @@
 //	DEBUG_LVL // will act like SetDebugVisible
 //	DEBUG_TIME // if 'true' it will print the date and time
 //	DEBUG_COLOR // if 'false' it will not use colors
+//	DEBUG_JSON // if 'true' it will print JSON-lines, see structured.go
+//	DEBUG_PKG // debug-levels for single packages, like "network=1,sda=3"
 // But for this the function ParseEnv() or AddFlags() has to be called.
 package log
 
@@ -50,6 +52,7 @@ import (
 	"regexp"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -127,14 +130,25 @@ var debugMut sync.RWMutex
 var regexpPaths, _ = regexp.Compile(".*/")
 
 func lvl(lvl, skip int, args ...interface{}) {
+	lvlFields(lvl, skip+1, nil, args...)
+}
+
+// lvlFields is like lvl, but the fields are added to the message.
+func lvlFields(lvl, skip int, fields Fields, args ...interface{}) {
 	debugMut.Lock()
 	defer debugMut.Unlock()
 
-	if lvl > debugVisible {
+	// Only look up the caller if we need it for the package-level
+	if len(pkgLevels) == 0 && lvl > debugVisible {
 		return
 	}
 	pc, _, line, _ := runtime.Caller(skip)
-	name := regexpPaths.ReplaceAllString(runtime.FuncForPC(pc).Name(), "")
+	funcName := runtime.FuncForPC(pc).Name()
+	pkg := packageName(funcName)
+	if lvl > packageLevel(pkg) {
+		return
+	}
+	name := regexpPaths.ReplaceAllString(funcName, "")
 	lineStr := fmt.Sprintf("%d", line)
 
 	// For the testing-framework, we check the resulting string. So as not to
@@ -156,6 +170,9 @@ func lvl(lvl, skip int, args ...interface{}) {
 		caller += "@" + StaticMsg
 	}
 	message := fmt.Sprintln(args...)
+	if len(fields) > 0 && !useJSON {
+		message = strings.TrimSuffix(message, "\n") + " " + fields.String() + "\n"
+	}
 	bright := lvl < 0
 	lvlAbs := lvl
 	if bright {
@@ -192,6 +209,16 @@ func lvl(lvl, skip int, args ...interface{}) {
 			}
 		}
 	}
+	if useJSON {
+		str := jsonLine(lvlStr, fmt.Sprintf("%s:%d", name, line), pkg,
+			strings.TrimSuffix(message, "\n"), fields)
+		if lvl < lvlInfo {
+			fmt.Fprint(stdErr, str)
+		} else {
+			fmt.Fprint(stdOut, str)
+		}
+		return
+	}
 	str := fmt.Sprintf(": (%s) - %s", caller, message)
 	if showTime {
 		ti := time.Now()
@@ -209,7 +236,7 @@ func lvl(lvl, skip int, args ...interface{}) {
 }
 
 func fg(c ct.Color, bright bool) {
-	if useColors {
+	if useColors && !useJSON {
 		ct.Foreground(c, bright)
 	}
 }
@@ -400,6 +427,8 @@ func MainTest(m *testing.M, ls ...int) {
 //   DEBUG_LVL - for the actual debug-lvl - default is 1
 //   DEBUG_TIME - whether to show the timestamp - default is false
 //   DEBUG_COLOR - whether to color the output - default is true
+//   DEBUG_JSON - whether to output JSON-lines - default is false
+//   DEBUG_PKG - a list of package=level - default is empty
 func ParseEnv() {
 	var err error
 	dv := os.Getenv("DEBUG_LVL")
@@ -426,6 +455,7 @@ func ParseEnv() {
 			Error("Couldn't convert", dc, "to boolean")
 		}
 	}
+	parseEnvStructured()
 }
 
 // RegisterFlags adds the flags and the variables for the debug-control using
@@ -435,4 +465,6 @@ func RegisterFlags() {
 	flag.IntVar(&debugVisible, "debug", DebugVisible(), "Change debug level (0-5)")
 	flag.BoolVar(&showTime, "debug-time", ShowTime(), "Shows the time of each message")
 	flag.BoolVar(&useColors, "debug-color", UseColors(), "Colors each message")
+	flag.BoolVar(&useJSON, "debug-json", UseJSON(), "Prints each message as a JSON-line")
+	flag.Var(pkgLevelsFlag{}, "debug-pkg", "Debug levels per package: package=level,...")
 }
@@ -0,0 +1,293 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Structured logging
+//
+// If JSON-output is turned on with
+//	log.SetUseJSON(true)
+// every message is printed as one line of JSON, so that the output of a
+// simulation can be parsed by a script instead of grep. Protocols can attach
+// fields to their messages using a Context:
+//	ctx := log.NewContext(p.ServerIdentity().String(), p.Name())
+//	ctx.With(log.FieldRound, round).With(log.FieldPhase, "commit").
+//		Lvl3("Received enough commit messages", "count", len(commits))
+// which prints
+//	{"time":"...","lvl":"3","caller":"...","pkg":"...","msg":"Received enough
+//	commit messages","node":"...","protocol":"...","round":2,"phase":"commit",
+//	"count":12}
+// Without JSON-output, the fields are appended to the message as key=value.
+// The protocols of onet, like pbft and blsftcosi, log their rounds through
+// the package timeline, which wraps a Context.
+//
+// The debug-level can also be set per package with
+//	log.SetPackageLevel("blsftcosi", 3)
+// where every package whose import-path contains the element 'blsftcosi' will
+// show messages up to level 3, regardless of the global debug-level.
+//
+// Both can be set using the environment-variables
+//	DEBUG_JSON // if 'true' it will print JSON-lines
+//	DEBUG_PKG // a list of package=level, like "network=1,blsftcosi=4"
+// or with the flags "-debug-json" and "-debug-pkg" of RegisterFlags.
+
+// Fields used by the protocols, so that the output can be searched for them.
+const (
+	// FieldNode is the node that emits the message
+	FieldNode = "node"
+	// FieldProtocol is the name of the protocol
+	FieldProtocol = "protocol"
+	// FieldRound is the round of the protocol
+	FieldRound = "round"
+	// FieldPhase is the phase of the protocol, like "prepare" or "commit"
+	FieldPhase = "phase"
+)
+
+// Fields are key/value pairs attached to a message.
+type Fields map[string]interface{}
+
+// Context holds fields that are added to every message logged through it.
+// A Context is immutable and can be shared between go-routines.
+type Context struct {
+	fields Fields
+	// skip is the number of frames between the caller and the Context
+	skip int
+}
+
+// If useJSON is true, every message is printed as a JSON-line.
+var useJSON = false
+
+// pkgLevels holds the debug-levels for single packages.
+var pkgLevels = map[string]int{}
+
+// NewContext returns a Context with the node and the protocol set.
+func NewContext(node, protocol string) *Context {
+	return &Context{fields: Fields{
+		FieldNode:     node,
+		FieldProtocol: protocol,
+	}}
+}
+
+// With returns a new Context with the key set to value.
+func (c *Context) With(key string, value interface{}) *Context {
+	fields := c.fields.clone()
+	fields[key] = value
+	return &Context{fields: fields, skip: c.skip}
+}
+
+// CallerSkip returns a new Context for a package that wraps it: the caller
+// of its messages, and the package whose debug-level applies, is taken skip
+// frames further up the stack.
+func (c *Context) CallerSkip(skip int) *Context {
+	return &Context{fields: c.fields.clone(), skip: c.skip + skip}
+}
+
+// Fields returns a copy of the fields of the Context.
+func (c *Context) Fields() Fields {
+	return c.fields.clone()
+}
+
+// Lvl1 prints the message with the fields of the Context and the
+// additional key/value-pairs in kv.
+func (c *Context) Lvl1(msg string, kv ...interface{}) { c.lvl(1, msg, kv...) }
+
+// Lvl2 is like Lvl1 but at level 2
+func (c *Context) Lvl2(msg string, kv ...interface{}) { c.lvl(2, msg, kv...) }
+
+// Lvl3 is like Lvl1 but at level 3
+func (c *Context) Lvl3(msg string, kv ...interface{}) { c.lvl(3, msg, kv...) }
+
+// Lvl4 is like Lvl1 but at level 4
+func (c *Context) Lvl4(msg string, kv ...interface{}) { c.lvl(4, msg, kv...) }
+
+// Lvl5 is like Lvl1 but at level 5
+func (c *Context) Lvl5(msg string, kv ...interface{}) { c.lvl(5, msg, kv...) }
+
+// Warn is like Lvl1 but prints a warning
+func (c *Context) Warn(msg string, kv ...interface{}) { c.lvl(lvlWarning, msg, kv...) }
+
+// Error is like Lvl1 but prints an error
+func (c *Context) Error(msg string, kv ...interface{}) { c.lvl(lvlError, msg, kv...) }
+
+// Needed to keep the caller-depth the same as for lvld.
+func (c *Context) lvl(l int, msg string, kv ...interface{}) {
+	fields := c.fields.clone()
+	for i := 0; i+1 < len(kv); i += 2 {
+		fields[fmt.Sprint(kv[i])] = kv[i+1]
+	}
+	if len(kv)%2 == 1 {
+		fields["extra"] = kv[len(kv)-1]
+	}
+	lvlFields(l, 3+c.skip, fields, msg)
+}
+
+func (f Fields) clone() Fields {
+	c := make(Fields, len(f))
+	for k, v := range f {
+		c[k] = v
+	}
+	return c
+}
+
+// String returns the fields as sorted key=value pairs.
+func (f Fields) String() string {
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	strs := make([]string, len(keys))
+	for i, k := range keys {
+		strs[i] = fmt.Sprintf("%s=%v", k, f[k])
+	}
+	return strings.Join(strs, " ")
+}
+
+// jsonLine returns the message as one line of JSON.
+func jsonLine(lvlStr, caller, pkg, msg string, fields Fields) string {
+	line := make(map[string]interface{}, len(fields)+5)
+	for k, v := range fields {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		line[k] = v
+	}
+	line["time"] = time.Now().Format(time.RFC3339Nano)
+	line["lvl"] = lvlStr
+	line["caller"] = caller
+	line["pkg"] = pkg
+	line["msg"] = msg
+	buf, err := json.Marshal(line)
+	if err != nil {
+		// One of the fields can't be marshalled - print it as a string
+		for k, v := range fields {
+			line[k] = fmt.Sprint(v)
+		}
+		buf, _ = json.Marshal(line)
+	}
+	return string(buf) + "\n"
+}
+
+// packageLevel returns the debug-level for the package 'pkg'. The level of
+// the longest matching entry in pkgLevels is taken, if none matches,
+// debugVisible is returned.
+func packageLevel(pkg string) int {
+	level := debugVisible
+	match := ""
+	path := "/" + pkg + "/"
+	for p, l := range pkgLevels {
+		if len(p) > len(match) && strings.Contains(path, "/"+p+"/") {
+			match = p
+			level = l
+		}
+	}
+	return level
+}
+
+// packageName returns the import-path of the function name as given by
+// runtime.FuncForPC.
+func packageName(funcName string) string {
+	slash := strings.LastIndex(funcName, "/")
+	dot := strings.Index(funcName[slash+1:], ".")
+	if dot < 0 {
+		return funcName
+	}
+	return funcName[:slash+1+dot]
+}
+
+// SetUseJSON turns on or off the output of JSON-lines
+func SetUseJSON(j bool) {
+	debugMut.Lock()
+	defer debugMut.Unlock()
+	useJSON = j
+}
+
+// UseJSON returns whether the output is in JSON-lines
+func UseJSON() bool {
+	debugMut.RLock()
+	defer debugMut.RUnlock()
+	return useJSON
+}
+
+// SetPackageLevel sets the debug-level of all packages whose import-path
+// contains the element 'pkg'. A negative level removes the entry again.
+func SetPackageLevel(pkg string, lvl int) {
+	debugMut.Lock()
+	defer debugMut.Unlock()
+	pkg = strings.Trim(pkg, "/")
+	if lvl < 0 {
+		delete(pkgLevels, pkg)
+		return
+	}
+	pkgLevels[pkg] = lvl
+}
+
+// PackageLevels returns the list of package-levels in the same format as
+// accepted by SetPackageLevels.
+func PackageLevels() string {
+	debugMut.RLock()
+	defer debugMut.RUnlock()
+	var strs []string
+	for p, l := range pkgLevels {
+		strs = append(strs, p+"="+strconv.Itoa(l))
+	}
+	sort.Strings(strs)
+	return strings.Join(strs, ",")
+}
+
+// SetPackageLevels takes a comma-separated list of package=level and sets
+// the debug-levels of these packages. All previous package-levels are
+// removed.
+func SetPackageLevels(list string) error {
+	levels := map[string]int{}
+	for _, pl := range strings.Split(list, ",") {
+		pl = strings.TrimSpace(pl)
+		if pl == "" {
+			continue
+		}
+		kv := strings.Split(pl, "=")
+		if len(kv) != 2 {
+			return fmt.Errorf("wrong package-level %s: should be package=level", pl)
+		}
+		l, err := strconv.Atoi(kv[1])
+		if err != nil {
+			return fmt.Errorf("wrong level in %s: %s", pl, err)
+		}
+		levels[strings.Trim(kv[0], "/")] = l
+	}
+	debugMut.Lock()
+	defer debugMut.Unlock()
+	pkgLevels = levels
+	return nil
+}
+
+// pkgLevelsFlag implements flag.Value for the "-debug-pkg" flag.
+type pkgLevelsFlag struct{}
+
+func (pkgLevelsFlag) String() string     { return PackageLevels() }
+func (pkgLevelsFlag) Set(s string) error { return SetPackageLevels(s) }
+
+// parseEnvStructured reads DEBUG_JSON and DEBUG_PKG
+func parseEnvStructured() {
+	dj := os.Getenv("DEBUG_JSON")
+	if dj != "" {
+		j, err := strconv.ParseBool(dj)
+		if err != nil {
+			Error("Couldn't convert", dj, "to boolean")
+		}
+		SetUseJSON(j)
+	}
+	dp := os.Getenv("DEBUG_PKG")
+	if dp != "" {
+		if err := SetPackageLevels(dp); err != nil {
+			Error("Couldn't parse DEBUG_PKG:", err)
+		}
+	}
+}
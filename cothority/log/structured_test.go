@@ -0,0 +1,132 @@
+package log
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestContext(t *testing.T) {
+	SetDebugVisible(1)
+	getStdOut()
+	ctx := NewContext("node0", "BlsFtCosi").With(FieldRound, 2)
+	ctx.With(FieldPhase, "commit").Lvl1("Received enough commit messages", "count", 12)
+	str := getStdOut()
+	if !strings.Contains(str, "Received enough commit messages count=12 node=node0 phase=commit protocol=BlsFtCosi round=2") {
+		t.Fatal("Didn't get correct string:", str)
+	}
+	if _, ok := ctx.Fields()[FieldPhase]; ok {
+		t.Fatal("With should not change the original context")
+	}
+}
+
+func TestJSON(t *testing.T) {
+	SetDebugVisible(1)
+	SetUseJSON(true)
+	defer SetUseJSON(false)
+	getStdOut()
+	NewContext("node0", "PBFT").With(FieldRound, 3).Lvl1("Prepare done", "count", 4)
+	Lvl1("Plain", "message")
+	lines := strings.Split(strings.TrimSpace(getStdOut()), "\n")
+	if len(lines) != 2 {
+		t.Fatal("Should have two lines:", lines)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["msg"] != "Prepare done" || m["node"] != "node0" ||
+		m["protocol"] != "PBFT" || m["round"] != 3.0 || m["count"] != 4.0 {
+		t.Fatal("Wrong fields:", m)
+	}
+	if m["lvl"] != "1" || !strings.HasSuffix(m["pkg"].(string), "/log") {
+		t.Fatal("Wrong level or package:", m)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["msg"] != "Plain message" {
+		t.Fatal("Wrong message:", m)
+	}
+
+	getStdErr()
+	NewContext("node1", "PBFT").Error("Failed", "err", os.ErrNotExist)
+	if !strings.Contains(getStdErr(), `"err":"file does not exist"`) {
+		t.Fatal("Errors should be printed as strings")
+	}
+}
+
+// wrapped logs like a package wrapping a Context.
+func wrapped(ctx *Context) {
+	ctx.Lvl1("Wrapped")
+}
+
+func TestContext_CallerSkip(t *testing.T) {
+	SetDebugVisible(1)
+	SetUseJSON(true)
+	defer SetUseJSON(false)
+	getStdOut()
+	wrapped(NewContext("node0", "PBFT").CallerSkip(1))
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(getStdOut()), &m); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(m["caller"].(string), "TestContext_CallerSkip") {
+		t.Fatal("Wrong caller:", m["caller"])
+	}
+}
+
+func TestPackageLevel(t *testing.T) {
+	SetDebugVisible(1)
+	defer SetPackageLevels("")
+	getStdOut()
+	SetPackageLevel("cothority/log", 3)
+	Lvl3("Shown")
+	if !strings.Contains(getStdOut(), "Shown") {
+		t.Fatal("Package-level should show level 3")
+	}
+	SetPackageLevel("log", 0)
+	Lvl3("Still shown")
+	if !strings.Contains(getStdOut(), "Still shown") {
+		t.Fatal("Longest match should win")
+	}
+	SetPackageLevel("cothority/log", -1)
+	Lvl1("Hidden")
+	if getStdOut() != "" {
+		t.Fatal("Package-level 0 should hide everything")
+	}
+	Error("Error")
+	if getStdErr() == "" {
+		t.Fatal("Errors should always be shown")
+	}
+
+	if err := SetPackageLevels("network=1, sda=4"); err != nil {
+		t.Fatal(err)
+	}
+	if PackageLevels() != "network=1,sda=4" {
+		t.Fatal("Wrong package-levels:", PackageLevels())
+	}
+	if SetPackageLevels("network") == nil {
+		t.Fatal("Should fail without level")
+	}
+	if packageLevel("github.com/csanti/pbft-experiments/cothority/sda") != 4 {
+		t.Fatal("sda should be at level 4")
+	}
+	if packageLevel("github.com/csanti/pbft-experiments/cothority/sdax") != 1 {
+		t.Fatal("Only full path-elements should match")
+	}
+}
+
+func TestPackageName(t *testing.T) {
+	for f, p := range map[string]string{
+		"github.com/a/b/protocol.(*BlsFtCosi).Start": "github.com/a/b/protocol",
+		"github.com/a/b/log.Lvl1":                    "github.com/a/b/log",
+		"main.main":                                  "main",
+		"github.com/a/b/log.TestX.func1":             "github.com/a/b/log",
+	} {
+		if packageName(f) != p {
+			t.Fatal("Wrong package for", f, ":", packageName(f))
+		}
+	}
+}
@@ -1,7 +1,9 @@
 // Package network is a networking library used in the SDA. You have Hosts which can
 // issue connections to others hosts, and Conn which are the connections itself.
 // Hosts and Conns are interfaces and can be of type Tcp, or Chans, or Udp or
-// whatever protocols you think might implement this interface.
+// whatever protocols you think might implement this interface. Besides TCP,
+// there is a QUIC-transport that multiplexes all connections of a host over
+// one UDP-socket, see quic.go.
 // In this library we also provide a way to encode / decode any kind of packet /
 // structs. When you want to send a struct to a conn, you first register
 // (one-time operation) this packet to the library, and then directly pass the
@@ -28,6 +30,8 @@ import (
 
 	"strings"
 
+	"sync"
+
 	"github.com/csanti/pbft-experiments/cothority/log"
 	"gopkg.in/dedis/crypto.v0/abstract"
 	"gopkg.in/dedis/crypto.v0/config"
@@ -220,6 +224,33 @@ func (t *TCPHost) listen(addr string, fn func(*TCPConn)) error {
 	}
 }
 
+// transport is used by NewSecureHost
+var transport = TransportTCP
+var transportMut sync.Mutex
+
+// SetTransport sets the transport used by NewSecureHost, it can be
+// TransportTCP or TransportQUIC.
+func SetTransport(t string) error {
+	if t != TransportTCP && t != TransportQUIC {
+		return fmt.Errorf("Unknown transport %s", t)
+	}
+	transportMut.Lock()
+	defer transportMut.Unlock()
+	transport = t
+	return nil
+}
+
+// NewSecureHost returns a SecureHost using the transport given in
+// SetTransport. The default is TCP.
+func NewSecureHost(private abstract.Scalar, si *ServerIdentity) SecureHost {
+	transportMut.Lock()
+	defer transportMut.Unlock()
+	if transport == TransportQUIC {
+		return NewSecureQUICHost(private, si)
+	}
+	return NewSecureTCPHost(private, si)
+}
+
 // NewSecureTCPHost returns a Secure Tcp Host
 // If the entity is nil, it will not verify the identity of the
 // remote host
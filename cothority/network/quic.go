@@ -0,0 +1,747 @@
+package network
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/csanti/pbft-experiments/cothority/log"
+	"github.com/quic-go/quic-go"
+	"golang.org/x/net/context"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/config"
+)
+
+// QUIC transport
+//
+// QUICHost and SecureQUICHost are drop-in replacements for TCPHost and
+// SecureTCPHost. Instead of one TCP-connection per peer, every host has one
+// UDP-socket that is used for listening and for opening connections. Each
+// side of a connection sends its packets on one QUIC-stream, with the same
+// encoding as over TCP: the Size followed by the marshalled Packet. So the
+// packets arrive in the order they were sent, as the protocols expect from
+// TCP.
+//
+// The TLS-certificate of QUIC is self-signed and not verified - the same as
+// with TCP, the remote host is identified by the ServerIdentity exchanged
+// by SecureQUICHost.
+
+// quicProtocol is the ALPN-name of the protocol.
+const quicProtocol = "cothority"
+
+// quicMaxStreams is the number of streams a remote host can open: one per
+// connection.
+const quicMaxStreams = 1
+
+// NewQUICHost returns a fresh QUIC Host.
+func NewQUICHost() *QUICHost {
+	return &QUICHost{
+		listeningPort: make(chan int, 1),
+		peers:         make(map[string]Conn),
+		quit:          make(chan bool),
+		constructors:  DefaultConstructors(Suite),
+		tlsConfig:     quicTLSConfig(),
+	}
+}
+
+// Open will create a new connection between this host
+// and the remote host named "name". This is a QUICConn.
+// If anything went wrong, Conn will be nil.
+func (q *QUICHost) Open(name string) (Conn, error) {
+	c, err := q.openQUICConn(name)
+	if err != nil {
+		return nil, err
+	}
+	q.peersMut.Lock()
+	defer q.peersMut.Unlock()
+	q.peers[name] = c
+	return c, nil
+}
+
+// Listen for any host trying to contact him.
+// Will launch in a goroutine the srv function once a connection is established
+func (q *QUICHost) Listen(addr string, fn func(Conn)) error {
+	receiver := func(qc *QUICConn) {
+		go fn(qc)
+	}
+	return q.listen(addr, receiver)
+}
+
+// Close will close every connection this host has opened and the
+// UDP-sockets.
+func (q *QUICHost) Close() error {
+	q.closedLock.Lock()
+	if q.closed {
+		q.closedLock.Unlock()
+		return nil
+	}
+	q.closed = true
+	close(q.quit)
+	q.closedLock.Unlock()
+
+	// Closing waits for the remote host to read all packets, so
+	// do it in parallel.
+	q.peersMut.Lock()
+	errs := make(chan error, len(q.peers))
+	for _, c := range q.peers {
+		go func(c Conn) {
+			errs <- c.Close()
+		}(c)
+	}
+	var err error
+	for range q.peers {
+		if e := <-errs; e != nil {
+			err = e
+		}
+	}
+	q.peersMut.Unlock()
+	if err != nil {
+		return err
+	}
+
+	q.transportMut.Lock()
+	defer q.transportMut.Unlock()
+	if q.listener != nil {
+		if err := q.listener.Close(); err != nil {
+			return quicError(err)
+		}
+	}
+	for _, tr := range []*quic.Transport{q.transport, q.dialer} {
+		if tr == nil {
+			continue
+		}
+		if err := tr.Close(); err != nil {
+			return quicError(err)
+		}
+		if err := tr.Conn.Close(); err != nil {
+			return handleError(err)
+		}
+	}
+	return nil
+}
+
+// Rx returns the number of bytes read by all its connections
+func (q *QUICHost) Rx() uint64 {
+	q.peersMut.Lock()
+	defer q.peersMut.Unlock()
+	var size uint64
+	for _, c := range q.peers {
+		size += c.Rx()
+	}
+	return size
+}
+
+// Tx returns the number of bytes written by all its connection
+func (q *QUICHost) Tx() uint64 {
+	q.peersMut.Lock()
+	defer q.peersMut.Unlock()
+	var size uint64
+	for _, c := range q.peers {
+		size += c.Tx()
+	}
+	return size
+}
+
+// openQUICConn opens a QUICConn to the given name. It uses the listening
+// socket if there is one.
+func (q *QUICHost) openQUICConn(name string) (*QUICConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", name)
+	if err != nil {
+		return nil, fmt.Errorf("Could not resolve %s: %s", name, err)
+	}
+	tr, err := q.dialTransport()
+	if err != nil {
+		return nil, err
+	}
+	// QUIC repeats the handshake-packets itself until
+	// HandshakeIdleTimeout, so there is no need to retry.
+	conn, err := tr.Dial(context.Background(), addr, q.tlsConfig, quicConfig())
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to %s: %s", name, err)
+	}
+	return newQUICConn(name, conn, q), nil
+}
+
+// dialTransport returns the socket used to open connections: the
+// listening socket, or else a socket on a random port.
+func (q *QUICHost) dialTransport() (*quic.Transport, error) {
+	q.transportMut.Lock()
+	defer q.transportMut.Unlock()
+	if q.transport != nil {
+		return q.transport, nil
+	}
+	if q.dialer == nil {
+		udp, err := net.ListenUDP("udp", &net.UDPAddr{})
+		if err != nil {
+			return nil, errors.New("Error opening socket: " + err.Error())
+		}
+		q.dialer = &quic.Transport{Conn: udp}
+	}
+	return q.dialer, nil
+}
+
+// listen is the private function that takes a function that takes a QUICConn.
+// That way we can control what to do of the QUICConn before returning it to
+// the function given by the user. Used by SecureQUICHost
+func (q *QUICHost) listen(addr string, fn func(*QUICConn)) error {
+	global, _ := GlobalBind(addr)
+	udpAddr, err := net.ResolveUDPAddr("udp", global)
+	if err != nil {
+		return errors.New("Error resolving address: " + err.Error())
+	}
+	var udp *net.UDPConn
+	for i := 0; i < MaxRetryConnect; i++ {
+		udp, err = net.ListenUDP("udp", udpAddr)
+		if err == nil {
+			break
+		} else if i == MaxRetryConnect-1 {
+			return errors.New("Error opening listener: " + err.Error())
+		}
+		time.Sleep(WaitRetry)
+	}
+	tr := &quic.Transport{Conn: udp}
+	ln, err := tr.Listen(q.tlsConfig, quicConfig())
+	if err != nil {
+		udp.Close()
+		return errors.New("Error opening listener: " + err.Error())
+	}
+	q.transportMut.Lock()
+	q.transport = tr
+	q.listener = ln
+	q.transportMut.Unlock()
+
+	// Send the actual listening port through the channel, in case
+	// it was a ":0"-address where the system choses its own
+	// port.
+	port := udp.LocalAddr().(*net.UDPAddr).Port
+	if len(q.listeningPort) == 0 {
+		// If the channel is empty, else we'd block.
+		log.Lvl3("Sending port", port, "over", q.listeningPort)
+		q.listeningPort <- port
+	}
+
+	for {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			select {
+			case <-q.quit:
+				return nil
+			default:
+			}
+			return quicError(err)
+		}
+		c := newQUICConn(conn.RemoteAddr().String(), conn, q)
+		q.peersMut.Lock()
+		q.peers[c.Endpoint] = c
+		q.peersMut.Unlock()
+		fn(c)
+	}
+}
+
+// newQUICConn returns a QUICConn and starts receiving the streams of the
+// remote host.
+func newQUICConn(endpoint string, conn *quic.Conn, host *QUICHost) *QUICConn {
+	c := &QUICConn{
+		Endpoint: endpoint,
+		conn:     conn,
+		host:     host,
+		packets:  make(chan Packet),
+		quit:     make(chan bool),
+		eof:      make(chan bool),
+	}
+	go c.receiveStream()
+	return c
+}
+
+// Remote returns the name of the peer at the end point of
+// the connection
+func (c *QUICConn) Remote() string {
+	return c.Endpoint
+}
+
+// Local returns the local address and port
+func (c *QUICConn) Local() string {
+	return c.conn.LocalAddr().String()
+}
+
+// Receive waits for the next packet of the remote host, or until ctx is
+// done.
+func (c *QUICConn) Receive(ctx context.Context) (Packet, error) {
+	select {
+	case am := <-c.packets:
+		if am.err != nil {
+			return EmptyApplicationPacket, am.err
+		}
+		return am, nil
+	case <-c.quit:
+		return EmptyApplicationPacket, ErrClosed
+	case <-c.eof:
+		select {
+		case <-c.quit:
+			// We closed the connection ourselves
+			return EmptyApplicationPacket, ErrClosed
+		default:
+		}
+		return EmptyApplicationPacket, ErrEOF
+	case <-ctx.Done():
+		return EmptyApplicationPacket, ErrCanceled
+	}
+}
+
+// Send marshals the packet and sends it on the stream of the connection.
+// Packets sent at the same time are written one after the other.
+func (c *QUICConn) Send(ctx context.Context, obj Body) error {
+	am, err := NewNetworkPacket(obj)
+	if err != nil {
+		return fmt.Errorf("Error converting packet: %v\n", err)
+	}
+	log.Lvlf5("%s->%s: Message SEND => %+v", c.Local(), c.Remote(), am)
+	b, err := am.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("Error marshaling  message: %s", err.Error())
+	}
+	packetSize := Size(len(b))
+	if err := c.send(ctx, packetSize, b); err != nil {
+		return err
+	}
+	log.Lvl5(c.Local(), c.Remote(), "Sent a total of", packetSize, "bytes")
+	c.addWrittenBytes(uint64(packetSize))
+	return nil
+}
+
+// Close tells the remote host that no more packets will be sent and waits
+// for it to read all packets, as closing the QUIC-connection would drop
+// the packets that are still on their way.
+func (c *QUICConn) Close() error {
+	var err error
+	c.quitOnce.Do(func() {
+		log.Lvl4("Closing connection", c.Local(), c.Remote())
+		if c.send(context.Background(), 0, nil) == nil {
+			select {
+			case <-c.conn.Context().Done():
+			case <-time.After(MaxIdentityExchange):
+				log.Lvl3("Remote host didn't close connection", c.Remote())
+			}
+		}
+		close(c.quit)
+		err = c.conn.CloseWithError(0, "")
+	})
+	if err != nil {
+		return quicError(err)
+	}
+	return nil
+}
+
+// Rx returns the number of bytes read by this connection
+func (c *QUICConn) Rx() uint64 {
+	c.bRxLock.Lock()
+	defer c.bRxLock.Unlock()
+	return c.bRx
+}
+
+// addReadBytes add b bytes to the total number of bytes read
+func (c *QUICConn) addReadBytes(b uint64) {
+	c.bRxLock.Lock()
+	defer c.bRxLock.Unlock()
+	c.bRx += b
+}
+
+// Tx returns the number of bytes written by this connection
+func (c *QUICConn) Tx() uint64 {
+	c.bTxLock.Lock()
+	defer c.bTxLock.Unlock()
+	return c.bTx
+}
+
+// addWrittenBytes add b bytes to the total number of bytes written
+func (c *QUICConn) addWrittenBytes(b uint64) {
+	c.bTxLock.Lock()
+	defer c.bTxLock.Unlock()
+	c.bTx += b
+}
+
+// send writes the size and the buffer to the stream of the connection,
+// which is opened with the first packet. A size of 0 tells the remote host
+// that we're closing the connection, and closes the stream.
+func (c *QUICConn) send(ctx context.Context, size Size, b []byte) error {
+	c.streamMut.Lock()
+	defer c.streamMut.Unlock()
+	if c.stream == nil {
+		s, err := c.conn.OpenUniStreamSync(ctx)
+		if err != nil {
+			return quicError(err)
+		}
+		c.stream = s
+	}
+	buf := make([]byte, 4, 4+len(b))
+	globalOrder.PutUint32(buf, uint32(size))
+	if _, err := c.stream.Write(append(buf, b...)); err != nil {
+		c.stream.CancelWrite(0)
+		return quicError(err)
+	}
+	if size == 0 {
+		if err := c.stream.Close(); err != nil {
+			return quicError(err)
+		}
+	}
+	return nil
+}
+
+// receiveStream accepts the stream of the remote host and hands its packets
+// over to Receive, one after the other, until the remote host closes the
+// connection.
+func (c *QUICConn) receiveStream() {
+	s, err := c.conn.AcceptUniStream(context.Background())
+	for err == nil {
+		am, more := c.readStream(s)
+		if !more || !c.deliver(am) {
+			break
+		}
+	}
+	// All packets are read, so the remote host can stop waiting
+	if err := c.conn.CloseWithError(0, ""); err != nil {
+		log.Lvl3("Couldn't close connection:", err)
+	}
+	close(c.eof)
+}
+
+// readStream reads the next packet from the stream. It returns false if
+// the remote host is closing the connection or the stream failed. A packet
+// that can't be unmarshalled is returned with its error.
+func (c *QUICConn) readStream(s *quic.ReceiveStream) (am Packet, more bool) {
+	var total Size
+	am.Constructors = c.host.constructors
+	defer func() {
+		if err := recover(); err != nil {
+			am = EmptyApplicationPacket
+			am.err = fmt.Errorf("Error Received message (size=%d): %v", total, err)
+		}
+	}()
+	if err := binary.Read(s, globalOrder, &total); err != nil {
+		s.CancelRead(0)
+		return am, false
+	}
+	if total == 0 {
+		return am, false
+	}
+	b := make([]byte, total)
+	if _, err := io.ReadFull(s, b); err != nil {
+		s.CancelRead(0)
+		return am, false
+	}
+	// the whole packet is read, so the next one can follow
+	more = true
+	if err := am.UnmarshalBinary(b); err != nil {
+		log.Errorf("Read %d bytes - buffer is %x", total, b)
+		DumpTypes()
+		am.err = fmt.Errorf("Error unmarshaling message type %s: %s", am.MsgType.String(), err.Error())
+		return
+	}
+	am.From = c.Remote()
+	c.addReadBytes(uint64(total))
+	return
+}
+
+// deliver waits for Receive to take the packet. It returns false if the
+// connection has been closed.
+func (c *QUICConn) deliver(am Packet) bool {
+	select {
+	case c.packets <- am:
+		return true
+	case <-c.quit:
+		return false
+	}
+}
+
+// NewSecureQUICHost returns a Secure QUIC Host.
+// If the entity is nil, it will not verify the identity of the
+// remote host
+func NewSecureQUICHost(private abstract.Scalar, si *ServerIdentity) *SecureQUICHost {
+	addr := ""
+	if si != nil {
+		addr = si.First()
+	}
+	return &SecureQUICHost{
+		private:        private,
+		serverIdentity: si,
+		QUICHost:       NewQUICHost(),
+		workingAddress: addr,
+	}
+}
+
+// Listen will try each addresses it the host ServerIdentity.
+// Returns an error if it can't listen on any of the addresses.
+func (sq *SecureQUICHost) Listen(fn func(SecureConn)) error {
+	receiver := func(c *QUICConn) {
+		sqc := &SecureQUICConn{
+			QUICConn: c,
+			host:     sq,
+		}
+		// if negotiation fails we drop the connection
+		if err := sqc.exchangeServerIdentity(); err != nil {
+			log.Warn("Negotiation failed:", err)
+			if err := sqc.Close(); err != nil {
+				log.Warn("Couldn't close secure connection:",
+					err)
+			}
+			return
+		}
+		sq.connMutex.Lock()
+		sq.conns = append(sq.conns, sqc)
+		sq.connMutex.Unlock()
+		go fn(sqc)
+	}
+	if sq.serverIdentity == nil {
+		return errors.New("Can't listen without ServerIdentity")
+	}
+	var err error
+	log.Lvl3("Addresses are", sq.serverIdentity.Addresses)
+	for i, addr := range sq.serverIdentity.Addresses {
+		log.Lvl3("Starting to listen on", addr)
+		go func(addr string) {
+			// Accepting a connection does the identity-exchange, so
+			// it mustn't block the listener.
+			err := sq.QUICHost.listen(addr, func(c *QUICConn) {
+				go receiver(c)
+			})
+			if err == nil || err == ErrClosed || err == ErrEOF {
+				return
+			}
+			log.Lvl3("Listening on", addr, "failed:", err)
+			sq.QUICHost.listeningPort <- -1
+		}(addr)
+		port := <-sq.QUICHost.listeningPort
+		if port > 0 {
+			// If the port we asked for is '0', we need to
+			// update the address.
+			if strings.HasSuffix(addr, ":0") {
+				log.Lvl3("Got port", port)
+				addr = strings.TrimRight(addr, "0") +
+					strconv.Itoa(port)
+				sq.serverIdentity.Addresses[i] = addr
+				sq.lockAddress.Lock()
+				sq.workingAddress = addr
+				sq.lockAddress.Unlock()
+			}
+			return nil
+		}
+		err = fmt.Errorf("Couldn't open address %s", addr)
+	}
+	return fmt.Errorf("No address worked for listening on this host %+s.",
+		err.Error())
+}
+
+// Open will try any address that is in the ServerIdentity and connect to the
+// first one that works. Then it exchanges the ServerIdentity to verify it is
+// talking with the right host.
+func (sq *SecureQUICHost) Open(si *ServerIdentity) (SecureConn, error) {
+	var secure *SecureQUICConn
+	for _, addr := range si.Addresses {
+		log.Lvl4("Trying address", addr)
+		c, err := sq.QUICHost.openQUICConn(addr)
+		if err != nil {
+			log.Lvl3("Address didn't accept connection:", addr, "=>", err)
+			continue
+		}
+		secure = &SecureQUICConn{
+			QUICConn:       c,
+			host:           sq,
+			serverIdentity: si,
+		}
+		break
+	}
+	if secure == nil {
+		return nil, errors.New("Could not connect to any address tied to this ServerIdentity")
+	}
+	if err := secure.negotiateOpen(si); err != nil {
+		secure.Close()
+		return nil, err
+	}
+	sq.connMutex.Lock()
+	sq.conns = append(sq.conns, secure)
+	sq.connMutex.Unlock()
+	log.Lvl3(secure.Local(), ": successfully connected and identified",
+		secure.Remote())
+	return secure, nil
+}
+
+// Close closes all connections and the UDP-sockets.
+func (sq *SecureQUICHost) Close() error {
+	sq.connMutex.Lock()
+	conns := sq.conns
+	sq.conns = nil
+	sq.connMutex.Unlock()
+	// The connections are not all in the peers of QUICHost, so they
+	// are closed here.
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *SecureQUICConn) {
+			defer wg.Done()
+			if err := c.Close(); err != nil {
+				log.Lvl3("Couldn't close connection:", err)
+			}
+		}(c)
+	}
+	wg.Wait()
+	return sq.QUICHost.Close()
+}
+
+// String returns a string identifying that host
+func (sq *SecureQUICHost) String() string {
+	return sq.WorkingAddress()
+}
+
+// Tx implements the CounterIO interface
+func (sq *SecureQUICHost) Tx() uint64 {
+	sq.connMutex.Lock()
+	defer sq.connMutex.Unlock()
+	var b uint64
+	for _, c := range sq.conns {
+		b += c.Tx()
+	}
+	return b
+}
+
+// Rx implements the CounterIO interface
+func (sq *SecureQUICHost) Rx() uint64 {
+	sq.connMutex.Lock()
+	defer sq.connMutex.Unlock()
+	var b uint64
+	for _, c := range sq.conns {
+		b += c.Rx()
+	}
+	return b
+}
+
+// WorkingAddress returns the working address
+func (sq *SecureQUICHost) WorkingAddress() string {
+	sq.lockAddress.Lock()
+	defer sq.lockAddress.Unlock()
+	return sq.workingAddress
+}
+
+// Receive is analog to Conn.Receive but also set the right ServerIdentity in
+// the message
+func (sc *SecureQUICConn) Receive(ctx context.Context) (Packet, error) {
+	nm, err := sc.QUICConn.Receive(ctx)
+	nm.ServerIdentity = sc.serverIdentity
+	return nm, err
+}
+
+// ServerIdentity returns the underlying entity tied to this connection
+func (sc *SecureQUICConn) ServerIdentity() *ServerIdentity {
+	return sc.serverIdentity
+}
+
+// exchangeServerIdentity sends our ServerIdentity and waits for the one of
+// the remote host.
+func (sc *SecureQUICConn) exchangeServerIdentity() error {
+	ourEnt := sc.host.serverIdentity
+	if ourEnt == nil {
+		ourEnt = NewServerIdentity(config.NewKeyPair(Suite).Public, "")
+	}
+	log.Lvlf4("Sending our identity %x to %s", ourEnt.ID, sc.Remote())
+	if err := sc.QUICConn.Send(context.TODO(), ourEnt); err != nil {
+		return fmt.Errorf("Error while sending indentity during negotiation: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), MaxIdentityExchange)
+	defer cancel()
+	nm, err := sc.QUICConn.Receive(ctx)
+	if err != nil {
+		return fmt.Errorf("%s: Error while receiving ServerIdentity during negotiation: %s",
+			sc.host.WorkingAddress(), err)
+	}
+	if nm.MsgType != ServerIdentityType {
+		return fmt.Errorf("Received wrong type during negotiation: %s", nm.MsgType.String())
+	}
+	e := nm.Msg.(ServerIdentity)
+	log.Lvlf4("%x: Received identity %x", ourEnt.ID, e.ID)
+	sc.serverIdentity = &e
+	return nil
+}
+
+// negotiateOpen exchanges the ServerIdentity and verifies that it is the
+// one we wanted to connect to.
+func (sc *SecureQUICConn) negotiateOpen(si *ServerIdentity) error {
+	if err := sc.exchangeServerIdentity(); err != nil {
+		return err
+	}
+	if sc.host.serverIdentity == nil {
+		return nil
+	}
+	if sc.ServerIdentity().ID != si.ID {
+		log.Lvl3("Wanted to connect to", si, si.ID, "but got", sc.ServerIdentity(), sc.ServerIdentity().ID)
+		return errors.New("Warning: ServerIdentity received during negotiation is wrong.")
+	}
+	return nil
+}
+
+// quicConfig returns the configuration of the QUIC-connections.
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout:       MaxIdentityExchange,
+		KeepAlivePeriod:            10 * time.Second,
+		MaxIncomingUniStreams:      quicMaxStreams,
+		MaxStreamReceiveWindow:     16 << 20,
+		MaxConnectionReceiveWindow: 64 << 20,
+	}
+}
+
+// quicTLSConfig returns a TLS-configuration with a fresh self-signed
+// certificate.
+func quicTLSConfig() *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Fatal("Couldn't create key for certificate:", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		log.Fatal("Couldn't create certificate:", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{der},
+			PrivateKey:  key,
+		}},
+		NextProtos:         []string{quicProtocol},
+		InsecureSkipVerify: true,
+	}
+}
+
+// quicError translates the errors of quic-go, which handleError doesn't
+// know.
+func quicError(err error) error {
+	var appErr *quic.ApplicationError
+	var idleErr *quic.IdleTimeoutError
+	switch {
+	case errors.As(err, &appErr):
+		if appErr.Remote {
+			return ErrEOF
+		}
+		return ErrClosed
+	case errors.As(err, &idleErr):
+		return ErrTimeout
+	case errors.Is(err, quic.ErrServerClosed), errors.Is(err, quic.ErrTransportClosed):
+		return ErrClosed
+	}
+	return handleError(err)
+}
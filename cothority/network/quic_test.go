@@ -0,0 +1,208 @@
+package network
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// Sends a packet back and forth between two QUICHosts
+func TestQUICSimple(t *testing.T) {
+	server := NewQUICHost()
+	client := NewQUICHost()
+	go func() {
+		err := server.Listen("localhost:0", func(c Conn) {
+			nm, err := c.Receive(context.TODO())
+			if err != nil {
+				t.Error("Couldn't receive:", err)
+				return
+			}
+			sp := nm.Msg.(SimplePacket)
+			sp.Name += " back"
+			if err := c.Send(context.TODO(), &sp); err != nil {
+				t.Error("Couldn't send:", err)
+			}
+		})
+		if err != nil {
+			t.Error("Couldn't listen:", err)
+		}
+	}()
+	port := <-server.listeningPort
+	c, err := client.Open("localhost:" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal("Couldn't open:", err)
+	}
+	if err := c.Send(context.TODO(), &SimplePacket{"client"}); err != nil {
+		t.Fatal(err)
+	}
+	nm, err := c.Receive(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nm.Msg.(SimplePacket).Name != "client back" {
+		t.Fatal("Wrong packet received:", nm.Msg)
+	}
+	if c.Tx() == 0 || c.Rx() == 0 || client.Tx() != c.Tx() {
+		t.Fatal("Bytes are not counted")
+	}
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Receive(context.TODO()); err != ErrClosed {
+		t.Fatal("Closed connection should return ErrClosed:", err)
+	}
+}
+
+// Sends a big and some small packets in parallel over a SecureQUICHost and
+// closes the connection directly - all packets must arrive.
+func TestSecureQUIC(t *testing.T) {
+	priv1, id1 := genServerIdentity("localhost:0")
+	priv2, id2 := genServerIdentity("localhost:0")
+	host1 := NewSecureQUICHost(priv1, id1)
+	host2 := NewSecureQUICHost(priv2, id2)
+
+	big := strings.Repeat("x", 4<<20)
+	nbrSmall := 10
+	received := make(chan string)
+	done := make(chan error)
+	err := host1.Listen(func(c SecureConn) {
+		if !c.ServerIdentity().ID.Equal(id2.ID) {
+			t.Error("Wrong identity")
+		}
+		for {
+			nm, err := c.Receive(context.TODO())
+			if err != nil {
+				done <- err
+				return
+			}
+			if !nm.ServerIdentity.ID.Equal(id2.ID) {
+				t.Error("Wrong identity in packet")
+			}
+			received <- nm.Msg.(SimplePacket).Name
+		}
+	})
+	if err != nil {
+		t.Fatal("Listening-error:", err)
+	}
+	c, err := host2.Open(id1)
+	if err != nil {
+		t.Fatal("Couldn't open:", err)
+	}
+	if !c.ServerIdentity().ID.Equal(id1.ID) {
+		t.Fatal("Wrong identity of server")
+	}
+	bigSent := make(chan bool)
+	go func() {
+		if err := c.Send(context.TODO(), &SimplePacket{big}); err != nil {
+			t.Error(err)
+		}
+		close(bigSent)
+	}()
+	for i := 0; i < nbrSmall; i++ {
+		if err := c.Send(context.TODO(), &SimplePacket{"small"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-bigSent
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	small, bigs := 0, 0
+	for i := 0; i <= nbrSmall; i++ {
+		switch <-received {
+		case "small":
+			small++
+		case big:
+			bigs++
+		default:
+			t.Fatal("Wrong packet received")
+		}
+	}
+	if small != nbrSmall || bigs != 1 {
+		t.Fatal("Didn't receive all packets:", small, bigs)
+	}
+	if err := <-done; err != ErrEOF {
+		t.Fatal("Should get EOF after the remote host closed:", err)
+	}
+	if err := host1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := host2.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Sends a big packet followed by small ones - they must arrive in the order
+// they were sent, as over TCP.
+func TestQUICOrder(t *testing.T) {
+	server := NewQUICHost()
+	client := NewQUICHost()
+	nbr := 20
+	received := make(chan string, nbr)
+	go func() {
+		err := server.Listen("localhost:0", func(c Conn) {
+			for i := 0; i < nbr; i++ {
+				nm, err := c.Receive(context.TODO())
+				if err != nil {
+					t.Error("Couldn't receive:", err)
+					return
+				}
+				received <- nm.Msg.(SimplePacket).Name
+			}
+		})
+		if err != nil {
+			t.Error("Couldn't listen:", err)
+		}
+	}()
+	port := <-server.listeningPort
+	c, err := client.Open("localhost:" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal("Couldn't open:", err)
+	}
+	big := strings.Repeat("x", 1<<20)
+	for i := 0; i < nbr; i++ {
+		name := strconv.Itoa(i)
+		if i == 0 {
+			name = big
+		}
+		if err := c.Send(context.TODO(), &SimplePacket{name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if name := <-received; name != big {
+		t.Fatal("The big packet should arrive first")
+	}
+	for i := 1; i < nbr; i++ {
+		if name := <-received; name != strconv.Itoa(i) {
+			t.Fatal("Packet", i, "arrived out of order:", name)
+		}
+	}
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetTransport(t *testing.T) {
+	defer SetTransport(TransportTCP)
+	priv, id := genServerIdentity("localhost:0")
+	if _, ok := NewSecureHost(priv, id).(*SecureTCPHost); !ok {
+		t.Fatal("Default transport should be TCP")
+	}
+	if err := SetTransport(TransportQUIC); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := NewSecureHost(priv, id).(*SecureQUICHost); !ok {
+		t.Fatal("Should get a QUIC-host")
+	}
+	if SetTransport("udp") == nil {
+		t.Fatal("Unknown transport should fail")
+	}
+}
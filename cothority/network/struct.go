@@ -2,6 +2,7 @@ package network
 
 import (
 	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -15,6 +16,7 @@ import (
 	"github.com/csanti/pbft-experiments/cothority/monitor"
 	"gopkg.in/dedis/crypto.v0/abstract"
 	"github.com/dedis/protobuf"
+	"github.com/quic-go/quic-go"
 	"github.com/satori/go.uuid"
 	"golang.org/x/net/context"
 )
@@ -176,6 +178,95 @@ type SecureTCPConn struct {
 	serverIdentity *ServerIdentity
 }
 
+// QUICHost is the implementation of Host using QUIC over UDP. All
+// connections of a host share the same UDP-socket, so there is only one
+// file-descriptor per host, regardless of the number of peers.
+type QUICHost struct {
+	// listeningPort is a channel where the port found will be
+	// sent through.
+	listeningPort chan int
+	// A list of connection maintained by this host
+	peers    map[string]Conn
+	peersMut sync.Mutex
+	// transport is the listening UDP-socket, it is also used to open
+	// connections. If the host doesn't listen, dialer is used.
+	transport    *quic.Transport
+	dialer       *quic.Transport
+	listener     *quic.Listener
+	transportMut sync.Mutex
+	// tlsConfig holds the self-signed certificate of this host
+	tlsConfig *tls.Config
+	// the close channel used to indicate to the listener we want to quit
+	quit chan bool
+	// indicates whether this host is closed already or not
+	closed     bool
+	closedLock sync.Mutex
+	// a list of constructors for en/decoding
+	constructors protobuf.Constructors
+}
+
+// QUICConn is the implementation of Conn over one QUIC-connection. All
+// packets are sent on one stream, so that they are received in the order
+// they were sent. Like with TCP, a big packet blocks the ones sent after it
+// until it is received completely.
+type QUICConn struct {
+	// The name of the endpoint we are connected to.
+	Endpoint string
+
+	// The connection used
+	conn *quic.Conn
+	// A pointer to the associated host
+	host *QUICHost
+	// packets holds the received packets
+	packets chan Packet
+	// quit is closed when Close is called, eof when the remote host
+	// closed the connection and all its packets are received.
+	quit     chan bool
+	quitOnce sync.Once
+	eof      chan bool
+	// stream carries all packets we send, in order
+	stream    *quic.SendStream
+	streamMut sync.Mutex
+	// bRx is the number of bytes received on this connection
+	bRx     uint64
+	bRxLock sync.Mutex
+	// bTx in the number of bytes sent on this connection
+	bTx     uint64
+	bTxLock sync.Mutex
+}
+
+// SecureQUICHost is a QUICHost that handles ServerIdentity, like
+// SecureTCPHost.
+type SecureQUICHost struct {
+	*QUICHost
+	// workingAddress is the actual address we're listening.
+	workingAddress string
+	// ServerIdentity of this host
+	serverIdentity *ServerIdentity
+	// Private key tied to this entity
+	private abstract.Scalar
+	// Lock for accessing this structure
+	lockAddress sync.Mutex
+	// list of all connections this host has opened
+	conns     []*SecureQUICConn
+	connMutex sync.Mutex
+}
+
+// SecureQUICConn is a QUIC connection using ServerIdentity as an identity.
+type SecureQUICConn struct {
+	*QUICConn
+	host           *SecureQUICHost
+	serverIdentity *ServerIdentity
+}
+
+// The transports that can be given to SetTransport
+const (
+	// TransportTCP uses SecureTCPHost, one TCP-connection per peer
+	TransportTCP = "tcp"
+	// TransportQUIC uses SecureQUICHost, one UDP-socket per host
+	TransportQUIC = "quic"
+)
+
 // Packet is the container for any Msg
 type Packet struct {
 	// The ServerIdentity of the remote peer we are talking to.
@@ -215,6 +306,12 @@ func (eid ServerIdentityID) Equal(other ServerIdentityID) bool {
 	return uuid.Equal(uuid.UUID(eid), uuid.UUID(other))
 }
 
+// String returns the default representation of the ID (wrapper around
+// uuid.UUID.String()
+func (eid ServerIdentityID) String() string {
+	return uuid.UUID(eid).String()
+}
+
 func (si *ServerIdentity) String() string {
 	return fmt.Sprintf("%v", si.Addresses)
 }
@@ -0,0 +1,425 @@
+// Package blockstore keeps committed blocks with their collective signatures
+// in an append-only file. Every block is written with its height, hash,
+// signature and mask (or exceptions) in a record synced to disk before
+// Append returns. The length of the record has its own checksum, and the
+// record a checksum of the length and the data, so that a damaged length
+// can't make a record look like the last one. When the file is opened, an
+// incomplete or corrupted record at the end, left by a crash, is cut off, so
+// that a restarting replica recovers all blocks it committed. A corrupted
+// record before the end is an error, as cutting it off would drop blocks
+// that have been committed.
+//
+// The store doesn't interpret the blocks and signatures, so that pbft,
+// blsftcosi and byzcoin_ng can store them in their own format.
+package blockstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/csanti/pbft-experiments/cothority/log"
+)
+
+// magic is written at the start of every store
+var magic = []byte("BLKSTOR2")
+
+// MaxRecord is the maximal size of a record, bigger lengths are treated as
+// corruption.
+const MaxRecord = 1 << 30
+
+// frameSize is the size of the length and the checksums before a record
+const frameSize = 12
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Entry is one committed block.
+type Entry struct {
+	Height uint64
+	Hash   []byte
+	// Block is empty if the block has been pruned by Compact
+	Block     []byte
+	Signature []byte
+	// Mask holds the mask or the exceptions of the signature
+	Mask []byte
+}
+
+// Store is an append-only file of entries with an index of their heights and
+// hashes in memory.
+type Store struct {
+	path    string
+	file    *os.File
+	size    int64
+	offsets []int64
+	hashes  map[string]uint64
+	sync.Mutex
+}
+
+// Open opens the store at path, creating it if it doesn't exist, and
+// recovers from a crash during the last append.
+func Open(path string) (*Store, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{path: path, file: f, hashes: make(map[string]uint64)}
+	if err := s.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load checks the magic and reads the index. A torn record at the end is
+// truncated, a corrupted record followed by others returns an error.
+func (s *Store) load() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < int64(len(magic)) {
+		// a new store, or one that crashed while being created
+		if err := s.file.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := s.file.WriteAt(magic, 0); err != nil {
+			return err
+		}
+		if err := s.file.Sync(); err != nil {
+			return err
+		}
+		s.size = int64(len(magic))
+		return syncDir(s.path)
+	}
+	head := make([]byte, len(magic))
+	if _, err := s.file.ReadAt(head, 0); err != nil {
+		return err
+	}
+	if !bytes.Equal(head, magic) {
+		return fmt.Errorf("%s is not a block store", s.path)
+	}
+
+	offset := int64(len(magic))
+	for offset < info.Size() {
+		e, next, err := s.read(offset)
+		if err == nil && e.Height != uint64(len(s.offsets)) {
+			return fmt.Errorf("%s: height %d instead of %d at %d", s.path,
+				e.Height, len(s.offsets), offset)
+		}
+		if err != nil {
+			// only the last append can be torn by a crash
+			torn, terr := s.torn(offset, next, info.Size())
+			if terr != nil {
+				return terr
+			}
+			if !torn {
+				return fmt.Errorf("%s: corrupted record at %d: %s", s.path,
+					offset, err)
+			}
+			log.Lvl1("Truncating", s.path, "after", len(s.offsets),
+				"blocks at", offset, ":", err)
+			if err := s.file.Truncate(offset); err != nil {
+				return err
+			}
+			if err := s.file.Sync(); err != nil {
+				return err
+			}
+			break
+		}
+		s.index(e, offset)
+		offset = next
+	}
+	s.size = offset
+	return nil
+}
+
+// Append writes the entry, which must have the height following the last
+// entry, and syncs it to disk.
+func (s *Store) Append(e *Entry) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.file == nil {
+		return errors.New("store is closed")
+	}
+	if e.Height != uint64(len(s.offsets)) {
+		return fmt.Errorf("got height %d but next height is %d", e.Height,
+			len(s.offsets))
+	}
+	if _, exists := s.hashes[string(e.Hash)]; exists {
+		return fmt.Errorf("block %x already stored", e.Hash)
+	}
+	record := encode(e)
+	if len(record) > MaxRecord {
+		return fmt.Errorf("block of %d bytes is too big", len(record))
+	}
+	if _, err := s.file.WriteAt(record, s.size); err != nil {
+		s.file.Truncate(s.size)
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		s.file.Truncate(s.size)
+		return err
+	}
+	s.index(e, s.size)
+	s.size += int64(len(record))
+	return nil
+}
+
+// Len returns the number of entries, which is the height of the next one.
+func (s *Store) Len() uint64 {
+	s.Lock()
+	defer s.Unlock()
+	return uint64(len(s.offsets))
+}
+
+// Get returns the entry at the given height.
+func (s *Store) Get(height uint64) (*Entry, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.get(height)
+}
+
+// GetByHash returns the entry of the block with the given hash.
+func (s *Store) GetByHash(hash []byte) (*Entry, error) {
+	s.Lock()
+	defer s.Unlock()
+	height, ok := s.hashes[string(hash)]
+	if !ok {
+		return nil, fmt.Errorf("no block %x", hash)
+	}
+	return s.get(height)
+}
+
+// Last returns the entry with the biggest height, or nil if the store is
+// empty.
+func (s *Store) Last() (*Entry, error) {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.offsets) == 0 {
+		return nil, nil
+	}
+	return s.get(uint64(len(s.offsets) - 1))
+}
+
+// Range returns the entries from height from up to, but without, height to.
+// A to bigger than Len returns the entries up to the last one.
+func (s *Store) Range(from, to uint64) ([]*Entry, error) {
+	s.Lock()
+	defer s.Unlock()
+	if to > uint64(len(s.offsets)) {
+		to = uint64(len(s.offsets))
+	}
+	var entries []*Entry
+	for h := from; h < to; h++ {
+		e, err := s.get(h)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Size returns the size of the store in bytes.
+func (s *Store) Size() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.size
+}
+
+// Close closes the file of the store.
+func (s *Store) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// Compact rewrites the closed store at path without the blocks below height
+// pruneBelow, keeping their hashes and signatures, so that the chain can
+// still be followed. The new store replaces the old one atomically. It
+// returns the number of bytes saved.
+func Compact(path string, pruneBelow uint64) (int64, error) {
+	src, err := Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	tmp := path + ".compact"
+	os.Remove(tmp)
+	dst, err := Open(tmp)
+	if err != nil {
+		return 0, err
+	}
+	for h := uint64(0); h < src.Len(); h++ {
+		e, err := src.Get(h)
+		if err != nil {
+			dst.Close()
+			return 0, err
+		}
+		if h < pruneBelow {
+			e.Block = nil
+		}
+		if err := dst.Append(e); err != nil {
+			dst.Close()
+			return 0, err
+		}
+	}
+	saved := src.Size() - dst.Size()
+	if err := dst.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return 0, err
+	}
+	return saved, syncDir(path)
+}
+
+// get returns the entry at height. The lock must be held.
+func (s *Store) get(height uint64) (*Entry, error) {
+	if s.file == nil {
+		return nil, errors.New("store is closed")
+	}
+	if height >= uint64(len(s.offsets)) {
+		return nil, fmt.Errorf("no block at height %d", height)
+	}
+	e, _, err := s.read(s.offsets[height])
+	return e, err
+}
+
+// index adds the entry at offset to the index.
+func (s *Store) index(e *Entry, offset int64) {
+	s.offsets = append(s.offsets, offset)
+	s.hashes[string(e.Hash)] = e.Height
+}
+
+// torn returns whether the damaged record at offset is the last one of a
+// file of the given size, as left by a crash during Append. next is the
+// offset after the record, or 0 if its length can't be trusted. A record
+// with a damaged length is only the last one if nothing has been written
+// from its offset on, as an append that didn't reach the disk reads as
+// zeros.
+func (s *Store) torn(offset, next, size int64) (bool, error) {
+	if offset+frameSize > size {
+		return true, nil
+	}
+	if next != 0 {
+		return next >= size, nil
+	}
+	buf := make([]byte, 64*1024)
+	for pos := offset; pos < size; pos += int64(len(buf)) {
+		n, err := s.file.ReadAt(buf, pos)
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// read returns the entry at offset and the offset of the next one. If the
+// entry can't be read but its length can, the offset of the next one is
+// returned with the error, so that the caller knows whether the record is
+// the last one.
+func (s *Store) read(offset int64) (*Entry, int64, error) {
+	frame := make([]byte, frameSize)
+	if _, err := s.file.ReadAt(frame, offset); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	if crc32.Checksum(frame[:4], crcTable) != binary.LittleEndian.Uint32(frame[4:]) {
+		return nil, 0, errors.New("wrong checksum of the length")
+	}
+	length := binary.LittleEndian.Uint32(frame)
+	next := offset + frameSize + int64(length)
+	if length > MaxRecord {
+		return nil, next, fmt.Errorf("record of %d bytes", length)
+	}
+	record := make([]byte, length)
+	if _, err := s.file.ReadAt(record, offset+frameSize); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, next, err
+	}
+	if checksum(frame, record) != binary.LittleEndian.Uint32(frame[8:]) {
+		return nil, next, errors.New("wrong checksum")
+	}
+	e, err := decode(record)
+	if err != nil {
+		return nil, next, err
+	}
+	return e, next, nil
+}
+
+// encode returns the entry with its frame.
+func encode(e *Entry) []byte {
+	var b bytes.Buffer
+	b.Write(make([]byte, frameSize))
+	binary.Write(&b, binary.LittleEndian, e.Height)
+	for _, field := range [][]byte{e.Hash, e.Block, e.Signature, e.Mask} {
+		binary.Write(&b, binary.LittleEndian, uint32(len(field)))
+		b.Write(field)
+	}
+	record := b.Bytes()
+	binary.LittleEndian.PutUint32(record, uint32(len(record)-frameSize))
+	binary.LittleEndian.PutUint32(record[4:], crc32.Checksum(record[:4], crcTable))
+	binary.LittleEndian.PutUint32(record[8:],
+		checksum(record[:frameSize], record[frameSize:]))
+	return record
+}
+
+// checksum returns the checksum of the length in the frame and the record.
+func checksum(frame, record []byte) uint32 {
+	return crc32.Update(crc32.Checksum(frame[:4], crcTable), crcTable, record)
+}
+
+// decode reads an entry written by encode, without its frame.
+func decode(record []byte) (*Entry, error) {
+	r := bytes.NewReader(record)
+	e := &Entry{}
+	if err := binary.Read(r, binary.LittleEndian, &e.Height); err != nil {
+		return nil, err
+	}
+	for _, field := range []*[]byte{&e.Hash, &e.Block, &e.Signature, &e.Mask} {
+		var length uint32
+		if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+			return nil, err
+		}
+		if int(length) > r.Len() {
+			return nil, errors.New("field longer than record")
+		}
+		if length > 0 {
+			*field = make([]byte, length)
+			r.Read(*field)
+		}
+	}
+	return e, nil
+}
+
+// syncDir syncs the directory of path, so that a new or renamed file
+// survives a crash.
+func syncDir(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
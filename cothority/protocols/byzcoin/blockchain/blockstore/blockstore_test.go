@@ -0,0 +1,216 @@
+package blockstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func entry(h uint64) *Entry {
+	return &Entry{
+		Height:    h,
+		Hash:      []byte("hash" + strconv.Itoa(int(h))),
+		Block:     bytes.Repeat([]byte{byte(h)}, 1000),
+		Signature: []byte("sig" + strconv.Itoa(int(h))),
+		Mask:      []byte{byte(h)},
+	}
+}
+
+func newStore(t *testing.T, n int) (*Store, string, func()) {
+	dir, err := ioutil.TempDir("", "blockstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "blocks.db")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for h := 0; h < n; h++ {
+		if err := s.Append(entry(uint64(h))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s, path, func() { os.RemoveAll(dir) }
+}
+
+func TestStore(t *testing.T) {
+	s, path, clean := newStore(t, 10)
+	defer clean()
+	if err := s.Append(entry(5)); err == nil {
+		t.Fatal("Appended a block at a wrong height")
+	}
+	e := entry(10)
+	e.Hash = entry(3).Hash
+	if err := s.Append(e); err == nil {
+		t.Fatal("Appended a block twice")
+	}
+
+	got, err := s.GetByHash(entry(3).Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Height != 3 || !bytes.Equal(got.Block, entry(3).Block) ||
+		!bytes.Equal(got.Signature, entry(3).Signature) {
+		t.Fatal("Got wrong entry", got.Height)
+	}
+	entries, err := s.Range(4, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 6 || entries[0].Height != 4 || entries[5].Height != 9 {
+		t.Fatal("Wrong range of", len(entries), "entries")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Len() != 10 {
+		t.Fatal("Reopened store has", s.Len(), "entries")
+	}
+	last, err := s.Last()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(last.Mask, entry(9).Mask) {
+		t.Fatal("Wrong last entry")
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	s, path, clean := newStore(t, 5)
+	defer clean()
+	size := s.Size()
+	s.Close()
+
+	// a crash while appending leaves half a record
+	record := encode(entry(5))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(record[:len(record)/2])
+	f.Close()
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 5 || s.Size() != size {
+		t.Fatal("Didn't recover: got", s.Len(), "entries")
+	}
+	if err := s.Append(entry(5)); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// a corrupted last record is dropped too
+	f, err = os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{0xff}, size+frameSize+20)
+	f.Close()
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 5 {
+		t.Fatal("Kept corrupted entry")
+	}
+	s.Close()
+
+	// an append that didn't reach the disk reads as zeros
+	f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(make([]byte, len(record)))
+	f.Close()
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Len() != 5 || s.Size() != size {
+		t.Fatal("Didn't recover from zeros: got", s.Len(), "entries")
+	}
+}
+
+func TestCorruption(t *testing.T) {
+	s, path, clean := newStore(t, 5)
+	defer clean()
+	offset := s.offsets[2]
+	s.Close()
+
+	// a corrupted record in the middle can't be left by a crash
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{0xff}, offset+frameSize+20)
+	f.Close()
+	if _, err := Open(path); err == nil {
+		t.Fatal("Opened store with a corrupted record in the middle")
+	}
+
+	// a damaged length pointing after the end doesn't make the record the
+	// last one
+	s, path, clean = newStore(t, 5)
+	defer clean()
+	offset = s.offsets[2]
+	s.Close()
+	f, err = os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{0xff, 0xff, 0xff}, offset)
+	f.Close()
+	if _, err := Open(path); err == nil {
+		t.Fatal("Truncated a store with a damaged length in the middle")
+	}
+}
+
+func TestCompact(t *testing.T) {
+	s, path, clean := newStore(t, 10)
+	defer clean()
+	s.Close()
+
+	saved, err := Compact(path, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved < 8*1000 {
+		t.Fatal("Saved only", saved, "bytes")
+	}
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Len() != 10 {
+		t.Fatal("Compacted store has", s.Len(), "entries")
+	}
+	pruned, err := s.Get(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned.Block) != 0 || !bytes.Equal(pruned.Signature, entry(2).Signature) {
+		t.Fatal("Block 2 not pruned correctly")
+	}
+	kept, err := s.GetByHash(entry(9).Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(kept.Block, entry(9).Block) {
+		t.Fatal("Block 9 pruned")
+	}
+}
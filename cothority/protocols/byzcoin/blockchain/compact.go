@@ -0,0 +1,138 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain/blkparser"
+)
+
+// CompactBlock is a block where the transactions are replaced by short IDs,
+// like the compact blocks of Bitcoin (BIP 152). A node holding most of the
+// transactions in its mempool rebuilds the block and only fetches the
+// missing transactions.
+type CompactBlock struct {
+	Magic      [4]byte
+	BlockSize  uint32
+	HeaderHash string
+	Header     *Header
+	TxCnt      uint32
+	// Key salts the short IDs, so that a collision in one block doesn't
+	// happen in the next one
+	Key      uint64
+	ShortIDs []uint64
+}
+
+// NewCompactBlock returns the compact block of b with short IDs salted by
+// key.
+func NewCompactBlock(b *TrBlock, key uint64) *CompactBlock {
+	cb := &CompactBlock{
+		Magic:      b.Magic,
+		BlockSize:  b.BlockSize,
+		HeaderHash: b.HeaderHash,
+		Header:     b.Header,
+		TxCnt:      b.TxCnt,
+		Key:        key,
+		ShortIDs:   make([]uint64, len(b.Txs)),
+	}
+	for i, tx := range b.Txs {
+		cb.ShortIDs[i] = ShortID(tx.Hash, key)
+	}
+	return cb
+}
+
+// ShortID returns the 6-byte ID of the transaction with the given hash.
+func ShortID(hash string, key uint64) uint64 {
+	h := sha256.New()
+	binary.Write(h, binary.LittleEndian, key)
+	h.Write([]byte(hash))
+	sum := h.Sum(nil)
+	return binary.LittleEndian.Uint64(append(sum[:6], 0, 0))
+}
+
+// MarshalBinary returns the compact block as JSON, like TrBlock.
+func (cb *CompactBlock) MarshalBinary() ([]byte, error) {
+	return json.Marshal(cb)
+}
+
+// UnmarshalBinary reads a compact block written by MarshalBinary.
+func (cb *CompactBlock) UnmarshalBinary(data []byte) error {
+	return json.Unmarshal(data, cb)
+}
+
+// Reconstruct looks up the transactions of the block in the mempool. It
+// returns the transactions found, the entries of the missing ones are
+// empty and their indexes are returned in missing. Short IDs matching
+// more than one transaction of the mempool are treated as missing.
+func (cb *CompactBlock) Reconstruct(m *Mempool) (txs []blkparser.Tx, missing []int) {
+	m.Lock()
+	index := make(map[uint64]*blkparser.Tx, len(m.txs))
+	collisions := make(map[uint64]bool)
+	for hash, ptx := range m.txs {
+		id := ShortID(hash, cb.Key)
+		if _, ok := index[id]; ok {
+			collisions[id] = true
+		}
+		index[id] = &ptx.tx
+	}
+	m.Unlock()
+
+	txs = make([]blkparser.Tx, len(cb.ShortIDs))
+	for i, id := range cb.ShortIDs {
+		tx, ok := index[id]
+		if !ok || collisions[id] {
+			missing = append(missing, i)
+			continue
+		}
+		txs[i] = *tx
+	}
+	return txs, missing
+}
+
+// Block returns the full block with the given transactions. It returns an
+// error if they don't match the short IDs or the merkle root of the header.
+func (cb *CompactBlock) Block(txs []blkparser.Tx) (*TrBlock, error) {
+	if len(txs) != len(cb.ShortIDs) || uint32(len(txs)) != cb.TxCnt {
+		return nil, fmt.Errorf("got %d transactions instead of %d",
+			len(txs), len(cb.ShortIDs))
+	}
+	for i, tx := range txs {
+		if ShortID(tx.Hash, cb.Key) != cb.ShortIDs[i] {
+			return nil, fmt.Errorf("transaction %d doesn't match its short ID", i)
+		}
+	}
+	tl := NewTransactionList(txs, len(txs))
+	if cb.Header == nil || HashRootTransactions(tl) != cb.Header.MerkleRoot {
+		return nil, errors.New("transactions don't match the merkle root")
+	}
+	trb := new(TrBlock)
+	trb.Magic = cb.Magic
+	trb.BlockSize = cb.BlockSize
+	trb.HeaderHash = cb.HeaderHash
+	trb.Header = cb.Header
+	trb.TransactionList = tl
+	return trb, nil
+}
+
+var mempools = struct {
+	nodes map[string]*Mempool
+	sync.Mutex
+}{nodes: make(map[string]*Mempool)}
+
+// NodeMempool returns the mempool of the node with the given ID, so that
+// all protocol instances running on a node rebuild compact blocks from the
+// same transactions. It is created empty the first time.
+func NodeMempool(node string) *Mempool {
+	mempools.Lock()
+	defer mempools.Unlock()
+	m, ok := mempools.nodes[node]
+	if !ok {
+		m = NewMempool(MempoolSize, nil)
+		mempools.nodes[node] = m
+	}
+	return m
+}
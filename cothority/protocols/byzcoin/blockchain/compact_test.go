@@ -0,0 +1,63 @@
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompactBlock(t *testing.T) {
+	txs := NewGenerator(Workload{WorkloadSeed: 1}).Transactions(100)
+	tl := NewTransactionList(txs, len(txs))
+	block := NewTrBlock(tl, NewHeader(tl, "0", "0"))
+	full, err := block.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cb := NewCompactBlock(block, 42)
+	data, err := cb.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) >= len(full) {
+		t.Fatal("Compact block is not smaller than the block")
+	}
+	received := &CompactBlock{}
+	if err := received.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// the mempool misses every tenth transaction
+	m := NewMempool(1<<20, nil)
+	for i, tx := range txs {
+		if i%10 != 0 {
+			m.Add(tx)
+		}
+	}
+	rebuilt, missing := received.Reconstruct(m)
+	if len(missing) != 10 {
+		t.Fatal("Should miss 10 transactions, but misses", len(missing))
+	}
+	if _, err := received.Block(rebuilt); err == nil {
+		t.Fatal("Block with missing transactions accepted")
+	}
+	for _, i := range missing {
+		rebuilt[i] = txs[i]
+	}
+	b, err := received.Block(rebuilt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, full) {
+		t.Fatal("Rebuilt block differs")
+	}
+
+	rebuilt[1], rebuilt[2] = rebuilt[2], rebuilt[1]
+	if _, err := received.Block(rebuilt); err == nil {
+		t.Fatal("Block with wrong order accepted")
+	}
+}
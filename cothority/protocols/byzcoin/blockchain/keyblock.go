@@ -1,7 +1,10 @@
 package blockchain
 
 import (
+	"encoding/hex"
+	"errors"
 	"log"
+	"math/big"
 	"net"
 )
 
@@ -38,3 +41,116 @@ func (trb *KeyBlock) Print() {
 	log.Printf("Hash %v", trb.HeaderHash)
 	return
 }
+
+// MineKeyBlock searches a keyblock following parentKey whose header-hash
+// starts with at least difficulty zero bits. publicKey is the hex-encoded
+// public key of the miner, who will be the leader for the microblocks following the keyblock. If quit
+// is closed before a keyblock is found, nil is returned.
+func MineKeyBlock(parentKey, publicKey string, difficulty uint32, quit <-chan bool) *KeyBlock {
+	hdr := &Header{
+		ParentKey:  parentKey,
+		PublicKey:  publicKey,
+		Difficulty: difficulty,
+	}
+	for ; ; hdr.Nonce++ {
+		if hdr.Nonce%1024 == 0 {
+			select {
+			case <-quit:
+				return nil
+			default:
+			}
+		}
+		hash := HashHeader(hdr)
+		if LeadingZeros(hash) >= int(difficulty) {
+			kb := (&KeyBlock{}).NewKeyBlock(TransactionList{}, hdr)
+			return &kb
+		}
+	}
+}
+
+// Verify checks the proof-of-work of the keyblock, which must have at least
+// difficulty zero bits.
+func (trb *KeyBlock) Verify(difficulty uint32) error {
+	if trb.Header == nil {
+		return errors.New("keyblock without header")
+	}
+	if trb.HeaderHash != HashHeader(trb.Header) {
+		return errors.New("wrong header-hash")
+	}
+	if trb.Difficulty < difficulty ||
+		LeadingZeros(trb.HeaderHash) < int(difficulty) {
+		return errors.New("not enough proof-of-work")
+	}
+	return nil
+}
+
+// LeadingZeros returns the number of zero bits a hex-encoded hash starts
+// with.
+func LeadingZeros(hash string) int {
+	b, err := hex.DecodeString(hash)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, c := range b {
+		for mask := byte(0x80); mask != 0; mask >>= 1 {
+			if c&mask != 0 {
+				return n
+			}
+			n++
+		}
+	}
+	return n
+}
+
+// KeyChain holds the tree of the keyblocks following a genesis hash and
+// chooses the chain with the most proof-of-work, like Bitcoin. Of two
+// chains with the same work, the first one seen is kept.
+type KeyChain struct {
+	blocks map[string]*keyLink
+	tip    string
+}
+
+// keyLink is a keyblock of the KeyChain
+type keyLink struct {
+	parent string
+	// work is the proof-of-work of the chain ending in this keyblock
+	work *big.Int
+}
+
+// NewKeyChain returns a KeyChain with only the genesis hash.
+func NewKeyChain(genesis string) *KeyChain {
+	return &KeyChain{
+		blocks: map[string]*keyLink{genesis: {work: big.NewInt(0)}},
+		tip:    genesis,
+	}
+}
+
+// Add stores the keyblock, which must follow a keyblock of the chain. It
+// returns true if the keyblock is the new tip, which is a reorganization of
+// the chain if it doesn't follow the old tip.
+func (c *KeyChain) Add(kb *KeyBlock) (bool, error) {
+	parent, ok := c.blocks[kb.ParentKey]
+	if !ok {
+		return false, errors.New("unknown parent keyblock")
+	}
+	if _, ok := c.blocks[kb.HeaderHash]; ok {
+		return false, errors.New("keyblock already known")
+	}
+	work := new(big.Int).Lsh(big.NewInt(1), uint(kb.Difficulty))
+	link := &keyLink{
+		parent: kb.ParentKey,
+		work:   work.Add(work, parent.work),
+	}
+	c.blocks[kb.HeaderHash] = link
+	if link.work.Cmp(c.blocks[c.tip].work) <= 0 {
+		return false, nil
+	}
+	c.tip = kb.HeaderHash
+	return true, nil
+}
+
+// Tip returns the hash of the last keyblock of the heaviest chain.
+func (c *KeyChain) Tip() string {
+	return c.tip
+}
@@ -0,0 +1,64 @@
+package blockchain
+
+import "testing"
+
+func TestMineKeyBlock(t *testing.T) {
+	kb := MineKeyBlock("parent", "miner", 8, nil)
+	if kb.ParentKey != "parent" || kb.PublicKey != "miner" {
+		t.Fatal("Wrong header")
+	}
+	if err := kb.Verify(8); err != nil {
+		t.Fatal(err)
+	}
+	if kb.Verify(32) == nil {
+		t.Fatal("Difficulty should be too small")
+	}
+	kb.Nonce++
+	if kb.Verify(8) == nil {
+		t.Fatal("Changed keyblock should not verify")
+	}
+
+	quit := make(chan bool)
+	close(quit)
+	if MineKeyBlock("parent", "miner", 256, quit) != nil {
+		t.Fatal("Mining should stop")
+	}
+}
+
+func TestLeadingZeros(t *testing.T) {
+	for hash, n := range map[string]int{"ff": 0, "01": 7, "0010": 11,
+		"0000": 16, "zz": 0} {
+		if LeadingZeros(hash) != n {
+			t.Fatal("Wrong leading zeros for", hash)
+		}
+	}
+}
+
+func TestKeyChain(t *testing.T) {
+	c := NewKeyChain("genesis")
+	a1 := MineKeyBlock("genesis", "a", 0, nil)
+	b1 := MineKeyBlock("genesis", "b", 0, nil)
+	if tip, err := c.Add(a1); !tip || err != nil {
+		t.Fatal("First keyblock should be the tip:", err)
+	}
+	// Same work, the first keyblock stays the tip
+	if tip, err := c.Add(b1); tip || err != nil {
+		t.Fatal("Fork with the same work should not be the tip:", err)
+	}
+	if _, err := c.Add(b1); err == nil {
+		t.Fatal("Keyblock should be known")
+	}
+	if _, err := c.Add(MineKeyBlock("unknown", "a", 0, nil)); err == nil {
+		t.Fatal("Parent should be unknown")
+	}
+	// The fork gets longer, the chain is reorganized
+	b2 := MineKeyBlock(b1.HeaderHash, "b", 0, nil)
+	if tip, err := c.Add(b2); !tip || err != nil || c.Tip() != b2.HeaderHash {
+		t.Fatal("Longer fork should be the tip:", err)
+	}
+	// A shorter chain with more work wins
+	a2 := MineKeyBlock(a1.HeaderHash, "a", 4, nil)
+	if tip, err := c.Add(a2); !tip || err != nil || c.Tip() != a2.HeaderHash {
+		t.Fatal("Heavier chain should be the tip:", err)
+	}
+}
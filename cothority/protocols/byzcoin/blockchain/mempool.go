@@ -0,0 +1,375 @@
+package blockchain
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+
+	"github.com/csanti/pbft-experiments/cothority/log"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain/blkparser"
+)
+
+// Orders of the transactions in the Mempool
+const (
+	// OrderFee puts the transactions with the highest fee per byte first
+	OrderFee = iota
+	// OrderPriority puts the transactions that spend the highest value per
+	// byte first, like the priority of Bitcoin without the age of the coins
+	OrderPriority
+)
+
+// MempoolSize is the default size of a mempool in bytes, the same as in
+// Bitcoin.
+var MempoolSize = 300 * 1000 * 1000
+
+// MaxBlockBytes is the maximum size of the transactions of a block in bytes,
+// the same as in Bitcoin.
+var MaxBlockBytes = 1000 * 1000
+
+// Mempool holds the transactions that are not yet committed in a block. It
+// keeps at most maxSize bytes of transactions and evicts the ones ordered
+// last if it's full. The first transaction spending an output wins, later
+// ones spending the same output are refused.
+type Mempool struct {
+	// Order is either OrderFee or OrderPriority
+	Order int
+	// utxo is used to find the values of the inputs, it can be nil
+	utxo    *UTXOSet
+	maxSize int
+	size    int
+	// txs holds all transactions, spends the transaction spending an output
+	txs    map[string]*poolTx
+	spends map[Outpoint]string
+	// queue holds the transactions with the one to evict first on top
+	queue evictQueue
+	// seq keeps the order of arrival for transactions with the same score
+	seq uint64
+	sync.Mutex
+}
+
+// poolTx is a transaction in the mempool
+type poolTx struct {
+	tx blkparser.Tx
+	// fee and value are 0 if the inputs are not known
+	fee   uint64
+	value uint64
+	seq   uint64
+	// index is the position in the evictQueue
+	index int
+}
+
+// NewMempool returns an empty mempool of maxSize bytes, ordered by the fee.
+// If utxo is not nil, it is used to find the values of the inputs to
+// calculate the fee of the transactions.
+func NewMempool(maxSize int, utxo *UTXOSet) *Mempool {
+	return &Mempool{
+		Order:   OrderFee,
+		utxo:    utxo,
+		maxSize: maxSize,
+		txs:     make(map[string]*poolTx),
+		spends:  make(map[Outpoint]string),
+	}
+}
+
+// Add stores the transaction in the mempool. It returns false if the
+// transaction is already in the mempool, if it spends an output already
+// spent by another transaction of the mempool, or if it has been evicted
+// because the mempool is full.
+func (m *Mempool) Add(tx blkparser.Tx) bool {
+	m.Lock()
+	defer m.Unlock()
+	if _, exists := m.txs[tx.Hash]; exists {
+		return false
+	}
+	ptx := &poolTx{tx: tx, seq: m.seq}
+	m.seq++
+	if !IsCoinbase(tx) {
+		for _, in := range tx.TxIns {
+			o := Outpoint{in.InputHash, in.InputVout}
+			if _, spent := m.spends[o]; spent {
+				log.Lvl3("Refusing double spend of", o)
+				return false
+			}
+			ptx.value += m.inputValue(o)
+		}
+	}
+	var out uint64
+	for _, txout := range tx.TxOuts {
+		out += txout.Value
+	}
+	if ptx.value > out {
+		ptx.fee = ptx.value - out
+	}
+	m.add(ptx)
+	for m.size > m.maxSize {
+		evict := m.worst()
+		log.Lvl3("Mempool is full - evicting", evict.tx.Hash)
+		m.evict(evict.tx.Hash)
+		if _, ok := m.txs[ptx.tx.Hash]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Remove drops the transactions from the mempool, as they are committed in
+// a block. Other transactions of the mempool spending the same outputs are
+// evicted.
+func (m *Mempool) Remove(txs ...blkparser.Tx) {
+	m.Lock()
+	defer m.Unlock()
+	for _, tx := range txs {
+		m.remove(tx.Hash)
+		if IsCoinbase(tx) {
+			continue
+		}
+		for _, in := range tx.TxIns {
+			if hash, ok := m.spends[Outpoint{in.InputHash, in.InputVout}]; ok {
+				m.evict(hash)
+			}
+		}
+	}
+}
+
+// Len returns the number of transactions in the mempool.
+func (m *Mempool) Len() int {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.txs)
+}
+
+// Size returns the size of all transactions in the mempool in bytes.
+func (m *Mempool) Size() int {
+	m.Lock()
+	defer m.Unlock()
+	return m.size
+}
+
+// Template returns at most n of the best transactions whose sizes add up to
+// at most size bytes. A transaction spending the output of another
+// transaction of the mempool comes after it. The transactions stay in the
+// mempool until they are removed.
+func (m *Mempool) Template(n, size int) TransactionList {
+	txs := m.Best(n, size)
+	return NewTransactionList(txs, len(txs))
+}
+
+// Best returns at most n of the best transactions whose sizes add up to at
+// most size bytes. If n or size are negative, there is no limit.
+func (m *Mempool) Best(n, size int) []blkparser.Tx {
+	m.Lock()
+	defer m.Unlock()
+	return m.best(n, size)
+}
+
+// Take returns the same transactions as Best and removes them from the
+// mempool, so that two leaders never put the same transaction in a block.
+func (m *Mempool) Take(n, size int) []blkparser.Tx {
+	m.Lock()
+	defer m.Unlock()
+	txs := m.best(n, size)
+	for _, tx := range txs {
+		m.remove(tx.Hash)
+	}
+	return txs
+}
+
+// Return puts back transactions returned by Take, if the block they were
+// taken for couldn't be signed. Transactions spending the same outputs as
+// newer transactions of the mempool are dropped.
+func (m *Mempool) Return(txs ...blkparser.Tx) {
+	for _, tx := range txs {
+		m.Add(tx)
+	}
+}
+
+// best returns the transactions for Best. The lock must be held.
+func (m *Mempool) best(n, size int) []blkparser.Tx {
+	var txs []blkparser.Tx
+	added := make(map[string]bool)
+	sorted := m.sorted()
+	// A transaction waiting for its parent is added in a later pass
+	for progress := true; progress && n != 0; {
+		progress = false
+		for _, ptx := range sorted {
+			if added[ptx.tx.Hash] || !m.parentsAdded(ptx.tx, added) {
+				continue
+			}
+			if size >= 0 && int(ptx.tx.Size) > size {
+				continue
+			}
+			txs = append(txs, ptx.tx)
+			added[ptx.tx.Hash] = true
+			size -= int(ptx.tx.Size)
+			progress = true
+			if n--; n == 0 {
+				break
+			}
+		}
+	}
+	return txs
+}
+
+// parentsAdded returns true if all transactions of the mempool tx spends
+// from are added. The lock must be held.
+func (m *Mempool) parentsAdded(tx blkparser.Tx, added map[string]bool) bool {
+	if IsCoinbase(tx) {
+		return true
+	}
+	for _, in := range tx.TxIns {
+		if _, ok := m.txs[in.InputHash]; ok && !added[in.InputHash] {
+			return false
+		}
+	}
+	return true
+}
+
+// sorted returns all transactions, the best first. The lock must be held.
+func (m *Mempool) sorted() []*poolTx {
+	txs := make([]*poolTx, 0, len(m.txs))
+	for _, ptx := range m.txs {
+		txs = append(txs, ptx)
+	}
+	sort.Slice(txs, func(i, j int) bool {
+		si, sj := m.score(txs[i]), m.score(txs[j])
+		if si != sj {
+			return si > sj
+		}
+		return txs[i].seq < txs[j].seq
+	})
+	return txs
+}
+
+// worst returns the transaction ordered last. The lock must be held.
+func (m *Mempool) worst() *poolTx {
+	m.reorder()
+	return m.queue.txs[0]
+}
+
+// reorder rebuilds the heap if the Order changed. The lock must be held.
+func (m *Mempool) reorder() {
+	if m.queue.order != m.Order {
+		m.queue.order = m.Order
+		heap.Init(&m.queue)
+	}
+}
+
+// score returns the fee or value per byte of the transaction.
+func (m *Mempool) score(ptx *poolTx) float64 {
+	return score(ptx, m.Order)
+}
+
+// score returns the fee or value per byte of the transaction, depending on
+// the order.
+func score(ptx *poolTx, order int) float64 {
+	size := float64(ptx.tx.Size)
+	if size == 0 {
+		size = 1
+	}
+	if order == OrderPriority {
+		return float64(ptx.value) / size
+	}
+	return float64(ptx.fee) / size
+}
+
+// evictQueue is a heap of transactions with the one ordered last on top, so
+// that a full mempool doesn't sort all transactions for every eviction.
+type evictQueue struct {
+	order int
+	txs   []*poolTx
+}
+
+func (q evictQueue) Len() int { return len(q.txs) }
+
+func (q evictQueue) Less(i, j int) bool {
+	si, sj := score(q.txs[i], q.order), score(q.txs[j], q.order)
+	if si != sj {
+		return si < sj
+	}
+	return q.txs[i].seq > q.txs[j].seq
+}
+
+func (q evictQueue) Swap(i, j int) {
+	q.txs[i], q.txs[j] = q.txs[j], q.txs[i]
+	q.txs[i].index = i
+	q.txs[j].index = j
+}
+
+func (q *evictQueue) Push(x interface{}) {
+	ptx := x.(*poolTx)
+	ptx.index = len(q.txs)
+	q.txs = append(q.txs, ptx)
+}
+
+func (q *evictQueue) Pop() interface{} {
+	ptx := q.txs[len(q.txs)-1]
+	q.txs = q.txs[:len(q.txs)-1]
+	return ptx
+}
+
+// inputValue returns the value of the output o, or 0 if it's not known. The
+// lock must be held.
+func (m *Mempool) inputValue(o Outpoint) uint64 {
+	if parent, ok := m.txs[o.Hash]; ok {
+		if int(o.Vout) < len(parent.tx.TxOuts) {
+			return parent.tx.TxOuts[o.Vout].Value
+		}
+		return 0
+	}
+	if m.utxo != nil {
+		v, _ := m.utxo.Value(o)
+		return v
+	}
+	return 0
+}
+
+// add stores the transaction. The lock must be held.
+func (m *Mempool) add(ptx *poolTx) {
+	m.txs[ptx.tx.Hash] = ptx
+	m.size += int(ptx.tx.Size)
+	m.reorder()
+	heap.Push(&m.queue, ptx)
+	if IsCoinbase(ptx.tx) {
+		return
+	}
+	for _, in := range ptx.tx.TxIns {
+		m.spends[Outpoint{in.InputHash, in.InputVout}] = ptx.tx.Hash
+	}
+}
+
+// evict drops the transaction with the given hash and all transactions
+// spending its outputs, as they can't be in a block anymore. The lock must
+// be held.
+func (m *Mempool) evict(hash string) {
+	ptx, ok := m.txs[hash]
+	if !ok {
+		return
+	}
+	m.remove(hash)
+	for i := range ptx.tx.TxOuts {
+		if child, ok := m.spends[Outpoint{hash, uint32(i)}]; ok {
+			m.evict(child)
+		}
+	}
+}
+
+// remove drops the transaction with the given hash, if it exists. The lock
+// must be held.
+func (m *Mempool) remove(hash string) {
+	ptx, ok := m.txs[hash]
+	if !ok {
+		return
+	}
+	delete(m.txs, hash)
+	m.size -= int(ptx.tx.Size)
+	heap.Remove(&m.queue, ptx.index)
+	if IsCoinbase(ptx.tx) {
+		return
+	}
+	for _, in := range ptx.tx.TxIns {
+		o := Outpoint{in.InputHash, in.InputVout}
+		if m.spends[o] == hash {
+			delete(m.spends, o)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package blockchain
+
+import "testing"
+
+func TestMempoolAdd(t *testing.T) {
+	g := NewGenerator(Workload{WorkloadSeed: 1})
+	m := NewMempool(1<<20, nil)
+	txs := g.Transactions(10)
+	for _, tx := range txs {
+		if !m.Add(tx) {
+			t.Fatal("Couldn't add transaction")
+		}
+	}
+	if m.Add(txs[0]) {
+		t.Fatal("Transaction added twice")
+	}
+	double := txs[1]
+	double.Hash = "double"
+	if m.Add(double) {
+		t.Fatal("Double spend accepted")
+	}
+	m.Remove(txs[:5]...)
+	if m.Len() != 5 {
+		t.Fatal("Committed transactions should be removed")
+	}
+	if !m.Add(double) {
+		t.Fatal("Output of removed transaction should be spendable")
+	}
+}
+
+func TestMempoolTemplate(t *testing.T) {
+	g := NewGenerator(Workload{WorkloadSeed: 1})
+	u := NewUTXOSet()
+	u.Add(g.Genesis())
+	m := NewMempool(1<<20, u)
+	for _, tx := range g.Transactions(1000) {
+		m.Add(tx)
+	}
+	tl := m.Template(-1, 50000)
+	size := 0
+	for _, tx := range tl.Txs {
+		size += int(tx.Size)
+	}
+	if size > 50000 || size < 40000 {
+		t.Fatal("Wrong size of template:", size)
+	}
+	if err := u.Commit(tl); err != nil {
+		t.Fatal("Template is not a valid block:", err)
+	}
+	m.Remove(tl.Txs...)
+	if err := u.Verify(m.Template(-1, 50000)); err != nil {
+		t.Fatal("Second template is not a valid block:", err)
+	}
+}
+
+func TestMempoolOrder(t *testing.T) {
+	// All transactions have the same fee per byte
+	g := NewGenerator(Workload{WorkloadSeed: 1, TxSizeDist: "fixed",
+		TxInputsMax: 1, TxOutputsMax: 1})
+	u := NewUTXOSet()
+	u.Add(g.Genesis())
+	m := NewMempool(1<<20, u)
+	txs := g.Transactions(10)
+	// Raise the fee of the last transaction
+	txs[9].TxOuts[0].Value /= 2
+	for _, tx := range txs {
+		m.Add(tx)
+	}
+	if best := m.Best(1, -1); best[0].Hash != txs[9].Hash {
+		t.Fatal("Transaction with highest fee should be first")
+	}
+
+	// Only the first transactions fit
+	m = NewMempool(int(txs[0].Size+txs[1].Size), u)
+	for i, tx := range txs {
+		if m.Add(tx) != (i < 2 || i == 9) {
+			t.Fatal("Wrong eviction for transaction", i)
+		}
+	}
+}
+
+func TestMempoolTake(t *testing.T) {
+	g := NewGenerator(Workload{WorkloadSeed: 1})
+	m := NewMempool(1<<20, nil)
+	for _, tx := range g.Transactions(100) {
+		m.Add(tx)
+	}
+	first := m.Take(50, -1)
+	second := m.Take(100, -1)
+	if len(first) != 50 || len(second) != 50 || m.Len() != 0 {
+		t.Fatal("Wrong number of transactions taken:", len(first), len(second))
+	}
+	// The block of first couldn't be signed
+	m.Return(first...)
+	if m.Len() != 50 {
+		t.Fatal("Transactions should be back in the mempool:", m.Len())
+	}
+}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/csanti/pbft-experiments/cothority/crypto"
 	"github.com/csanti/pbft-experiments/cothority/log"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/membership"
 )
 
 type Block struct {
@@ -56,6 +57,14 @@ type Header struct {
 	ParentKey  string
 	PublicKey  string
 	LeaderId   net.IP
+	// Nonce and Difficulty are only used for the proof-of-work of keyblocks
+	Nonce      uint64
+	Difficulty uint32
+	// Epoch is the membership epoch of the roster signing the block
+	Epoch uint64
+	// RosterChanges are agreed by signing the block and take effect at the
+	// next epoch boundary
+	RosterChanges []membership.Change
 }
 
 // HashSum returns a hash representation of the header
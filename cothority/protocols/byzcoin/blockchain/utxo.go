@@ -0,0 +1,181 @@
+package blockchain
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain/blkparser"
+)
+
+// Outpoint references the output Vout of the transaction with hash Hash.
+type Outpoint struct {
+	Hash string
+	Vout uint32
+}
+
+// UTXOSet holds all unspent transaction-outputs and their values. It is
+// updated with every committed block and used to verify the transactions
+// of new blocks.
+type UTXOSet struct {
+	outputs map[Outpoint]uint64
+	sync.Mutex
+}
+
+// NewUTXOSet returns an empty set, so that only blocks starting with a
+// coinbase or the genesis of the chain can be verified.
+func NewUTXOSet() *UTXOSet {
+	return &UTXOSet{outputs: make(map[Outpoint]uint64)}
+}
+
+// Add stores the outputs of the transactions, without verifying them. It is
+// used to create the genesis of a chain.
+func (u *UTXOSet) Add(txs ...blkparser.Tx) {
+	u.Lock()
+	defer u.Unlock()
+	for _, tx := range txs {
+		for i, out := range tx.TxOuts {
+			u.outputs[Outpoint{tx.Hash, uint32(i)}] = out.Value
+		}
+	}
+}
+
+// Value returns the value of the unspent output o and whether it exists.
+func (u *UTXOSet) Value(o Outpoint) (uint64, bool) {
+	u.Lock()
+	defer u.Unlock()
+	v, ok := u.outputs[o]
+	return v, ok
+}
+
+// Len returns the number of unspent outputs.
+func (u *UTXOSet) Len() int {
+	u.Lock()
+	defer u.Unlock()
+	return len(u.outputs)
+}
+
+// Verify checks that all transactions of the list only spend existing and
+// unspent outputs, that no output is spent twice and that no transaction
+// creates more value than it spends. A transaction can spend the outputs of
+// transactions that come before it in the list. The set is not changed.
+func (u *UTXOSet) Verify(tl TransactionList) error {
+	u.Lock()
+	defer u.Unlock()
+	_, _, err := u.apply(tl)
+	return err
+}
+
+// Commit verifies the transactions of the list and updates the set with
+// them. If the verification fails, the set is not changed.
+func (u *UTXOSet) Commit(tl TransactionList) error {
+	u.Lock()
+	defer u.Unlock()
+	spent, created, err := u.apply(tl)
+	if err != nil {
+		return err
+	}
+	for o := range spent {
+		delete(u.outputs, o)
+	}
+	for o, v := range created {
+		u.outputs[o] = v
+	}
+	return nil
+}
+
+// apply returns the outputs spent and created by the transactions of the
+// list, or the first error. The lock must be held.
+func (u *UTXOSet) apply(tl TransactionList) (spent map[Outpoint]bool,
+	created map[Outpoint]uint64, err error) {
+	spent = make(map[Outpoint]bool)
+	created = make(map[Outpoint]uint64)
+	for _, tx := range tl.Txs {
+		var in uint64
+		if !IsCoinbase(tx) {
+			for _, txin := range tx.TxIns {
+				o := Outpoint{txin.InputHash, txin.InputVout}
+				if spent[o] {
+					return nil, nil, fmt.Errorf("%s: double spend of %s:%d",
+						tx.Hash, o.Hash, o.Vout)
+				}
+				v, ok := created[o]
+				if ok {
+					delete(created, o)
+				} else if v, ok = u.outputs[o]; !ok {
+					return nil, nil, fmt.Errorf("%s: missing input %s:%d",
+						tx.Hash, o.Hash, o.Vout)
+				}
+				spent[o] = true
+				in += v
+			}
+		}
+		var out uint64
+		for i, txout := range tx.TxOuts {
+			out += txout.Value
+			created[Outpoint{tx.Hash, uint32(i)}] = txout.Value
+		}
+		if !IsCoinbase(tx) && out > in {
+			return nil, nil, fmt.Errorf("%s: outputs of %d are bigger than inputs of %d",
+				tx.Hash, out, in)
+		}
+	}
+	return spent, created, nil
+}
+
+// snapshot is the stored form of a set at a height of the chain.
+type snapshot struct {
+	Height  uint64
+	Outputs []snapshotOutput
+}
+
+type snapshotOutput struct {
+	Outpoint
+	Value uint64
+}
+
+// Save writes the set to path as the state after the first height blocks,
+// so that it can be restored when these blocks have been pruned. The old
+// snapshot is replaced atomically.
+func (u *UTXOSet) Save(path string, height uint64) error {
+	u.Lock()
+	snap := &snapshot{Height: height}
+	for o, v := range u.outputs {
+		snap.Outputs = append(snap.Outputs, snapshotOutput{o, v})
+	}
+	u.Unlock()
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadUTXOSet reads the set saved at path and returns it together with the
+// number of blocks it holds.
+func LoadUTXOSet(path string) (*UTXOSet, uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	snap := &snapshot{}
+	if err := json.Unmarshal(data, snap); err != nil {
+		return nil, 0, err
+	}
+	u := NewUTXOSet()
+	for _, out := range snap.Outputs {
+		u.outputs[out.Outpoint] = out.Value
+	}
+	return u, snap.Height, nil
+}
+
+// IsCoinbase returns true if the transaction creates new coins.
+func IsCoinbase(tx blkparser.Tx) bool {
+	return len(tx.TxIns) == 1 && tx.TxIns[0].InputVout == 0xffffffff
+}
@@ -0,0 +1,87 @@
+package blockchain
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUTXOSetCommit(t *testing.T) {
+	g := NewGenerator(Workload{WorkloadSeed: 1})
+	u := NewUTXOSet()
+	block := NewTransactionList(g.Block(100000), 10000)
+	if err := u.Verify(block); err == nil || !strings.Contains(err.Error(), "missing input") {
+		t.Fatal("Should miss the genesis:", err)
+	}
+	u.Add(g.Genesis())
+	if u.Len() != g.Coins {
+		t.Fatal("Genesis should create all coins")
+	}
+	if err := u.Verify(block); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Commit(block); err != nil {
+		t.Fatal(err)
+	}
+	if u.Verify(block) == nil {
+		t.Fatal("Block should not be accepted twice")
+	}
+	next := NewTransactionList(g.Block(100000), 10000)
+	if err := u.Commit(next); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUTXOSetVerify(t *testing.T) {
+	g := NewGenerator(Workload{WorkloadSeed: 1, ConflictRate: 1})
+	u := NewUTXOSet()
+	u.Add(g.Genesis())
+	if err := u.Verify(NewTransactionList(g.Transactions(100), 100)); err == nil ||
+		!strings.Contains(err.Error(), "double spend") {
+		t.Fatal("Conflicts should be found:", err)
+	}
+
+	g = NewGenerator(Workload{WorkloadSeed: 1})
+	u = NewUTXOSet()
+	u.Add(g.Genesis())
+	txs := g.Transactions(10)
+	txs[5].TxOuts[0].Value += coinValue
+	if err := u.Verify(NewTransactionList(txs, 10)); err == nil ||
+		!strings.Contains(err.Error(), "bigger than inputs") {
+		t.Fatal("Value should be conserved:", err)
+	}
+	if u.Len() != g.Coins {
+		t.Fatal("Failed verification changed the set")
+	}
+}
+
+func TestUTXOSetSave(t *testing.T) {
+	g := NewGenerator(Workload{WorkloadSeed: 1})
+	u := NewUTXOSet()
+	u.Add(g.Genesis())
+	if err := u.Commit(NewTransactionList(g.Block(100000), 10000)); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "utxo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "utxo.json")
+	if err := u.Save(path, 2); err != nil {
+		t.Fatal(err)
+	}
+	loaded, height, err := LoadUTXOSet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height != 2 || loaded.Len() != u.Len() {
+		t.Fatal("Loaded a different set")
+	}
+	next := NewTransactionList(g.Block(100000), 10000)
+	if err := loaded.Commit(next); err != nil {
+		t.Fatal(err)
+	}
+}
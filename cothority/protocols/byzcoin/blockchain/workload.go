@@ -0,0 +1,476 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/csanti/pbft-experiments/cothority/log"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain/blkparser"
+)
+
+// Workload describes the transactions created by a Generator. It can be
+// embedded in a simulation, so that all fields can be set in the .toml-file.
+// Fields that are 0 take the default value.
+type Workload struct {
+	// WorkloadSeed makes the transactions and arrival-times reproducible
+	WorkloadSeed int64
+	// TxSizeDist is "fixed", "uniform" or "lognormal" (default)
+	TxSizeDist string
+	// TxSizeMean and TxSizeStdDev in bytes for "fixed" and "lognormal"
+	TxSizeMean   int
+	TxSizeStdDev int
+	// TxSizeMin and TxSizeMax limit the size, they are the range for
+	// "uniform". A transaction can't be smaller than its inputs and outputs.
+	TxSizeMin int
+	TxSizeMax int
+	// The number of inputs and outputs is uniformly distributed
+	TxInputsMin  int
+	TxInputsMax  int
+	TxOutputsMin int
+	TxOutputsMax int
+	// TxFee in satoshi per byte
+	TxFee int
+	// ConflictRate is the probability that a transaction double-spends an
+	// output that has already been spent
+	ConflictRate float64
+	// Arrival is "poisson" (open-loop, default) or "closed" (closed-loop)
+	Arrival string
+	// ArrivalRate in transactions per second for "poisson"
+	ArrivalRate float64
+	// Clients is the number of outstanding transactions for "closed"
+	Clients int
+	// Coins is the number of outputs of the genesis-transaction
+	Coins int
+}
+
+// The default workload is about what the Bitcoin-network sees
+var defaultWorkload = Workload{
+	TxSizeDist:   "lognormal",
+	TxSizeMean:   250,
+	TxSizeStdDev: 150,
+	TxSizeMax:    100000,
+	TxInputsMin:  1,
+	TxInputsMax:  3,
+	TxOutputsMin: 1,
+	TxOutputsMax: 3,
+	TxFee:        10,
+	Arrival:      "poisson",
+	ArrivalRate:  1000,
+	Clients:      100,
+	Coins:        10000,
+}
+
+// coinValue is the value of every output of the genesis-transaction
+const coinValue = 50 * 100000000
+
+// coinbaseVout is the InputVout of a coinbase-transaction
+const coinbaseVout = 0xffffffff
+
+// maxSpent is the number of spent outputs kept to create conflicts
+const maxSpent = 10000
+
+// outpoint is an output of a transaction
+type outpoint struct {
+	hash  string
+	vout  uint32
+	value uint64
+}
+
+// Generator creates transactions that spend the outputs of the previous
+// ones, starting from a genesis-transaction. For the same Workload, it always
+// creates the same transactions.
+type Generator struct {
+	Workload
+	genesis blkparser.Tx
+	// rnd is used for the transactions, arrival for the arrival-times, so
+	// that the transactions don't depend on the timing
+	rnd      *rand.Rand
+	arrival  *rand.Rand
+	unspent  []outpoint
+	spent    []outpoint
+	pending  *blkparser.Tx
+	window   chan bool
+	coinbase uint32
+	lock     sync.Mutex
+}
+
+// NewGenerator returns a Generator for the workload w.
+func NewGenerator(w Workload) *Generator {
+	w.setDefaults()
+	g := &Generator{
+		Workload: w,
+		rnd:      rand.New(rand.NewSource(w.WorkloadSeed)),
+		arrival:  rand.New(rand.NewSource(w.WorkloadSeed + 1)),
+		window:   make(chan bool, w.Clients),
+	}
+	for i := 0; i < w.Clients; i++ {
+		g.window <- true
+	}
+	g.genesis = g.newCoinbase(w.Coins)
+	return g
+}
+
+// Genesis returns the transaction that creates the coins spent by all other
+// transactions.
+func (g *Generator) Genesis() blkparser.Tx {
+	return g.genesis
+}
+
+// Next returns a new transaction. If all outputs are spent, it returns a
+// coinbase-transaction with new coins.
+func (g *Generator) Next() blkparser.Tx {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.pending != nil {
+		tx := *g.pending
+		g.pending = nil
+		return tx
+	}
+	return g.next()
+}
+
+// Transactions returns the next n transactions.
+func (g *Generator) Transactions(n int) []blkparser.Tx {
+	txs := make([]blkparser.Tx, n)
+	for i := range txs {
+		txs[i] = g.Next()
+	}
+	return txs
+}
+
+// Block returns the next transactions whose sizes add up to at most size
+// bytes, but at least one transaction.
+func (g *Generator) Block(size int) []blkparser.Tx {
+	var txs []blkparser.Tx
+	total := 0
+	for {
+		tx := g.Next()
+		if len(txs) > 0 && total+int(tx.Size) > size {
+			// Keep it for the next call
+			g.lock.Lock()
+			g.pending = &tx
+			g.lock.Unlock()
+			return txs
+		}
+		txs = append(txs, tx)
+		total += int(tx.Size)
+	}
+}
+
+// GenesisBlock is like Block, but starts with the genesis-transaction, so
+// that the inputs of the other transactions are in the block. It is used by
+// the simulations signing a block that doesn't follow other blocks.
+func (g *Generator) GenesisBlock(size int) []blkparser.Tx {
+	return append([]blkparser.Tx{g.Genesis()}, g.Block(size-int(g.genesis.Size))...)
+}
+
+// Arrivals sends new transactions to c until quit is closed. With the
+// "poisson"-arrival, the time between two transactions is exponentially
+// distributed with ArrivalRate transactions per second, independent of how
+// fast c is read. With the "closed"-arrival, there are at most Clients
+// transactions outstanding, and Commit has to be called for every
+// transaction that is done.
+func (g *Generator) Arrivals(c chan<- blkparser.Tx, quit <-chan bool) {
+	next := time.Now()
+	for {
+		switch g.Arrival {
+		case "closed":
+			select {
+			case <-g.window:
+			case <-quit:
+				return
+			}
+		default:
+			g.lock.Lock()
+			next = next.Add(time.Duration(g.arrival.ExpFloat64() /
+				g.ArrivalRate * float64(time.Second)))
+			g.lock.Unlock()
+			select {
+			case <-time.After(next.Sub(time.Now())):
+			case <-quit:
+				return
+			}
+		}
+		select {
+		case c <- g.Next():
+		case <-quit:
+			return
+		}
+	}
+}
+
+// Commit tells a closed-loop generator that n transactions are done, so
+// that n new transactions can be sent.
+func (g *Generator) Commit(n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case g.window <- true:
+		default:
+			return
+		}
+	}
+}
+
+// next creates a new transaction. The lock must be held.
+func (g *Generator) next() blkparser.Tx {
+	nIn := g.uniform(g.TxInputsMin, g.TxInputsMax)
+	if nIn > len(g.unspent) {
+		nIn = len(g.unspent)
+	}
+	if nIn == 0 {
+		log.Lvl2("All outputs are spent - creating new coins")
+		return g.newCoinbase(g.TxOutputsMax)
+	}
+	conflict := len(g.spent) > 0 && g.rnd.Float64() < g.ConflictRate
+	ins := make([]outpoint, nIn)
+	for i := range ins {
+		idx := g.rnd.Intn(len(g.unspent))
+		ins[i] = g.unspent[idx]
+		if !conflict {
+			// Only a valid transaction spends its inputs
+			g.unspent[idx] = g.unspent[len(g.unspent)-1]
+			g.unspent = g.unspent[:len(g.unspent)-1]
+		}
+	}
+	if conflict {
+		ins[0] = g.spent[g.rnd.Intn(len(g.spent))]
+	}
+	var value uint64
+	for _, in := range ins {
+		value += in.value
+	}
+
+	size := g.size()
+	nOut := g.uniform(g.TxOutputsMin, g.TxOutputsMax)
+	fee := uint64(size * g.TxFee)
+	if fee > value {
+		fee = value
+	}
+	values := g.split(value-fee, nOut)
+	tx := g.newTx(ins, values, size)
+	if !conflict {
+		for _, in := range ins {
+			g.spend(in)
+		}
+		g.addOutputs(tx)
+	}
+	return tx
+}
+
+// newCoinbase returns a transaction with n new coins.
+func (g *Generator) newCoinbase(n int) blkparser.Tx {
+	// Every coinbase needs another input to have another hash
+	var in outpoint
+	in.vout = coinbaseVout
+	in.hash = hex.EncodeToString(make([]byte, 28)) +
+		hex.EncodeToString([]byte{byte(g.coinbase >> 24), byte(g.coinbase >> 16),
+			byte(g.coinbase >> 8), byte(g.coinbase)})
+	g.coinbase++
+	values := make([]uint64, n)
+	for i := range values {
+		values[i] = coinValue
+	}
+	tx := g.newTx([]outpoint{in}, values, 0)
+	g.addOutputs(tx)
+	return tx
+}
+
+// newTx serializes the transaction in the format of Bitcoin and parses it
+// again, so that it is the same as a transaction read from a .dat-file. The
+// signature-scripts are filled up with random bytes to reach size.
+func (g *Generator) newTx(ins []outpoint, values []uint64, size int) blkparser.Tx {
+	pkscripts := make([][]byte, len(values))
+	for i := range pkscripts {
+		// Pay-to-pubkey-hash
+		pk := append([]byte{0x76, 0xa9, 0x14}, g.random(20)...)
+		pkscripts[i] = append(pk, 0x88, 0xac)
+	}
+	// A signature and a public key, as in pay-to-pubkey-hash
+	sigs := make([][]byte, len(ins))
+	for i := range sigs {
+		sigs[i] = g.random(107)
+	}
+	raw := serializeTx(ins, sigs, values, pkscripts)
+	if size > 0 {
+		// Fill up the first input, but not below 1 byte, as the
+		// varint of its length can grow
+		for i := 0; i < 3 && len(raw) != size; i++ {
+			l := len(sigs[0]) + size - len(raw)
+			if l < 1 {
+				l = 1
+			}
+			if l > len(sigs[0]) {
+				sigs[0] = append(sigs[0], g.random(l-len(sigs[0]))...)
+			} else {
+				sigs[0] = sigs[0][:l]
+			}
+			raw = serializeTx(ins, sigs, values, pkscripts)
+		}
+	}
+	tx, _ := blkparser.NewTx(raw)
+	tx.Hash = blkparser.GetShaString(raw)
+	tx.Size = uint32(len(raw))
+	return *tx
+}
+
+// serializeTx returns the transaction as a Bitcoin raw transaction.
+func serializeTx(ins []outpoint, sigs [][]byte, values []uint64, pkscripts [][]byte) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, uint32(1))
+	writeVarInt(&b, len(ins))
+	for i, in := range ins {
+		h, _ := hex.DecodeString(in.hash)
+		// InputHash is printed reversed
+		for j := len(h) - 1; j >= 0; j-- {
+			b.WriteByte(h[j])
+		}
+		binary.Write(&b, binary.LittleEndian, in.vout)
+		writeVarInt(&b, len(sigs[i]))
+		b.Write(sigs[i])
+		binary.Write(&b, binary.LittleEndian, uint32(0xffffffff))
+	}
+	writeVarInt(&b, len(values))
+	for i, v := range values {
+		binary.Write(&b, binary.LittleEndian, v)
+		writeVarInt(&b, len(pkscripts[i]))
+		b.Write(pkscripts[i])
+	}
+	// LockTime
+	binary.Write(&b, binary.LittleEndian, uint32(0))
+	return b.Bytes()
+}
+
+// writeVarInt writes a variable length integer as decoded by
+// blkparser.DecodeVariableLengthInteger.
+func writeVarInt(b *bytes.Buffer, n int) {
+	switch {
+	case n < 0xfd:
+		b.WriteByte(byte(n))
+	case n <= 0xffff:
+		b.WriteByte(0xfd)
+		binary.Write(b, binary.LittleEndian, uint16(n))
+	case n <= 0xffffffff:
+		b.WriteByte(0xfe)
+		binary.Write(b, binary.LittleEndian, uint32(n))
+	default:
+		b.WriteByte(0xff)
+		binary.Write(b, binary.LittleEndian, uint64(n))
+	}
+}
+
+// addOutputs makes the outputs of tx available for the next transactions.
+func (g *Generator) addOutputs(tx blkparser.Tx) {
+	for i, out := range tx.TxOuts {
+		g.unspent = append(g.unspent, outpoint{tx.Hash, uint32(i), out.Value})
+	}
+}
+
+// spend remembers the output, so that a conflicting transaction can spend
+// it again.
+func (g *Generator) spend(o outpoint) {
+	if len(g.spent) < maxSpent {
+		g.spent = append(g.spent, o)
+	} else {
+		g.spent[g.rnd.Intn(maxSpent)] = o
+	}
+}
+
+// size returns the size of the next transaction.
+func (g *Generator) size() int {
+	var s int
+	switch g.TxSizeDist {
+	case "fixed":
+		s = g.TxSizeMean
+	case "uniform":
+		s = g.uniform(g.TxSizeMin, g.TxSizeMax)
+	default:
+		m := float64(g.TxSizeMean)
+		sd := float64(g.TxSizeStdDev)
+		sigma2 := math.Log(1 + sd*sd/(m*m))
+		mu := math.Log(m) - sigma2/2
+		s = int(math.Exp(mu + math.Sqrt(sigma2)*g.rnd.NormFloat64()))
+	}
+	if s < g.TxSizeMin {
+		s = g.TxSizeMin
+	}
+	if s > g.TxSizeMax {
+		s = g.TxSizeMax
+	}
+	return s
+}
+
+// split divides value into n random parts.
+func (g *Generator) split(value uint64, n int) []uint64 {
+	values := make([]uint64, n)
+	rest := value
+	for i := 0; i < n-1; i++ {
+		values[i] = uint64(g.rnd.Int63n(int64(rest/uint64(n-i)) + 1))
+		rest -= values[i]
+	}
+	values[n-1] = rest
+	return values
+}
+
+// uniform returns a random number in [min, max].
+func (g *Generator) uniform(min, max int) int {
+	if max <= min {
+		return min
+	}
+	return min + g.rnd.Intn(max-min+1)
+}
+
+// random returns n random bytes.
+func (g *Generator) random(n int) []byte {
+	b := make([]byte, n)
+	g.rnd.Read(b)
+	return b
+}
+
+// setDefaults replaces all fields that are 0 with the defaults.
+func (w *Workload) setDefaults() {
+	d := defaultWorkload
+	if w.TxSizeDist == "" {
+		w.TxSizeDist = d.TxSizeDist
+	}
+	if w.TxSizeMean == 0 {
+		w.TxSizeMean = d.TxSizeMean
+	}
+	if w.TxSizeStdDev == 0 {
+		w.TxSizeStdDev = d.TxSizeStdDev
+	}
+	if w.TxSizeMax == 0 {
+		w.TxSizeMax = d.TxSizeMax
+	}
+	if w.TxInputsMin == 0 {
+		w.TxInputsMin = d.TxInputsMin
+	}
+	if w.TxInputsMax == 0 {
+		w.TxInputsMax = d.TxInputsMax
+	}
+	if w.TxOutputsMin == 0 {
+		w.TxOutputsMin = d.TxOutputsMin
+	}
+	if w.TxOutputsMax == 0 {
+		w.TxOutputsMax = d.TxOutputsMax
+	}
+	if w.TxFee == 0 {
+		w.TxFee = d.TxFee
+	}
+	if w.Arrival == "" {
+		w.Arrival = d.Arrival
+	}
+	if w.ArrivalRate == 0 {
+		w.ArrivalRate = d.ArrivalRate
+	}
+	if w.Clients == 0 {
+		w.Clients = d.Clients
+	}
+	if w.Coins == 0 {
+		w.Coins = d.Coins
+	}
+}
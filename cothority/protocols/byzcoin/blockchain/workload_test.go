@@ -0,0 +1,68 @@
+package blockchain
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestGeneratorDeterministic(t *testing.T) {
+	w := Workload{WorkloadSeed: 42}
+	txs1 := NewGenerator(w).Transactions(100)
+	txs2 := NewGenerator(w).Transactions(100)
+	for i := range txs1 {
+		if txs1[i].Hash != txs2[i].Hash {
+			t.Fatal("Same seed should give the same transactions")
+		}
+	}
+	w.WorkloadSeed++
+	if NewGenerator(w).Next().Hash == txs1[0].Hash {
+		t.Fatal("Different seeds should give different transactions")
+	}
+}
+
+func TestGeneratorSize(t *testing.T) {
+	g := NewGenerator(Workload{TxSizeDist: "fixed", TxSizeMean: 500})
+	for _, tx := range g.Transactions(100) {
+		if tx.Size != 500 {
+			t.Fatal("Wrong size:", tx.Size)
+		}
+		if len(tx.TxIns) == 0 || len(tx.TxOuts) == 0 {
+			t.Fatal("Transaction without inputs or outputs")
+		}
+	}
+	block := NewGenerator(Workload{}).Block(100000)
+	size := 0
+	for _, tx := range block {
+		size += int(tx.Size)
+	}
+	if size > 100000 || len(block) < 2 {
+		t.Fatal("Block doesn't respect the size:", size, len(block))
+	}
+	g = NewGenerator(Workload{})
+	block = g.GenesisBlock(100000)
+	size = 0
+	for _, tx := range block {
+		size += int(tx.Size)
+	}
+	if block[0].Hash != g.Genesis().Hash || size > 100000 {
+		t.Fatal("Block doesn't start with the genesis:", size, len(block))
+	}
+}
+
+func TestGeneratorConflicts(t *testing.T) {
+	g := NewGenerator(Workload{ConflictRate: 0.5})
+	spent := make(map[string]bool)
+	conflicts := 0
+	for _, tx := range g.Transactions(1000) {
+		for _, in := range tx.TxIns {
+			o := fmt.Sprint(in.InputHash, in.InputVout)
+			if spent[o] {
+				conflicts++
+			}
+			spent[o] = true
+		}
+	}
+	if conflicts < 300 || conflicts > 700 {
+		t.Fatal("Wrong number of conflicts:", conflicts)
+	}
+}
@@ -0,0 +1,418 @@
+// Package fetch is the part of blocksync that doesn't depend on the
+// framework. It is shared by the sync of sda, in
+// cothority/protocols/byzcoin/blocksync, and the one of onet, in blocksync,
+// which only pass it the messages of the peers and send its requests.
+//
+// A Fetcher asks all peers for the height of their block store. It only
+// trusts a height claimed by more than a third of the peers, so that at
+// least one honest peer has all blocks up to it. It splits the missing
+// heights in chunks and downloads the chunks in parallel from different
+// peers. The blocks are verified with the Verify function, which checks the
+// collective signature against the roster of the time, and appended to the
+// store in order. A peer that sends invalid blocks, or doesn't answer in
+// time, isn't asked again and its chunks go to other peers. A peer answers
+// with at most MaxChunkBytes of blocks, the rest of the chunk is asked
+// again.
+package fetch
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/csanti/pbft-experiments/cothority/log"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain/blockstore"
+)
+
+// DefaultChunkSize is the number of blocks asked from a peer at once.
+const DefaultChunkSize = 50
+
+// MaxChunkBytes is the size of the blocks a peer sends at most in one
+// answer. A bigger block is sent alone.
+const MaxChunkBytes = 4 << 20
+
+// DefaultTimeout is how long a peer has to answer.
+const DefaultTimeout = 10 * time.Second
+
+// DefaultMaxBlocks is the number of blocks fetched at most by one sync. A
+// store that is further behind has to sync again.
+const DefaultMaxBlocks = 10000
+
+// VerifyFunction checks a block and its signature. prev is the block before,
+// or nil for the first block of the chain.
+type VerifyFunction func(prev, e *blockstore.Entry) error
+
+// GetStatus asks a peer for the height of its store.
+type GetStatus struct{}
+
+// Status holds the height of the store of a peer.
+type Status struct {
+	Height uint64
+}
+
+// GetBlocks asks a peer for the blocks from height From up to, but without,
+// height To.
+type GetBlocks struct {
+	From uint64
+	To   uint64
+}
+
+// Blocks holds the first blocks of a GetBlocks with their signatures.
+type Blocks struct {
+	From    uint64
+	Entries []blockstore.Entry
+}
+
+// Finish tells the peers that the sync is over.
+type Finish struct{}
+
+// Fetcher downloads the blocks missing in a store from the peers, which are
+// numbered from 0.
+type Fetcher struct {
+	// Store is the store to fetch the blocks for
+	Store *blockstore.Store
+	// Verify is called for every block before it is stored
+	Verify VerifyFunction
+	// OnBlock is called with every stored block
+	OnBlock   func(*blockstore.Entry)
+	ChunkSize int
+	Timeout   time.Duration
+	MaxBlocks uint64
+
+	peers  int
+	send   func(peer int, msg interface{}) error
+	status chan peerStatus
+	blocks chan peerBlocks
+	done   chan struct{}
+}
+
+// peerStatus is a Status with the peer that sent it
+type peerStatus struct {
+	peer   int
+	height uint64
+}
+
+// peerBlocks is a Blocks with the peer that sent it
+type peerBlocks struct {
+	peer int
+	*Blocks
+}
+
+// span are the heights from up to, but without, to
+type span struct {
+	from uint64
+	to   uint64
+}
+
+// request is a span being downloaded from a peer
+type request struct {
+	span
+	deadline time.Time
+}
+
+// NewFetcher returns a Fetcher for the store that sends its requests to the
+// given number of peers with send.
+func NewFetcher(store *blockstore.Store, peers int,
+	send func(peer int, msg interface{}) error) *Fetcher {
+	return &Fetcher{
+		Store:     store,
+		ChunkSize: DefaultChunkSize,
+		Timeout:   DefaultTimeout,
+		MaxBlocks: DefaultMaxBlocks,
+		peers:     peers,
+		send:      send,
+		status:    make(chan peerStatus, peers),
+		blocks:    make(chan peerBlocks, peers),
+		done:      make(chan struct{}),
+	}
+}
+
+// ReceiveStatus passes the Status sent by a peer to the Fetcher.
+func (f *Fetcher) ReceiveStatus(peer int, s *Status) {
+	select {
+	case f.status <- peerStatus{peer, s.Height}:
+	case <-f.done:
+	}
+}
+
+// ReceiveBlocks passes the Blocks sent by a peer to the Fetcher.
+func (f *Fetcher) ReceiveBlocks(peer int, b *Blocks) {
+	select {
+	case f.blocks <- peerBlocks{peer, b}:
+	case <-f.done:
+	}
+}
+
+// Fetch downloads and stores the blocks the peers have and the store
+// doesn't. It returns the number of stored blocks and can only be called
+// once.
+func (f *Fetcher) Fetch() (uint64, error) {
+	defer close(f.done)
+	if f.Store == nil {
+		return 0, errors.New("no store to sync")
+	}
+	if f.Verify == nil {
+		return 0, errors.New("no verification function")
+	}
+	if f.Timeout <= 0 {
+		f.Timeout = DefaultTimeout
+	}
+	chunk := uint64(f.ChunkSize)
+	if chunk == 0 {
+		chunk = DefaultChunkSize
+	}
+	for peer := 0; peer < f.peers; peer++ {
+		if err := f.send(peer, &GetStatus{}); err != nil {
+			log.Lvl2("Couldn't ask peer", peer, err)
+		}
+	}
+	heights := make(map[int]uint64)
+	timeout := time.After(f.Timeout)
+collect:
+	for len(heights) < f.peers {
+		select {
+		case s := <-f.status:
+			heights[s.peer] = s.height
+		case <-f.blocks:
+			// nothing has been asked yet
+		case <-timeout:
+			break collect
+		}
+	}
+
+	first := f.Store.Len()
+	target := f.target(heights, first)
+	if target <= first {
+		log.Lvl2("Up to date at height", first)
+		return 0, nil
+	}
+	log.Lvl2("Syncing blocks", first, "to", target)
+
+	// cursor is the first height that hasn't been asked yet, retry holds
+	// the spans that have to be asked again
+	cursor := first
+	var retry []span
+	// take returns the next span that a peer of the given height has
+	take := func(height uint64) (span, bool) {
+		for i, s := range retry {
+			if s.to > s.from+chunk {
+				s.to = s.from + chunk
+			}
+			if height < s.to {
+				continue
+			}
+			if s.to == retry[i].to {
+				retry = append(retry[:i], retry[i+1:]...)
+			} else {
+				retry[i].from = s.to
+			}
+			return s, true
+		}
+		to := cursor + chunk
+		if to > target {
+			to = target
+		}
+		if cursor >= target || height < to {
+			return span{}, false
+		}
+		s := span{cursor, to}
+		cursor = to
+		return s, true
+	}
+
+	busy := make(map[int]request)
+	banned := make(map[int]bool)
+	// source holds the peer each downloaded block comes from
+	source := make(map[uint64]int)
+	received := make(map[uint64]*blockstore.Entry)
+	prev, err := f.Store.Last()
+	if err != nil {
+		return 0, err
+	}
+	ticker := time.NewTicker(f.Timeout / 10)
+	defer ticker.Stop()
+
+	next := first
+	for next < target {
+		// every free peer gets the first span it has all blocks of
+		for peer := 0; peer < f.peers; peer++ {
+			if _, ok := busy[peer]; ok || banned[peer] {
+				continue
+			}
+			s, ok := take(heights[peer])
+			if !ok {
+				continue
+			}
+			if err := f.send(peer, &GetBlocks{From: s.from, To: s.to}); err != nil {
+				log.Lvl2("Couldn't ask peer", peer, err)
+				banned[peer] = true
+				retry = append(retry, s)
+				continue
+			}
+			busy[peer] = request{s, time.Now().Add(f.Timeout)}
+		}
+		if len(busy) == 0 {
+			return next - first, fmt.Errorf("no peer left to sync blocks %d to %d",
+				next, target)
+		}
+
+		select {
+		case msg := <-f.blocks:
+			req, ok := busy[msg.peer]
+			if !ok || req.from != msg.From {
+				// a late answer of a peer that timed out
+				continue
+			}
+			delete(busy, msg.peer)
+			if err := checkChunk(msg.Entries, req.span); err != nil {
+				log.Lvl2("Invalid blocks from peer", msg.peer, err)
+				banned[msg.peer] = true
+				retry = append(retry, req.span)
+				continue
+			}
+			for i := range msg.Entries {
+				received[msg.Entries[i].Height] = &msg.Entries[i]
+				source[msg.Entries[i].Height] = msg.peer
+			}
+			if rest := req.from + uint64(len(msg.Entries)); rest < req.to {
+				// the answer has been cut at MaxChunkBytes
+				retry = append(retry, span{rest, req.to})
+			}
+		case <-f.status:
+			// the heights have been collected
+		case <-ticker.C:
+			now := time.Now()
+			for peer, req := range busy {
+				if now.After(req.deadline) {
+					log.Lvl2("Peer", peer, "timed out on blocks", req.from,
+						"to", req.to)
+					banned[peer] = true
+					retry = append(retry, req.span)
+					delete(busy, peer)
+				}
+			}
+		}
+
+		// store the received blocks in order
+		for next < target {
+			e, ok := received[next]
+			if !ok {
+				break
+			}
+			if err := f.Verify(prev, e); err != nil {
+				bad := source[next]
+				log.Lvl2("Block", next, "of peer", bad, "doesn't verify:", err)
+				banned[bad] = true
+				if req, ok := busy[bad]; ok {
+					retry = append(retry, req.span)
+					delete(busy, bad)
+				}
+				// all blocks of the peer go to other peers
+				for h := next; h < target; h++ {
+					if _, ok := received[h]; !ok || source[h] != bad {
+						continue
+					}
+					delete(received, h)
+					if n := len(retry); n > 0 && retry[n-1].to == h {
+						retry[n-1].to++
+					} else {
+						retry = append(retry, span{h, h + 1})
+					}
+				}
+				break
+			}
+			if err := f.Store.Append(e); err != nil {
+				return next - first, err
+			}
+			if f.OnBlock != nil {
+				f.OnBlock(e)
+			}
+			delete(received, next)
+			delete(source, next)
+			prev = e
+			next++
+		}
+	}
+	return next - first, nil
+}
+
+// target returns the height to sync to: the highest height claimed by more
+// than a third of the peers, so that a lying peer can't make us wait for
+// blocks that don't exist, and at most MaxBlocks above first.
+func (f *Fetcher) target(heights map[int]uint64, first uint64) uint64 {
+	faulty := f.peers / 3
+	target := first
+	for _, h := range heights {
+		claims := 0
+		for _, other := range heights {
+			if other >= h {
+				claims++
+			}
+		}
+		if claims > faulty && h > target {
+			target = h
+		}
+	}
+	max := f.MaxBlocks
+	if max == 0 {
+		max = DefaultMaxBlocks
+	}
+	if target-first > max {
+		target = first + max
+	}
+	return target
+}
+
+// StatusOf returns the Status of the store, which may be nil.
+func StatusOf(store *blockstore.Store) *Status {
+	if store == nil {
+		return &Status{}
+	}
+	return &Status{Height: store.Len()}
+}
+
+// BlocksOf returns the blocks of the store, which may be nil, asked by req.
+// It stops before the blocks exceed MaxChunkBytes, but returns at least one
+// block.
+func BlocksOf(store *blockstore.Store, req *GetBlocks) *Blocks {
+	reply := &Blocks{From: req.From}
+	if store == nil {
+		return reply
+	}
+	to := req.To
+	if height := store.Len(); to > height {
+		to = height
+	}
+	size := 0
+	for h := req.From; h < to; h++ {
+		e, err := store.Get(h)
+		if err != nil {
+			log.Error("Couldn't read block", h, ":", err)
+			break
+		}
+		size += len(e.Hash) + len(e.Block) + len(e.Signature) + len(e.Mask)
+		if size > MaxChunkBytes && len(reply.Entries) > 0 {
+			break
+		}
+		reply.Entries = append(reply.Entries, *e)
+	}
+	return reply
+}
+
+// checkChunk returns an error if the entries aren't the first complete
+// blocks of the span, at least one.
+func checkChunk(entries []blockstore.Entry, s span) error {
+	if len(entries) == 0 || uint64(len(entries)) > s.to-s.from {
+		return fmt.Errorf("got %d blocks for %d", len(entries), s.to-s.from)
+	}
+	for i, e := range entries {
+		if e.Height != s.from+uint64(i) {
+			return fmt.Errorf("got height %d instead of %d", e.Height,
+				s.from+uint64(i))
+		}
+		if len(e.Block) == 0 {
+			return fmt.Errorf("block %d is pruned", e.Height)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package fetch
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/csanti/pbft-experiments/cothority/log"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain/blockstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	log.MainTest(m)
+}
+
+// chain returns n blocks of size bytes linked by their hashes, with the
+// hash of the hash as signature.
+func chain(n, size int) []*blockstore.Entry {
+	var entries []*blockstore.Entry
+	var prev []byte
+	for i := 0; i < n; i++ {
+		block := make([]byte, size)
+		copy(block, "block "+strconv.Itoa(i))
+		hash := sha256.Sum256(append(prev, block...))
+		sig := sha256.Sum256(hash[:])
+		entries = append(entries, &blockstore.Entry{
+			Height:    uint64(i),
+			Hash:      hash[:],
+			Block:     block,
+			Signature: sig[:],
+		})
+		prev = hash[:]
+	}
+	return entries
+}
+
+func verify(prev, e *blockstore.Entry) error {
+	var parent []byte
+	if prev != nil {
+		parent = prev.Hash
+	}
+	hash := sha256.Sum256(append(append([]byte{}, parent...), e.Block...))
+	sig := sha256.Sum256(hash[:])
+	if !bytes.Equal(hash[:], e.Hash) || !bytes.Equal(sig[:], e.Signature) {
+		return errors.New("wrong block")
+	}
+	return nil
+}
+
+// peer answers the requests of a Fetcher from its store, or lies about its
+// height.
+type peer struct {
+	store  *blockstore.Store
+	height uint64
+}
+
+func TestFetcher_Fetch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fetch")
+	log.ErrFatal(err)
+	defer os.RemoveAll(dir)
+	open := func(name string, blocks []*blockstore.Entry) *blockstore.Store {
+		s, err := blockstore.Open(filepath.Join(dir, name))
+		log.ErrFatal(err)
+		for _, e := range blocks {
+			log.ErrFatal(s.Append(e))
+		}
+		return s
+	}
+
+	// the blocks are big enough that an answer holds only two of them
+	blocks := chain(12, MaxChunkBytes/2-100)
+	bad := make([]*blockstore.Entry, len(blocks))
+	for i, e := range blocks {
+		wrong := *e
+		wrong.Block = []byte("bad")
+		bad[i] = &wrong
+	}
+	local := open("local", blocks[:2])
+	defer local.Close()
+	peers := []*peer{
+		{store: open("0", blocks)},
+		{store: open("1", blocks)},
+		{store: open("2", bad[:10])},
+		// claims blocks nobody else has
+		{store: open("3", nil), height: 1000000},
+	}
+	for _, p := range peers {
+		defer p.store.Close()
+	}
+
+	var f *Fetcher
+	f = NewFetcher(local, len(peers), func(i int, msg interface{}) error {
+		p := peers[i]
+		go func() {
+			switch m := msg.(type) {
+			case *GetStatus:
+				s := StatusOf(p.store)
+				if p.height > 0 {
+					s.Height = p.height
+				}
+				f.ReceiveStatus(i, s)
+			case *GetBlocks:
+				f.ReceiveBlocks(i, BlocksOf(p.store, m))
+			}
+		}()
+		return nil
+	})
+	f.Verify = verify
+	f.ChunkSize = 4
+	f.Timeout = time.Second
+	var got int
+	f.OnBlock = func(*blockstore.Entry) { got++ }
+	n, err := f.Fetch()
+	log.ErrFatal(err)
+	assert.Equal(t, uint64(len(blocks)-2), n)
+	assert.Equal(t, len(blocks)-2, got)
+	assert.Equal(t, uint64(len(blocks)), local.Len())
+	for _, e := range blocks {
+		stored, err := local.Get(e.Height)
+		log.ErrFatal(err)
+		assert.Equal(t, e.Hash, stored.Hash)
+	}
+}
+
+func TestFetcher_Target(t *testing.T) {
+	f := NewFetcher(nil, 4, nil)
+	// one liar out of four isn't believed
+	assert.Equal(t, uint64(10), f.target(map[int]uint64{0: 10, 1: 10, 2: 5,
+		3: 1000}, 3))
+	// two peers have the blocks
+	assert.Equal(t, uint64(20), f.target(map[int]uint64{0: 20, 1: 20, 2: 5,
+		3: 5}, 3))
+	f.MaxBlocks = 7
+	assert.Equal(t, uint64(10), f.target(map[int]uint64{0: 20, 1: 20}, 3))
+	assert.Equal(t, uint64(3), f.target(map[int]uint64{0: 1}, 3))
+}
+
+func TestBlocksOf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fetch")
+	log.ErrFatal(err)
+	defer os.RemoveAll(dir)
+	s, err := blockstore.Open(filepath.Join(dir, "store"))
+	log.ErrFatal(err)
+	defer s.Close()
+	for _, e := range chain(5, MaxChunkBytes/3) {
+		log.ErrFatal(s.Append(e))
+	}
+	assert.Equal(t, 2, len(BlocksOf(s, &GetBlocks{0, 5}).Entries))
+	assert.Equal(t, 1, len(BlocksOf(s, &GetBlocks{4, 50}).Entries))
+	assert.Equal(t, 0, len(BlocksOf(nil, &GetBlocks{0, 5}).Entries))
+}
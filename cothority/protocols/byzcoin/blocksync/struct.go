@@ -0,0 +1,41 @@
+package blocksync
+
+import (
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blocksync/fetch"
+	"github.com/csanti/pbft-experiments/cothority/sda"
+)
+
+// StructGetStatus just contains GetStatus and the data necessary to identify
+// and process the message in the sda framework.
+type StructGetStatus struct {
+	*sda.TreeNode
+	fetch.GetStatus
+}
+
+// StructStatus just contains Status and the data necessary to identify and
+// process the message in the sda framework.
+type StructStatus struct {
+	*sda.TreeNode
+	fetch.Status
+}
+
+// StructGetBlocks just contains GetBlocks and the data necessary to identify
+// and process the message in the sda framework.
+type StructGetBlocks struct {
+	*sda.TreeNode
+	fetch.GetBlocks
+}
+
+// StructBlocks just contains Blocks and the data necessary to identify and
+// process the message in the sda framework.
+type StructBlocks struct {
+	*sda.TreeNode
+	fetch.Blocks
+}
+
+// StructFinish just contains Finish and the data necessary to identify and
+// process the message in the sda framework.
+type StructFinish struct {
+	*sda.TreeNode
+	fetch.Finish
+}
@@ -12,6 +12,7 @@ import (
 
 	"github.com/csanti/pbft-experiments/cothority/log"
 	"github.com/csanti/pbft-experiments/cothority/monitor"
+	"github.com/csanti/pbft-experiments/cothority/network"
 	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain"
 	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain/blkparser"
 	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/cosi"
@@ -44,6 +45,8 @@ type ByzCoin struct {
 	challengeCommitChan chan challengeCommitChan
 	// channel for response
 	responseChan chan responseChan
+	// channel for the final signature of the commit round
+	committedChan chan committedChan
 	// channel to notify when we are done
 	done chan bool
 	// channel to notify when the prepare round is finished
@@ -59,6 +62,9 @@ type ByzCoin struct {
 	// transactions is the slice of transactions that contains transactions
 	// coming from clients
 	transactions []blkparser.Tx
+	// mempool of the server the transactions come from, they are removed
+	// once the block is committed. Only set for the root.
+	mempool *blockchain.Mempool
 	// last block computed
 	lastBlock string
 	// last key block computed
@@ -170,6 +176,9 @@ func NewByzCoinProtocol(n *sda.TreeNodeInstance) (*ByzCoin, error) {
 	if err := n.RegisterChannel(&bz.responseChan); err != nil {
 		return bz, err
 	}
+	if err := n.RegisterChannel(&bz.committedChan); err != nil {
+		return bz, err
+	}
 	if err := n.RegisterChannel(&bz.viewchangeChan); err != nil {
 		return bz, err
 	}
@@ -242,6 +251,10 @@ func (bz *ByzCoin) listen() {
 					err = bz.handleResponseCommit(&msg.Response)
 				}
 			}
+		case msg := <-bz.committedChan:
+			if !fail {
+				err = bz.handleCommitted(&msg.Committed)
+			}
 		case timeout := <-bz.timeoutChan:
 			// start the timer
 			if timeoutStarted {
@@ -429,7 +442,7 @@ func (bz *ByzCoin) startChallengePrepare() error {
 		TrBlock:   trblock,
 	}
 
-	go VerifyBlock(bz.tempBlock, bz.lastBlock, bz.lastKeyBlock, bz.verifyBlockChan)
+	go VerifyBlock(bz.tempBlock, bz.lastBlock, bz.lastKeyBlock, UTXOSet(bz.TreeNodeInstance), bz.verifyBlockChan)
 	log.Lvl3(bz.Name(), "ByzCoin Start Challenge PREPARE")
 	// send to children
 	for _, tn := range bz.Children() {
@@ -470,7 +483,7 @@ func (bz *ByzCoin) startChallengeCommit() error {
 func (bz *ByzCoin) handleChallengePrepare(ch *ChallengePrepare) error {
 	bz.tempBlock = ch.TrBlock
 	// start the verification of the block
-	go VerifyBlock(bz.tempBlock, bz.lastBlock, bz.lastKeyBlock, bz.verifyBlockChan)
+	go VerifyBlock(bz.tempBlock, bz.lastBlock, bz.lastKeyBlock, UTXOSet(bz.TreeNodeInstance), bz.verifyBlockChan)
 	// acknowledge the challenge and send its down
 	chal := bz.prepare.Challenge(ch.Challenge)
 	ch.Challenge = chal
@@ -566,10 +579,8 @@ func (bz *ByzCoin) startResponseCommit() error {
 		bzr.Response = resp
 	}
 	log.Lvl3(bz.Name(), "ByzCoin Start Response COMMIT")
-	// send to parent
-	err := bz.SendTo(bz.Parent(), bzr)
-	bz.Done()
-	return err
+	// send to parent, we are done once the signature is committed
+	return bz.SendTo(bz.Parent(), bzr)
 }
 
 // handleResponseCommit handles the responses for the commit round during the
@@ -609,19 +620,53 @@ func (bz *ByzCoin) handleResponseCommit(bzr *Response) error {
 		if bz.onResponseCommitDone != nil {
 			bz.onResponseCommitDone()
 		}
+		err := bz.sendCommitted(&Committed{
+			Signature:  sig.Sig,
+			Exceptions: sig.Exceptions,
+		})
 		if bz.onSignatureDone != nil {
 			bz.onSignatureDone(sig)
 		}
 		bz.Done()
-		return nil
+		return err
 	}
 
-	// otherwise , send the response up
-	err := bz.SendTo(bz.Parent(), bzr)
+	// otherwise , send the response up and wait for the final signature
+	return bz.SendTo(bz.Parent(), bzr)
+}
+
+// handleCommitted verifies the final signature of the commit round sent by
+// the root, then commits the block and sends the signature down the tree.
+func (bz *ByzCoin) handleCommitted(c *Committed) error {
+	err := bz.sendCommitted(c)
 	bz.Done()
 	return err
 }
 
+// sendCommitted commits the block if the signature of the commit round is
+// correct and forwards it to the children.
+func (bz *ByzCoin) sendCommitted(c *Committed) error {
+	sig := &BlockSignature{
+		Sig:        c.Signature,
+		Block:      bz.tempBlock,
+		Exceptions: c.Exceptions,
+	}
+	if err := verifyBlockSignature(bz.suite, bz.aggregatedPublic, sig); err != nil {
+		log.Error(bz.Name(), "Verification of the final signature failed:", err)
+	} else if len(c.Exceptions) > bz.threshold {
+		log.Errorf("More than 1/3 (%d/%d) refused to sign ! Not committing", len(c.Exceptions), len(bz.Roster().List))
+	} else {
+		bz.commitBlock()
+	}
+	var err error
+	for _, tn := range bz.Children() {
+		if e := bz.SendTo(tn, c); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
 func (bz *ByzCoin) handleResponsePrepare(bzr *Response) error {
 	// check if we have enough
 	bz.tprMut.Lock()
@@ -681,26 +726,65 @@ func (bz *ByzCoin) waitResponseVerification() (*Response, bool) {
 	return bzr, true
 }
 
-// VerifyBlock is a simulation of a real verification block algorithm
-func VerifyBlock(block *blockchain.TrBlock, lastBlock, lastKeyBlock string, done chan bool) {
-	//We measure the average block verification delays is 174ms for an average
-	//block of 500kB.
-	//To simulate the verification cost of bigger blocks we multiply 174ms
-	//times the size/500*1024
-	b, _ := json.Marshal(block)
-	s := len(b)
-	var n time.Duration
-	n = time.Duration(s / (500 * 1024))
-	time.Sleep(150 * time.Millisecond * n) //verification of 174ms per 500KB simulated
+// VerifyBlock checks the header of the block and verifies its transactions
+// against the unspent outputs of utxo.
+func VerifyBlock(block *blockchain.TrBlock, lastBlock, lastKeyBlock string, utxo *blockchain.UTXOSet, done chan bool) {
 	// verification of the header
 	verified := block.Header.Parent == lastBlock && block.Header.ParentKey == lastKeyBlock
 	verified = verified && block.Header.MerkleRoot == blockchain.HashRootTransactions(block.TransactionList)
 	verified = verified && block.HeaderHash == blockchain.HashHeader(block.Header)
+	// verification of the transactions
+	if verified {
+		if err := utxo.Verify(block.TransactionList); err != nil {
+			log.Lvl2("Invalid transaction:", err)
+			verified = false
+		}
+	}
 	// notify it
 	log.Lvl3("Verification of the block done =", verified)
 	done <- verified
 }
 
+// UTXOSet returns the unspent outputs of the host n runs on. As a new
+// ByzCoin is created for every block, the sets are kept here.
+func UTXOSet(n *sda.TreeNodeInstance) *blockchain.UTXOSet {
+	utxoSetsMut.Lock()
+	defer utxoSetsMut.Unlock()
+	id := n.ServerIdentity().ID
+	if utxoSets[id] == nil {
+		utxoSets[id] = blockchain.NewUTXOSet()
+	}
+	return utxoSets[id]
+}
+
+// setUTXOSet makes utxo the unspent outputs of the host n runs on. It fails
+// if the host already uses other unspent outputs.
+func setUTXOSet(n *sda.TreeNodeInstance, utxo *blockchain.UTXOSet) error {
+	utxoSetsMut.Lock()
+	defer utxoSetsMut.Unlock()
+	id := n.ServerIdentity().ID
+	if u, ok := utxoSets[id]; ok && u != utxo {
+		return errors.New("host already has unspent outputs")
+	}
+	utxoSets[id] = utxo
+	return nil
+}
+
+var utxoSets = make(map[network.ServerIdentityID]*blockchain.UTXOSet)
+var utxoSetsMut sync.Mutex
+
+// commitBlock adds the block to the unspent outputs of this host, once the
+// signature of the commit-round is complete.
+func (bz *ByzCoin) commitBlock() {
+	if err := UTXOSet(bz.TreeNodeInstance).Commit(bz.tempBlock.TransactionList); err != nil {
+		log.Error(bz.Name(), "Couldn't commit block:", err)
+		return
+	}
+	if bz.mempool != nil {
+		bz.mempool.Remove(bz.tempBlock.Txs...)
+	}
+}
+
 // GetBlock returns the next block available from the transaction pool.
 func GetBlock(transactions []blkparser.Tx, lastBlock, lastKeyBlock string) (*blockchain.TrBlock, error) {
 	if len(transactions) < 1 {
@@ -9,6 +9,7 @@ import (
 	"github.com/csanti/pbft-experiments/cothority/monitor"
 	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain"
 	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/cosi"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/gossip"
 	"github.com/csanti/pbft-experiments/cothority/protocols/manage"
 	"github.com/csanti/pbft-experiments/cothority/sda"
 	"gopkg.in/dedis/crypto.v0/abstract"
@@ -40,6 +41,39 @@ type SimulationConfig struct {
 	// 1 fail by doing nothing
 	// 2 fail by sending wrong blocks
 	Fail uint
+	// Gossip makes the client send the transactions to the gossip of the
+	// root, which spreads them to the mempools of all nodes
+	Gossip             bool
+	GossipFanout       int
+	GossipTTL          int
+	GossipBatchSize    int
+	GossipBatchDelayMs int
+	// Workload describes the transactions sent by the client
+	blockchain.Workload
+}
+
+// startGossip starts the gossip on the tree, passing the transactions to the
+// server of the root.
+func (sc *SimulationConfig) startGossip(sdaConf *sda.SimulationConfig, server *Server) (*gossip.Gossip, error) {
+	pi, err := sdaConf.Overlay.CreateProtocolSDA(gossip.Name, sdaConf.Tree)
+	if err != nil {
+		return nil, err
+	}
+	g := pi.(*gossip.Gossip)
+	if sc.GossipFanout > 0 {
+		g.Fanout = sc.GossipFanout
+	}
+	if sc.GossipTTL > 0 {
+		g.TTL = sc.GossipTTL
+	}
+	if sc.GossipBatchSize > 0 {
+		g.BatchSize = sc.GossipBatchSize
+	}
+	if sc.GossipBatchDelayMs > 0 {
+		g.BatchDelayMs = sc.GossipBatchDelayMs
+	}
+	g.OnTransaction(server.AddTransaction)
+	return g, g.Start()
 }
 
 // NewSimulation returns a fresh byzcoin simulation out of the toml config
@@ -52,17 +86,12 @@ func NewSimulation(config string) (sda.Simulation, error) {
 	return es, nil
 }
 
-// Setup implements sda.Simulation interface. It checks on the availability
-// of the block-file and downloads it if missing. Then the block-file will be
-// copied to the simulation-directory
+// Setup implements sda.Simulation interface. The transactions are created by
+// the client, so no block-file is needed.
 func (e *Simulation) Setup(dir string, hosts []string) (*sda.SimulationConfig, error) {
-	err := blockchain.EnsureBlockIsAvailable(dir)
-	if err != nil {
-		log.Fatal("Couldn't get block:", err)
-	}
 	sc := &sda.SimulationConfig{}
 	e.CreateRoster(sc, hosts, 2000)
-	err = e.CreateTree(sc)
+	err := e.CreateTree(sc)
 	if err != nil {
 		return nil, err
 	}
@@ -105,26 +134,30 @@ func (e *Simulation) Run(sdaConf *sda.SimulationConfig) error {
 	// wait
 	<-broadDone
 
-	for round := 0; round < e.Rounds; round++ {
-		client := NewClient(server)
-		err := client.StartClientSimulation(blockchain.GetBlockDir(), e.Blocksize)
+	// the client sends the transactions of the workload during all rounds
+	var sink TransactionSink = server
+	if e.Gossip {
+		g, err := e.startGossip(sdaConf, server)
 		if err != nil {
-			log.Error("Error in ClientSimulation:", err)
 			return err
 		}
-
+		defer g.Stop()
+		sink = g
+	}
+	client := NewClient(sink, e.Workload)
+	client.StartClientSimulation()
+	defer client.Stop()
+	for round := 0; round < e.Rounds; round++ {
 		log.Lvl1("Starting round", round)
 		// create an empty node
 		tni := sdaConf.Overlay.NewTreeNodeInstanceFromProtoName(sdaConf.Tree, "ByzCoin")
-		if err != nil {
-			return err
-		}
-		// instantiate a byzcoin protocol
-		rComplete := monitor.NewTimeMeasure("round")
+		// instantiate a byzcoin protocol, which waits for enough
+		// transactions of the workload
 		pi, err := server.Instantiate(tni)
 		if err != nil {
 			return err
 		}
+		rComplete := monitor.NewTimeMeasure("round")
 		sdaConf.Overlay.RegisterProtocolInstance(pi)
 
 		bz := pi.(*ByzCoin)
@@ -134,6 +167,7 @@ func (e *Simulation) Run(sdaConf *sda.SimulationConfig) error {
 				log.Error("Round", round, "failed:", err)
 			} else {
 				log.Lvl2("Round", round, "success")
+				client.Committed(len(sig.Block.Txs))
 			}
 
 		})
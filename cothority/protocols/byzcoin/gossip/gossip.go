@@ -0,0 +1,310 @@
+// Package gossip spreads the transactions of clients to the mempools of all
+// nodes. Every node sends the transactions it sees for the first time in
+// batches to Fanout random nodes, until they travelled TTL hops. Every node
+// measures how long the transactions took to reach it and reports the
+// percentiles to the monitor when the gossip stops.
+package gossip
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/csanti/pbft-experiments/cothority/log"
+	"github.com/csanti/pbft-experiments/cothority/monitor"
+	"github.com/csanti/pbft-experiments/cothority/network"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain/blkparser"
+	"github.com/csanti/pbft-experiments/cothority/sda"
+)
+
+// Name of the protocol
+const Name = "TxGossip"
+
+func init() {
+	network.RegisterPacketType(Rumor{})
+	network.RegisterPacketType(Stop{})
+	sda.ProtocolRegisterName(Name, NewGossip)
+}
+
+// DefaultConfig is the config of a new root.
+var DefaultConfig = Config{
+	Fanout:       3,
+	TTL:          5,
+	BatchSize:    100,
+	BatchDelayMs: 50,
+}
+
+// Gossip runs on every node as long as the root doesn't stop it.
+type Gossip struct {
+	*sda.TreeNodeInstance
+	Config
+	// mempool of the node the transactions are added to
+	mempool       *blockchain.Mempool
+	onTransaction func(blkparser.Tx)
+	seen          map[string]bool
+	pending       []pending
+	// delays of the transactions first seen in a rumor
+	delays  []time.Duration
+	started bool
+	full    chan bool
+	stop    chan bool
+	sync.Mutex
+}
+
+// pending is a transaction waiting for the next batch
+type pending struct {
+	tx      blkparser.Tx
+	created int64
+	hops    int
+}
+
+// NewGossip returns the gossip of a node, adding the transactions to the
+// mempool of the node.
+func NewGossip(n *sda.TreeNodeInstance) (sda.ProtocolInstance, error) {
+	g := &Gossip{
+		TreeNodeInstance: n,
+		Config:           DefaultConfig,
+		mempool:          blockchain.NodeMempool(n.ServerIdentity().ID.String()),
+		seen:             make(map[string]bool),
+		full:             make(chan bool, 1),
+		stop:             make(chan bool),
+	}
+	if err := g.RegisterHandlers(g.HandleRumor, g.HandleStop); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Start starts sending batches on the root.
+func (g *Gossip) Start() error {
+	g.start()
+	return nil
+}
+
+// OnTransaction registers a function called with every new transaction,
+// e.g. to pass them to a ByzCoin server.
+func (g *Gossip) OnTransaction(f func(blkparser.Tx)) {
+	g.Lock()
+	defer g.Unlock()
+	g.onTransaction = f
+}
+
+// AddTransaction is called by a client connected to this node. The
+// transaction enters the network here.
+func (g *Gossip) AddTransaction(tx blkparser.Tx) {
+	g.Lock()
+	if g.seen[tx.Hash] {
+		g.Unlock()
+		return
+	}
+	g.seen[tx.Hash] = true
+	g.pending = append(g.pending, pending{tx, time.Now().UnixNano(), g.TTL})
+	g.Unlock()
+	g.deliver(tx)
+	g.start()
+	g.checkFull()
+}
+
+// HandleRumor adds the new transactions of the batch and passes them on.
+func (g *Gossip) HandleRumor(msg StructRumor) error {
+	var fresh []blkparser.Tx
+	now := time.Now()
+	g.Lock()
+	if !g.started {
+		g.Config = msg.Config
+	}
+	for i, tx := range msg.Txs {
+		if g.seen[tx.Hash] {
+			continue
+		}
+		g.seen[tx.Hash] = true
+		fresh = append(fresh, tx)
+		var created int64
+		if i < len(msg.Created) {
+			created = msg.Created[i]
+			g.delays = append(g.delays, now.Sub(time.Unix(0, created)))
+		}
+		if msg.Hops > 1 {
+			g.pending = append(g.pending, pending{tx, created, msg.Hops - 1})
+		}
+	}
+	g.Unlock()
+	for _, tx := range fresh {
+		g.deliver(tx)
+	}
+	g.start()
+	g.checkFull()
+	return nil
+}
+
+// Stop is called on the root to stop the gossip on all nodes.
+func (g *Gossip) Stop() error {
+	for _, tn := range g.List() {
+		if tn.ID.Equal(g.TreeNode().ID) {
+			continue
+		}
+		if err := g.SendTo(tn, &Stop{}); err != nil {
+			log.Error("Couldn't stop", tn.ServerIdentity, err)
+		}
+	}
+	return g.HandleStop(StructStop{g.TreeNode(), Stop{}})
+}
+
+// HandleStop reports the delays to the monitor and stops the gossip.
+func (g *Gossip) HandleStop(msg StructStop) error {
+	g.Lock()
+	if g.stop != nil {
+		close(g.stop)
+		g.stop = nil
+	}
+	delays := g.delays
+	g.Unlock()
+	report(delays)
+	g.Done()
+	return nil
+}
+
+// Delays returns the delays of all transactions the node got in a rumor.
+func (g *Gossip) Delays() []time.Duration {
+	g.Lock()
+	defer g.Unlock()
+	return append([]time.Duration{}, g.delays...)
+}
+
+// deliver adds the transaction to the mempool and passes it on to the
+// registered function.
+func (g *Gossip) deliver(tx blkparser.Tx) {
+	g.mempool.Add(tx)
+	g.Lock()
+	f := g.onTransaction
+	g.Unlock()
+	if f != nil {
+		f(tx)
+	}
+}
+
+// start starts sending batches, once.
+func (g *Gossip) start() {
+	g.Lock()
+	defer g.Unlock()
+	if g.started || g.stop == nil {
+		return
+	}
+	g.started = true
+	delay := time.Duration(g.BatchDelayMs) * time.Millisecond
+	if delay <= 0 {
+		delay = time.Millisecond
+	}
+	go g.run(delay, g.stop)
+}
+
+// checkFull sends the batch right away if it is full.
+func (g *Gossip) checkFull() {
+	g.Lock()
+	full := len(g.pending) >= g.BatchSize
+	g.Unlock()
+	if full {
+		select {
+		case g.full <- true:
+		default:
+		}
+	}
+}
+
+// run sends the pending transactions every delay or when the batch is full.
+func (g *Gossip) run(delay time.Duration, stop chan bool) {
+	ticker := time.NewTicker(delay)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-g.full:
+		case <-stop:
+			return
+		}
+		g.send()
+	}
+}
+
+// send sends the pending transactions to Fanout random nodes.
+func (g *Gossip) send() {
+	g.Lock()
+	batch := g.pending
+	g.pending = nil
+	config := g.Config
+	g.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	// transactions with different hops left are sent in different rumors
+	rumors := make(map[int]*Rumor)
+	for _, p := range batch {
+		r, ok := rumors[p.hops]
+		if !ok {
+			r = &Rumor{Config: config, Hops: p.hops}
+			rumors[p.hops] = r
+		}
+		r.Txs = append(r.Txs, p.tx)
+		r.Created = append(r.Created, p.created)
+	}
+	for _, r := range rumors {
+		for _, tn := range g.peers(config.Fanout) {
+			if err := g.SendTo(tn, r); err != nil {
+				log.Lvl2(g.ServerIdentity(), "couldn't send rumor:", err)
+			}
+		}
+	}
+}
+
+// peers returns n random nodes other than us.
+func (g *Gossip) peers(n int) []*sda.TreeNode {
+	var others []*sda.TreeNode
+	for _, tn := range g.List() {
+		if !tn.ID.Equal(g.TreeNode().ID) {
+			others = append(others, tn)
+		}
+	}
+	for i, j := range rand.Perm(len(others)) {
+		others[i], others[j] = others[j], others[i]
+	}
+	if n < len(others) {
+		others = others[:n]
+	}
+	return others
+}
+
+// report sends the percentiles of the delays in milliseconds to the monitor.
+func report(delays []time.Duration) {
+	if len(delays) == 0 {
+		return
+	}
+	sorted := append([]time.Duration{}, delays...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for _, p := range []struct {
+		name string
+		p    float64
+	}{{"gossip_delay_p50", 0.5}, {"gossip_delay_p90", 0.9}, {"gossip_delay_p99", 0.99}} {
+		ms := float64(Percentile(sorted, p.p)) / float64(time.Millisecond)
+		monitor.NewSingleMeasure(p.name, ms).Record()
+	}
+	monitor.NewSingleMeasure("gossip_received", float64(len(delays))).Record()
+}
+
+// Percentile returns the p-th percentile of the sorted delays with the
+// nearest-rank method.
+func Percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
@@ -0,0 +1,65 @@
+package gossip
+
+import (
+	"testing"
+	"time"
+
+	"github.com/csanti/pbft-experiments/cothority/log"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain"
+	"github.com/csanti/pbft-experiments/cothority/sda"
+)
+
+func TestMain(m *testing.M) {
+	log.MainTest(m)
+}
+
+func TestGossip(t *testing.T) {
+	local := sda.NewLocalTest()
+	defer local.CloseAll()
+	hosts, _, tree := local.GenTree(7, false, true, true)
+
+	pi, err := local.CreateProtocol(Name, tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := pi.(*Gossip)
+	// with a fanout of all other nodes every node gets every batch
+	g.Config = Config{Fanout: 6, TTL: 3, BatchSize: 10, BatchDelayMs: 10}
+	if err := g.Start(); err != nil {
+		t.Fatal(err)
+	}
+	txs := blockchain.NewGenerator(blockchain.Workload{WorkloadSeed: 1}).Transactions(50)
+	for _, tx := range txs {
+		g.AddTransaction(tx)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for _, h := range hosts {
+		mempool := blockchain.NodeMempool(h.ServerIdentity.ID.String())
+		for mempool.Len() < len(txs) {
+			select {
+			case <-timeout:
+				t.Fatal(h.ServerIdentity, "got only", mempool.Len(), "transactions")
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+	if err := g.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var delays []time.Duration
+	for i := 1; i <= 100; i++ {
+		delays = append(delays, time.Duration(i))
+	}
+	for p, want := range map[float64]time.Duration{0.5: 50, 0.9: 90, 0.99: 99, 1: 100, 0: 1} {
+		if got := Percentile(delays, p); got != want {
+			t.Fatal("percentile", p, "is", got, "instead of", want)
+		}
+	}
+	if Percentile(nil, 0.5) != 0 {
+		t.Fatal("percentile of no delays should be 0")
+	}
+}
@@ -0,0 +1,47 @@
+package gossip
+
+import (
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain/blkparser"
+	"github.com/csanti/pbft-experiments/cothority/sda"
+)
+
+// Config holds the parameters of the gossip. They are sent with every
+// rumor, so that only the root has to be configured.
+type Config struct {
+	// Fanout is the number of random nodes a batch is sent to
+	Fanout int
+	// TTL is the number of hops a transaction travels
+	TTL int
+	// BatchSize is the number of transactions sent together
+	BatchSize int
+	// BatchDelayMs is how long a transaction waits for a batch to fill
+	BatchDelayMs int
+}
+
+// Rumor holds a batch of transactions.
+type Rumor struct {
+	Config Config
+	// Hops is how many more hops the transactions travel
+	Hops int
+	Txs  []blkparser.Tx
+	// Created holds when each transaction entered the network, in unix
+	// nanoseconds
+	Created []int64
+}
+
+// StructRumor just contains Rumor and the data necessary to identify and
+// process the message in the sda framework.
+type StructRumor struct {
+	*sda.TreeNode
+	Rumor
+}
+
+// Stop tells all nodes to report their delays and to stop the gossip.
+type Stop struct{}
+
+// StructStop just contains Stop and the data necessary to identify and
+// process the message in the sda framework.
+type StructStop struct {
+	*sda.TreeNode
+	Stop
+}
@@ -0,0 +1,250 @@
+// Package membership changes the roster of the consensus protocols in epochs.
+// A request to join or to leave is put in the header of a block and agreed
+// by the current roster when it signs the block. The committed changes take
+// effect at the next epoch boundary, when a new epoch with the changed
+// roster starts. Schedule keeps the members of every epoch, so that the
+// signature of a block can be verified against the roster of its epoch.
+//
+// Members are identified by the string of their ServerIdentityID, so that
+// the package can be used with sda and onet rosters.
+package membership
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// MinMembers is the smallest roster that tolerates a faulty member.
+const MinMembers = 4
+
+// Change adds or removes a member.
+type Change struct {
+	// Join is true to add the member and false to remove it
+	Join   bool
+	Member string
+}
+
+// String returns the change as "+member" or "-member".
+func (c Change) String() string {
+	if c.Join {
+		return "+" + c.Member
+	}
+	return "-" + c.Member
+}
+
+// Epoch holds the members signing the blocks from height Start on, until the
+// next epoch starts.
+type Epoch struct {
+	Number  uint64
+	Start   uint64
+	Members []string
+}
+
+// Index returns the index of the member in the epoch, or -1.
+func (e *Epoch) Index(member string) int {
+	for i, m := range e.Members {
+		if m == member {
+			return i
+		}
+	}
+	return -1
+}
+
+// Threshold returns the number of members that have to sign a block, so
+// that a third of faulty members is tolerated.
+func (e *Epoch) Threshold() int {
+	return len(e.Members) - (len(e.Members)-1)/3
+}
+
+// Schedule holds all epochs and the changes committed in the current one.
+type Schedule struct {
+	epochs  []*Epoch
+	pending []Change
+	sync.Mutex
+}
+
+// NewSchedule returns a schedule with the members in epoch 0.
+func NewSchedule(members []string) *Schedule {
+	return &Schedule{
+		epochs: []*Epoch{{Members: append([]string{}, members...)}},
+	}
+}
+
+// NewScheduleFrom returns a schedule starting at the given epoch, for a node
+// joining later. The epochs before it are unknown.
+func NewScheduleFrom(e Epoch) *Schedule {
+	e.Members = append([]string{}, e.Members...)
+	return &Schedule{epochs: []*Epoch{&e}}
+}
+
+// Current returns the current epoch.
+func (s *Schedule) Current() *Epoch {
+	s.Lock()
+	defer s.Unlock()
+	return s.epochs[len(s.epochs)-1]
+}
+
+// Epoch returns the epoch with the given number.
+func (s *Schedule) Epoch(number uint64) (*Epoch, error) {
+	s.Lock()
+	defer s.Unlock()
+	first := s.epochs[0].Number
+	if number < first {
+		return nil, fmt.Errorf("epoch %d is before the first known one", number)
+	}
+	if number-first >= uint64(len(s.epochs)) {
+		return nil, fmt.Errorf("epoch %d didn't start yet", number)
+	}
+	return s.epochs[number-first], nil
+}
+
+// EpochAt returns the epoch of the block at height.
+func (s *Schedule) EpochAt(height uint64) *Epoch {
+	s.Lock()
+	defer s.Unlock()
+	for i := len(s.epochs) - 1; i > 0; i-- {
+		if s.epochs[i].Start <= height {
+			return s.epochs[i]
+		}
+	}
+	return s.epochs[0]
+}
+
+// Pending returns the changes committed in the current epoch.
+func (s *Schedule) Pending() []Change {
+	s.Lock()
+	defer s.Unlock()
+	return append([]Change{}, s.pending...)
+}
+
+// Validate returns an error if the changes can't follow the committed ones,
+// so that the current roster refuses to sign a block with them.
+func (s *Schedule) Validate(changes []Change) error {
+	s.Lock()
+	defer s.Unlock()
+	_, err := apply(s.epochs[len(s.epochs)-1].Members,
+		append(append([]Change{}, s.pending...), changes...))
+	return err
+}
+
+// Commit adds the changes of a signed block to the changes of the next
+// epoch.
+func (s *Schedule) Commit(changes []Change) error {
+	s.Lock()
+	defer s.Unlock()
+	pending := append(append([]Change{}, s.pending...), changes...)
+	if _, err := apply(s.epochs[len(s.epochs)-1].Members, pending); err != nil {
+		return err
+	}
+	s.pending = pending
+	return nil
+}
+
+// NewEpoch starts the next epoch at the height start with the committed
+// changes applied.
+func (s *Schedule) NewEpoch(start uint64) (*Epoch, error) {
+	s.Lock()
+	defer s.Unlock()
+	current := s.epochs[len(s.epochs)-1]
+	if start < current.Start {
+		return nil, errors.New("epoch starts before the current one")
+	}
+	members, err := apply(current.Members, s.pending)
+	if err != nil {
+		return nil, err
+	}
+	e := &Epoch{Number: current.Number + 1, Start: start, Members: members}
+	s.epochs = append(s.epochs, e)
+	s.pending = nil
+	return e, nil
+}
+
+// apply returns the members with the changes applied in order. Joining
+// members are added at the end.
+func apply(members []string, changes []Change) ([]string, error) {
+	result := append([]string{}, members...)
+	for _, c := range changes {
+		i := -1
+		for j, m := range result {
+			if m == c.Member {
+				i = j
+				break
+			}
+		}
+		switch {
+		case c.Join && i >= 0:
+			return nil, fmt.Errorf("%s is already a member", c.Member)
+		case c.Join:
+			result = append(result, c.Member)
+		case i < 0:
+			return nil, fmt.Errorf("%s is not a member", c.Member)
+		default:
+			result = append(result[:i], result[i+1:]...)
+		}
+	}
+	if len(result) < MinMembers {
+		return nil, fmt.Errorf("roster of %d members is too small", len(result))
+	}
+	return result, nil
+}
+
+// Follower tracks the epochs on a replica, which only learns them from the
+// blocks it verifies and commits.
+type Follower struct {
+	self     string
+	schedule *Schedule
+	// height is the number of committed blocks
+	height uint64
+	sync.Mutex
+}
+
+// NewFollower returns the follower of the member self, starting with the
+// schedule.
+func NewFollower(self string, s *Schedule) *Follower {
+	return &Follower{self: self, schedule: s}
+}
+
+// Verify returns an error if the replica may not sign a block of the epoch
+// with the changes, signed by the given members. A block of the next epoch
+// starts it with the committed changes. Only a node joining later, which
+// isn't a member of its current epoch, starts with the epoch and the signers
+// of the block. A member refuses a block of a later epoch, it has to sync
+// first, so that a leader can't choose its roster.
+func (f *Follower) Verify(epoch uint64, signers []string, changes []Change) error {
+	f.Lock()
+	defer f.Unlock()
+	current := f.schedule.Current()
+	member := current.Index(f.self) >= 0
+	switch {
+	case epoch < current.Number:
+		return fmt.Errorf("block of past epoch %d", epoch)
+	case epoch == current.Number+1 && member:
+		var err error
+		if current, err = f.schedule.NewEpoch(f.height); err != nil {
+			return err
+		}
+	case epoch > current.Number && member:
+		return fmt.Errorf("block of epoch %d, but we are in epoch %d", epoch, current.Number)
+	case epoch > current.Number:
+		f.schedule = NewScheduleFrom(Epoch{Number: epoch, Start: f.height, Members: signers})
+		current = f.schedule.Current()
+	}
+	if epoch != current.Number {
+		return fmt.Errorf("block of epoch %d in epoch %d", epoch, current.Number)
+	}
+	for _, s := range signers {
+		if current.Index(s) < 0 {
+			return fmt.Errorf("signer %s is not a member of epoch %d", s, epoch)
+		}
+	}
+	return f.schedule.Validate(changes)
+}
+
+// Commit adds the changes of a signed block to the next epoch.
+func (f *Follower) Commit(changes []Change) error {
+	f.Lock()
+	defer f.Unlock()
+	f.height++
+	return f.schedule.Commit(changes)
+}
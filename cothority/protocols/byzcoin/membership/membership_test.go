@@ -0,0 +1,101 @@
+package membership
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSchedule(t *testing.T) {
+	s := NewSchedule([]string{"a", "b", "c", "d"})
+	if err := s.Validate([]Change{{false, "a"}}); err == nil {
+		t.Fatal("Roster of three members accepted")
+	}
+	if err := s.Validate([]Change{{true, "a"}}); err == nil {
+		t.Fatal("Member joined twice")
+	}
+	if err := s.Commit([]Change{{true, "e"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Validate([]Change{{true, "e"}}); err == nil {
+		t.Fatal("Pending join accepted twice")
+	}
+	if err := s.Commit([]Change{{false, "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	// the changes wait for the boundary
+	if s.Current().Number != 0 || len(s.Current().Members) != 4 {
+		t.Fatal("Changes applied before the boundary")
+	}
+
+	e, err := s.NewEpoch(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Number != 1 || !reflect.DeepEqual(e.Members, []string{"a", "c", "d", "e"}) {
+		t.Fatal("Wrong epoch", e)
+	}
+	if len(s.Pending()) != 0 {
+		t.Fatal("Pending changes kept")
+	}
+	if e.Threshold() != 3 {
+		t.Fatal("Threshold of 4 members is", e.Threshold())
+	}
+	if s.EpochAt(9).Number != 0 || s.EpochAt(10).Number != 1 || s.EpochAt(100).Number != 1 {
+		t.Fatal("Wrong epoch at height")
+	}
+	if _, err := s.Epoch(2); err == nil {
+		t.Fatal("Got future epoch")
+	}
+	old, err := s.Epoch(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old.Index("b") != 1 || e.Index("b") != -1 {
+		t.Fatal("Wrong members of the epochs")
+	}
+
+	joined := NewScheduleFrom(*e)
+	if _, err := joined.Epoch(0); err == nil {
+		t.Fatal("Got epoch before the first one")
+	}
+	if got, err := joined.Epoch(1); err != nil || got.Number != 1 {
+		t.Fatal("Didn't get first epoch", err)
+	}
+}
+
+func TestFollower(t *testing.T) {
+	members := []string{"a", "b", "c", "d"}
+	f := NewFollower("b", NewSchedule(members))
+	if err := f.Verify(0, members, []Change{{true, "e"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Verify(0, []string{"a", "x"}, nil); err == nil {
+		t.Fatal("Signer outside the epoch accepted")
+	}
+	if err := f.Commit([]Change{{true, "e"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Verify(0, members, []Change{{true, "e"}}); err == nil {
+		t.Fatal("Change accepted twice")
+	}
+	next := []string{"a", "b", "c", "d", "e"}
+	if err := f.Verify(1, []string{"a", "x"}, nil); err == nil {
+		t.Fatal("Signer outside epoch 1 accepted")
+	}
+	if err := f.Verify(1, next, []Change{{false, "c"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Verify(0, members, nil); err == nil {
+		t.Fatal("Block of past epoch accepted")
+	}
+	// a member doesn't take the roster of a later epoch from the leader
+	if err := f.Verify(3, []string{"a", "x", "y"}, nil); err == nil {
+		t.Fatal("Member skipped to a later epoch")
+	}
+
+	// e wasn't a member of epoch 0 and starts with the epoch of the block
+	joined := NewFollower("e", NewSchedule(members))
+	if err := joined.Verify(1, next, []Change{{false, "c"}}); err != nil {
+		t.Fatal(err)
+	}
+}
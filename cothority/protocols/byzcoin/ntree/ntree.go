@@ -95,7 +95,7 @@ func NewNTreeRootProtocol(node *sda.TreeNodeInstance, transactions []blkparser.T
 // Start announces the new block to sign
 func (nt *Ntree) Start() error {
 	log.Lvl3(nt.Name(), "Start()")
-	go byzcoin.VerifyBlock(nt.block, "", "", nt.verifyBlockChan)
+	go byzcoin.VerifyBlock(nt.block, "", "", byzcoin.UTXOSet(nt.TreeNodeInstance), nt.verifyBlockChan)
 	for _, tn := range nt.Children() {
 		if err := nt.SendTo(tn, &BlockAnnounce{nt.block}); err != nil {
 			return err
@@ -120,7 +120,7 @@ func (nt *Ntree) listen() {
 			log.Lvl3(nt.Name(), "Received Block announcement")
 			nt.block = msg.BlockAnnounce.Block
 			// verify the block
-			go byzcoin.VerifyBlock(nt.block, "", "", nt.verifyBlockChan)
+			go byzcoin.VerifyBlock(nt.block, "", "", byzcoin.UTXOSet(nt.TreeNodeInstance), nt.verifyBlockChan)
 			if nt.IsLeaf() {
 				nt.startBlockSignature()
 				continue
@@ -238,21 +238,27 @@ func (nt *Ntree) verifySignatureRequest(msg *RoundSignatureRequest) {
 	threshold := int(math.Ceil(float64(len(nt.Tree().List())) / 3.0))
 	if len(msg.Exceptions) > threshold {
 		nt.verifySignatureRequestChan <- false
+		return
 	}
 
-	// verification of all the signatures
+	// verification of all the signatures, each has to be made by one of the
+	// nodes of the tree
 	var goodSig int
 	marshalled, _ := json.Marshal(nt.block)
 	for _, sig := range msg.Sigs {
-		if err := crypto.VerifySchnorr(nt.Suite(), nt.Public(), marshalled, sig); err == nil {
-			goodSig++
+		for _, pub := range nt.Roster().Publics() {
+			if err := crypto.VerifySchnorr(nt.Suite(), pub, marshalled, sig); err == nil {
+				goodSig++
+				break
+			}
 		}
 	}
 
 	log.Lvl3(nt.Name(), "Verification of signatures =>", goodSig, "/", len(msg.Sigs), ")")
 	// enough good signatures ?
-	if goodSig <= 2*threshold {
+	if goodSig < len(nt.Tree().List())-threshold {
 		nt.verifySignatureRequestChan <- false
+		return
 	}
 
 	nt.verifySignatureRequestChan <- true
@@ -268,13 +274,18 @@ func (nt *Ntree) startSignatureResponse() {
 }
 
 // computeSignatureResponse will compute the response out of the signature
-// request. It's the final signature.
+// request. It's the final signature. A node accepting the signatures of the
+// block commits it to its unspent outputs, so that the next block can spend
+// them.
 func (nt *Ntree) computeSignatureResponse() {
 	// wait for the verification to be done
 	ok := <-nt.verifySignatureRequestChan
 	if !ok {
 		nt.tempSignatureResponse.Exceptions = append(nt.tempSignatureResponse.Exceptions, Exception{nt.TreeNode().ID})
 	} else {
+		if err := byzcoin.UTXOSet(nt.TreeNodeInstance).Commit(nt.block.TransactionList); err != nil {
+			log.Error(nt.Name(), "Couldn't commit block:", err)
+		}
 		// compute the message out of the previous signature
 		// marshal only the header here (so signature between the two phases are
 		// garanteed to be different)
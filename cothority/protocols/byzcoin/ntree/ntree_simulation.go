@@ -5,7 +5,6 @@ import (
 	"github.com/csanti/pbft-experiments/cothority/log"
 	"github.com/csanti/pbft-experiments/cothority/monitor"
 	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin"
-	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain"
 	"github.com/csanti/pbft-experiments/cothority/sda"
 )
 
@@ -34,14 +33,9 @@ func NewSimulation(config string) (sda.Simulation, error) {
 
 // Setup implements sda.Simulation interface
 func (e *Simulation) Setup(dir string, hosts []string) (*sda.SimulationConfig, error) {
-	err := blockchain.EnsureBlockIsAvailable(dir)
-	if err != nil {
-		log.Fatal("Couldn't get block:", err)
-	}
-
 	sc := &sda.SimulationConfig{}
 	e.CreateRoster(sc, hosts, 2000)
-	err = e.CreateTree(sc)
+	err := e.CreateTree(sc)
 	if err != nil {
 		return nil, err
 	}
@@ -52,28 +46,29 @@ func (e *Simulation) Setup(dir string, hosts []string) (*sda.SimulationConfig, e
 func (e *Simulation) Run(sdaConf *sda.SimulationConfig) error {
 	log.Lvl2("Naive Tree Simulation starting with: Rounds=", e.Rounds)
 	server := NewNtreeServer(e.Blocksize)
+	// the client sends the transactions of the workload during all rounds
+	client := byzcoin.NewClient(server, e.Workload)
+	client.StartClientSimulation()
+	defer client.Stop()
 	for round := 0; round < e.Rounds; round++ {
-		client := byzcoin.NewClient(server)
-		err := client.StartClientSimulation(blockchain.GetBlockDir(), e.Blocksize)
-		if err != nil {
-			log.Error("ClientSimulation:", err)
-		}
-
 		log.Lvl1("Starting round", round)
 		// create an empty node
 		node := sdaConf.Overlay.NewTreeNodeInstanceFromProtoName(sdaConf.Tree, "ByzCoinNtree")
-		// instantiate a byzcoin protocol
-		rComplete := monitor.NewTimeMeasure("round")
+		// instantiate a byzcoin protocol, which waits for enough
+		// transactions of the workload
 		pi, err := server.Instantiate(node)
 		if err != nil {
 			return err
 		}
+		rComplete := monitor.NewTimeMeasure("round")
 		sdaConf.Overlay.RegisterProtocolInstance(pi)
 
 		nt := pi.(*Ntree)
 		// Register when the protocol is finished (all the nodes have finished)
 		done := make(chan bool)
 		nt.RegisterOnDone(func(sig *NtreeSignature) {
+			server.Committed(sig.Block.Txs...)
+			client.Committed(len(sig.Block.Txs))
 			rComplete.Record()
 			log.Lvl3("Done")
 			done <- true
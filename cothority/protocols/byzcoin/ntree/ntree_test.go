@@ -0,0 +1,52 @@
+package byzcoinNtree
+
+import (
+	"testing"
+	"time"
+
+	"github.com/csanti/pbft-experiments/cothority/log"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain"
+	"github.com/csanti/pbft-experiments/cothority/sda"
+)
+
+func TestMain(m *testing.M) {
+	log.MainTest(m)
+}
+
+// TestNtree_Rounds makes sure the blocks of later rounds can spend the
+// outputs of the blocks before.
+func TestNtree_Rounds(t *testing.T) {
+	defer log.AfterTest(t)
+	local := sda.NewLocalTest()
+	defer local.CloseAll()
+	_, _, tree := local.GenTree(4, false, true, true)
+
+	server := NewNtreeServer(10)
+	gen := blockchain.NewGenerator(blockchain.Workload{WorkloadSeed: 1})
+	server.AddTransaction(gen.Genesis())
+	for _, tx := range gen.Transactions(40) {
+		server.AddTransaction(tx)
+	}
+	for round := 0; round < 3; round++ {
+		node, err := local.NewTreeNodeInstance(tree.Root, "ByzCoinNtree")
+		log.ErrFatal(err)
+		pi, err := server.Instantiate(node)
+		log.ErrFatal(err)
+		log.ErrFatal(local.Overlays[tree.Root.ServerIdentity.ID].RegisterProtocolInstance(pi))
+		nt := pi.(*Ntree)
+		done := make(chan *NtreeSignature, 1)
+		nt.RegisterOnDone(func(sig *NtreeSignature) {
+			done <- sig
+		})
+		log.ErrFatal(nt.Start())
+		select {
+		case sig := <-done:
+			if len(sig.Exceptions) > 0 {
+				t.Fatal("Round", round, "was refused by", len(sig.Exceptions), "nodes")
+			}
+			server.Committed(sig.Block.Txs...)
+		case <-time.After(10 * time.Second):
+			t.Fatal("Round", round, "timed out")
+		}
+	}
+}
@@ -21,6 +21,10 @@ func NewNtreeServer(blockSize int) *NtreeServer {
 
 // Instantiate returns a new NTree protocol instance
 func (nt *NtreeServer) Instantiate(node *sda.TreeNodeInstance) (sda.ProtocolInstance, error) {
+	// the root commits the blocks to the unspent outputs of the mempool
+	if err := nt.ShareUTXOSet(node); err != nil {
+		return nil, err
+	}
 	log.Lvl2("Waiting for enough transactions...")
 	currTransactions := nt.WaitEnoughBlocks()
 	pi, err := NewNTreeRootProtocol(node, currTransactions)
@@ -95,6 +95,23 @@ type challengeCommitChan struct {
 	ChallengeCommit
 }
 
+// Committed is sent down the tree by the root once the signature of the
+// "commit" round is complete. Only then do the nodes apply the block to their
+// unspent outputs.
+type Committed struct {
+	// Signature is the final signature of the "commit" round
+	Signature *cosi.Signature
+	// Exceptions is the list of peers that did not sign
+	Exceptions []cosi.Exception
+}
+
+// committedChan is the type of the channel used to catch the committed
+// messages.
+type committedChan struct {
+	*sda.TreeNode
+	Committed
+}
+
 // Response is the struct used by ByzCoin during the response. It
 // contains the response + the basic exception list.
 type Response struct {
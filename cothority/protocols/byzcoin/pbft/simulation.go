@@ -5,12 +5,11 @@ import (
 	"github.com/csanti/pbft-experiments/cothority/log"
 	"github.com/csanti/pbft-experiments/cothority/monitor"
 	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain/blkparser"
 	"github.com/csanti/pbft-experiments/cothority/protocols/manage"
 	"github.com/csanti/pbft-experiments/cothority/sda"
 )
 
-var magicNum = [4]byte{0xF9, 0xBE, 0xB4, 0xD9}
-
 func init() {
 	sda.SimulationRegister("ByzCoinPBFT", NewSimulation)
 	sda.ProtocolRegisterName("ByzCoinPBFT", func(n *sda.TreeNodeInstance) (sda.ProtocolInstance, error) { return NewProtocol(n) })
@@ -23,6 +22,8 @@ type Simulation struct {
 	// pbft simulation specific fields:
 	// Blocksize is the number of transactions in one block:
 	Blocksize int
+	// Workload describes the transactions of the blocks
+	blockchain.Workload
 }
 
 // NewSimulation returns a pbft simulation
@@ -37,14 +38,9 @@ func NewSimulation(config string) (sda.Simulation, error) {
 
 // Setup implements sda.Simulation interface
 func (e *Simulation) Setup(dir string, hosts []string) (*sda.SimulationConfig, error) {
-	err := blockchain.EnsureBlockIsAvailable(dir)
-	if err != nil {
-		log.Fatal("Couldn't get block:", err)
-	}
-
 	sc := &sda.SimulationConfig{}
 	e.CreateRoster(sc, hosts, 2000)
-	err = e.CreateTree(sc)
+	err := e.CreateTree(sc)
 	if err != nil {
 		return nil, err
 	}
@@ -57,23 +53,11 @@ func (e *Simulation) Run(sdaConf *sda.SimulationConfig) error {
 	doneCB := func() {
 		doneChan <- true
 	}
-	// FIXME use client instead
-	dir := blockchain.GetBlockDir()
-	parser, err := blockchain.NewParser(dir, magicNum)
-	if err != nil {
-		log.Error("Error: Couldn't parse blocks in", dir)
-		return err
-	}
-	transactions, err := parser.Parse(0, e.Blocksize)
-	if err != nil {
-		log.Error("Error while parsing transactions", err)
-		return err
-	}
-
-	// FIXME c&p from byzcoin.go
-	trlist := blockchain.NewTransactionList(transactions, len(transactions))
-	header := blockchain.NewHeader(trlist, "", "")
-	trblock := blockchain.NewTrBlock(trlist, header)
+	// every round signs a new block of the workload, the first one starts
+	// with the genesis-transaction creating the coins
+	gen := blockchain.NewGenerator(e.Workload)
+	genesis := []blkparser.Tx{gen.Genesis()}
+	lastBlock := ""
 
 	// Here we first setup the N^2 connections with a broadcast protocol
 	pi, err := sdaConf.Overlay.CreateProtocolSDA("Broadcast", sdaConf.Tree)
@@ -101,7 +85,13 @@ func (e *Simulation) Run(sdaConf *sda.SimulationConfig) error {
 		}
 		proto := p.(*Protocol)
 
-		proto.trBlock = trblock
+		// FIXME c&p from byzcoin.go
+		transactions := append(genesis, gen.Transactions(e.Blocksize-len(genesis))...)
+		genesis = nil
+		trlist := blockchain.NewTransactionList(transactions, len(transactions))
+		header := blockchain.NewHeader(trlist, lastBlock, "")
+		proto.trBlock = blockchain.NewTrBlock(trlist, header)
+		lastBlock = proto.trBlock.HeaderHash
 		proto.onDoneCB = doneCB
 
 		r := monitor.NewTimeMeasure("round_pbft")
@@ -1,9 +1,8 @@
 package byzcoin
 
 import (
-	"sync"
-
 	"github.com/csanti/pbft-experiments/cothority/log"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain"
 	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain/blkparser"
 	"github.com/csanti/pbft-experiments/cothority/sda"
 )
@@ -20,10 +19,12 @@ type BlockServer interface {
 // It creates the ByzCoin protocols and run them. only used by the root since
 // only the root participates to the creation of the block.
 type Server struct {
-	// transactions pool where all the incoming transactions are stored
-	transactions []blkparser.Tx
-	// lock associated
-	transactionLock sync.Mutex
+	// mempool where all the incoming transactions are stored until they are
+	// committed
+	mempool *blockchain.Mempool
+	// utxo holds the unspent outputs of the root, the mempool uses them to
+	// calculate the fees
+	utxo *blockchain.UTXOSet
 	// how many transactions should we give to an instance
 	blockSize int
 	timeOutMs uint64
@@ -31,32 +32,37 @@ type Server struct {
 	// blockSignatureChan is the channel used to pass out the signatures that
 	// ByzCoin's instances have made
 	blockSignatureChan chan BlockSignature
-	// enoughBlock signals the server we have enough
-	// no comments..
-	transactionChan chan blkparser.Tx
-	requestChan     chan bool
-	responseChan    chan []blkparser.Tx
+	// newTransaction signals the server that a transaction arrived
+	newTransaction chan bool
 }
 
 // NewByzCoinServer returns a new fresh ByzCoinServer. It must be given the blockSize in order
 // to efficiently give the transactions to the ByzCoin instances.
 func NewByzCoinServer(blockSize int, timeOutMs uint64, fail uint) *Server {
-	s := &Server{
+	utxo := blockchain.NewUTXOSet()
+	return &Server{
+		mempool:            blockchain.NewMempool(blockchain.MempoolSize, utxo),
+		utxo:               utxo,
 		blockSize:          blockSize,
 		timeOutMs:          timeOutMs,
 		fail:               fail,
 		blockSignatureChan: make(chan BlockSignature),
-		transactionChan:    make(chan blkparser.Tx),
-		requestChan:        make(chan bool),
-		responseChan:       make(chan []blkparser.Tx),
+		newTransaction:     make(chan bool, 1),
 	}
-	go s.listenEnoughBlocks()
-	return s
 }
 
-// AddTransaction add a new transactions to the list of transactions to commit
+// AddTransaction add a new transactions to the mempool. Transactions already
+// in the mempool or spending the same outputs as another transaction of the
+// mempool are dropped.
 func (s *Server) AddTransaction(tr blkparser.Tx) {
-	s.transactionChan <- tr
+	if !s.mempool.Add(tr) {
+		log.Lvl3("Dropping transaction", tr.Hash)
+		return
+	}
+	select {
+	case s.newTransaction <- true:
+	default:
+	}
 }
 
 // ListenClientTransactions will bind to a port a listen for incoming connection
@@ -66,14 +72,33 @@ func (s *Server) ListenClientTransactions() {
 	panic("not implemented yet")
 }
 
+// ShareUTXOSet makes the unspent outputs of the mempool the ones of the root
+// node, so that the blocks it commits update the mempool.
+func (s *Server) ShareUTXOSet(node *sda.TreeNodeInstance) error {
+	return setUTXOSet(node, s.utxo)
+}
+
 // Instantiate takes blockSize transactions and create the byzcoin instances.
 func (s *Server) Instantiate(node *sda.TreeNodeInstance) (sda.ProtocolInstance, error) {
+	// the root commits the blocks to the unspent outputs of the mempool
+	if err := s.ShareUTXOSet(node); err != nil {
+		return nil, err
+	}
 	// wait until we have enough blocks
 	currTransactions := s.WaitEnoughBlocks()
 	log.Lvl2("Instantiate ByzCoin Round with", len(currTransactions), "transactions")
 	pi, err := NewByzCoinRootProtocol(node, currTransactions, s.timeOutMs, s.fail)
+	if err != nil {
+		return nil, err
+	}
+	// the transactions are removed once the block is committed
+	pi.mempool = s.mempool
+	return pi, nil
+}
 
-	return pi, err
+// Committed removes the transactions of a committed block from the mempool.
+func (s *Server) Committed(txs ...blkparser.Tx) {
+	s.mempool.Remove(txs...)
 }
 
 // BlockSignaturesChan returns a channel that is given each new block signature as
@@ -87,38 +112,11 @@ func (s *Server) onDoneSign(blk BlockSignature) {
 }
 
 // WaitEnoughBlocks is called to wait on the server until it has enough
-// transactions to make a block
+// transactions to make a block. It returns the template of the mempool with
+// the best blockSize transactions.
 func (s *Server) WaitEnoughBlocks() []blkparser.Tx {
-	s.requestChan <- true
-	transactions := <-s.responseChan
-	return transactions
-}
-
-func (s *Server) listenEnoughBlocks() {
-	// TODO the server should have a transaction pool instead:
-	var transactions []blkparser.Tx
-	var want bool
-	for {
-		select {
-		case tr := <-s.transactionChan:
-			// FIXME this will lead to a very large slice if the client sends many
-			if len(transactions) < s.blockSize {
-				transactions = append(transactions, tr)
-			}
-			if want {
-				if len(transactions) >= s.blockSize {
-					s.responseChan <- transactions[:s.blockSize]
-					transactions = transactions[s.blockSize:]
-					want = false
-				}
-			}
-		case <-s.requestChan:
-			want = true
-			if len(transactions) >= s.blockSize {
-				s.responseChan <- transactions[:s.blockSize]
-				transactions = transactions[s.blockSize:]
-				want = false
-			}
-		}
+	for s.mempool.Len() < s.blockSize {
+		<-s.newTransaction
 	}
+	return s.mempool.Template(s.blockSize, blockchain.MaxBlockBytes).Txs
 }
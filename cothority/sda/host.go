@@ -25,7 +25,7 @@ type Host struct {
 	ServerIdentity *network.ServerIdentity
 	// Our private-key
 	private abstract.Scalar
-	// The TCPHost
+	// The TCPHost or QUICHost
 	host network.SecureHost
 	Dispatcher
 	// Overlay handles the mapping from tree and entityList to ServerIdentity.
@@ -63,7 +63,7 @@ func NewHost(si *network.ServerIdentity, pkey abstract.Scalar) *Host {
 		ServerIdentity:       si,
 		Dispatcher:           NewBlockingDispatcher(),
 		connections:          make(map[network.ServerIdentityID]network.SecureConn),
-		host:                 network.NewSecureTCPHost(pkey, si),
+		host:                 network.NewSecureHost(pkey, si),
 		private:              pkey,
 		suite:                network.Suite,
 		networkChan:          make(chan network.Packet, 1),
@@ -2,6 +2,7 @@ package sda
 
 import (
 	"errors"
+	"io"
 	"io/ioutil"
 	"strconv"
 	"strings"
@@ -88,6 +89,16 @@ func LoadSimulationConfig(dir, ha string) ([]*SimulationConfig, error) {
 		return nil, err
 	}
 	scf := msg.(SimulationConfigFile)
+	// The transport has to be set before the hosts are created
+	var bft SimulationBFTree
+	if _, err := toml.Decode(scf.Config, &bft); err != nil {
+		return nil, err
+	}
+	if bft.Transport != "" {
+		if err := network.SetTransport(bft.Transport); err != nil {
+			return nil, err
+		}
+	}
 	sc := &SimulationConfig{
 		Roster:      scf.Roster,
 		PrivateKeys: scf.PrivateKeys,
@@ -203,6 +214,11 @@ type SimulationBFTree struct {
 	Hosts      int
 	SingleHost bool
 	Depth      int
+	// PortBase is the first port to use on localhost. If it is 0, free
+	// ports are searched.
+	PortBase int
+	// Transport is either "tcp" or "quic", if empty, "tcp" is used
+	Transport string
 }
 
 // CreateRoster creates an Roster with the host-names in 'addresses'.
@@ -225,7 +241,7 @@ func (s *SimulationBFTree) CreateRoster(sc *SimulationConfig, addresses []string
 		}
 	}
 	localhosts := false
-	listeners := make([]net.Listener, hosts)
+	listeners := make([]io.Closer, hosts)
 	if strings.Contains(addresses[0], "localhost") {
 		localhosts = true
 	}
@@ -238,14 +254,15 @@ func (s *SimulationBFTree) CreateRoster(sc *SimulationConfig, addresses []string
 		key.Public.Add(key.Public,
 			key.Suite.Point().Base())
 		address := addresses[c%nbrAddr] + ":"
-		if localhosts {
+		if localhosts && s.PortBase > 0 {
+			// A range of ports has been reserved for us
+			address += strconv.Itoa(s.PortBase + c)
+		} else if localhosts {
 			// If we have localhosts, we have to search for an empty port
-			var err error
-			listeners[c], err = net.Listen("tcp", ":0")
+			p, err := s.freePort(&listeners[c])
 			if err != nil {
 				log.Fatal("Couldn't search for empty port:", err)
 			}
-			_, p, _ := net.SplitHostPort(listeners[c].Addr().String())
 			address += p
 			log.Lvl4("Found free port", address)
 		} else {
@@ -257,6 +274,9 @@ func (s *SimulationBFTree) CreateRoster(sc *SimulationConfig, addresses []string
 	// And close all our listeners
 	if localhosts {
 		for _, l := range listeners {
+			if l == nil {
+				continue
+			}
 			err := l.Close()
 			if err != nil {
 				log.Fatal("Couldn't close port:", l, err)
@@ -268,6 +288,28 @@ func (s *SimulationBFTree) CreateRoster(sc *SimulationConfig, addresses []string
 	log.Lvl3("Creating entity List took: " + time.Now().Sub(start).String())
 }
 
+// freePort searches a free port on localhost for the transport of the
+// simulation. The socket is stored in l, so that the port stays reserved
+// until all ports are found.
+func (s *SimulationBFTree) freePort(l *io.Closer) (string, error) {
+	var addr net.Addr
+	if s.Transport == network.TransportQUIC {
+		pc, err := net.ListenPacket("udp", ":0")
+		if err != nil {
+			return "", err
+		}
+		*l, addr = pc, pc.LocalAddr()
+	} else {
+		ln, err := net.Listen("tcp", ":0")
+		if err != nil {
+			return "", err
+		}
+		*l, addr = ln, ln.Addr()
+	}
+	_, p, err := net.SplitHostPort(addr.String())
+	return p, err
+}
+
 // CreateTree the tree as defined in SimulationBFTree and stores the result
 // in 'sc'
 func (s *SimulationBFTree) CreateTree(sc *SimulationConfig) error {
@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 
 	"github.com/csanti/pbft-experiments/cothority/log"
+	"github.com/csanti/pbft-experiments/cothority/network"
 )
 
 func TestSimulationBF(t *testing.T) {
@@ -43,6 +44,22 @@ func TestSimulationBF(t *testing.T) {
 	}
 }
 
+func TestSimulationPortBase(t *testing.T) {
+	sc := &SimulationConfig{}
+	sb := &SimulationBFTree{
+		Hosts:    4,
+		BF:       2,
+		PortBase: 23000,
+	}
+	sb.CreateRoster(sc, []string{"localhost0", "localhost1"}, 2000)
+	for i, a := range sc.Roster.List {
+		port := "2300" + strconv.Itoa(i)
+		if a.Addresses[0][len(a.Addresses[0])-5:] != port {
+			t.Fatal("Address", a.Addresses[0], "should use port", port)
+		}
+	}
+}
+
 func TestBigTree(t *testing.T) {
 	for i := uint(12); i < 15; i++ {
 		_, _, err := createBFTree(1<<i-1, 2)
@@ -70,6 +87,26 @@ func TestLoadSave(t *testing.T) {
 	}
 }
 
+func TestLoadTransport(t *testing.T) {
+	defer network.SetTransport(network.TransportTCP)
+	sc, _, err := createBFTree(7, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.Config = "Transport = \"quic\""
+	dir, err := ioutil.TempDir("", "example")
+	log.ErrFatal(err)
+	defer os.RemoveAll(dir)
+	sc.Save(dir)
+	sc2, err := LoadSimulationConfig(dir, "local1:2000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sc2[0].Host.host.(*network.SecureQUICHost); !ok {
+		t.Fatal("Host should use QUIC")
+	}
+}
+
 func TestMultipleInstances(t *testing.T) {
 	sc, _, err := createBFTree(7, 2)
 	if err != nil {
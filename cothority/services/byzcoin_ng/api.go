@@ -9,7 +9,12 @@ This part of the service runs on the client or the app.
 */
 
 import (
+	"errors"
+
+	"github.com/csanti/pbft-experiments/cothority/crypto"
+	"github.com/csanti/pbft-experiments/cothority/network"
 	"github.com/csanti/pbft-experiments/cothority/sda"
+	"gopkg.in/dedis/crypto.v0/abstract"
 )
 
 // Client is a structure to communicate with the CoSi
@@ -22,3 +27,33 @@ type Client struct {
 func NewClient() *Client {
 	return &Client{Client: sda.NewClient(ServiceName)}
 }
+
+// SyncBlocks asks the service at dst to fetch the blocks it missed from the
+// roster and returns its new height.
+func (c *Client) SyncBlocks(dst *network.ServerIdentity, roster *sda.Roster) (uint64, error) {
+	reply, err := c.Send(dst, &SyncBlocks{Roster: roster})
+	if e := sda.ErrMsg(reply, err); e != nil {
+		return 0, e
+	}
+	sr, ok := reply.Msg.(SyncBlocksReply)
+	if !ok {
+		return 0, errors.New("Wrong return type")
+	}
+	return sr.Height, nil
+}
+
+// ChangeRoster asks all members of the roster to add or remove the node at
+// the next epoch. The request is signed with the private key of the node.
+func (c *Client) ChangeRoster(roster *sda.Roster, join bool, si *network.ServerIdentity, private abstract.Scalar) error {
+	sig, err := crypto.SignSchnorr(network.Suite, private, ChangeMessage(join, si))
+	if err != nil {
+		return err
+	}
+	for _, dst := range roster.List {
+		reply, err := c.Send(dst, &ChangeRoster{Join: join, ServerIdentity: si, Signature: sig})
+		if e := sda.ErrMsg(reply, err); e != nil {
+			return e
+		}
+	}
+	return nil
+}
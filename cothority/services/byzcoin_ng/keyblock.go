@@ -0,0 +1,272 @@
+package byzcoin_ng
+
+/*
+Keyblocks elect the leader of the microblocks like in Bitcoin-NG: all
+services mine keyblocks on top of the last one, the first one to find a
+keyblock sends it to all others and becomes the leader. The consensus group
+signing the microblocks is a window of the last miners.
+*/
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/csanti/pbft-experiments/cothority/crypto"
+	"github.com/csanti/pbft-experiments/cothority/log"
+	"github.com/csanti/pbft-experiments/cothority/monitor"
+	"github.com/csanti/pbft-experiments/cothority/network"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain"
+	"github.com/csanti/pbft-experiments/cothority/sda"
+)
+
+// StartMining is sent to all services to start mining keyblocks.
+type StartMining struct {
+	Roster *sda.Roster
+	// Workload describes the transactions of the microblocks
+	Workload blockchain.Workload
+	// Transactions is the number of transactions of the workload
+	Transactions int
+	// Difficulty is the number of zero bits a keyblock-hash starts with
+	Difficulty uint32
+	// WindowSize is how many of the last miners sign the microblocks
+	WindowSize int
+	// MicroBlocks is how many microblocks a leader creates
+	MicroBlocks int
+	// BlockSize is the number of transactions in a microblock
+	BlockSize int
+	// Epoch is the epoch of the roster, for a node joining later
+	Epoch uint64
+}
+
+// StopMining is sent to all services to stop mining keyblocks.
+type StopMining struct{}
+
+// KeyBlockAnnounce is sent by the miner of a new keyblock to all others.
+type KeyBlockAnnounce struct {
+	KeyBlock *blockchain.KeyBlock
+}
+
+// keyBlockMining holds the state of the keyblock-chain of a service.
+type keyBlockMining struct {
+	config *StartMining
+	// leader is the miner of the last keyblock
+	leader *network.ServerIdentity
+	// group is the window of the last miners signing the microblocks
+	group *sda.Roster
+	// chain holds all keyblocks and chooses the heaviest chain
+	chain *blockchain.KeyChain
+	// groups holds the window of the last miners after every keyblock, so
+	// that the group is known if the chain is reorganized
+	groups map[string]*sda.Roster
+	// newKeyBlock is closed when a keyblock is accepted
+	newKeyBlock chan bool
+	// keyBlocks gets all accepted keyblocks, so that a simulation can
+	// wait for them
+	keyBlocks chan *blockchain.KeyBlock
+	stop      chan bool
+	sync.Mutex
+}
+
+// StartMining is called by the simulation on all services and starts a go-
+// routine mining keyblocks.
+func (s *Service) StartMining(si *network.ServerIdentity, sm *StartMining) (network.Body, error) {
+	s.mining.Lock()
+	defer s.mining.Unlock()
+	if s.mining.config != nil {
+		return nil, errors.New("already mining")
+	}
+	if s.mempool.Len() == 0 {
+		if err := s.StartSimul(sm.Workload, sm.Transactions, sm.Roster); err != nil {
+			return nil, err
+		}
+	}
+	s.Roster = sm.Roster
+	s.startMembers(sm.Roster, sm.Epoch)
+	s.mining.config = sm
+	s.mining.chain = blockchain.NewKeyChain(s.lastKeyBlock)
+	s.mining.groups = map[string]*sda.Roster{s.lastKeyBlock: s.mining.group}
+	s.mining.newKeyBlock = make(chan bool)
+	s.mining.stop = make(chan bool)
+	go s.mine()
+	return nil, nil
+}
+
+// StopMining stops the mining of keyblocks.
+func (s *Service) StopMining(si *network.ServerIdentity, sm *StopMining) (network.Body, error) {
+	s.mining.Lock()
+	defer s.mining.Unlock()
+	if s.mining.config != nil {
+		close(s.mining.stop)
+		s.mining.config = nil
+	}
+	return nil, nil
+}
+
+// KeyBlockAnnounce receives the keyblock mined by another service.
+func (s *Service) KeyBlockAnnounce(si *network.ServerIdentity, kba *KeyBlockAnnounce) (network.Body, error) {
+	return nil, s.addKeyBlock(kba.KeyBlock, si)
+}
+
+// mine searches keyblocks on top of the last keyblock until the mining is
+// stopped.
+func (s *Service) mine() {
+	// a node joining later first fetches the blocks it missed
+	s.mining.Lock()
+	config := s.mining.config
+	s.mining.Unlock()
+	if config == nil {
+		return
+	}
+	if err := s.syncBlocks(config.Roster); err != nil {
+		log.Lvl2("Couldn't sync blocks:", err)
+	}
+	for {
+		s.mining.Lock()
+		if s.mining.config == nil {
+			s.mining.Unlock()
+			return
+		}
+		parent := s.lastKeyBlock
+		difficulty := s.mining.config.Difficulty
+		roster := s.mining.config.Roster
+		quit := make(chan bool)
+		newKeyBlock, stop := s.mining.newKeyBlock, s.mining.stop
+		s.mining.Unlock()
+		go func() {
+			select {
+			case <-newKeyBlock:
+			case <-stop:
+			}
+			close(quit)
+		}()
+
+		key, err := crypto.PubHex(network.Suite, s.ServerIdentity().Public)
+		if err != nil {
+			log.Error("Couldn't encode public key:", err)
+			return
+		}
+		kb := blockchain.MineKeyBlock(parent, key, difficulty, quit)
+		if kb == nil {
+			continue
+		}
+		if err := s.addKeyBlock(kb, s.ServerIdentity()); err != nil {
+			log.Lvl3("Lost the race:", err)
+			continue
+		}
+		if err := s.SendISMOthers(roster, &KeyBlockAnnounce{kb}); err != nil {
+			log.Error("Couldn't send keyblock:", err)
+		}
+	}
+}
+
+// addKeyBlock stores the keyblock if it follows a known keyblock. If it
+// ends the chain with the most proof-of-work, the miner becomes the leader
+// and enters the consensus group. A keyblock on a lighter fork is kept, as
+// the fork might become the heaviest chain later.
+func (s *Service) addKeyBlock(kb *blockchain.KeyBlock, miner *network.ServerIdentity) error {
+	s.mining.Lock()
+	defer s.mining.Unlock()
+	if s.mining.config == nil {
+		return errors.New("not mining")
+	}
+	if err := kb.Verify(s.mining.config.Difficulty); err != nil {
+		return err
+	}
+	key, err := crypto.PubHex(network.Suite, miner.Public)
+	if err != nil {
+		return err
+	}
+	if kb.PublicKey != key {
+		return errors.New("keyblock not mined by sender")
+	}
+	if !s.isMember(miner) {
+		return errors.New("keyblock not mined by a member")
+	}
+	tip, err := s.mining.chain.Add(kb)
+	if err != nil {
+		return err
+	}
+	group := s.mining.groups[kb.ParentKey]
+	s.mining.groups[kb.HeaderHash] = slideWindow(group, miner,
+		s.mining.config.WindowSize)
+	if !tip {
+		return errors.New("keyblock doesn't end the heaviest chain")
+	}
+	if kb.ParentKey != s.lastKeyBlock {
+		log.Lvl2(s.ServerIdentity(), "reorganizes the keyblock chain")
+	}
+	log.Lvl2(s.ServerIdentity(), "accepts keyblock of", miner)
+	s.lastKeyBlock = kb.HeaderHash
+	s.mining.leader = miner
+	// the keyblock ends the epoch, the agreed roster changes take effect.
+	// They are agreed in the microblocks, so a reorganization doesn't undo
+	// them.
+	if roster := s.newEpoch(); roster != nil {
+		s.Roster = roster
+		s.mining.config.Roster = roster
+		s.mining.groups[kb.HeaderHash] = slideWindow(
+			epochRoster(roster, group), miner, s.mining.config.WindowSize)
+	}
+	s.mining.group = s.mining.groups[kb.HeaderHash]
+	close(s.mining.newKeyBlock)
+	s.mining.newKeyBlock = make(chan bool)
+	select {
+	case s.mining.keyBlocks <- kb:
+	default:
+	}
+	if miner.ID.Equal(s.ServerIdentity().ID) {
+		go s.lead(kb.HeaderHash, s.mining.config.MicroBlocks,
+			s.mining.config.BlockSize)
+	}
+	return nil
+}
+
+// lead creates microblocks as long as no other keyblock is accepted.
+func (s *Service) lead(keyBlock string, microBlocks, size int) {
+	for i := 0; i < microBlocks; i++ {
+		s.mining.Lock()
+		if s.lastKeyBlock != keyBlock {
+			s.mining.Unlock()
+			return
+		}
+		s.mining.Unlock()
+		lat := monitor.NewTimeMeasure("microblock")
+		block, err := s.startEpoch(i, size)
+		if err != nil {
+			log.Error("Couldn't create microblock:", err)
+			return
+		}
+		lat.Record()
+		log.Lvl3("Microblock", i, block.HeaderHash, "committed")
+	}
+}
+
+// consensusGroup returns the roster signing the microblocks: the window of
+// the last miners, or the whole roster if no keyblock has been mined.
+func (s *Service) consensusGroup() *sda.Roster {
+	s.mining.Lock()
+	defer s.mining.Unlock()
+	if s.mining.group != nil {
+		return s.mining.group
+	}
+	return s.Roster
+}
+
+// slideWindow returns the roster with the miner at the end and at most size
+// members, dropping the oldest miners. A miner already in the window is
+// moved to the end.
+func slideWindow(window *sda.Roster, miner *network.ServerIdentity, size int) *sda.Roster {
+	var list []*network.ServerIdentity
+	if window != nil {
+		for _, si := range window.List {
+			if !si.ID.Equal(miner.ID) {
+				list = append(list, si)
+			}
+		}
+	}
+	list = append(list, miner)
+	if size > 0 && len(list) > size {
+		list = list[len(list)-size:]
+	}
+	return sda.NewRoster(list)
+}
@@ -0,0 +1,268 @@
+package byzcoin_ng
+
+/*
+The roster of the miners changes in epochs. A node asks to join or to leave
+with ChangeRoster, signed with its key and sent to all members. The leader
+puts the asked changes in the header of its next microblock, and every
+member only signs the block if it got the same requests and they are valid.
+The committed changes take effect at the next keyblock, which starts a new
+epoch. A node joining later starts mining with the roster and the epoch it
+joins.
+*/
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/csanti/pbft-experiments/cothority/crypto"
+	"github.com/csanti/pbft-experiments/cothority/log"
+	"github.com/csanti/pbft-experiments/cothority/network"
+	"github.com/csanti/pbft-experiments/cothority/protocols/bftcosi"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/membership"
+	"github.com/csanti/pbft-experiments/cothority/sda"
+	"gopkg.in/dedis/crypto.v0/abstract"
+)
+
+func init() {
+	network.RegisterPacketType(&ChangeRoster{})
+}
+
+// ChangeRoster asks the members to add or remove a node at the next epoch.
+// Only the node itself may ask, it signs ChangeMessage with its key.
+type ChangeRoster struct {
+	Join           bool
+	ServerIdentity *network.ServerIdentity
+	Signature      crypto.SchnorrSig
+}
+
+// ChangeMessage returns the message the node signs to join or to leave.
+func ChangeMessage(join bool, si *network.ServerIdentity) []byte {
+	msg := []byte("leave:")
+	if join {
+		msg = []byte("join:")
+	}
+	return append(msg, []byte(si.ID.String())...)
+}
+
+// members holds the epochs of the roster of the miners.
+type members struct {
+	schedule *membership.Schedule
+	// identities holds the members and the nodes asking to join
+	identities map[string]*network.ServerIdentity
+	// requests are the asked changes not committed yet
+	requests []membership.Change
+	// height is the number of committed microblocks
+	height uint64
+	sync.Mutex
+}
+
+// ChangeRoster records the request of a node, which the next leader puts in
+// a microblock.
+func (s *Service) ChangeRoster(si *network.ServerIdentity, req *ChangeRoster) (network.Body, error) {
+	s.members.Lock()
+	defer s.members.Unlock()
+	if s.members.schedule == nil {
+		return nil, errors.New("not mining")
+	}
+	if req.ServerIdentity == nil {
+		return nil, errors.New("no node to change")
+	}
+	if err := crypto.VerifySchnorr(network.Suite, req.ServerIdentity.Public,
+		ChangeMessage(req.Join, req.ServerIdentity), req.Signature); err != nil {
+		return nil, errors.New("change isn't signed by the node: " + err.Error())
+	}
+	c := membership.Change{Join: req.Join, Member: req.ServerIdentity.ID.String()}
+	if known, ok := s.members.identities[c.Member]; ok && !known.Public.Equal(req.ServerIdentity.Public) {
+		return nil, errors.New("node has another key")
+	}
+	for _, r := range s.members.requests {
+		if r == c {
+			return nil, nil
+		}
+	}
+	if err := s.members.schedule.Validate(append(s.members.requests, c)); err != nil {
+		return nil, err
+	}
+	s.members.identities[c.Member] = req.ServerIdentity
+	s.members.requests = append(s.members.requests, c)
+	log.Lvl2(s.ServerIdentity(), "got roster change", c)
+	return nil, nil
+}
+
+// startMembers starts the epochs with the roster to mine with.
+func (s *Service) startMembers(roster *sda.Roster, epoch uint64) {
+	s.members.Lock()
+	defer s.members.Unlock()
+	s.members.identities = make(map[string]*network.ServerIdentity)
+	var ids []string
+	for _, si := range roster.List {
+		ids = append(ids, si.ID.String())
+		s.members.identities[si.ID.String()] = si
+	}
+	s.members.schedule = membership.NewScheduleFrom(membership.Epoch{
+		Number:  epoch,
+		Start:   s.members.height,
+		Members: ids,
+	})
+	s.members.requests = nil
+}
+
+// proposeChanges sets the epoch of the new block and the changes asked so
+// far.
+func (s *Service) proposeChanges(block *bftcosi.MicroBlock) {
+	s.members.Lock()
+	defer s.members.Unlock()
+	if s.members.schedule == nil {
+		return
+	}
+	block.Header.Epoch = s.members.schedule.Current().Number
+	block.Header.RosterChanges = append([]membership.Change{}, s.members.requests...)
+	block.HeaderHash = blockchain.HashHeader(block.Header)
+}
+
+// verifyChanges returns an error if the block isn't signed by members of
+// the current epoch or if we didn't get its roster changes.
+func (s *Service) verifyChanges(block *bftcosi.MicroBlock) error {
+	s.members.Lock()
+	defer s.members.Unlock()
+	if s.members.schedule == nil {
+		return nil
+	}
+	epoch := s.members.schedule.Current()
+	if block.Header.Epoch != epoch.Number {
+		return errors.New("block of another epoch")
+	}
+	if block.Roster != nil {
+		for _, si := range block.Roster.List {
+			if epoch.Index(si.ID.String()) < 0 {
+				return errors.New("signer is not a member of the epoch")
+			}
+		}
+	}
+	for _, c := range block.Header.RosterChanges {
+		requested := false
+		for _, r := range s.members.requests {
+			requested = requested || r == c
+		}
+		if !requested {
+			return errors.New("roster change " + c.String() + " wasn't asked")
+		}
+	}
+	return s.members.schedule.Validate(block.Header.RosterChanges)
+}
+
+// signers returns the public keys of the consensus group of the block,
+// taken from the roster of its epoch and not from the block, and the number
+// of members that have to sign. Blocks of epochs before we joined are checked
+// against our roster.
+func (s *Service) signers(block *bftcosi.MicroBlock) ([]abstract.Point, int, error) {
+	s.members.Lock()
+	defer s.members.Unlock()
+	var epoch *membership.Epoch
+	if s.members.schedule != nil {
+		var err error
+		epoch, err = s.members.schedule.Epoch(block.Header.Epoch)
+		if err != nil {
+			log.Lvl3("Checking the signers with our roster:", err)
+		}
+	}
+	if epoch == nil && s.Roster == nil {
+		return nil, 0, errors.New("no roster to check the signers")
+	}
+	var threshold int
+	if epoch != nil {
+		threshold = epoch.Threshold()
+	} else {
+		n := len(s.Roster.List)
+		threshold = n - (n-1)/3
+	}
+	var publics []abstract.Point
+	for _, si := range block.Roster.List {
+		var member *network.ServerIdentity
+		if epoch != nil {
+			if epoch.Index(si.ID.String()) >= 0 {
+				member = s.members.identities[si.ID.String()]
+			}
+		} else if s.Roster != nil {
+			_, member = s.Roster.Search(si.ID)
+		}
+		if member == nil {
+			return nil, 0, errors.New("signer is not a member of the epoch")
+		}
+		publics = append(publics, member.Public)
+	}
+	return publics, threshold, nil
+}
+
+// commitChanges adds the roster changes of a committed block to the next
+// epoch.
+func (s *Service) commitChanges(block *bftcosi.MicroBlock) {
+	s.members.Lock()
+	defer s.members.Unlock()
+	s.members.height++
+	if s.members.schedule == nil || len(block.Header.RosterChanges) == 0 {
+		return
+	}
+	if err := s.members.schedule.Commit(block.Header.RosterChanges); err != nil {
+		log.Error("Couldn't commit roster changes:", err)
+		return
+	}
+	var requests []membership.Change
+	for _, r := range s.members.requests {
+		committed := false
+		for _, c := range block.Header.RosterChanges {
+			committed = committed || r == c
+		}
+		if !committed {
+			requests = append(requests, r)
+		}
+	}
+	s.members.requests = requests
+}
+
+// isMember returns whether the node is a member of the current epoch.
+func (s *Service) isMember(si *network.ServerIdentity) bool {
+	s.members.Lock()
+	defer s.members.Unlock()
+	if s.members.schedule == nil {
+		return true
+	}
+	return s.members.schedule.Current().Index(si.ID.String()) >= 0
+}
+
+// newEpoch starts the next epoch at a keyblock and returns its roster.
+func (s *Service) newEpoch() *sda.Roster {
+	s.members.Lock()
+	defer s.members.Unlock()
+	if s.members.schedule == nil {
+		return nil
+	}
+	epoch, err := s.members.schedule.NewEpoch(s.members.height)
+	if err != nil {
+		log.Error("Couldn't start epoch:", err)
+		return nil
+	}
+	var list []*network.ServerIdentity
+	for _, id := range epoch.Members {
+		list = append(list, s.members.identities[id])
+	}
+	log.Lvl2(s.ServerIdentity(), "starts epoch", epoch.Number, "with",
+		len(list), "members")
+	return sda.NewRoster(list)
+}
+
+// epochRoster returns the roster with only the members of the current
+// epoch, keeping the order.
+func epochRoster(roster, group *sda.Roster) *sda.Roster {
+	if group == nil {
+		return nil
+	}
+	var list []*network.ServerIdentity
+	for _, si := range group.List {
+		if _, member := roster.Search(si.ID); member != nil {
+			list = append(list, si)
+		}
+	}
+	return sda.NewRoster(list)
+}
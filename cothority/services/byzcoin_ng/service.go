@@ -5,16 +5,21 @@ Defines the service of Byzcoin-NG that intatiates one bfrcosi protocol per block
 */
 
 import (
+	"bytes"
 	"container/heap"
-	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/csanti/pbft-experiments/cothority/log"
 	"github.com/csanti/pbft-experiments/cothority/network"
 	"github.com/csanti/pbft-experiments/cothority/protocols/bftcosi"
 	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain"
 	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain/blkparser"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain/blockstore"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blocksync"
 	"github.com/csanti/pbft-experiments/cothority/protocols/manage"
 	"github.com/csanti/pbft-experiments/cothority/sda"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 )
@@ -23,11 +28,12 @@ import (
 // package.
 const ServiceName = "ByzcoinNG"
 const BNGBFT = "Byzcoin_NG_BFT"
-const ReadFirstNBlocks = 66000
 
 func init() {
 	sda.RegisterNewService(ServiceName, newByzcoinNGService)
 	network.RegisterPacketType(&bftcosi.MicroBlock{})
+	network.RegisterPacketType(&SyncBlocks{})
+	network.RegisterPacketType(&SyncBlocksReply{})
 	sda.ProtocolRegisterName(BNGBFT, func(n *sda.TreeNodeInstance) (sda.ProtocolInstance, error) {
 		return bftcosi.NewBFTCoSiProtocol(n, nil, nil)
 	})
@@ -54,56 +60,74 @@ type Service struct {
 	lastBlock    string
 	lastKeyBlock string
 
-	transaction *[]blkparser.Tx
+	// mempool holds the transactions not yet in a block
+	mempool *blockchain.Mempool
+	// utxo holds the outputs not spent by the verified blocks
+	utxo *blockchain.UTXOSet
+	// applied holds the hashes of the blocks in utxo
+	applied    map[string]bool
+	appliedMut sync.Mutex
+	// mining holds the keyblocks electing the leader
+	mining keyBlockMining
+	// store holds the committed blocks, protected by appliedMut
+	store *blockstore.Store
+	// members holds the epochs of the roster
+	members members
 }
 
-var magicNum = [4]byte{0xF9, 0xBE, 0xB4, 0xD9}
+// SyncBlocks asks a service to fetch the blocks it missed from the roster.
+type SyncBlocks struct {
+	Roster *sda.Roster
+}
+
+// SyncBlocksReply holds the height of the store after the sync.
+type SyncBlocksReply struct {
+	Height uint64
+}
 
-func (s *Service) StartSimul(blocksPath string, nTxs int, Roster *sda.Roster) error {
+// StartSimul fills the mempool with nTxs transactions of the workload w,
+// following the genesis-transaction that creates the coins. The transactions
+// only depend on w, so every service gets the same ones.
+func (s *Service) StartSimul(w blockchain.Workload, nTxs int, Roster *sda.Roster) error {
 	s.Roster = Roster
 	log.Lvl2("ByzCoin will trigger up to", nTxs, "transactions")
-	parser, err := blockchain.NewParser(blocksPath, magicNum)
-	log.Lvl1(blocksPath)
-
-	transactions, err := parser.Parse(0, ReadFirstNBlocks)
-	if len(transactions) == 0 {
-		return errors.New("Couldn't read any transactions.")
-	}
-	if err != nil {
-		log.Error("Error: Couldn't parse blocks in", blocksPath,
-			".\nPlease download bitcoin blocks as .dat files first and place them in",
-			blocksPath, "Either run a bitcoin node (recommended) or using a torrent.")
-		return err
+	gen := blockchain.NewGenerator(w)
+	s.mempool.Add(gen.Genesis())
+	for _, tx := range gen.Transactions(nTxs) {
+		s.mempool.Add(tx)
 	}
-	if len(transactions) < nTxs {
-		log.Errorf("Read only %v but caller wanted %v", len(transactions), nTxs)
-	}
-
-	s.transaction = &transactions
-
 	return nil
 }
 
 func (s *Service) startEpoch(priority int, size int) (*bftcosi.MicroBlock, error) {
 	//number of rounds... should be viariable
-	block, err := GetBlock(size, *s.transaction, s.lastBlock, s.lastKeyBlock, priority)
+	txs := s.mempool.Take(size, blockchain.MaxBlockBytes)
+	block, err := GetBlock(size, txs, s.lastBlock, s.lastKeyBlock, priority)
 	if err != nil {
 		log.Lvl1("cannot get block")
 		return nil, err
 	}
 
-	block.Roster = s.Roster
-	s.signNewBlock(block)
+	s.proposeChanges(block)
+	block.Roster = s.consensusGroup()
+	_, err = s.signNewBlock(block)
 	if err != nil {
 		log.Lvl1("cannot sign block")
+		// the transactions go into the next block
+		s.mempool.Return(txs...)
 		return nil, err
 	}
 	err = block.BlockSig.Verify(network.Suite, block.Roster.Publics())
 	if err != nil {
 		log.Lvl1("cannot verify block")
+		s.mempool.Return(txs...)
+		return nil, err
+	}
+	// the signed block is accepted: all services commit its transactions
+	// to their unspent outputs, so that the next block can spend them
+	if err := s.startPropagation(block); err != nil {
 		return nil, err
 	}
-
 	return block, nil
 }
 
@@ -123,11 +147,10 @@ func (s *Service) signNewBlock(block *bftcosi.MicroBlock) (*bftcosi.MicroBlock,
 			return nil, err
 		}
 		// Verify it
-		err = block.BlockSig.Verify(network.Suite, s.Roster.Publics())
+		err = block.BlockSig.Verify(network.Suite, block.Roster.Publics())
 		if err != nil {
 			return nil, err
 		}
-		//s.startPropagation(block)
 		s.lastBlock = block.HeaderHash
 
 		return block, nil
@@ -198,6 +221,8 @@ func (s *Service) NewProtocol(tn *sda.TreeNodeInstance, conf *sda.GenericConfig)
 		pi.(*manage.Propagate).RegisterOnData(s.PropagateSkipBlock)
 	case BNGBFT:
 		pi, err = bftcosi.NewBFTCoSiProtocol(tn, s.bftVerify, s.SerilizeChan)
+	case blocksync.Name:
+		pi, err = blocksync.NewSync(tn)
 	}
 	return pi, err
 
@@ -212,11 +237,21 @@ func newByzcoinNGService(c *sda.Context, path string) sda.Service {
 		path:             path,
 		lastBlock:        "0",
 		lastKeyBlock:     "0",
-		transaction:      &[]blkparser.Tx{},
 		Vempty:           true,
 		PQueue:           &bftcosi.PriorityQueue{},
 		PQueuever:        &bftcosi.PriorityQueue{},
 		SerilizeChan:     make(chan bftcosi.Item),
+		utxo:             blockchain.NewUTXOSet(),
+		applied:          make(map[string]bool),
+	}
+	s.mempool = blockchain.NewMempool(blockchain.MempoolSize, s.utxo)
+	s.mining.keyBlocks = make(chan *blockchain.KeyBlock, 1000)
+	if err := s.loadBlocks(); err != nil {
+		log.Error("Couldn't load blocks:", err)
+	}
+	if err := s.RegisterMessages(s.StartMining, s.StopMining,
+		s.KeyBlockAnnounce, s.SyncBlocks, s.ChangeRoster); err != nil {
+		log.Error("Couldn't register messages:", err)
 	}
 	heap.Init(s.PQueue)
 	heap.Init(s.PQueuever)
@@ -265,13 +300,11 @@ func GetBlock(size int, transactions []blkparser.Tx, lastBlock string, lastKeyBl
 	return block, nil
 }
 
-// VerifyBlock is a simulation of a real verification block algorithm
+// bftVerify checks the header of the block and its transactions against the
+// unspent outputs. The block is only applied once it is signed and
+// propagated, in PropagateSkipBlock.
 //TODO change footprint to the bftcosi one
 func (s *Service) bftVerify(msg []byte, data []byte) bool {
-	//We measure the average block verification delays is 174ms for an average
-	//block of 500kB.
-	//To simulate the verification cost of bigger blocks we multiply 174ms
-	//times the size/500*1024
 	log.Lvlf4("%s verifying block %x", s.ServerIdentity(), msg)
 	_, sbN, err := network.UnmarshalRegistered(data)
 	if err != nil {
@@ -318,13 +351,24 @@ func (s *Service) bftVerify(msg []byte, data []byte) bool {
 
 	// }
 
-	b, _ := json.Marshal(block)
-	s1 := len(b)
-	var n time.Duration
-	n = time.Duration(s1 / (500 * 1024))
-	//s.HWMutex.Lock()
-	time.Sleep(150 * time.Millisecond * n) //verification of 174ms per 500KB simulated
-	//s.HWMutex.Unlock()
+	// verification of the header
+	verified := true
+	//verified := block.Header.Parent == s.lastBlock //&& block.Header.ParentKey == s.lastKeyBlock
+	verified = verified && block.Header.MerkleRoot == blockchain.HashRootTransactions(block.TransactionList)
+	verified = verified && block.HeaderHash == blockchain.HashHeader(block.Header)
+	if verified {
+		if err := s.verifyChanges(block); err != nil {
+			log.Lvl2("Invalid epoch:", err)
+			verified = false
+		}
+	}
+	// verification of the transactions
+	if verified {
+		if err := s.utxo.Verify(block.TransactionList); err != nil {
+			log.Lvl2("Invalid transaction:", err)
+			verified = false
+		}
+	}
 	s.QMutexver.Lock()
 	if s.PQueuever.Len() != 0 {
 		item := s.PQueuever.Pop().(*bftcosi.Item)
@@ -334,11 +378,6 @@ func (s *Service) bftVerify(msg []byte, data []byte) bool {
 	}
 	s.QMutexver.Unlock()
 
-	// verification of the header
-	verified := true
-	//verified := block.Header.Parent == s.lastBlock //&& block.Header.ParentKey == s.lastKeyBlock
-	verified = verified && block.Header.MerkleRoot == blockchain.HashRootTransactions(block.TransactionList)
-	verified = verified && block.HeaderHash == blockchain.HashHeader(block.Header)
 	// notify it
 	log.Lvl3("Verification of the block done =", verified)
 	if !verified {
@@ -347,10 +386,31 @@ func (s *Service) bftVerify(msg []byte, data []byte) bool {
 	return verified
 }
 
+// applyBlock updates the unspent outputs and the mempool with the
+// transactions of the block, if it isn't applied yet.
+func (s *Service) applyBlock(block *bftcosi.MicroBlock) error {
+	s.appliedMut.Lock()
+	defer s.appliedMut.Unlock()
+	if s.applied[block.HeaderHash] {
+		return nil
+	}
+	if err := s.utxo.Commit(block.TransactionList); err != nil {
+		return err
+	}
+	s.applied[block.HeaderHash] = true
+	s.mempool.Remove(block.Txs...)
+	return nil
+}
+
 // notify other services about new/updated skipblock
 func (s *Service) startPropagation(block *bftcosi.MicroBlock) error {
 	log.Lvlf3("Starting to propagate for service %x", s.Context.ServerIdentity().ID[0:8])
-	roster := block.Roster
+	// the block is only signed by the consensus group, but all services
+	// need it
+	roster := s.Roster
+	if roster == nil {
+		roster = block.Roster
+	}
 	if roster == nil {
 		return errors.New("Didn't find Roster")
 	}
@@ -377,6 +437,214 @@ func (s *Service) PropagateSkipBlock(msg network.Body) {
 		return
 	}
 	s.lastBlock = sb.HeaderHash
-	//TODO: Handle Key blocks
+	// the block is signed, only now its transactions are spent
+	if err := s.applyBlock(sb); err != nil {
+		log.Error("Couldn't apply block:", err)
+	}
+	if err := s.storeBlock(sb); err != nil {
+		log.Error("Couldn't store block:", err)
+	}
+	s.commitChanges(sb)
 	log.Lvlf3("Stored skip block %+v in %x", *sb, s.Context.ServerIdentity().ID[0:8])
 }
+
+// storeBlock appends the committed block with its signature to the store,
+// if it isn't stored yet.
+func (s *Service) storeBlock(block *bftcosi.MicroBlock) error {
+	s.appliedMut.Lock()
+	defer s.appliedMut.Unlock()
+	if s.store == nil {
+		return nil
+	}
+	if _, err := s.store.GetByHash([]byte(block.HeaderHash)); err == nil {
+		return nil
+	}
+	data, err := network.MarshalRegisteredType(block)
+	if err != nil {
+		return err
+	}
+	e := &blockstore.Entry{
+		Height: s.store.Len(),
+		Hash:   []byte(block.HeaderHash),
+		Block:  data,
+	}
+	if block.BlockSig != nil {
+		e.Signature = block.BlockSig.Sig
+		e.Mask = exceptionMask(block.BlockSig.Exceptions)
+	}
+	if err := s.store.Append(e); err != nil {
+		return err
+	}
+	if s.store.Len()%snapshotInterval == 0 {
+		return s.utxo.Save(s.snapshotPath(), s.store.Len())
+	}
+	return nil
+}
+
+// snapshotInterval is the number of blocks after which the unspent outputs
+// are saved, so that the stored blocks can be compacted.
+const snapshotInterval = 100
+
+// snapshotPath returns the file of the saved unspent outputs.
+func (s *Service) snapshotPath() string {
+	return filepath.Join(s.path, "utxo.json")
+}
+
+// loadBlocks opens the store and replays the committed blocks, so that a
+// restarting service recovers its chain and its unspent outputs. The blocks
+// in the saved unspent outputs are not replayed, so they can be pruned by
+// compaction.
+func (s *Service) loadBlocks() error {
+	store, err := blockstore.Open(filepath.Join(s.path, "blocks.db"))
+	if err != nil {
+		return err
+	}
+	s.store = store
+	blocksync.RegisterStore(s.ServerIdentity().ID.String(), store)
+	var saved uint64
+	utxo, height, err := blockchain.LoadUTXOSet(s.snapshotPath())
+	switch {
+	case err == nil && height <= store.Len():
+		s.utxo = utxo
+		s.mempool = blockchain.NewMempool(blockchain.MempoolSize, utxo)
+		saved = height
+	case err == nil:
+		return errors.New("saved unspent outputs are ahead of the stored blocks")
+	case !os.IsNotExist(err):
+		return err
+	}
+	entries, err := store.Range(0, store.Len())
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Height < saved {
+			s.lastBlock = string(e.Hash)
+			s.applied[string(e.Hash)] = true
+			continue
+		}
+		if len(e.Block) == 0 {
+			return fmt.Errorf("block %d is pruned but not in the saved unspent outputs", e.Height)
+		}
+		s.applyEntry(e)
+	}
+	if len(entries) > 0 {
+		log.Lvl2(s.ServerIdentity(), "recovered", len(entries), "blocks")
+	}
+	return s.utxo.Save(s.snapshotPath(), store.Len())
+}
+
+// exceptionMask returns a bitmask with the indexes of the nodes that didn't
+// sign.
+func exceptionMask(exceptions []bftcosi.Exception) []byte {
+	var mask []byte
+	for _, e := range exceptions {
+		for len(mask) <= e.Index/8 {
+			mask = append(mask, 0)
+		}
+		mask[e.Index/8] |= 1 << uint(e.Index%8)
+	}
+	return mask
+}
+
+// applyEntry applies a stored block, which has been committed before.
+// Pruned blocks are never applied, loadBlocks takes them from the saved
+// unspent outputs.
+func (s *Service) applyEntry(e *blockstore.Entry) {
+	s.lastBlock = string(e.Hash)
+	_, msg, err := network.UnmarshalRegistered(e.Block)
+	if err != nil {
+		log.Error("Couldn't unmarshal block", e.Height, ":", err)
+		return
+	}
+	if err := s.applyBlock(msg.(*bftcosi.MicroBlock)); err != nil {
+		log.Lvl2("Couldn't apply stored block", e.Height, ":", err)
+	}
+}
+
+// SyncBlocks fetches the blocks this service missed from the nodes of the
+// roster and returns the new height.
+func (s *Service) SyncBlocks(si *network.ServerIdentity, req *SyncBlocks) (network.Body, error) {
+	if s.Roster == nil {
+		// a new node trusts the roster it is asked to sync from
+		s.Roster = req.Roster
+	}
+	if err := s.syncBlocks(req.Roster); err != nil {
+		return nil, err
+	}
+	return &SyncBlocksReply{Height: s.store.Len()}, nil
+}
+
+// syncBlocks runs the sync protocol with us as root and the nodes of the
+// roster as peers, which works for new nodes not in the roster, too.
+func (s *Service) syncBlocks(roster *sda.Roster) error {
+	if s.store == nil {
+		return errors.New("no block store")
+	}
+	list := []*network.ServerIdentity{s.ServerIdentity()}
+	for _, si := range roster.List {
+		if !si.ID.Equal(s.ServerIdentity().ID) {
+			list = append(list, si)
+		}
+	}
+	tree := sda.NewRoster(list).GenerateNaryTreeWithRoot(len(list), s.ServerIdentity())
+	pi, err := s.CreateProtocolService(blocksync.Name, tree)
+	if err != nil {
+		return err
+	}
+	p := pi.(*blocksync.Sync)
+	p.Verify = s.verifyEntry
+	p.OnBlock = s.applyEntry
+	if err := p.Start(); err != nil {
+		return err
+	}
+	return <-p.Finished
+}
+
+// verifyEntry checks that a fetched block is the stored one and that it is
+// signed by its consensus group, with the keys of the members of its epoch
+// that we know. Microblocks of parallel epochs don't link to each other, so
+// the parent isn't checked.
+func (s *Service) verifyEntry(prev, e *blockstore.Entry) error {
+	_, msg, err := network.UnmarshalRegistered(e.Block)
+	if err != nil {
+		return err
+	}
+	block, ok := msg.(*bftcosi.MicroBlock)
+	if !ok {
+		return errors.New("not a microblock")
+	}
+	if block.HeaderHash != string(e.Hash) ||
+		block.HeaderHash != blockchain.HashHeader(block.Header) {
+		return errors.New("wrong header hash")
+	}
+	if block.Header.MerkleRoot != blockchain.HashRootTransactions(block.TransactionList) {
+		return errors.New("wrong merkle root")
+	}
+	if block.BlockSig == nil || block.Roster == nil {
+		return errors.New("block is not signed")
+	}
+	if !bytes.Equal(block.BlockSig.Msg, []byte(block.HeaderHash)) {
+		return errors.New("signature is not on the header hash")
+	}
+	publics, threshold, err := s.signers(block)
+	if err != nil {
+		return err
+	}
+	seen := make(map[int]bool)
+	for _, ex := range block.BlockSig.Exceptions {
+		if ex.Index < 0 || ex.Index >= len(publics) || seen[ex.Index] {
+			return fmt.Errorf("invalid exception index %d", ex.Index)
+		}
+		seen[ex.Index] = true
+	}
+	if len(publics)-len(seen) < threshold {
+		return fmt.Errorf("only %d of %d needed members signed",
+			len(publics)-len(seen), threshold)
+	}
+	if !bytes.Equal(block.BlockSig.Sig, e.Signature) ||
+		!bytes.Equal(exceptionMask(block.BlockSig.Exceptions), e.Mask) {
+		return errors.New("signature differs from the stored one")
+	}
+	return block.BlockSig.Verify(network.Suite, publics)
+}
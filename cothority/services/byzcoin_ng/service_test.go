@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/csanti/pbft-experiments/cothority/log"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain"
 	"github.com/csanti/pbft-experiments/cothority/sda"
 )
 
@@ -27,3 +28,25 @@ func TestServiceTemplate(t *testing.T) {
 	log.ErrFatal(err, "Couldn't send")
 	log.Lvl1("It took", duration, "to go through the tree.")
 }
+
+// TestService_Rounds makes sure the blocks of later rounds can spend the
+// outputs of the blocks before, on all services.
+func TestService_Rounds(t *testing.T) {
+	defer log.AfterTest(t)
+	local := sda.NewLocalTest()
+	defer local.CloseAll()
+	sid := sda.ServiceFactory.ServiceID(ServiceName)
+	hosts, el, s := local.MakeHELS(4, sid)
+	service := s.(*Service)
+
+	log.ErrFatal(service.StartSimul(blockchain.Workload{WorkloadSeed: 1}, 40, el))
+	for round := 0; round < 4; round++ {
+		block, err := service.startEpoch(round, 10)
+		log.ErrFatal(err, "Couldn't sign block of round", round)
+		for _, svc := range local.GetServices(hosts, sid) {
+			if svc.(*Service).lastBlock != block.HeaderHash {
+				t.Fatal("Block of round", round, "isn't committed on all services")
+			}
+		}
+	}
+}
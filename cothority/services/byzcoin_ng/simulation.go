@@ -1,6 +1,8 @@
 package byzcoin_ng
 
 import (
+	"errors"
+
 	"github.com/BurntSushi/toml"
 	"github.com/csanti/pbft-experiments/cothority/log"
 	"github.com/csanti/pbft-experiments/cothority/monitor"
@@ -26,6 +28,15 @@ type simulation struct {
 	Blocksize int
 	lock      sync.Mutex
 	Threads   int
+	// If KeyBlocks is set, the services mine that many keyblocks and the
+	// winner of each keyblock creates MicroBlocks microblocks, signed by
+	// the last WindowSize miners.
+	KeyBlocks   int
+	Difficulty  uint32
+	WindowSize  int
+	MicroBlocks int
+	// Workload describes the transactions of the blocks
+	blockchain.Workload
 }
 
 // NewSimulation returns the new simulation, where all fields are
@@ -42,14 +53,9 @@ func NewSimulation(config string) (sda.Simulation, error) {
 // Setup creates the tree used for that simulation
 func (e *simulation) Setup(dir string, hosts []string) (
 	*sda.SimulationConfig, error) {
-	err := blockchain.EnsureBlockIsAvailable(dir)
-	if err != nil {
-		log.Fatal("Couldn't get block:", err)
-	}
-
 	sc := &sda.SimulationConfig{}
 	e.CreateRoster(sc, hosts, 2000)
-	err = e.CreateTree(sc)
+	err := e.CreateTree(sc)
 	if err != nil {
 		return nil, err
 	}
@@ -64,7 +70,10 @@ func (e *simulation) Run(config *sda.SimulationConfig) error {
 	if service == nil || !ok {
 		log.Fatal("Didn't find service", ServiceName)
 	}
-	err := service.StartSimul(blockchain.GetBlockDir(), e.Blocksize, config.Roster)
+	if e.KeyBlocks > 0 {
+		return e.runKeyBlocks(service, config)
+	}
+	err := service.StartSimul(e.Workload, e.Blocksize*e.Rounds, config.Roster)
 	if err != nil {
 		log.Error(err)
 	}
@@ -95,9 +104,6 @@ func (e *simulation) Run(config *sda.SimulationConfig) error {
 			wg.Done()
 		}(i)
 		time.Sleep(1000 * time.Millisecond)
-
-		//Propagation is not needed but bftcosi does not save the block
-		//service.startPropagation(block)
 	}
 	wg.Wait()
 	round1.Record()
@@ -106,3 +112,37 @@ func (e *simulation) Run(config *sda.SimulationConfig) error {
 
 	return nil
 }
+
+// runKeyBlocks lets all services mine until KeyBlocks keyblocks are found.
+func (e *simulation) runKeyBlocks(service *Service, config *sda.SimulationConfig) error {
+	sm := &StartMining{
+		Roster:       config.Roster,
+		Workload:     e.Workload,
+		Transactions: e.Blocksize * e.MicroBlocks * e.KeyBlocks,
+		Difficulty:   e.Difficulty,
+		WindowSize:   e.WindowSize,
+		MicroBlocks:  e.MicroBlocks,
+		BlockSize:    e.Blocksize,
+	}
+	if err := service.SendISMOthers(config.Roster, sm); err != nil {
+		return err
+	}
+	if _, err := service.StartMining(service.ServerIdentity(), sm); err != nil {
+		return err
+	}
+	for i := 0; i < e.KeyBlocks; i++ {
+		keyBlock := monitor.NewTimeMeasure("keyblock")
+		select {
+		case kb := <-service.mining.keyBlocks:
+			log.Lvl1("Keyblock", i, "mined by", kb.PublicKey)
+		case <-time.After(time.Minute * 10):
+			return errors.New("timed out while waiting for keyblock")
+		}
+		keyBlock.Record()
+	}
+	if err := service.SendISMOthers(config.Roster, &StopMining{}); err != nil {
+		return err
+	}
+	_, err := service.StopMining(service.ServerIdentity(), &StopMining{})
+	return err
+}
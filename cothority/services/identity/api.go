@@ -1,6 +1,7 @@
 package identity
 
 import (
+	"bytes"
 	"errors"
 	"io"
 
@@ -37,6 +38,16 @@ func init() {
 		&ConfigUpdate{},
 		&UpdateSkipBlock{},
 		&ProposeVote{},
+		&RotateKey{},
+		&GetHistory{},
+		&GetHistoryReply{},
+		&StoreFile{},
+		&StoreFileReply{},
+		&GetFile{},
+		&GetFileReply{},
+		&PropagateFile{},
+		&EncryptedValue{},
+		&EncryptedKey{},
 	} {
 		network.RegisterPacketType(s)
 	}
@@ -219,6 +230,145 @@ func (i *Identity) ProposeVote(accept bool) error {
 	return nil
 }
 
+// ProposeRevoke proposes to remove the device, e.g. a lost one, from the
+// latest config. The other devices vote on it like on any other
+// proposition. The threshold is lowered if there are fewer devices left.
+func (i *Identity) ProposeRevoke(device string) error {
+	if err := i.ConfigUpdate(); err != nil {
+		return err
+	}
+	conf := i.Config.Copy()
+	if _, ok := conf.Device[device]; !ok {
+		return errors.New("Didn't find device " + device)
+	}
+	if len(conf.Device) == 1 {
+		return errors.New("Can't revoke the last device")
+	}
+	delete(conf.Device, device)
+	if conf.Threshold > len(conf.Device) {
+		conf.Threshold = len(conf.Device)
+	}
+	return i.ProposeSend(conf)
+}
+
+// ProposeThreshold proposes to change the number of devices of the latest
+// config needed to accept a proposition.
+func (i *Identity) ProposeThreshold(threshold int) error {
+	if err := i.ConfigUpdate(); err != nil {
+		return err
+	}
+	conf := i.Config.Copy()
+	if threshold < 1 || threshold > len(conf.Device) {
+		return errors.New("Threshold has to be between 1 and the number of devices")
+	}
+	conf.Threshold = threshold
+	return i.ProposeSend(conf)
+}
+
+// RotateKey replaces the key of this device with a new one. The old key
+// signs the new one, so no votes of the other devices are needed. A
+// proposition waiting for votes stays pending with the new key, and the
+// devices have to vote on it again.
+func (i *Identity) RotateKey() error {
+	if err := i.ConfigUpdate(); err != nil {
+		return err
+	}
+	kp := config.NewKeyPair(network.Suite)
+	msg, err := i.Config.RotateMessage(i.DeviceName, kp.Public)
+	if err != nil {
+		return err
+	}
+	sig, err := crypto.SignSchnorr(network.Suite, i.Private, msg)
+	if err != nil {
+		return err
+	}
+	reply, err := i.Send(i.Cothority.RandomServerIdentity(), &RotateKey{
+		ID:        i.ID,
+		Device:    i.DeviceName,
+		Public:    kp.Public,
+		Signature: &sig,
+	})
+	if err = sda.ErrMsg(reply, err); err != nil {
+		return err
+	}
+	i.Private = kp.Secret
+	i.Public = kp.Public
+	return i.ConfigUpdate()
+}
+
+// History returns all configurations of the identity, starting with the
+// first one. It checks that every data-skipblock is signed by the
+// cothority and follows the previous one.
+func (i *Identity) History() ([]*Config, error) {
+	msg, err := i.Send(i.Cothority.RandomServerIdentity(), &GetHistory{i.ID})
+	if err != nil {
+		return nil, err
+	}
+	blocks := msg.Msg.(GetHistoryReply).Blocks
+	if len(blocks) == 0 || !blocks[0].Hash.Equal(skipchain.SkipBlockID(i.ID)) {
+		return nil, errors.New("History doesn't start with the identity")
+	}
+	var configs []*Config
+	for n, sb := range blocks {
+		if sb == nil {
+			return nil, errors.New("History has an empty block")
+		}
+		if n > 0 && (len(sb.BackLinkIds) == 0 ||
+			!sb.BackLinkIds[0].Equal(blocks[n-1].Hash)) {
+			return nil, errors.New("History has a missing block")
+		}
+		if sb.BlockSig == nil || !sb.BlockSig.Hash.Equal(sb.Hash) {
+			return nil, errors.New("Signature is not on the block")
+		}
+		if err := sb.VerifySignatures(); err != nil {
+			return nil, err
+		}
+		_, c, err := network.UnmarshalRegistered(sb.Data)
+		if err != nil {
+			return nil, err
+		}
+		conf, ok := c.(*Config)
+		if !ok {
+			return nil, errors.New("Block doesn't hold a config")
+		}
+		configs = append(configs, conf)
+	}
+	return configs, nil
+}
+
+// StoreFile stores the content on the cothority and returns its FileHash,
+// which has to be added to the config to distribute the file.
+func (i *Identity) StoreFile(content []byte) (string, error) {
+	sig, err := crypto.SignSchnorr(network.Suite, i.Private,
+		FileMessage(i.ID, content))
+	if err != nil {
+		return "", err
+	}
+	msg, err := i.Send(i.Cothority.RandomServerIdentity(), &StoreFile{
+		ID:        i.ID,
+		Content:   content,
+		Device:    i.DeviceName,
+		Signature: &sig,
+	})
+	if err != nil {
+		return "", err
+	}
+	return msg.Msg.(StoreFileReply).Hash, nil
+}
+
+// GetFile returns the content of the stored file with the given FileHash.
+func (i *Identity) GetFile(hash string) ([]byte, error) {
+	msg, err := i.Send(i.Cothority.RandomServerIdentity(), &GetFile{i.ID, hash})
+	if err != nil {
+		return nil, err
+	}
+	content := msg.Msg.(GetFileReply).Content
+	if FileHash(content) != hash {
+		return nil, errors.New("Got file with wrong hash")
+	}
+	return content, nil
+}
+
 // ConfigUpdate asks if there is any new config available that has already
 // been approved by others and updates the local configuration
 func (i *Identity) ConfigUpdate() error {
@@ -1,11 +1,13 @@
 package identity
 
 import (
+	"bytes"
 	"testing"
 
 	"io/ioutil"
 	"os"
 
+	"github.com/csanti/pbft-experiments/cothority/crypto"
 	"github.com/csanti/pbft-experiments/cothority/log"
 	"github.com/csanti/pbft-experiments/cothority/network"
 	"github.com/csanti/pbft-experiments/cothority/sda"
@@ -217,7 +219,120 @@ func TestCrashAfterRevocation(t *testing.T) {
 	log.ErrFatal(c1.ProposeUpdate())
 }
 
+func TestIdentity_RevokeRotate(t *testing.T) {
+	l := sda.NewLocalTest()
+	_, el, _ := l.GenTree(5, true, true, true)
+	defer l.CloseAll()
+
+	c1 := NewIdentity(el, 2, "one")
+	c2 := NewIdentity(el, 2, "two")
+	c3 := NewIdentity(el, 2, "three")
+	log.ErrFatal(c1.CreateIdentity())
+	log.ErrFatal(c2.AttachToIdentity(c1.ID))
+	proposeUpVote(c1)
+	log.ErrFatal(c3.AttachToIdentity(c1.ID))
+	proposeUpVote(c1)
+	proposeUpVote(c2)
+
+	log.Lvl1("Rotating key of two")
+	old := c2.Public
+	log.ErrFatal(c2.RotateKey())
+	if !c2.Config.Device["two"].Point.Equal(c2.Public) || old.Equal(c2.Public) {
+		t.Fatal("Key wasn't rotated")
+	}
+
+	log.Lvl1("Revoking three")
+	log.ErrFatal(c1.ConfigUpdate())
+	if c1.ProposeThreshold(4) == nil {
+		t.Fatal("Threshold above the number of devices accepted")
+	}
+	log.ErrFatal(c1.ProposeRevoke("three"))
+	proposeUpVote(c1)
+	log.Lvl1("Rotating key of two with a pending proposition")
+	log.ErrFatal(c2.RotateKey())
+	log.ErrFatal(c2.ProposeUpdate())
+	if c2.Proposed == nil || !c2.Proposed.Device["two"].Point.Equal(c2.Public) {
+		t.Fatal("Rotation didn't keep the pending proposition")
+	}
+	if _, ok := c2.Proposed.Device["three"]; ok {
+		t.Fatal("Pending proposition changed")
+	}
+	proposeUpVote(c1)
+	proposeUpVote(c2)
+	log.ErrFatal(c1.ConfigUpdate())
+	if _, ok := c1.Config.Device["three"]; ok {
+		t.Fatal("Three wasn't revoked")
+	}
+	if c3.RotateKey() == nil {
+		t.Fatal("Revoked device rotated its key")
+	}
+
+	log.ErrFatal(c1.ProposeThreshold(1))
+	proposeUpVote(c1)
+	proposeUpVote(c2)
+
+	history, err := c1.History()
+	log.ErrFatal(err)
+	// creation, two attachments, two rotations, revocation and threshold
+	if len(history) != 7 {
+		t.Fatal("History should have 7 configs but has", len(history))
+	}
+	if history[6].Threshold != 1 || len(history[5].Device) != 2 ||
+		!history[4].Device["two"].Point.Equal(c2.Public) {
+		t.Fatal("Wrong history")
+	}
+}
+
 func proposeUpVote(i *Identity) {
 	log.ErrFatal(i.ProposeUpdate())
 	log.ErrFatal(i.ProposeVote(true))
 }
+
+func TestIdentity_StoreFile(t *testing.T) {
+	l := sda.NewLocalTest()
+	_, el, _ := l.GenTree(3, true, true, true)
+	defer l.CloseAll()
+
+	c1 := NewIdentity(el, 1, "one")
+	log.ErrFatal(c1.CreateIdentity())
+	content := []byte("-----BEGIN CERTIFICATE-----")
+	hash, err := c1.StoreFile(content)
+	log.ErrFatal(err)
+	if hash != FileHash(content) {
+		t.Fatal("Wrong hash of the file")
+	}
+	// every conode has to be able to return the file
+	for _, si := range el.List {
+		msg, err := c1.Send(si, &GetFile{c1.ID, hash})
+		log.ErrFatal(err)
+		if !bytes.Equal(msg.Msg.(GetFileReply).Content, content) {
+			t.Fatal("Conode returned wrong file")
+		}
+	}
+	if _, err := c1.GetFile(FileHash([]byte("other"))); err == nil {
+		t.Fatal("Got file that wasn't stored")
+	}
+	if _, err := c1.StoreFile(make([]byte, MaxFileSize+1)); err == nil {
+		t.Fatal("Stored a too big file")
+	}
+	sig, err := crypto.SignSchnorr(network.Suite, c1.Private,
+		FileMessage(c1.ID, content))
+	log.ErrFatal(err)
+	if _, err := c1.Send(el.List[0], &StoreFile{c1.ID, content, "two", &sig}); err == nil {
+		t.Fatal("Stored a file of an unknown device")
+	}
+
+	log.Lvl1("Removing unreferenced files")
+	kept := []byte("kept")
+	keptHash, err := c1.StoreFile(kept)
+	log.ErrFatal(err)
+	conf := c1.Config.Copy()
+	conf.Data[FilePrefix+":kept"] = keptHash
+	log.ErrFatal(c1.ProposeSend(conf))
+	proposeUpVote(c1)
+	if _, err := c1.GetFile(hash); err == nil {
+		t.Fatal("Unreferenced file wasn't removed")
+	}
+	_, err = c1.GetFile(keptHash)
+	log.ErrFatal(err)
+}
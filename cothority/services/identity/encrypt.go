@@ -0,0 +1,165 @@
+package identity
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/csanti/pbft-experiments/cothority/network"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/random"
+)
+
+/*
+Values of Config.Data can be encrypted to some of the devices, so that the
+conodes replicating the identity can't read them. The value is encrypted with
+AES-GCM under a random key, and that key is encrypted to every device with an
+ElGamal key-exchange with its public key.
+
+A device can only decrypt the values encrypted to its current key: values
+have to be encrypted again after a key-rotation, and a revoked device can
+still read the values it had access to.
+*/
+
+// EncryptedPrefix starts the values of Config.Data that are encrypted.
+const EncryptedPrefix = "encrypted:"
+
+// EncryptedValue holds a value encrypted to some devices.
+type EncryptedValue struct {
+	// Keys holds the key of the value encrypted to every device.
+	Keys       map[string]*EncryptedKey
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+// EncryptedKey is the key of a value encrypted to one device: K is the
+// ephemeral public key and Key the encrypted key.
+type EncryptedKey struct {
+	K   abstract.Point
+	Key []byte
+}
+
+// IsEncrypted returns whether the value of Config.Data is encrypted.
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, EncryptedPrefix)
+}
+
+// Encrypt returns the value encrypted to the given devices of the config,
+// to be stored in Config.Data.
+func (c *Config) Encrypt(value string, devices []string) (string, error) {
+	if len(devices) == 0 {
+		return "", errors.New("No devices to encrypt to")
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	ev := &EncryptedValue{
+		Keys:  make(map[string]*EncryptedKey),
+		Nonce: make([]byte, 12),
+	}
+	if _, err := rand.Read(ev.Nonce); err != nil {
+		return "", err
+	}
+	var err error
+	if ev.Ciphertext, err = seal(key, ev.Nonce, []byte(value)); err != nil {
+		return "", err
+	}
+	for _, d := range devices {
+		dev, ok := c.Device[d]
+		if !ok {
+			return "", errors.New("Didn't find device " + d)
+		}
+		r := network.Suite.Scalar().Pick(random.Stream)
+		ek := &EncryptedKey{K: network.Suite.Point().Mul(network.Suite.Point().Base(), r)}
+		kek, err := sharedKey(network.Suite.Point().Mul(dev.Point, r))
+		if err != nil {
+			return "", err
+		}
+		// every kek is used only once, so the nonce can be fixed
+		if ek.Key, err = seal(kek, make([]byte, 12), key); err != nil {
+			return "", err
+		}
+		ev.Keys[d] = ek
+	}
+	b, err := network.MarshalRegisteredType(ev)
+	if err != nil {
+		return "", err
+	}
+	return EncryptedPrefix + hex.EncodeToString(b), nil
+}
+
+// Decrypt returns the plaintext of an encrypted value of Config.Data, if it
+// is encrypted to this device.
+func (i *Identity) Decrypt(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return "", errors.New("Value is not encrypted")
+	}
+	b, err := hex.DecodeString(strings.TrimPrefix(value, EncryptedPrefix))
+	if err != nil {
+		return "", err
+	}
+	_, msg, err := network.UnmarshalRegistered(b)
+	if err != nil {
+		return "", err
+	}
+	ev, ok := msg.(*EncryptedValue)
+	if !ok {
+		return "", errors.New("Not an encrypted value")
+	}
+	ek, ok := ev.Keys[i.DeviceName]
+	if !ok {
+		return "", errors.New("Value is not encrypted to " + i.DeviceName)
+	}
+	kek, err := sharedKey(network.Suite.Point().Mul(ek.K, i.Private))
+	if err != nil {
+		return "", err
+	}
+	key, err := open(kek, make([]byte, 12), ek.Key)
+	if err != nil {
+		return "", err
+	}
+	plain, err := open(key, ev.Nonce, ev.Ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// sharedKey returns the AES-key from the ElGamal shared secret.
+func sharedKey(secret abstract.Point) ([]byte, error) {
+	b, err := secret.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(b)
+	return h[:], nil
+}
+
+func seal(key, nonce, plain []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, nonce, plain, nil), nil
+}
+
+func open(key, nonce, ciphertext []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
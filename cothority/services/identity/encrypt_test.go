@@ -0,0 +1,36 @@
+package identity
+
+import (
+	"testing"
+
+	"github.com/csanti/pbft-experiments/cothority/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_Encrypt(t *testing.T) {
+	one := NewIdentity(nil, 2, "one")
+	two := NewIdentity(nil, 2, "two")
+	three := NewIdentity(nil, 2, "three")
+	conf := one.Config
+	conf.Device["two"] = &Device{two.Public}
+	conf.Device["three"] = &Device{three.Public}
+
+	_, err := conf.Encrypt("token", []string{"one", "four"})
+	assert.NotNil(t, err)
+	value, err := conf.Encrypt("token", []string{"one", "two"})
+	log.ErrFatal(err)
+	assert.True(t, IsEncrypted(value))
+	assert.NotContains(t, value, "token")
+
+	for _, id := range []*Identity{one, two} {
+		plain, err := id.Decrypt(value)
+		log.ErrFatal(err)
+		assert.Equal(t, "token", plain)
+	}
+	_, err = three.Decrypt(value)
+	assert.NotNil(t, err)
+	// three can't use the key of another device
+	three.DeviceName = "two"
+	_, err = three.Decrypt(value)
+	assert.NotNil(t, err)
+}
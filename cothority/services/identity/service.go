@@ -37,6 +37,10 @@ const ServiceName = "Identity"
 
 var identityService sda.ServiceID
 
+// VerifyIdentity is the VerifierID of the data-skipchains: every new Config
+// has to be voted by the devices of the previous one.
+var VerifyIdentity = skipchain.RegisterVerification(ServiceName, verifyConfig)
+
 func init() {
 	sda.RegisterNewService(ServiceName, newIdentityService)
 	identityService = sda.ServiceFactory.ServiceID(ServiceName)
@@ -66,6 +70,10 @@ type Storage struct {
 	Votes    map[string]*crypto.SchnorrSig
 	Root     *skipchain.SkipBlock
 	Data     *skipchain.SkipBlock
+	// History holds all data-skipblocks, as signed by the cothority
+	History []*skipchain.SkipBlock
+	// Files holds the stored files by their FileHash
+	Files map[string][]byte
 }
 
 // AddIdentity will register a new SkipChain and add it to our list of
@@ -78,16 +86,17 @@ func (s *Service) AddIdentity(si *network.ServerIdentity, ai *AddIdentity) (netw
 	log.Lvl3("Creating Root-skipchain")
 	var err error
 	ids.Root, err = s.skipchain.CreateRoster(ai.Roster, 2, 10,
-		skipchain.VerifyNone, nil)
+		skipchain.VerifyRoster, nil)
 	if err != nil {
 		return nil, err
 	}
 	log.Lvl3("Creating Data-skipchain")
 	ids.Root, ids.Data, err = s.skipchain.CreateData(ids.Root, 2, 10,
-		skipchain.VerifyNone, ai.Config)
+		VerifyIdentity, ai.Config)
 	if err != nil {
 		return nil, err
 	}
+	ids.History = []*skipchain.SkipBlock{ids.Data}
 
 	roster := ids.Root.Roster
 	replies, err := manage.PropagateStartAndWait(s.Context, roster,
@@ -130,6 +139,12 @@ func (s *Service) ProposeSend(si *network.ServerIdentity, p *ProposeSend) (netwo
 	if sid == nil {
 		return nil, errors.New("Didn't find Identity")
 	}
+	if len(p.Config.Device) == 0 {
+		return nil, errors.New("Config without devices")
+	}
+	if p.Config.Threshold < 1 {
+		return nil, errors.New("Threshold has to be at least 1")
+	}
 	roster := sid.Root.Roster
 	replies, err := manage.PropagateStartAndWait(s.Context, roster,
 		p, 1000, s.Propagate)
@@ -206,33 +221,212 @@ func (s *Service) ProposeVote(si *network.ServerIdentity, v *ProposeVote) (netwo
 	if err != nil {
 		return nil, err
 	}
-	if len(sid.Votes) >= sid.Latest.Threshold ||
-		len(sid.Votes) == len(sid.Latest.Device) {
+	sid.Lock()
+	if sid.Proposed == nil {
+		// Another vote already stored the proposal
+		sid.Unlock()
+		return nil, nil
+	}
+	conf := sid.Proposed.Copy()
+	conf.Votes = make(map[string]*crypto.SchnorrSig)
+	for signer, sig := range sid.Votes {
+		if sig != nil {
+			conf.Votes[signer] = sig
+		}
+	}
+	sid.Unlock()
+	if len(conf.Votes) >= sid.Latest.Threshold ||
+		len(conf.Votes) == len(sid.Latest.Device) {
 		// If we have enough signatures, make a new data-skipblock and
 		// propagate it
 		log.Lvl3("Having majority or all votes")
 
 		// Making a new data-skipblock
-		log.Lvl3("Sending data-block with", sid.Proposed.Device)
-		reply, err := s.skipchain.ProposeData(sid.Root, sid.Data, sid.Proposed)
-		if err != nil {
+		log.Lvl3("Sending data-block with", conf.Device)
+		if err := s.storeConfig(v.ID, sid, conf, nil); err != nil {
 			return nil, err
 		}
-		_, msg, _ := network.UnmarshalRegistered(reply.Latest.Data)
-		log.Lvl3("SB signed is", msg.(*Config).Device)
-		usb := &UpdateSkipBlock{
-			ID:     v.ID,
-			Latest: reply.Latest,
+		return sid.Data, nil
+	}
+	return nil, nil
+}
+
+// RotateKey replaces the key of a device if the old key signed the new one.
+// A pending proposition stays pending with the new key, but as its hash
+// changes, the devices have to vote on it again.
+func (s *Service) RotateKey(si *network.ServerIdentity, rk *RotateKey) (network.Body, error) {
+	log.Lvl2(s, "Rotating key of", rk.Device)
+	sid := s.getIdentityStorage(rk.ID)
+	if sid == nil {
+		return nil, errors.New("Didn't find identity")
+	}
+	var pending *Config
+	conf, err := func() (*Config, error) {
+		sid.Lock()
+		defer sid.Unlock()
+		old, ok := sid.Latest.Device[rk.Device]
+		if !ok {
+			return nil, errors.New("Didn't find device")
+		}
+		if rk.Signature == nil {
+			return nil, errors.New("Rotation isn't signed")
 		}
-		_, err = manage.PropagateStartAndWait(s.Context, sid.Root.Roster,
-			usb, 1000, s.Propagate)
+		msg, err := sid.Latest.RotateMessage(rk.Device, rk.Public)
 		if err != nil {
 			return nil, err
 		}
-		s.save()
-		return sid.Data, nil
+		err = crypto.VerifySchnorr(network.Suite, old.Point, msg, *rk.Signature)
+		if err != nil {
+			return nil, errors.New("Wrong signature: " + err.Error())
+		}
+		conf := sid.Latest.Copy()
+		conf.Device[rk.Device] = &Device{rk.Public}
+		conf.Votes = map[string]*crypto.SchnorrSig{rk.Device: rk.Signature}
+		if sid.Proposed != nil {
+			pending = sid.Proposed.Copy()
+			if _, ok := pending.Device[rk.Device]; ok {
+				pending.Device[rk.Device] = &Device{rk.Public}
+			}
+			pending.Votes = nil
+		}
+		return conf, nil
+	}()
+	if err != nil {
+		return nil, err
 	}
-	return nil, nil
+	if err := s.storeConfig(rk.ID, sid, conf, pending); err != nil {
+		return nil, err
+	}
+	return sid.Data, nil
+}
+
+// GetHistory returns all signed data-skipblocks of the identity.
+func (s *Service) GetHistory(si *network.ServerIdentity, gh *GetHistory) (network.Body, error) {
+	sid := s.getIdentityStorage(gh.ID)
+	if sid == nil {
+		return nil, errors.New("Didn't find identity")
+	}
+	sid.Lock()
+	defer sid.Unlock()
+	return &GetHistoryReply{sid.History}, nil
+}
+
+// StoreFile stores the file on all services of the identity.
+func (s *Service) StoreFile(si *network.ServerIdentity, sf *StoreFile) (network.Body, error) {
+	sid := s.getIdentityStorage(sf.ID)
+	if sid == nil {
+		return nil, errors.New("Didn't find identity")
+	}
+	if len(sf.Content) > MaxFileSize {
+		return nil, fmt.Errorf("File is bigger than %d bytes", MaxFileSize)
+	}
+	err := func() error {
+		sid.Lock()
+		defer sid.Unlock()
+		dev, ok := sid.Latest.Device[sf.Device]
+		if !ok {
+			return errors.New("Didn't find device")
+		}
+		if sf.Signature == nil {
+			return errors.New("File isn't signed")
+		}
+		err := crypto.VerifySchnorr(network.Suite, dev.Point,
+			FileMessage(sf.ID, sf.Content), *sf.Signature)
+		if err != nil {
+			return errors.New("Wrong signature: " + err.Error())
+		}
+		size := len(sf.Content)
+		for _, content := range sid.Files {
+			size += len(content)
+		}
+		if size > MaxFilesSize {
+			return fmt.Errorf("Files are bigger than %d bytes", MaxFilesSize)
+		}
+		return nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+	roster := sid.Root.Roster
+	replies, err := manage.PropagateStartAndWait(s.Context, roster,
+		&PropagateFile{sf.ID, sf.Content}, 1000, s.Propagate)
+	if err != nil {
+		return nil, err
+	}
+	if replies != len(roster.List) {
+		log.Warn("Did only get", replies, "out of", len(roster.List))
+	}
+	s.save()
+	return &StoreFileReply{FileHash(sf.Content)}, nil
+}
+
+// GetFile returns a stored file of the identity.
+func (s *Service) GetFile(si *network.ServerIdentity, gf *GetFile) (network.Body, error) {
+	sid := s.getIdentityStorage(gf.ID)
+	if sid == nil {
+		return nil, errors.New("Didn't find identity")
+	}
+	sid.Lock()
+	defer sid.Unlock()
+	content, ok := sid.Files[gf.Hash]
+	if !ok {
+		return nil, errors.New("Didn't find file")
+	}
+	return &GetFileReply{content}, nil
+}
+
+// storeConfig signs the config in a new data-skipblock and sends it to all
+// services, with the proposition that stays pending, if any.
+func (s *Service) storeConfig(id ID, sid *Storage, conf, pending *Config) error {
+	reply, err := s.skipchain.ProposeData(sid.Root, sid.Data, conf)
+	if err != nil {
+		return err
+	}
+	_, msg, _ := network.UnmarshalRegistered(reply.Latest.Data)
+	log.Lvl3("SB signed is", msg.(*Config).Device)
+	usb := &UpdateSkipBlock{
+		ID:       id,
+		Latest:   reply.Latest,
+		Proposed: pending,
+	}
+	_, err = manage.PropagateStartAndWait(s.Context, sid.Root.Roster,
+		usb, 1000, s.Propagate)
+	if err != nil {
+		return err
+	}
+	s.save()
+	return nil
+}
+
+// verifyConfig makes sure the Config of a new data-skipblock is voted by the
+// devices of the Config of the last one.
+func verifyConfig(s *skipchain.Service, last, proposed *skipchain.SkipBlock) error {
+	_, msg, err := network.UnmarshalRegistered(proposed.Data)
+	if err != nil {
+		return err
+	}
+	conf, ok := msg.(*Config)
+	if !ok {
+		return errors.New("data isn't a Config")
+	}
+	if len(conf.Device) == 0 {
+		return errors.New("Config without devices")
+	}
+	if conf.Threshold < 1 {
+		return errors.New("Threshold has to be at least 1")
+	}
+	if last == nil {
+		return nil
+	}
+	_, msg, err = network.UnmarshalRegistered(last.Data)
+	if err != nil {
+		return err
+	}
+	previous, ok := msg.(*Config)
+	if !ok {
+		return errors.New("last data isn't a Config")
+	}
+	return conf.VerifyVotes(previous)
 }
 
 // NewProtocol is called by the Overlay when a new protocol request comes in.
@@ -261,6 +455,8 @@ func (s *Service) Propagate(msg network.Body) {
 		id = msg.(*ProposeVote).ID
 	case *UpdateSkipBlock:
 		id = msg.(*UpdateSkipBlock).ID
+	case *PropagateFile:
+		id = msg.(*PropagateFile).ID
 	case *PropagateIdentity:
 		pi := msg.(*PropagateIdentity)
 		id = ID(pi.Data.Hash)
@@ -289,6 +485,12 @@ func (s *Service) Propagate(msg network.Body) {
 		case *ProposeVote:
 			v := msg.(*ProposeVote)
 			sid.Votes[v.Signer] = v.Signature
+		case *PropagateFile:
+			content := msg.(*PropagateFile).Content
+			if sid.Files == nil {
+				sid.Files = make(map[string][]byte)
+			}
+			sid.Files[FileHash(content)] = content
 		case *UpdateSkipBlock:
 			skipblock := msg.(*UpdateSkipBlock).Latest
 			_, msgLatest, err := network.UnmarshalRegistered(skipblock.Data)
@@ -303,7 +505,21 @@ func (s *Service) Propagate(msg network.Body) {
 			}
 			sid.Data = skipblock
 			sid.Latest = al
-			sid.Proposed = nil
+			sid.Proposed = msg.(*UpdateSkipBlock).Proposed
+			sid.Votes = make(map[string]*crypto.SchnorrSig)
+			sid.History = append(sid.History, skipblock)
+			sid.removeFiles()
+		}
+	}
+}
+
+// removeFiles removes the files that aren't referenced by the latest or the
+// proposed config.
+func (sid *Storage) removeFiles() {
+	latest, proposed := sid.Latest.FileHashes(), sid.Proposed.FileHashes()
+	for hash := range sid.Files {
+		if !latest[hash] && !proposed[hash] {
+			delete(sid.Files, hash)
 		}
 	}
 }
@@ -376,7 +592,8 @@ func newIdentityService(c *sda.Context, path string) sda.Service {
 		log.Error(err)
 	}
 	for _, f := range []interface{}{s.ProposeSend, s.ProposeVote,
-		s.AddIdentity, s.ProposeUpdate, s.ConfigUpdate} {
+		s.AddIdentity, s.ProposeUpdate, s.ConfigUpdate, s.RotateKey,
+		s.GetHistory, s.StoreFile, s.GetFile} {
 		if err := s.RegisterMessage(f); err != nil {
 			log.Fatal("Registration error:", err)
 		}
@@ -1,10 +1,15 @@
 package identity
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"sort"
 
 	"fmt"
+	"io"
 	"strings"
 
 	"github.com/csanti/pbft-experiments/cothority/crypto"
@@ -18,12 +23,27 @@ import (
 // ID represents one skipblock and corresponds to its Hash.
 type ID skipchain.SkipBlockID
 
+// MaxFileSize is the biggest file the cothority stores for an identity.
+const MaxFileSize = 1 << 16
+
+// MaxFilesSize is the total size of the files the cothority stores for an
+// identity.
+const MaxFilesSize = 1 << 22
+
+// FilePrefix starts the keys in Config.Data holding the FileHash of a file.
+const FilePrefix = "file"
+
 // Config holds the information about all devices and the data stored in this
 // identity-blockchain. All Devices have voting-rights to the Config-structure.
 type Config struct {
 	Threshold int
 	Device    map[string]*Device
 	Data      map[string]string
+	// Votes are set by the service when it stores the config: the
+	// signatures of the devices of the previous config on the hash of this
+	// one, or the signature of the old key for a key rotation. They aren't
+	// part of the hash.
+	Votes map[string]*crypto.SchnorrSig
 }
 
 // Device is represented by a public key.
@@ -59,7 +79,8 @@ func (c *Config) Copy() *Config {
 }
 
 // Hash makes a cryptographic hash of the configuration-file - this
-// can be used as an ID.
+// can be used as an ID. It covers the threshold, the devices and all
+// entries of Data, so that the devices vote on all of them.
 func (c *Config) Hash() (crypto.HashID, error) {
 	hash := network.Suite.Hash()
 	err := binary.Write(hash, binary.LittleEndian, int32(c.Threshold))
@@ -72,26 +93,148 @@ func (c *Config) Hash() (crypto.HashID, error) {
 	}
 	sort.Strings(owners)
 	for _, s := range owners {
-		_, err = hash.Write([]byte(s))
-		if err != nil {
+		if err = writeLength(hash, []byte(s)); err != nil {
 			return nil, err
 		}
-		_, err = hash.Write([]byte(c.Data[s]))
+		b, err := network.MarshalRegisteredType(c.Device[s])
 		if err != nil {
 			return nil, err
 		}
-		b, err := network.MarshalRegisteredType(c.Device[s])
-		if err != nil {
+		if err = writeLength(hash, b); err != nil {
 			return nil, err
 		}
-		_, err = hash.Write(b)
-		if err != nil {
+	}
+	var keys []string
+	for k := range c.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err = writeLength(hash, []byte(k)); err != nil {
+			return nil, err
+		}
+		if err = writeLength(hash, []byte(c.Data[k])); err != nil {
 			return nil, err
 		}
 	}
 	return hash.Sum(nil), nil
 }
 
+// writeLength writes the length of b before b, so that the entries of the
+// hash can't be shifted into each other.
+func writeLength(w io.Writer, b []byte) error {
+	if err := binary.Write(w, binary.LittleEndian, int32(len(b))); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// RotateMessage returns the message the old key of the device signs to
+// replace it with public. It depends on the current Config, so that the
+// signature can't be used again later.
+func (c *Config) RotateMessage(device string, public abstract.Point) ([]byte, error) {
+	hash, err := c.Hash()
+	if err != nil {
+		return nil, err
+	}
+	b, err := public.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	msg := append([]byte(hash), []byte(device)...)
+	return append(msg, b...), nil
+}
+
+// VerifyVotes returns an error if neither a threshold of the devices of the
+// previous config, or all of them, signed c, nor c is a key rotation
+// signed by the old key.
+func (c *Config) VerifyVotes(previous *Config) error {
+	hash, err := c.Hash()
+	if err != nil {
+		return err
+	}
+	votes := 0
+	for name, sig := range c.Votes {
+		dev, ok := previous.Device[name]
+		if !ok || sig == nil {
+			continue
+		}
+		if crypto.VerifySchnorr(network.Suite, dev.Point, hash, *sig) == nil {
+			votes++
+		}
+	}
+	if votes >= previous.Threshold || votes == len(previous.Device) {
+		return nil
+	}
+	if c.verifyRotation(previous) == nil {
+		return nil
+	}
+	return fmt.Errorf("config has %d votes, but needs %d", votes,
+		previous.Threshold)
+}
+
+// verifyRotation returns an error if c isn't the previous config with the
+// key of one device replaced and signed by its old key.
+func (c *Config) verifyRotation(previous *Config) error {
+	if len(c.Votes) != 1 {
+		return errors.New("not a key rotation")
+	}
+	for name, sig := range c.Votes {
+		old, ok := previous.Device[name]
+		dev, ok2 := c.Device[name]
+		if !ok || !ok2 || sig == nil {
+			return errors.New("rotation of an unknown device")
+		}
+		rotated := previous.Copy()
+		rotated.Device[name] = &Device{dev.Point}
+		want, err := rotated.Hash()
+		if err != nil {
+			return err
+		}
+		hash, err := c.Hash()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(want, hash) {
+			return errors.New("rotation changes more than the key")
+		}
+		msg, err := previous.RotateMessage(name, dev.Point)
+		if err != nil {
+			return err
+		}
+		return crypto.VerifySchnorr(network.Suite, old.Point, msg, *sig)
+	}
+	return nil
+}
+
+// FileHash returns the hex-encoded hash that identifies the content of a
+// file.
+func FileHash(content []byte) string {
+	h := sha256.Sum256(content)
+	return hex.EncodeToString(h[:])
+}
+
+// FileMessage returns the message a device signs to store the content as a
+// file of the identity.
+func FileMessage(id ID, content []byte) []byte {
+	return append(append([]byte{}, id...), []byte(FileHash(content))...)
+}
+
+// FileHashes returns the FileHashes referenced by the config.
+func (c *Config) FileHashes() map[string]bool {
+	hashes := make(map[string]bool)
+	if c == nil {
+		return hashes
+	}
+	for k, v := range c.Data {
+		if strings.HasPrefix(k, FilePrefix+":") {
+			hashes[v] = true
+		}
+	}
+	return hashes
+}
+
 // String returns a nicely formatted output of the AccountList
 func (c *Config) String() string {
 	var owners []string
@@ -219,6 +362,55 @@ type ProposeVote struct {
 	Signature *crypto.SchnorrSig
 }
 
+// RotateKey replaces the key of a device. The signature of the old key on
+// RotateMessage authorizes the rotation without the votes of the other
+// devices.
+type RotateKey struct {
+	ID        ID
+	Device    string
+	Public    abstract.Point
+	Signature *crypto.SchnorrSig
+}
+
+// GetHistory asks for all signed data-skipblocks of an identity.
+type GetHistory struct {
+	ID ID
+}
+
+// GetHistoryReply holds the data-skipblocks, starting with the one that
+// created the identity. Every skipblock holds a Config.
+type GetHistoryReply struct {
+	Blocks []*skipchain.SkipBlock
+}
+
+// StoreFile asks the cothority to store a file of the identity. The file is
+// referenced by its FileHash in Config.Data, so that the devices vote on it.
+// Files that aren't referenced by the latest or the proposed config are
+// removed when a new config is stored.
+type StoreFile struct {
+	ID      ID
+	Content []byte
+	// Device of the identity that signed the FileMessage
+	Device    string
+	Signature *crypto.SchnorrSig
+}
+
+// StoreFileReply returns the FileHash of the stored file.
+type StoreFileReply struct {
+	Hash string
+}
+
+// GetFile asks for the file with the given FileHash.
+type GetFile struct {
+	ID   ID
+	Hash string
+}
+
+// GetFileReply holds the content of the file.
+type GetFileReply struct {
+	Content []byte
+}
+
 // Messages to be sent from one identity to another
 
 // PropagateIdentity sends a new identity to other identityServices
@@ -232,8 +424,16 @@ type ProposeSend struct {
 	*Config
 }
 
+// PropagateFile sends a new file to other identityServices
+type PropagateFile struct {
+	ID      ID
+	Content []byte
+}
+
 // UpdateSkipBlock asks the service to fetch the latest SkipBlock
 type UpdateSkipBlock struct {
 	ID     ID
 	Latest *skipchain.SkipBlock
+	// Proposed is the proposition that stays pending after Latest, or nil
+	Proposed *Config
 }
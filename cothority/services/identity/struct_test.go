@@ -3,7 +3,11 @@ package identity
 import (
 	"testing"
 
+	"github.com/csanti/pbft-experiments/cothority/crypto"
+	"github.com/csanti/pbft-experiments/cothority/log"
+	"github.com/csanti/pbft-experiments/cothority/network"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/dedis/crypto.v0/config"
 )
 
 func TestGetKeys(t *testing.T) {
@@ -29,6 +33,46 @@ func TestKvGetIntKeys(t *testing.T) {
 	assert.Equal(t, "gh", s2)
 }
 
+func TestConfig_VerifyVotes(t *testing.T) {
+	kp1 := config.NewKeyPair(network.Suite)
+	kp2 := config.NewKeyPair(network.Suite)
+	previous := NewConfig(2, kp1.Public, "one")
+	previous.Device["two"] = &Device{kp2.Public}
+
+	conf := previous.Copy()
+	conf.Data["one"] = "new"
+	hash, err := conf.Hash()
+	log.ErrFatal(err)
+	sig1, err := crypto.SignSchnorr(network.Suite, kp1.Secret, hash)
+	log.ErrFatal(err)
+	conf.Votes = map[string]*crypto.SchnorrSig{"one": &sig1}
+	assert.NotNil(t, conf.VerifyVotes(previous))
+	conf.Votes["two"] = &sig1
+	assert.NotNil(t, conf.VerifyVotes(previous))
+	sig2, err := crypto.SignSchnorr(network.Suite, kp2.Secret, hash)
+	log.ErrFatal(err)
+	conf.Votes["two"] = &sig2
+	assert.Nil(t, conf.VerifyVotes(previous))
+	changed := conf.Copy()
+	changed.Data[FilePrefix+":name"] = "hash"
+	assert.NotNil(t, changed.VerifyVotes(previous))
+
+	kp3 := config.NewKeyPair(network.Suite)
+	msg, err := previous.RotateMessage("one", kp3.Public)
+	log.ErrFatal(err)
+	sig, err := crypto.SignSchnorr(network.Suite, kp1.Secret, msg)
+	log.ErrFatal(err)
+	rotated := previous.Copy()
+	rotated.Device["one"] = &Device{kp3.Public}
+	rotated.Votes = map[string]*crypto.SchnorrSig{"one": &sig}
+	assert.Nil(t, rotated.VerifyVotes(previous))
+	rotated.Data["one"] = "new"
+	assert.NotNil(t, rotated.VerifyVotes(previous))
+	delete(rotated.Data, "one")
+	rotated.Data["ssh:one:gh"] = "key"
+	assert.NotNil(t, rotated.VerifyVotes(previous))
+}
+
 func setupConfig() *Config {
 	return &Config{
 		Data: map[string]string{
@@ -2,6 +2,7 @@ package medco
 
 import (
 	"strconv"
+	"strings"
 
 	"github.com/btcsuite/goleveldb/leveldb/errors"
 	"github.com/csanti/pbft-experiments/cothority/log"
@@ -50,21 +51,54 @@ func (c *API) CreateSurvey(entities *sda.Roster, surveyDescription libmedco.Surv
 	return &surveyID, nil
 }
 
+// CreateQuerySurvey creates a survey for the client responses of a query.
+func (c *API) CreateQuerySurvey(entities *sda.Roster, query *libmedco.Query) (*libmedco.SurveyID, error) {
+	if err := query.Validate(); err != nil {
+		return nil, err
+	}
+	return c.CreateSurvey(entities, query.Description())
+}
+
 // SendSurveyResultsData creates and sends a client response encrypted with the cothority collective key.
 func (c *API) SendSurveyResultsData(surveyID libmedco.SurveyID, grouping, aggregating []int64, groupKey abstract.Point) error {
 	log.Lvl1(c, "responds {", grouping, ",", aggregating, "}")
 	encGrouping := libmedco.EncryptIntVector(groupKey, grouping)
 	encAggregating := libmedco.EncryptIntVector(groupKey, aggregating)
 	_, err := c.Send(c.entryPoint, &SurveyResponseQuery{surveyID,
-		libmedco.ClientResponse{
+		[]libmedco.ClientResponse{{
 			ProbabilisticGroupingAttributes: *encGrouping,
-			AggregatingAttributes:           *encAggregating}})
+			AggregatingAttributes:           *encAggregating}}})
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// SendSurveyResponses encrypts and sends a chunk of client responses, so that a data provider can send its responses
+// over time until the survey is closed.
+func (c *API) SendSurveyResponses(surveyID libmedco.SurveyID, grouping, aggregating [][]int64, groupKey abstract.Point) error {
+	if len(grouping) != len(aggregating) {
+		return errors.New("Got different numbers of grouping and aggregating attributes")
+	}
+	log.Lvl1(c, "sends", len(grouping), "responses")
+	responses := make([]libmedco.ClientResponse, len(grouping))
+	for i := range grouping {
+		responses[i] = libmedco.ClientResponse{
+			ProbabilisticGroupingAttributes: *libmedco.EncryptIntVector(groupKey, grouping[i]),
+			AggregatingAttributes:           *libmedco.EncryptIntVector(groupKey, aggregating[i]),
+		}
+	}
+	_, err := c.Send(c.entryPoint, &SurveyResponseQuery{surveyID, responses})
+	return err
+}
+
+// CloseSurvey stops the servers from accepting client responses, which is needed before getting the results.
+func (c *API) CloseSurvey(surveyID libmedco.SurveyID) error {
+	log.Lvl1(c, "closes the survey", surveyID)
+	_, err := c.Send(c.entryPoint, &SurveyCloseQuery{surveyID})
+	return err
+}
+
 // GetSurveyResults to get the result from associated server and decrypt the response using its private key.
 func (c *API) GetSurveyResults(surveyID libmedco.SurveyID) (*[][]int64, *[][]int64, error) {
 	resp, err := c.Send(c.entryPoint, &SurveyResultsQuery{surveyID, c.public})
@@ -73,6 +107,13 @@ func (c *API) GetSurveyResults(surveyID libmedco.SurveyID) (*[][]int64, *[][]int
 	}
 	if encResults, ok := resp.Msg.(SurveyResultResponse); ok == true {
 		log.Lvl1(c, "got the survey result from", c.entryPoint)
+		if len(encResults.BadServers) > 0 {
+			var bad []string
+			for _, b := range encResults.BadServers {
+				bad = append(bad, b.Server.String()+": "+b.Reason)
+			}
+			return nil, nil, errors.New("Results are corrupted by " + strings.Join(bad, ", "))
+		}
 		grp := make([][]int64, len(encResults.Results))
 		aggr := make([][]int64, len(encResults.Results))
 		for i, res := range encResults.Results {
@@ -87,6 +128,24 @@ func (c *API) GetSurveyResults(surveyID libmedco.SurveyID) (*[][]int64, *[][]int
 
 }
 
+// SendQueryResponse encodes the record for the query and sends it like SendSurveyResultsData.
+func (c *API) SendQueryResponse(surveyID libmedco.SurveyID, query *libmedco.Query, record map[string]int64, groupKey abstract.Point) error {
+	grouping, aggregating, err := query.Encode(record)
+	if err != nil {
+		return err
+	}
+	return c.SendSurveyResultsData(surveyID, grouping, aggregating, groupKey)
+}
+
+// GetQueryResults gets the survey results and returns the ones of the groups matching the query.
+func (c *API) GetQueryResults(surveyID libmedco.SurveyID, query *libmedco.Query) ([]libmedco.QueryResult, error) {
+	grp, aggr, err := c.GetSurveyResults(surveyID)
+	if err != nil {
+		return nil, err
+	}
+	return query.Decode(*grp, *aggr)
+}
+
 // String permits to have the string representation of a client.
 func (c *API) String() string {
 	return "[Client-" + strconv.FormatInt(c.localClientNumber, 10) + "]"
@@ -127,10 +127,17 @@ func DecryptPoint(prikey abstract.Scalar, c CipherText) abstract.Point {
 	return M
 }
 
-// DecryptInt decrypts an integer from an ElGamal cipher text where integer are encoded in the exponent.
+// DecryptInt decrypts an integer from an ElGamal cipher text where integer are encoded in the exponent. Negative
+// integers, e.g. from differential-privacy noise, are decrypted too.
 func DecryptInt(prikey abstract.Scalar, cipher CipherText) int64 {
 	M := DecryptPoint(prikey, cipher)
-	return discreteLog(M)
+	if m := discreteLog(M); m < MaxHomomorphicInt {
+		return m
+	}
+	if m := discreteLog(suite.Point().Neg(M)); m < MaxHomomorphicInt {
+		return -m
+	}
+	return MaxHomomorphicInt
 }
 
 // DecryptIntVector decrypts a cipherVector.
@@ -194,7 +201,10 @@ func (cv *CipherVector) DeterministicSwitching(cipher *CipherVector, private abs
 
 // ProbabilisticSwitching performs one step in the Probabilistic switching process and stores result in receiver.
 func (c *CipherText) ProbabilisticSwitching(cipher *CipherText, PHContrib abstract.Point, targetPublic abstract.Point) *CipherText {
-	r := suite.Scalar().Pick(random.Stream)
+	return c.probabilisticSwitching(cipher, PHContrib, targetPublic, suite.Scalar().Pick(random.Stream))
+}
+
+func (c *CipherText) probabilisticSwitching(cipher *CipherText, PHContrib, targetPublic abstract.Point, r abstract.Scalar) *CipherText {
 	EGEphemContrib := suite.Point().Mul(suite.Point().Base(), r)
 	EGContrib := suite.Point().Mul(targetPublic, r)
 	c.ReplaceContribution(cipher, PHContrib, EGContrib)
@@ -212,7 +222,10 @@ func (cv *CipherVector) ProbabilisticSwitching(cipher *CipherVector, phContrib,
 
 // KeySwitching performs one step in the Key switching process and stores result in receiver.
 func (c *CipherText) KeySwitching(cipher *CipherText, originalEphemeralKey, newKey abstract.Point, private abstract.Scalar) *CipherText {
-	r := suite.Scalar().Pick(random.Stream)
+	return c.keySwitching(cipher, originalEphemeralKey, newKey, private, suite.Scalar().Pick(random.Stream))
+}
+
+func (c *CipherText) keySwitching(cipher *CipherText, originalEphemeralKey, newKey abstract.Point, private, r abstract.Scalar) *CipherText {
 	oldContrib := suite.Point().Mul(originalEphemeralKey, private)
 	newContrib := suite.Point().Mul(newKey, r)
 	ephemContrib := suite.Point().Mul(suite.Point().Base(), r)
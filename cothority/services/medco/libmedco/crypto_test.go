@@ -168,3 +168,11 @@ func TestEqualDeterministCipherText(t *testing.T) {
 	assert.False(t, pdcv1.Equal(&dcv2))
 	assert.True(t, pdcv1.Equal(nilp))
 }
+
+// TestNegativeInt verifies the decryption of negative integers, e.g. after adding noise.
+func TestNegativeInt(t *testing.T) {
+	secKey, pubKey := GenKey()
+	sum := NewCipherText()
+	sum.Add(*EncryptInt(pubKey, 2), *EncryptInt(pubKey, -5))
+	assert.Equal(t, int64(-3), DecryptInt(secKey, *sum))
+}
@@ -1,6 +1,7 @@
 package libmedco
 
 import (
+	"errors"
 	"strings"
 
 	"github.com/csanti/pbft-experiments/cothority/sda"
@@ -8,7 +9,7 @@ import (
 )
 
 // PROOF is true if we use protocols with proofs (ZKPs).
-const PROOF = false
+const PROOF = true
 
 // GroupingAttributes are attributes involved in grouping.
 type GroupingAttributes DeterministCipherVector
@@ -34,14 +35,102 @@ type Survey struct {
 	ID                SurveyID
 	Roster            sda.Roster
 	SurveyPHKey       abstract.Scalar
-	ClientPublic      abstract.Point
 	SurveyDescription SurveyDescription
+	// Closed is set once the survey doesn't accept client responses anymore.
+	Closed bool
 }
 
-// SurveyDescription is currently only used to define a client response format.
+// SurveyStorage is the state of a survey that is stored, so that a server can continue the survey after a restart.
+type SurveyStorage struct {
+	ID                SurveyID
+	Roster            sda.Roster
+	SurveyPHKey       abstract.Scalar
+	SurveyDescription SurveyDescription
+	Closed            bool
+	// ClientResponses are the responses with grouping attributes that aren't grouped yet.
+	ClientResponses []ClientResponse
+	// Aggregated is the sum of the responses without grouping attributes.
+	Aggregated CipherVector
+	// Groups are the sums of the grouped responses.
+	Groups []GroupStorage
+}
+
+// GroupStorage is the sum of the responses of a group as stored.
+type GroupStorage struct {
+	Grouping    GroupingAttributes
+	Aggregating CipherVector
+}
+
+// Storage returns the state of the survey to store.
+func (s *Survey) Storage() *SurveyStorage {
+	return &SurveyStorage{
+		ID:                s.ID,
+		Roster:            s.Roster,
+		SurveyPHKey:       s.SurveyPHKey,
+		SurveyDescription: s.SurveyDescription,
+		Closed:            s.Closed,
+		ClientResponses:   s.ClientResponses,
+		Aggregated:        s.LocGroupingAggregating[DefaultGroup],
+		Groups:            s.groups(),
+	}
+}
+
+// groups returns the sums of the grouped responses to store.
+func (s *Survey) groups() []GroupStorage {
+	var groups []GroupStorage
+	for key, aggr := range s.LocGroupingAggregating {
+		if key == DefaultGroup {
+			continue
+		}
+		groups = append(groups, GroupStorage{s.LocGroupingGroups[key], aggr})
+	}
+	return groups
+}
+
+// NewSurveyFromStorage returns the survey of the stored state.
+func NewSurveyFromStorage(st *SurveyStorage) Survey {
+	s := Survey{
+		SurveyStore:       NewSurveyStore(),
+		ID:                st.ID,
+		Roster:            st.Roster,
+		SurveyPHKey:       st.SurveyPHKey,
+		SurveyDescription: st.SurveyDescription,
+		Closed:            st.Closed,
+	}
+	s.ClientResponses = st.ClientResponses
+	if len(st.Aggregated) > 0 {
+		s.LocGroupingAggregating[DefaultGroup] = st.Aggregated
+	}
+	for _, g := range st.Groups {
+		key := g.Grouping.Key()
+		s.LocGroupingGroups[key] = g.Grouping
+		s.LocGroupingAggregating[key] = g.Aggregating
+	}
+	return s
+}
+
+// SurveyDescription defines a client response format and the privacy of the results.
 type SurveyDescription struct {
 	GroupingAttributesCount    int32
 	AggregatingAttributesCount uint32
+	// Epsilon is the differential privacy of the results, they are exact if it is 0.
+	Epsilon float64
+	// Sensitivity is the most a single client response changes an aggregating attribute, 1 if not set.
+	Sensitivity int64
+	// Filters is the number of first grouping attributes that are filters of a query. The querier learns the
+	// aggregates of the groups that don't match them too, so they need differential privacy.
+	Filters int32
+}
+
+// Validate checks that the servers can run the survey without revealing the exact aggregates of filtered groups.
+func (sd *SurveyDescription) Validate() error {
+	if sd.Filters < 0 || sd.Filters > sd.GroupingAttributesCount {
+		return errors.New("filters have to be grouping attributes")
+	}
+	if sd.Filters > 0 && sd.Epsilon <= 0 {
+		return errors.New("survey with filters needs differential privacy")
+	}
+	return nil
 }
 
 // Key is used in order to get a map-friendly representation of grouping attributes to be used as keys.
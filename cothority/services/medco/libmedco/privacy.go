@@ -0,0 +1,151 @@
+package libmedco
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+)
+
+// DefaultPrivacyBudget is the total epsilon a querier can spend on a server.
+const DefaultPrivacyBudget = 1.0
+
+// noiseRand draws the noise from crypto/rand, so that it can't be predicted.
+var noiseRand = struct {
+	*rand.Rand
+	sync.Mutex
+}{Rand: rand.New(cryptoSource{})}
+
+// NoiseShare returns the share of one out of nodes servers of the noise for a
+// result with the given epsilon and sensitivity. The shares of all servers add
+// up to two-sided geometric noise, Pr[x] proportional to alpha^|x| with
+// alpha = exp(-epsilon/sensitivity), so that no server knows the noise.
+func NoiseShare(epsilon float64, sensitivity int64, nodes int) int64 {
+	if sensitivity < 1 {
+		sensitivity = 1
+	}
+	alpha := math.Exp(-epsilon / float64(sensitivity))
+	share := 1 / float64(nodes)
+	noiseRand.Lock()
+	defer noiseRand.Unlock()
+	return polya(noiseRand.Rand, share, alpha) - polya(noiseRand.Rand, share, alpha)
+}
+
+// NoiseShareVector returns a vector of length noise shares.
+func NoiseShareVector(epsilon float64, sensitivity int64, nodes, length int) []int64 {
+	noise := make([]int64, length)
+	for i := range noise {
+		noise[i] = NoiseShare(epsilon, sensitivity, nodes)
+	}
+	return noise
+}
+
+// polya draws from the negative binomial distribution with r failures and
+// success probability p. The sum of n draws with r = 1/n is geometric.
+func polya(rnd *rand.Rand, r, p float64) int64 {
+	return poisson(rnd, gamma(rnd, r)*p/(1-p))
+}
+
+// gamma draws from the gamma distribution with the given shape and scale 1,
+// following Marsaglia and Tsang.
+func gamma(rnd *rand.Rand, shape float64) float64 {
+	if shape < 1 {
+		return gamma(rnd, shape+1) * math.Pow(rnd.Float64(), 1/shape)
+	}
+	d := shape - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := rnd.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		if math.Log(rnd.Float64()) < 0.5*x*x+d-d*v+d*math.Log(v) {
+			return d * v
+		}
+	}
+}
+
+// poisson draws from the poisson distribution, in steps small enough for
+// exp(-lambda) not to underflow.
+func poisson(rnd *rand.Rand, lambda float64) int64 {
+	var k int64
+	for lambda > 0 {
+		step := math.Min(lambda, 500)
+		lambda -= step
+		limit := math.Exp(-step)
+		for p := rnd.Float64(); p > limit; p *= rnd.Float64() {
+			k++
+		}
+	}
+	return k
+}
+
+type cryptoSource struct{}
+
+func (cryptoSource) Int63() int64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return int64(binary.LittleEndian.Uint64(b[:]) >> 1)
+}
+
+func (cryptoSource) Seed(int64) {}
+
+// PrivacyBudget holds the epsilon spent by every querier, identified by its public key. Every server keeps its own
+// budget and refuses its share of the noise once the querier spent its budget. The key of the querier isn't
+// registered, so a querier using several keys gets several budgets.
+type PrivacyBudget struct {
+	Limit float64
+	Spent map[string]float64
+	sync.Mutex
+}
+
+// NewPrivacyBudget returns a budget allowing each querier to spend limit.
+func NewPrivacyBudget(limit float64) *PrivacyBudget {
+	return &PrivacyBudget{
+		Limit: limit,
+		Spent: make(map[string]float64),
+	}
+}
+
+// Remaining returns the epsilon the querier can still spend.
+func (b *PrivacyBudget) Remaining(querier string) float64 {
+	b.Lock()
+	defer b.Unlock()
+	return b.Limit - b.Spent[querier]
+}
+
+// Spend charges epsilon to the querier, or returns an error if it exceeds
+// the remaining budget.
+func (b *PrivacyBudget) Spend(querier string, epsilon float64) error {
+	if epsilon <= 0 {
+		return errors.New("epsilon has to be positive")
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.Spent == nil {
+		b.Spent = make(map[string]float64)
+	}
+	if b.Spent[querier]+epsilon > b.Limit {
+		return fmt.Errorf("privacy budget exhausted: %g of %g spent",
+			b.Spent[querier], b.Limit)
+	}
+	b.Spent[querier] += epsilon
+	return nil
+}
+
+// Refund gives back epsilon spent by the querier on a query that failed.
+func (b *PrivacyBudget) Refund(querier string, epsilon float64) {
+	b.Lock()
+	defer b.Unlock()
+	b.Spent[querier] -= epsilon
+	if b.Spent[querier] <= 0 {
+		delete(b.Spent, querier)
+	}
+}
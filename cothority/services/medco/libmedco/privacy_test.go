@@ -0,0 +1,48 @@
+package libmedco_test
+
+import (
+	"math"
+	"testing"
+
+	. "github.com/csanti/pbft-experiments/cothority/services/medco/libmedco"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestNoiseShare checks that the shares of all servers add up to
+// two-sided geometric noise.
+func TestNoiseShare(t *testing.T) {
+	epsilon, nodes, rounds := 0.5, 5, 20000
+	alpha := math.Exp(-epsilon)
+	var sum, sumSquares, zeros float64
+	for i := 0; i < rounds; i++ {
+		var noise int64
+		for n := 0; n < nodes; n++ {
+			noise += NoiseShare(epsilon, 1, nodes)
+		}
+		sum += float64(noise)
+		sumSquares += float64(noise * noise)
+		if noise == 0 {
+			zeros++
+		}
+	}
+	mean := sum / float64(rounds)
+	variance := sumSquares/float64(rounds) - mean*mean
+	expected := 2 * alpha / ((1 - alpha) * (1 - alpha))
+	assert.InDelta(t, 0, mean, 0.2)
+	assert.InEpsilon(t, expected, variance, 0.1)
+	assert.InEpsilon(t, (1-alpha)/(1+alpha), zeros/float64(rounds), 0.1)
+}
+
+func TestPrivacyBudget(t *testing.T) {
+	b := NewPrivacyBudget(1)
+	assert.Nil(t, b.Spend("querier", 0.6))
+	assert.NotNil(t, b.Spend("querier", 0.6))
+	assert.Nil(t, b.Spend("other", 0.6))
+	assert.Nil(t, b.Spend("querier", 0.4))
+	assert.NotNil(t, b.Spend("querier", 0.1))
+	assert.NotNil(t, b.Spend("other", 0))
+	assert.InDelta(t, 0.4, b.Remaining("other"), 1e-9)
+	b.Refund("other", 0.6)
+	assert.InDelta(t, 1, b.Remaining("other"), 1e-9)
+	assert.Nil(t, b.Spend("other", 1))
+}
@@ -0,0 +1,235 @@
+package libmedco
+
+import (
+	"errors"
+	"fmt"
+
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/random"
+)
+
+// DLEQProof is a non-interactive Chaum-Pedersen proof that P1 = xG and P2 = xH for the same secret x.
+type DLEQProof struct {
+	Challenge abstract.Scalar
+	Response  abstract.Scalar
+}
+
+// DeterministicSwitchingProof proves that a server removed its ElGamal contribution, the product of its private key
+// and the ephemeral key, and added its Pohlig-Hellman contribution, the product of its Pohlig-Hellman key and the base
+// point.
+type DeterministicSwitchingProof struct {
+	EGContrib abstract.Point
+	PHContrib abstract.Point
+	Proof     DLEQProof
+	// PHProof is a DLEQProof with both bases the base point, so a proof of knowledge of the Pohlig-Hellman key.
+	PHProof DLEQProof
+}
+
+// ProbabilisticSwitchingProof proves that a server removed its Pohlig-Hellman contribution and encrypted the
+// ciphertext to the target key.
+type ProbabilisticSwitchingProof struct {
+	PHContrib abstract.Point
+	Proof     DLEQProof
+}
+
+// KeySwitchingProof proves that a server removed its contribution to the original encryption and encrypted the
+// ciphertext to the new key.
+type KeySwitchingProof struct {
+	OldContrib abstract.Point
+	OldProof   DLEQProof
+	NewProof   DLEQProof
+}
+
+// Constructors
+//______________________________________________________________________________________________________________________
+
+// NewDLEQProof returns the proof that xG and xH have the same discrete logarithm x.
+func NewDLEQProof(x abstract.Scalar, G, H abstract.Point) DLEQProof {
+	v := suite.Scalar().Pick(random.Stream)
+	t1 := suite.Point().Mul(G, v)
+	t2 := suite.Point().Mul(H, v)
+	c := dleqChallenge(G, H, suite.Point().Mul(G, x), suite.Point().Mul(H, x), t1, t2)
+	r := suite.Scalar().Sub(v, suite.Scalar().Mul(c, x))
+	return DLEQProof{Challenge: c, Response: r}
+}
+
+// Verify checks that P1 = xG and P2 = xH for the same x.
+func (p *DLEQProof) Verify(G, H, P1, P2 abstract.Point) bool {
+	if p.Challenge == nil || p.Response == nil {
+		return false
+	}
+	t1 := suite.Point().Add(suite.Point().Mul(G, p.Response), suite.Point().Mul(P1, p.Challenge))
+	t2 := suite.Point().Add(suite.Point().Mul(H, p.Response), suite.Point().Mul(P2, p.Challenge))
+	return dleqChallenge(G, H, P1, P2, t1, t2).Equal(p.Challenge)
+}
+
+// dleqChallenge hashes the statement and the commitments to the challenge.
+func dleqChallenge(points ...abstract.Point) abstract.Scalar {
+	var buf []byte
+	for _, p := range points {
+		b, err := p.MarshalBinary()
+		if err != nil {
+			panic(err)
+		}
+		buf = append(buf, b...)
+	}
+	return suite.Scalar().Pick(suite.Cipher(buf))
+}
+
+// Switching with proofs
+//______________________________________________________________________________________________________________________
+
+// DeterministicSwitchingWithProof performs the deterministic switching with the Pohlig-Hellman key and returns the
+// proof of it.
+func (c *CipherText) DeterministicSwitchingWithProof(cipher *CipherText, private, phKey abstract.Scalar) DeterministicSwitchingProof {
+	base := suite.Point().Base()
+	proof := DeterministicSwitchingProof{
+		EGContrib: suite.Point().Mul(cipher.K, private),
+		PHContrib: suite.Point().Mul(base, phKey),
+		Proof:     NewDLEQProof(private, base, cipher.K),
+		PHProof:   NewDLEQProof(phKey, base, base),
+	}
+	c.DeterministicSwitching(cipher, private, proof.PHContrib)
+	return proof
+}
+
+// ProbabilisticSwitchingWithProof performs the probabilistic switching and returns the proof of it.
+func (c *CipherText) ProbabilisticSwitchingWithProof(cipher *CipherText, phContrib, targetPublic abstract.Point) ProbabilisticSwitchingProof {
+	r := suite.Scalar().Pick(random.Stream)
+	c.probabilisticSwitching(cipher, phContrib, targetPublic, r)
+	return ProbabilisticSwitchingProof{
+		PHContrib: phContrib,
+		Proof:     NewDLEQProof(r, suite.Point().Base(), targetPublic),
+	}
+}
+
+// KeySwitchingWithProof performs the key switching and returns the proof of it.
+func (c *CipherText) KeySwitchingWithProof(cipher *CipherText, originalEphemeralKey, newKey abstract.Point, private abstract.Scalar) KeySwitchingProof {
+	r := suite.Scalar().Pick(random.Stream)
+	c.keySwitching(cipher, originalEphemeralKey, newKey, private, r)
+	return KeySwitchingProof{
+		OldContrib: suite.Point().Mul(originalEphemeralKey, private),
+		OldProof:   NewDLEQProof(private, suite.Point().Base(), originalEphemeralKey),
+		NewProof:   NewDLEQProof(r, suite.Point().Base(), newKey),
+	}
+}
+
+// DeterministicSwitchingWithProof performs the deterministic switching on a vector and returns the proofs of it.
+func (cv *CipherVector) DeterministicSwitchingWithProof(cipher *CipherVector, private, phKey abstract.Scalar) []DeterministicSwitchingProof {
+	proofs := make([]DeterministicSwitchingProof, len(*cipher))
+	for i, c := range *cipher {
+		proofs[i] = (*cv)[i].DeterministicSwitchingWithProof(&c, private, phKey)
+	}
+	return proofs
+}
+
+// ProbabilisticSwitchingWithProof performs the probabilistic switching on a vector and returns the proofs of it.
+func (cv *CipherVector) ProbabilisticSwitchingWithProof(cipher *CipherVector, phContrib, targetPublic abstract.Point) []ProbabilisticSwitchingProof {
+	proofs := make([]ProbabilisticSwitchingProof, len(*cipher))
+	for i, c := range *cipher {
+		proofs[i] = (*cv)[i].ProbabilisticSwitchingWithProof(&c, phContrib, targetPublic)
+	}
+	return proofs
+}
+
+// KeySwitchingWithProof performs the key switching on a vector and returns the proofs of it.
+func (cv *CipherVector) KeySwitchingWithProof(cipher *CipherVector, originalEphemeralKeys *[]abstract.Point, newKey abstract.Point, private abstract.Scalar) []KeySwitchingProof {
+	proofs := make([]KeySwitchingProof, len(*cipher))
+	for i, c := range *cipher {
+		proofs[i] = (*cv)[i].KeySwitchingWithProof(&c, (*originalEphemeralKeys)[i], newKey, private)
+	}
+	return proofs
+}
+
+// Verification
+//______________________________________________________________________________________________________________________
+
+// Verify checks that switched is cipher deterministically switched by the server with the public key.
+func (p *DeterministicSwitchingProof) Verify(cipher, switched *CipherText, public abstract.Point) error {
+	if !switched.K.Equal(cipher.K) {
+		return errors.New("ephemeral key changed")
+	}
+	if !p.Proof.Verify(suite.Point().Base(), cipher.K, public, p.EGContrib) {
+		return errors.New("wrong ElGamal contribution")
+	}
+	if !p.PHProof.Verify(suite.Point().Base(), suite.Point().Base(), p.PHContrib, p.PHContrib) {
+		return errors.New("wrong Pohlig-Hellman contribution")
+	}
+	expected := suite.Point().Sub(cipher.C, p.EGContrib)
+	if !switched.C.Equal(expected.Add(expected, p.PHContrib)) {
+		return errors.New("ciphertext doesn't match the contributions")
+	}
+	return nil
+}
+
+// Verify checks that switched is cipher probabilistically switched to the target key.
+func (p *ProbabilisticSwitchingProof) Verify(cipher, switched *CipherText, targetPublic abstract.Point) error {
+	ephemContrib := suite.Point().Sub(switched.K, cipher.K)
+	newContrib := suite.Point().Sub(switched.C, cipher.C)
+	newContrib.Add(newContrib, p.PHContrib)
+	if !p.Proof.Verify(suite.Point().Base(), targetPublic, ephemContrib, newContrib) {
+		return errors.New("wrong encryption to the target key")
+	}
+	return nil
+}
+
+// Verify checks that switched is cipher switched from the key of the server with the public key to the new key.
+func (p *KeySwitchingProof) Verify(cipher, switched *CipherText, originalEphemeralKey, newKey, public abstract.Point) error {
+	if !p.OldProof.Verify(suite.Point().Base(), originalEphemeralKey, public, p.OldContrib) {
+		return errors.New("wrong contribution to the original encryption")
+	}
+	ephemContrib := suite.Point().Sub(switched.K, cipher.K)
+	newContrib := suite.Point().Sub(switched.C, cipher.C)
+	newContrib.Add(newContrib, p.OldContrib)
+	if !p.NewProof.Verify(suite.Point().Base(), newKey, ephemContrib, newContrib) {
+		return errors.New("wrong encryption to the new key")
+	}
+	return nil
+}
+
+// VerifyDeterministicSwitching checks the proofs of a switched vector. All ciphertexts have to get the same
+// Pohlig-Hellman contribution, else they can't be compared.
+func VerifyDeterministicSwitching(cipher, switched CipherVector, proofs []DeterministicSwitchingProof, public abstract.Point) error {
+	if len(cipher) != len(switched) || len(cipher) != len(proofs) {
+		return errors.New("wrong number of ciphertexts or proofs")
+	}
+	for i := range proofs {
+		if !proofs[i].PHContrib.Equal(proofs[0].PHContrib) {
+			return fmt.Errorf("ciphertext %d: different Pohlig-Hellman contribution", i)
+		}
+		if err := proofs[i].Verify(&cipher[i], &switched[i], public); err != nil {
+			return fmt.Errorf("ciphertext %d: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// VerifyProbabilisticSwitching checks the proofs of a switched vector. The Pohlig-Hellman contribution removed has
+// to be the one the server added in the deterministic switching.
+func VerifyProbabilisticSwitching(cipher, switched CipherVector, proofs []ProbabilisticSwitchingProof, phContrib, targetPublic abstract.Point) error {
+	if len(cipher) != len(switched) || len(cipher) != len(proofs) {
+		return errors.New("wrong number of ciphertexts or proofs")
+	}
+	for i := range proofs {
+		if !proofs[i].PHContrib.Equal(phContrib) {
+			return fmt.Errorf("ciphertext %d: wrong Pohlig-Hellman contribution", i)
+		}
+		if err := proofs[i].Verify(&cipher[i], &switched[i], targetPublic); err != nil {
+			return fmt.Errorf("ciphertext %d: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// VerifyKeySwitching checks the proofs of a switched vector.
+func VerifyKeySwitching(cipher, switched CipherVector, proofs []KeySwitchingProof, originalEphemeralKeys []abstract.Point, newKey, public abstract.Point) error {
+	if len(cipher) != len(switched) || len(cipher) != len(proofs) || len(cipher) != len(originalEphemeralKeys) {
+		return errors.New("wrong number of ciphertexts or proofs")
+	}
+	for i := range proofs {
+		if err := proofs[i].Verify(&cipher[i], &switched[i], originalEphemeralKeys[i], newKey, public); err != nil {
+			return fmt.Errorf("ciphertext %d: %s", i, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package libmedco_test
+
+import (
+	"testing"
+
+	. "github.com/csanti/pbft-experiments/cothority/services/medco/libmedco"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/dedis/crypto.v0/abstract"
+)
+
+// TestDeterministicSwitchingProof verifies the proofs of an honest and of a cheating server.
+func TestDeterministicSwitchingProof(t *testing.T) {
+	secKey, pubKey := GenKey()
+	phKey, _ := GenKey()
+	cipher := *EncryptIntVector(pubKey, []int64{1, 2})
+	switched := *NewCipherVector(2)
+	proofs := switched.DeterministicSwitchingWithProof(&cipher, secKey, phKey)
+	assert.Nil(t, VerifyDeterministicSwitching(cipher, switched, proofs, pubKey))
+
+	otherKey, otherPub := GenKey()
+	assert.NotNil(t, VerifyDeterministicSwitching(cipher, switched, proofs, otherPub))
+	cheated := *NewCipherVector(2)
+	proofs = cheated.DeterministicSwitchingWithProof(&cipher, otherKey, phKey)
+	assert.NotNil(t, VerifyDeterministicSwitching(cipher, cheated, proofs, pubKey))
+
+	// a Pohlig-Hellman contribution without the knowledge of its key
+	proofs = switched.DeterministicSwitchingWithProof(&cipher, secKey, phKey)
+	for i := range proofs {
+		proofs[i].PHContrib = otherPub
+		switched[i].C = suite.Point().Add(suite.Point().Sub(cipher[i].C, proofs[i].EGContrib), otherPub)
+	}
+	assert.NotNil(t, VerifyDeterministicSwitching(cipher, switched, proofs, pubKey))
+
+	proofs = switched.DeterministicSwitchingWithProof(&cipher, secKey, phKey)
+	switched[1].C.Add(switched[1].C, suite.Point().Base())
+	assert.NotNil(t, VerifyDeterministicSwitching(cipher, switched, proofs, pubKey))
+}
+
+// TestProbabilisticSwitchingProof verifies the proofs of an honest and of a cheating server.
+func TestProbabilisticSwitchingProof(t *testing.T) {
+	phKey, _ := GenKey()
+	phContrib := suite.Point().Mul(suite.Point().Base(), phKey)
+	_, targetPub := GenKey()
+	_, pubKey := GenKey()
+	cipher := *EncryptIntVector(pubKey, []int64{1, 2})
+	switched := *NewCipherVector(2)
+	proofs := switched.ProbabilisticSwitchingWithProof(&cipher, phContrib, targetPub)
+	assert.Nil(t, VerifyProbabilisticSwitching(cipher, switched, proofs, phContrib, targetPub))
+
+	_, otherPub := GenKey()
+	assert.NotNil(t, VerifyProbabilisticSwitching(cipher, switched, proofs, phContrib, otherPub))
+	assert.NotNil(t, VerifyProbabilisticSwitching(cipher, switched, proofs, otherPub, targetPub))
+	switched[0].C.Add(switched[0].C, suite.Point().Base())
+	assert.NotNil(t, VerifyProbabilisticSwitching(cipher, switched, proofs, phContrib, targetPub))
+}
+
+// TestKeySwitchingProof verifies the proofs of key switching from the collective to the querier key.
+func TestKeySwitchingProof(t *testing.T) {
+	group, privs, pubs := GenKeys(2)
+	targetKey, targetPub := GenKey()
+	cipher := *EncryptIntVector(group, []int64{3, 4})
+	ephemeral := []abstract.Point{cipher[0].K, cipher[1].K}
+	switched := *NewCipherVector(2)
+	for i := range switched {
+		switched[i].K = suite.Point().Null()
+		switched[i].C = suite.Point().Add(suite.Point().Null(), cipher[i].C)
+	}
+
+	var previous CipherVector
+	for s := range privs {
+		previous = *NewCipherVector(2).Add(switched, *NewCipherVector(2))
+		proofs := switched.KeySwitchingWithProof(&previous, &ephemeral, targetPub, privs[s])
+		assert.Nil(t, VerifyKeySwitching(previous, switched, proofs, ephemeral, targetPub, pubs[s]))
+		assert.NotNil(t, VerifyKeySwitching(previous, switched, proofs, ephemeral, targetPub, pubs[1-s]))
+	}
+	assert.Equal(t, []int64{3, 4}, DecryptIntVector(targetKey, &switched))
+}
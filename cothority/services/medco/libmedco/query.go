@@ -0,0 +1,233 @@
+package libmedco
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+/*
+A Query is compiled to the grouping and aggregating attributes of a survey. The equality filters, the group-by
+attributes and the buckets of the range queries become grouping attributes, which the servers compare after the
+deterministic switching. The count and the sums become aggregating attributes, added homomorphically. The querier then
+keeps the groups matching the filters, so it learns the aggregates of the other groups too: a query with filters needs
+a survey with differential privacy to protect them, and the servers refuse to create a survey with filters without it.
+
+With differential privacy, the counts and the sums are noisy. The groups with a noisy count of zero or less are left
+out, and an average is the noisy sum divided by the noisy count, so it is far off for small groups.
+
+The grouping values and the results have to be smaller than MaxHomomorphicInt to be decrypted.
+*/
+
+// AggregateOp is the operation of an aggregate.
+type AggregateOp int
+
+const (
+	// Count counts the matching client responses.
+	Count AggregateOp = iota
+	// Sum adds the values of an attribute of the matching client responses.
+	Sum
+	// Avg is the average of an attribute of the matching client responses.
+	Avg
+)
+
+// Filter keeps the client responses whose attribute has the value.
+type Filter struct {
+	Attribute string
+	Value     int64
+}
+
+// Range groups the client responses by buckets of an attribute: bucket 0 holds the values smaller than Bounds[0],
+// bucket i the values in [Bounds[i-1], Bounds[i]) and the last bucket the values from the last bound on.
+type Range struct {
+	Attribute string
+	Bounds    []int64
+}
+
+// Aggregate is one result of a query, computed for each group.
+type Aggregate struct {
+	Op        AggregateOp
+	Attribute string
+}
+
+// Query selects the client responses matching all filters and computes the aggregates for every group.
+type Query struct {
+	Where      []Filter
+	GroupBy    []string
+	Ranges     []Range
+	Aggregates []Aggregate
+	// Epsilon and Sensitivity are the differential privacy of the survey, Epsilon has to be set if there are filters.
+	Epsilon     float64
+	Sensitivity int64
+}
+
+// QueryResult holds the aggregates of one group, in the order of the query. Group holds the values of the group-by
+// attributes and the buckets of the ranges.
+type QueryResult struct {
+	Group  map[string]int64
+	Values []float64
+}
+
+// Validate checks that the query can be compiled.
+func (q *Query) Validate() error {
+	if len(q.Aggregates) == 0 {
+		return errors.New("query has no aggregates")
+	}
+	if len(q.Where) > 0 && q.Epsilon <= 0 {
+		return errors.New("query with filters needs differential privacy")
+	}
+	for _, a := range q.Aggregates {
+		if a.Op != Count && a.Attribute == "" {
+			return errors.New("sum and average need an attribute")
+		}
+	}
+	for _, r := range q.Ranges {
+		if len(r.Bounds) == 0 {
+			return fmt.Errorf("range of %s has no bounds", r.Attribute)
+		}
+		for i := 1; i < len(r.Bounds); i++ {
+			if r.Bounds[i-1] >= r.Bounds[i] {
+				return fmt.Errorf("bounds of %s are not increasing", r.Attribute)
+			}
+		}
+	}
+	return nil
+}
+
+// Description returns the survey description the clients respond to.
+func (q *Query) Description() SurveyDescription {
+	return SurveyDescription{
+		GroupingAttributesCount:    int32(len(q.Where) + len(q.GroupBy) + len(q.Ranges)),
+		AggregatingAttributesCount: uint32(1 + len(q.sumAttributes())),
+		Epsilon:                    q.Epsilon,
+		Sensitivity:                q.Sensitivity,
+		Filters:                    int32(len(q.Where)),
+	}
+}
+
+// Encode returns the grouping and aggregating attributes of a client response from its record.
+func (q *Query) Encode(record map[string]int64) (grouping, aggregating []int64, err error) {
+	if err := q.Validate(); err != nil {
+		return nil, nil, err
+	}
+	value := func(attribute string) (int64, error) {
+		v, ok := record[attribute]
+		if !ok {
+			return 0, fmt.Errorf("record has no attribute %s", attribute)
+		}
+		if v <= -MaxHomomorphicInt || v >= MaxHomomorphicInt {
+			return 0, fmt.Errorf("value of %s is too big", attribute)
+		}
+		return v, nil
+	}
+	for _, f := range q.Where {
+		v, err := value(f.Attribute)
+		if err != nil {
+			return nil, nil, err
+		}
+		grouping = append(grouping, v)
+	}
+	for _, a := range q.GroupBy {
+		v, err := value(a)
+		if err != nil {
+			return nil, nil, err
+		}
+		grouping = append(grouping, v)
+	}
+	for _, r := range q.Ranges {
+		v, ok := record[r.Attribute]
+		if !ok {
+			return nil, nil, fmt.Errorf("record has no attribute %s", r.Attribute)
+		}
+		grouping = append(grouping, int64(sort.Search(len(r.Bounds), func(i int) bool { return v < r.Bounds[i] })))
+	}
+	aggregating = []int64{1}
+	for _, a := range q.sumAttributes() {
+		v, err := value(a)
+		if err != nil {
+			return nil, nil, err
+		}
+		aggregating = append(aggregating, v)
+	}
+	return grouping, aggregating, nil
+}
+
+// Decode returns the results of the groups matching the filters from the decrypted survey results. Groups with a
+// count of zero or less, possible with noise, are left out.
+func (q *Query) Decode(grouping, aggregating [][]int64) ([]QueryResult, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	if len(grouping) != len(aggregating) {
+		return nil, errors.New("got different numbers of groups and aggregates")
+	}
+	desc := q.Description()
+	sums := q.sumAttributes()
+	var results []QueryResult
+	for i := range grouping {
+		grp, aggr := grouping[i], aggregating[i]
+		if len(grp) != int(desc.GroupingAttributesCount) || len(aggr) != int(desc.AggregatingAttributesCount) {
+			return nil, fmt.Errorf("result %d doesn't match the query", i)
+		}
+		if !q.matches(grp) {
+			continue
+		}
+		count := aggr[0]
+		if count <= 0 {
+			continue
+		}
+		res := QueryResult{Group: make(map[string]int64)}
+		grp = grp[len(q.Where):]
+		for j, a := range q.GroupBy {
+			res.Group[a] = grp[j]
+		}
+		grp = grp[len(q.GroupBy):]
+		for j, r := range q.Ranges {
+			res.Group[r.Attribute] = grp[j]
+		}
+		for _, a := range q.Aggregates {
+			var v float64
+			switch a.Op {
+			case Count:
+				v = float64(count)
+			case Sum:
+				v = float64(aggr[1+indexOf(sums, a.Attribute)])
+			case Avg:
+				v = float64(aggr[1+indexOf(sums, a.Attribute)]) / float64(count)
+			}
+			res.Values = append(res.Values, v)
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// matches checks the filters on the first grouping attributes.
+func (q *Query) matches(grouping []int64) bool {
+	for i, f := range q.Where {
+		if grouping[i] != f.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// sumAttributes returns the attributes to add, each once.
+func (q *Query) sumAttributes() []string {
+	var attributes []string
+	for _, a := range q.Aggregates {
+		if a.Op != Count && indexOf(attributes, a.Attribute) < 0 {
+			attributes = append(attributes, a.Attribute)
+		}
+	}
+	return attributes
+}
+
+func indexOf(list []string, s string) int {
+	for i, l := range list {
+		if l == s {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,77 @@
+package libmedco_test
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/csanti/pbft-experiments/cothority/services/medco/libmedco"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestQuery encodes records, aggregates them like the servers and decodes the results.
+func TestQuery(t *testing.T) {
+	query := &Query{
+		Where:   []Filter{{"diabetes", 1}},
+		GroupBy: []string{"sex"},
+		Ranges:  []Range{{"age", []int64{40, 65}}},
+		Aggregates: []Aggregate{
+			{Op: Count},
+			{Op: Sum, Attribute: "visits"},
+			{Op: Avg, Attribute: "visits"},
+		},
+		Epsilon: 0.5,
+	}
+	desc := query.Description()
+	assert.Equal(t, int32(3), desc.GroupingAttributesCount)
+	assert.Equal(t, uint32(2), desc.AggregatingAttributesCount)
+	assert.Equal(t, 0.5, desc.Epsilon)
+	assert.Equal(t, int32(1), desc.Filters)
+	assert.Nil(t, desc.Validate())
+	desc.Epsilon = 0
+	assert.NotNil(t, desc.Validate())
+
+	records := []map[string]int64{
+		{"diabetes": 1, "sex": 0, "age": 30, "visits": 2},
+		{"diabetes": 1, "sex": 0, "age": 39, "visits": 4},
+		{"diabetes": 1, "sex": 1, "age": 70, "visits": 5},
+		{"diabetes": 0, "sex": 1, "age": 70, "visits": 9},
+	}
+	groups := make(map[string]int)
+	var grouping, aggregating [][]int64
+	for _, r := range records {
+		grp, aggr, err := query.Encode(r)
+		assert.Nil(t, err)
+		key := fmt.Sprint(grp)
+		if i, ok := groups[key]; ok {
+			for j := range aggr {
+				aggregating[i][j] += aggr[j]
+			}
+			continue
+		}
+		groups[key] = len(grouping)
+		grouping = append(grouping, grp)
+		aggregating = append(aggregating, aggr)
+	}
+
+	results, err := query.Decode(grouping, aggregating)
+	assert.Nil(t, err)
+	assert.Equal(t, []QueryResult{
+		{map[string]int64{"sex": 0, "age": 0}, []float64{2, 6, 3}},
+		{map[string]int64{"sex": 1, "age": 2}, []float64{1, 5, 5}},
+	}, results)
+
+	// a noisy count of zero leaves the group out
+	results, err = query.Decode([][]int64{{1, 0, 0}}, [][]int64{{0, 3}})
+	assert.Nil(t, err)
+	assert.Empty(t, results)
+
+	_, _, err = query.Encode(map[string]int64{"diabetes": 1, "sex": 0})
+	assert.NotNil(t, err)
+	exact := *query
+	exact.Epsilon = 0
+	_, _, err = exact.Encode(records[0])
+	assert.NotNil(t, err)
+	_, _, err = (&Query{Ranges: []Range{{"age", []int64{65, 40}}},
+		Aggregates: []Aggregate{{Op: Count}}}).Encode(records[0])
+	assert.NotNil(t, err)
+}
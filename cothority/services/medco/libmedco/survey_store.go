@@ -2,6 +2,10 @@ package libmedco
 
 import (
 	"fmt"
+	"sort"
+
+	"github.com/csanti/pbft-experiments/cothority/network"
+	"gopkg.in/dedis/crypto.v0/abstract"
 )
 
 // DefaultGroup defines the default grouping key and is used when a survey consists of an aggregation only (no grouping).
@@ -36,9 +40,20 @@ type SurveyStore struct {
 	GroupedDeterministicGroupingAttributes map[TempID]GroupingAttributes
 	GroupedAggregatingAttributes           map[TempID]CipherVector
 
+	// BadServers holds the servers with a proof that didn't verify.
+	BadServers []BadServer
+	// PHContribs holds the Pohlig-Hellman contribution of every server seen in a proof.
+	PHContribs map[network.ServerIdentityID]abstract.Point
+
 	lastID uint64
 }
 
+// BadServer is a server that switched a ciphertext wrongly.
+type BadServer struct {
+	Server *network.ServerIdentity
+	Reason string
+}
+
 // NewSurveyStore is the store constructor.
 func NewSurveyStore() *SurveyStore {
 	return &SurveyStore{
@@ -50,6 +65,8 @@ func NewSurveyStore() *SurveyStore {
 
 		GroupedDeterministicGroupingAttributes: make(map[TempID]GroupingAttributes),
 		GroupedAggregatingAttributes:           make(map[TempID]CipherVector),
+
+		PHContribs: make(map[network.ServerIdentityID]abstract.Point),
 	}
 }
 
@@ -100,6 +117,16 @@ func (s *SurveyStore) PushDeterministicGroupingAttributes(detGroupAttr map[TempI
 	s.AggregatingAttributes = make(map[TempID]CipherVector) //clear map
 }
 
+// PushGroupedClientResponses adds the first client responses, whose grouping attributes are switched to
+// deterministic, to the sums of their groups and removes them.
+func (s *SurveyStore) PushGroupedClientResponses(detGroupAttr []GroupingAttributes) {
+	for i, ga := range detGroupAttr {
+		addInMapping(s.LocGroupingAggregating, ga.Key(), s.ClientResponses[i].AggregatingAttributes)
+		s.LocGroupingGroups[ga.Key()] = ga
+	}
+	s.ClientResponses = s.ClientResponses[len(detGroupAttr):]
+}
+
 // HasNextAggregatedResponses verifies the presence of locally aggregated results.
 func (s *SurveyStore) HasNextAggregatedResponses() bool {
 	return len(s.LocGroupingAggregating) > 0
@@ -136,6 +163,27 @@ func (s *SurveyStore) PushCothorityAggregatedGroups(gNew map[GroupingKey]Groupin
 	}
 }
 
+// CothorityAggregatedGroupsCount returns the number of groups of the collective aggregation.
+func (s *SurveyStore) CothorityAggregatedGroupsCount() int {
+	return len(s.AfterAggrProto)
+}
+
+// AddNoise adds a noise vector to each group of the collective aggregation, in the order of their keys.
+func (s *SurveyStore) AddNoise(noise []CipherVector) error {
+	if len(noise) != len(s.AfterAggrProto) {
+		return fmt.Errorf("got noise for %d groups instead of %d", len(noise), len(s.AfterAggrProto))
+	}
+	var keys []string
+	for key := range s.AfterAggrProto {
+		keys = append(keys, string(key))
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		addInMapping(s.AfterAggrProto, GroupingKey(key), noise[i])
+	}
+	return nil
+}
+
 // HasNextAggregatedGroupsID verifies that the server has local grouping results (group attributes).
 func (s *SurveyStore) HasNextAggregatedGroupsID() bool {
 	return len(s.GroupedDeterministicGroupingAttributes) > 0
@@ -186,6 +234,26 @@ func (s *SurveyStore) PushQuerierKeyEncryptedData(groupingAttributes map[TempID]
 	}
 }
 
+// CheckProof records the server as bad if err, the result of verifying one of its proofs, isn't nil. It returns
+// whether the proof is valid.
+func (s *SurveyStore) CheckProof(server *network.ServerIdentity, err error) bool {
+	if err == nil {
+		return true
+	}
+	s.BadServers = append(s.BadServers, BadServer{server, err.Error()})
+	return false
+}
+
+// KnownPHContrib returns the Pohlig-Hellman contribution of the server in the first proof of the survey, and
+// stores contrib if this is the first. A server has to use the same contribution in all switchings of the survey.
+func (s *SurveyStore) KnownPHContrib(server network.ServerIdentityID, contrib abstract.Point) abstract.Point {
+	if known, ok := s.PHContribs[server]; ok {
+		return known
+	}
+	s.PHContribs[server] = contrib
+	return contrib
+}
+
 // PollDeliverableResults gets the results.
 func (s *SurveyStore) PollDeliverableResults() []SurveyResult {
 	results := s.DeliverableResults
@@ -137,3 +137,34 @@ func TestStoring(t *testing.T) {
 
 	log.Lvl1("... Done")
 }
+
+// TestSurveyStorage tests that a survey continues from its stored state.
+func TestSurveyStorage(t *testing.T) {
+	secKey := network.Suite.Scalar().Pick(random.Stream)
+	pubKey := network.Suite.Point().Mul(network.Suite.Point().Base(), secKey)
+	survey := Survey{
+		SurveyStore:       NewSurveyStore(),
+		ID:                SurveyID("survey"),
+		SurveyPHKey:       secKey,
+		SurveyDescription: SurveyDescription{AggregatingAttributesCount: 2},
+	}
+	survey.InsertClientResponse(ClientResponse{CipherVector{}, *EncryptIntVector(pubKey, []int64{1, 2})})
+	survey.InsertClientResponse(ClientResponse{*EncryptIntVector(pubKey, []int64{1}),
+		*EncryptIntVector(pubKey, []int64{3, 4})})
+	survey.Closed = true
+
+	restored := NewSurveyFromStorage(survey.Storage())
+	if restored.ID != survey.ID || !restored.Closed || !restored.SurveyPHKey.Equal(secKey) {
+		t.Fatal("Survey parameters weren't restored")
+	}
+	if len(restored.ClientResponses) != 1 {
+		t.Fatal("Client responses weren't restored")
+	}
+	// a response sent after the restart is aggregated with the stored ones
+	restored.InsertClientResponse(ClientResponse{CipherVector{}, *EncryptIntVector(pubKey, []int64{3, 4})})
+	_, aggr := restored.PollLocallyAggregatedResponses()
+	cv := aggr[DefaultGroup]
+	if !reflect.DeepEqual(DecryptIntVector(secKey, &cv), []int64{4, 6}) {
+		t.Fatal("Aggregation wasn't restored")
+	}
+}
@@ -0,0 +1,354 @@
+package medco
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+
+	"github.com/csanti/pbft-experiments/cothority/log"
+	"github.com/csanti/pbft-experiments/cothority/network"
+	"github.com/csanti/pbft-experiments/cothority/sda"
+	"github.com/csanti/pbft-experiments/cothority/services/medco/libmedco"
+	"gopkg.in/dedis/crypto.v0/abstract"
+)
+
+// NoiseProtocolName is the name of the protocol collecting the differential-privacy noise.
+const NoiseProtocolName = "MedcoNoise"
+
+// BudgetProtocolName is the name of the protocol charging a query to the privacy budget of the querier.
+const BudgetProtocolName = "MedcoBudget"
+
+func init() {
+	network.RegisterPacketType(NoiseAnnounce{})
+	network.RegisterPacketType(NoiseReply{})
+	network.RegisterPacketType(BudgetAnnounce{})
+	network.RegisterPacketType(BudgetReply{})
+	network.RegisterPacketType(BudgetOutcome{})
+	network.RegisterPacketType(BudgetStorage{})
+}
+
+// NoiseAnnounce asks every server for its share of the noise of the results.
+type NoiseAnnounce struct {
+	Groups      int32
+	Attributes  int32
+	Epsilon     float64
+	Sensitivity int64
+}
+
+// BudgetStorage is the privacy budget of a server as stored on disk.
+type BudgetStorage struct {
+	Limit float64
+	Spent map[string]float64
+}
+
+// StructNoiseAnnounce is the NoiseAnnounce with the sender.
+type StructNoiseAnnounce struct {
+	*sda.TreeNode
+	NoiseAnnounce
+}
+
+// NoiseReply holds the encrypted noise of a subtree, or the error of a server.
+type NoiseReply struct {
+	Noise []libmedco.CipherVector
+	Error string
+}
+
+// StructNoiseReply is the NoiseReply with the sender.
+type StructNoiseReply struct {
+	*sda.TreeNode
+	NoiseReply
+}
+
+// NoiseProtocol collects the noise shares of all servers, encrypted under the collective key and added up the tree,
+// so that no server knows the noise added to the results.
+type NoiseProtocol struct {
+	*sda.TreeNodeInstance
+	// FeedbackChannel gets the total noise on the root.
+	FeedbackChannel chan NoiseReply
+	// Announce is set on the root before it starts.
+	Announce NoiseAnnounce
+}
+
+// NewNoiseProtocol is the constructor of the noise protocol.
+func NewNoiseProtocol(tni *sda.TreeNodeInstance) (sda.ProtocolInstance, error) {
+	p := &NoiseProtocol{
+		TreeNodeInstance: tni,
+		FeedbackChannel:  make(chan NoiseReply, 1),
+	}
+	if err := p.RegisterHandlers(p.HandleAnnounce, p.HandleReply); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Start sends the announcement down the tree.
+func (p *NoiseProtocol) Start() error {
+	return p.HandleAnnounce(StructNoiseAnnounce{p.TreeNode(), p.Announce})
+}
+
+// HandleAnnounce passes the announcement to the children, the leaves answer right away.
+func (p *NoiseProtocol) HandleAnnounce(msg StructNoiseAnnounce) error {
+	p.Announce = msg.NoiseAnnounce
+	if p.IsLeaf() {
+		return p.HandleReply(nil)
+	}
+	for _, c := range p.Children() {
+		if err := p.SendTo(c, &msg.NoiseAnnounce); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HandleReply adds our noise to the one of the children and sends it to the parent.
+func (p *NoiseProtocol) HandleReply(replies []StructNoiseReply) error {
+	defer p.Done()
+	reply := p.noise(replies)
+	if p.IsRoot() {
+		p.FeedbackChannel <- reply
+		return nil
+	}
+	return p.SendTo(p.Parent(), &reply)
+}
+
+// noise returns the sum of our noise and the noise of the children.
+func (p *NoiseProtocol) noise(replies []StructNoiseReply) NoiseReply {
+	for _, r := range replies {
+		if r.Error != "" {
+			return r.NoiseReply
+		}
+	}
+	a := p.Announce
+	reply := NoiseReply{Noise: make([]libmedco.CipherVector, a.Groups)}
+	for g := range reply.Noise {
+		share := libmedco.NoiseShareVector(a.Epsilon, a.Sensitivity, len(p.Roster().List), int(a.Attributes))
+		noise := libmedco.EncryptIntVector(p.Roster().Aggregate, share)
+		for _, r := range replies {
+			if len(r.Noise) != len(reply.Noise) {
+				return NoiseReply{Error: "wrong number of noise vectors from " + r.ServerIdentity.String()}
+			}
+			noise = libmedco.NewCipherVector(len(*noise)).Add(*noise, r.Noise[g])
+		}
+		reply.Noise[g] = *noise
+	}
+	return reply
+}
+
+// BudgetAnnounce asks every server to charge epsilon to the budget of the querier for a query of the survey.
+type BudgetAnnounce struct {
+	SurveyID libmedco.SurveyID
+	Querier  abstract.Point
+	Epsilon  float64
+}
+
+// StructBudgetAnnounce is the BudgetAnnounce with the sender.
+type StructBudgetAnnounce struct {
+	*sda.TreeNode
+	BudgetAnnounce
+}
+
+// BudgetReply holds the error of the first server of a subtree refusing the charge.
+type BudgetReply struct {
+	Error string
+}
+
+// StructBudgetReply is the BudgetReply with the sender.
+type StructBudgetReply struct {
+	*sda.TreeNode
+	BudgetReply
+}
+
+// BudgetOutcome tells all servers if the query is refused, so that the servers that charged it refund it.
+type BudgetOutcome struct {
+	Refund bool
+}
+
+// StructBudgetOutcome is the BudgetOutcome with the sender.
+type StructBudgetOutcome struct {
+	*sda.TreeNode
+	BudgetOutcome
+}
+
+// BudgetProtocol charges a query to the privacy budget of the querier on all servers before the pipeline runs, and
+// tells them the survey the pipeline queries. If a server refuses, all the others refund it, so that the query is
+// charged by all servers or by none.
+type BudgetProtocol struct {
+	*sda.TreeNodeInstance
+	// FeedbackChannel gets the outcome on the root.
+	FeedbackChannel chan BudgetReply
+	// Announce is set on the root before it starts.
+	Announce BudgetAnnounce
+	// MedcoServiceInstance holds the privacy budget of this server.
+	MedcoServiceInstance *Service
+	// spent is true if this server charged the query.
+	spent bool
+	err   error
+}
+
+// NewBudgetProtocol is the constructor of the budget protocol.
+func NewBudgetProtocol(tni *sda.TreeNodeInstance) (sda.ProtocolInstance, error) {
+	p := &BudgetProtocol{
+		TreeNodeInstance: tni,
+		FeedbackChannel:  make(chan BudgetReply, 1),
+	}
+	if err := p.RegisterHandlers(p.HandleAnnounce, p.HandleReply, p.HandleOutcome); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Start sends the announcement down the tree.
+func (p *BudgetProtocol) Start() error {
+	return p.HandleAnnounce(StructBudgetAnnounce{p.TreeNode(), p.Announce})
+}
+
+// HandleAnnounce charges the query and passes the announcement to the children, the leaves answer right away.
+func (p *BudgetProtocol) HandleAnnounce(msg StructBudgetAnnounce) error {
+	p.Announce = msg.BudgetAnnounce
+	_, p.err = p.MedcoServiceInstance.startQuery(p.Announce.SurveyID, p.Announce.Querier)
+	if p.err == nil && p.Announce.Epsilon > 0 {
+		p.err = p.MedcoServiceInstance.spend(p.Announce.Querier, p.Announce.Epsilon)
+		p.spent = p.err == nil
+	}
+	if p.err != nil {
+		log.Lvl1(p.ServerIdentity(), "refuses the query:", p.err)
+	}
+	if p.IsLeaf() {
+		return p.HandleReply(nil)
+	}
+	for _, c := range p.Children() {
+		if err := p.SendTo(c, &msg.BudgetAnnounce); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HandleReply sends our error or the one of the children to the parent. The root decides on the outcome.
+func (p *BudgetProtocol) HandleReply(replies []StructBudgetReply) error {
+	reply := BudgetReply{}
+	if p.err != nil {
+		reply.Error = p.ServerIdentity().String() + ": " + p.err.Error()
+	}
+	for _, r := range replies {
+		if reply.Error == "" {
+			reply.Error = r.Error
+		}
+	}
+	if !p.IsRoot() {
+		return p.SendTo(p.Parent(), &reply)
+	}
+	err := p.HandleOutcome(StructBudgetOutcome{p.TreeNode(), BudgetOutcome{reply.Error != ""}})
+	p.FeedbackChannel <- reply
+	return err
+}
+
+// HandleOutcome refunds the query if it is refused and passes the outcome to the children.
+func (p *BudgetProtocol) HandleOutcome(msg StructBudgetOutcome) error {
+	defer p.Done()
+	if msg.Refund && p.spent {
+		if err := p.MedcoServiceInstance.refund(p.Announce.Querier, p.Announce.Epsilon); err != nil {
+			log.Error(p.ServerIdentity(), "couldn't refund the query:", err)
+		}
+	}
+	for _, c := range p.Children() {
+		if err := p.SendTo(c, &msg.BudgetOutcome); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BudgetPhase charges the query of the querier to its privacy budget on all servers, if the survey asks for noise. It
+// runs for every query, as it tells the servers the queried survey.
+func (mcs *Service) BudgetPhase(targetSurvey libmedco.SurveyID) error {
+	pi, err := mcs.startProtocol(BudgetProtocolName, targetSurvey)
+	if err != nil {
+		return err
+	}
+	reply := <-pi.(*BudgetProtocol).FeedbackChannel
+	if reply.Error != "" {
+		return errors.New(reply.Error)
+	}
+	return nil
+}
+
+// NoisePhase adds the differential-privacy noise to the collectively aggregated results, if the survey asks for it.
+func (mcs *Service) NoisePhase(targetSurvey libmedco.SurveyID) error {
+	survey, err := mcs.getSurvey(targetSurvey)
+	if err != nil {
+		return err
+	}
+	if survey.SurveyDescription.Epsilon == 0 {
+		return nil
+	}
+	pi, err := mcs.startProtocol(NoiseProtocolName, targetSurvey)
+	if err != nil {
+		return err
+	}
+	reply := <-pi.(*NoiseProtocol).FeedbackChannel
+	if reply.Error != "" {
+		return errors.New(reply.Error)
+	}
+	return survey.AddNoise(reply.Noise)
+}
+
+// budgetFile returns the file of the privacy budget. The services of all servers of a process share the path, so it
+// is named after the server.
+func (mcs *Service) budgetFile() string {
+	return mcs.homePath + "/medco_budget_" + mcs.ServerIdentity().ID.String() + ".bin"
+}
+
+// loadBudget reads the privacy budget of the queriers, or starts a new one.
+func (mcs *Service) loadBudget() error {
+	mcs.budget = libmedco.NewPrivacyBudget(libmedco.DefaultPrivacyBudget)
+	b, err := ioutil.ReadFile(mcs.budgetFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	_, msg, err := network.UnmarshalRegistered(b)
+	if err != nil {
+		return err
+	}
+	budget, ok := msg.(*BudgetStorage)
+	if !ok {
+		return errors.New("not a privacy budget")
+	}
+	mcs.budget.Limit = budget.Limit
+	if budget.Spent != nil {
+		mcs.budget.Spent = budget.Spent
+	}
+	return nil
+}
+
+// spend charges epsilon to the budget of the querier and stores the budget, so that a querier can't get a new one by
+// restarting a server.
+func (mcs *Service) spend(querier abstract.Point, epsilon float64) error {
+	if err := mcs.budget.Spend(querier.String(), epsilon); err != nil {
+		return err
+	}
+	return mcs.saveBudget()
+}
+
+// refund gives back epsilon to the budget of the querier and stores the budget.
+func (mcs *Service) refund(querier abstract.Point, epsilon float64) error {
+	mcs.budget.Refund(querier.String(), epsilon)
+	return mcs.saveBudget()
+}
+
+// saveBudget stores the privacy budget of the queriers.
+func (mcs *Service) saveBudget() error {
+	mcs.budget.Lock()
+	b, err := network.MarshalRegisteredType(&BudgetStorage{
+		Limit: mcs.budget.Limit,
+		Spent: mcs.budget.Spent,
+	})
+	mcs.budget.Unlock()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(mcs.budgetFile(), b, 0600)
+}
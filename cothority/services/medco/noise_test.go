@@ -0,0 +1,27 @@
+package medco
+
+import (
+	"testing"
+
+	"github.com/csanti/pbft-experiments/cothority/log"
+	"github.com/csanti/pbft-experiments/cothority/network"
+	"github.com/csanti/pbft-experiments/cothority/sda"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/dedis/crypto.v0/config"
+)
+
+// TestService_Budget makes sure the privacy budget survives a restart of the service.
+func TestService_Budget(t *testing.T) {
+	local := sda.NewLocalTest()
+	defer local.CloseAll()
+	_, _, s := local.MakeHELS(1, sda.ServiceFactory.ServiceID(ServiceName))
+	service := s.(*Service)
+
+	querier := config.NewKeyPair(network.Suite).Public
+	log.ErrFatal(service.spend(querier, 0.6))
+	log.ErrFatal(service.refund(querier, 0.2))
+
+	reloaded := NewService(service.Context, service.homePath).(*Service)
+	assert.InDelta(t, 0.6, reloaded.budget.Remaining(querier.String()), 1e-9)
+	assert.NotNil(t, reloaded.spend(querier, 0.7))
+}
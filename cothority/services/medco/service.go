@@ -1,6 +1,12 @@
 package medco
 
 import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
 	"github.com/btcsuite/goleveldb/leveldb/errors"
 	"github.com/csanti/pbft-experiments/cothority/log"
 	"github.com/csanti/pbft-experiments/cothority/network"
@@ -22,6 +28,8 @@ func init() {
 	network.RegisterPacketType(&SurveyCreationQuery{})
 	network.RegisterPacketType(&SurveyResultResponse{})
 	network.RegisterPacketType(&ServiceResponse{})
+	network.RegisterPacketType(&SurveyCloseQuery{})
+	network.RegisterPacketType(&libmedco.SurveyStorage{})
 }
 
 // SurveyCreationQuery is used to trigger the creation of a survey.
@@ -31,10 +39,15 @@ type SurveyCreationQuery struct {
 	libmedco.SurveyDescription
 }
 
-// SurveyResponseQuery is used to ask a client for its response to a survey.
+// SurveyResponseQuery is used by a client to send a chunk of responses to a survey.
 type SurveyResponseQuery struct {
+	SurveyID        libmedco.SurveyID
+	ClientResponses []libmedco.ClientResponse
+}
+
+// SurveyCloseQuery is used to stop accepting client responses before asking for the results.
+type SurveyCloseQuery struct {
 	SurveyID libmedco.SurveyID
-	libmedco.ClientResponse
 }
 
 // SurveyResultsQuery is used by querier to ask for the response of the survey.
@@ -48,17 +61,36 @@ type ServiceResponse struct {
 	SurveyID libmedco.SurveyID
 }
 
-// SurveyResultResponse will contain final results of a survey and be sent to querier.
+// SurveyResultResponse will contain final results of a survey and be sent to querier, with the servers whose proofs
+// didn't verify.
 type SurveyResultResponse struct {
-	Results []libmedco.SurveyResult
+	Results    []libmedco.SurveyResult
+	BadServers []libmedco.BadServer
 }
 
-// Service defines a service in medco case with a survey.
+// errNoQuery is returned when a protocol of the pipeline starts before the BudgetProtocol announced the survey.
+var errNoQuery = errors.New("No survey is queried")
+
+// Service defines a service in medco case with its surveys.
 type Service struct {
 	*sda.ServiceProcessor
 	homePath string
 
-	survey libmedco.Survey // For now, server only handles one survey.
+	// surveys are the surveys of this server by ID, every one stored in its own file.
+	surveys map[libmedco.SurveyID]*libmedco.Survey
+	// queried is the survey whose results the servers compute and querier the key the results are switched to. They
+	// are announced by the BudgetProtocol before the pipeline, so that the protocols started by another server know
+	// them. The servers compute the results of one survey at a time.
+	queried libmedco.SurveyID
+	querier abstract.Point
+	budget  *libmedco.PrivacyBudget
+	// surveyLock protects the surveys from concurrent client responses.
+	surveyLock sync.Mutex
+	// groupLock lets one grouping run at a time, without the surveyLock, so that the responses it groups stay the
+	// first ones of their survey.
+	groupLock sync.Mutex
+	// queryLock lets this server compute the results of one survey at a time.
+	queryLock sync.Mutex
 }
 
 // NewService constructor which registers the needed messages.
@@ -66,10 +98,16 @@ func NewService(c *sda.Context, path string) sda.Service {
 	newMedCoInstance := &Service{
 		ServiceProcessor: sda.NewServiceProcessor(c),
 		homePath:         path,
+		surveys:          make(map[libmedco.SurveyID]*libmedco.Survey),
 	}
 	newMedCoInstance.RegisterMessage(newMedCoInstance.HandleSurveyResponseData)
 	newMedCoInstance.RegisterMessage(newMedCoInstance.HandleSurveyResultsQuery)
 	newMedCoInstance.RegisterMessage(newMedCoInstance.HandleSurveyCreationQuery)
+	newMedCoInstance.RegisterMessage(newMedCoInstance.HandleSurveyCloseQuery)
+	if err := newMedCoInstance.loadBudget(); err != nil {
+		log.Error("Couldn't load privacy budget:", err)
+	}
+	newMedCoInstance.loadSurveys()
 	return newMedCoInstance
 }
 
@@ -78,6 +116,9 @@ func NewService(c *sda.Context, path string) sda.Service {
 // HandleSurveyCreationQuery handles the reception of a survey creation query by instantiating the corresponding survey.
 func (mcs *Service) HandleSurveyCreationQuery(si *network.ServerIdentity, recq *SurveyCreationQuery) (network.Body, error) {
 	log.Lvl1(mcs.ServerIdentity(), "received a Survey Creation Query")
+	if err := recq.SurveyDescription.Validate(); err != nil {
+		return nil, err
+	}
 	if recq.SurveyID == nil {
 		newID := libmedco.SurveyID(uuid.NewV4().String())
 		recq.SurveyID = &newID
@@ -87,82 +128,165 @@ func (mcs *Service) HandleSurveyCreationQuery(si *network.ServerIdentity, recq *
 		log.Lvl1(mcs.ServerIdentity(), "initiated the survey", newID)
 	}
 
-	mcs.survey = libmedco.Survey{
+	mcs.surveyLock.Lock()
+	defer mcs.surveyLock.Unlock()
+	if _, ok := mcs.surveys[*recq.SurveyID]; ok {
+		return nil, errors.New("Survey already exists")
+	}
+	survey := &libmedco.Survey{
 		SurveyStore:       libmedco.NewSurveyStore(),
 		ID:                *recq.SurveyID,
 		Roster:            recq.Roster,
 		SurveyPHKey:       network.Suite.Scalar().Pick(random.Stream),
-		ClientPublic:      nil,
 		SurveyDescription: recq.SurveyDescription,
 	}
+	if err := mcs.saveSurvey(survey); err != nil {
+		return nil, err
+	}
+	mcs.surveys[survey.ID] = survey
 	log.Lvl1(mcs.ServerIdentity(), "created the survey", *recq.SurveyID)
 
 	return &ServiceResponse{*recq.SurveyID}, nil
 }
 
-// HandleSurveyResponseData handles a survey answers submission by a subject.
+// HandleSurveyResponseData handles a chunk of survey answers submitted by a subject. The responses are stored before
+// the reply, so they survive a restart, then grouped and aggregated. If the grouping fails, the responses stay stored
+// and are grouped with the next chunk.
 func (mcs *Service) HandleSurveyResponseData(si *network.ServerIdentity, resp *SurveyResponseQuery) (network.Body, error) {
 	log.Lvl1(mcs.ServerIdentity(), "recieved response data for survey ", resp.SurveyID)
-	if mcs.survey.ID == resp.SurveyID {
-		mcs.survey.InsertClientResponse(resp.ClientResponse)
-		return &ServiceResponse{"1"}, nil
+	mcs.surveyLock.Lock()
+	survey, ok := mcs.surveys[resp.SurveyID]
+	if !ok {
+		mcs.surveyLock.Unlock()
+		log.Lvl1(mcs.ServerIdentity(), "does not know about this survey!")
+		return &ServiceResponse{resp.SurveyID}, nil
+	}
+	if survey.Closed {
+		mcs.surveyLock.Unlock()
+		return nil, errors.New("Survey is closed")
+	}
+	for _, cr := range resp.ClientResponses {
+		survey.InsertClientResponse(cr)
+	}
+	err := mcs.saveSurvey(survey)
+	mcs.surveyLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if err := mcs.DeterministicSwitchingPhase(resp.SurveyID); err != nil {
+		return nil, errors.New("Responses are stored, but couldn't be grouped: " + err.Error())
 	}
-	log.Lvl1(mcs.ServerIdentity(), "does not know about this survey!")
-	return &ServiceResponse{resp.SurveyID}, nil
+	return &ServiceResponse{"1"}, nil
+}
+
+// HandleSurveyCloseQuery closes the survey on all servers, so that they don't accept client responses anymore.
+func (mcs *Service) HandleSurveyCloseQuery(si *network.ServerIdentity, closeq *SurveyCloseQuery) (network.Body, error) {
+	log.Lvl1(mcs.ServerIdentity(), "received a Survey Close Query")
+	mcs.surveyLock.Lock()
+	defer mcs.surveyLock.Unlock()
+	survey, ok := mcs.surveys[closeq.SurveyID]
+	if !ok {
+		return nil, errors.New("Unknown survey")
+	}
+	if i, _ := survey.Roster.Search(si.ID); i < 0 {
+		if err := mcs.SendISMOthers(&survey.Roster, closeq); err != nil {
+			return nil, err
+		}
+	}
+	survey.Closed = true
+	if err := mcs.saveSurvey(survey); err != nil {
+		return nil, err
+	}
+	return &ServiceResponse{closeq.SurveyID}, nil
 }
 
 // HandleSurveyResultsQuery handles the survey result query by the surveyor.
 func (mcs *Service) HandleSurveyResultsQuery(si *network.ServerIdentity, resq *SurveyResultsQuery) (network.Body, error) {
 
 	log.Lvl1(mcs.ServerIdentity(), "recieved a survey result query from", si)
-	mcs.survey.ClientPublic = resq.ClientPublic
-	pi, _ := mcs.startProtocol(medco.MedcoServiceProtocolName, resq.SurveyID)
+	mcs.queryLock.Lock()
+	defer mcs.queryLock.Unlock()
+	survey, err := mcs.startQuery(resq.SurveyID, resq.ClientPublic)
+	if err != nil {
+		return nil, err
+	}
+	if err := mcs.BudgetPhase(resq.SurveyID); err != nil {
+		return nil, err
+	}
+	pi, err := mcs.startProtocol(medco.MedcoServiceProtocolName, resq.SurveyID)
+	if err != nil {
+		return nil, err
+	}
 
 	<-pi.(*medco.PipelineProtocol).FeedbackChannel
 	log.Lvl1(mcs.ServerIdentity(), "completed the query processing...")
-	return &SurveyResultResponse{mcs.survey.PollDeliverableResults()}, nil
+	mcs.surveyLock.Lock()
+	defer mcs.surveyLock.Unlock()
+	if len(survey.BadServers) > 0 {
+		// a switching didn't verify, its output doesn't go to the querier
+		return &SurveyResultResponse{nil, survey.BadServers}, nil
+	}
+	return &SurveyResultResponse{survey.PollDeliverableResults(), nil}, nil
 }
 
-// NewProtocol handles the creation of the right protocol parameters.
+// NewProtocol handles the creation of the right protocol parameters. The protocols of the pipeline work on the
+// queried survey.
 func (mcs *Service) NewProtocol(tn *sda.TreeNodeInstance, conf *sda.GenericConfig) (sda.ProtocolInstance, error) {
 
 	var pi sda.ProtocolInstance
 	var err error
 	switch tn.ProtocolName() {
 	case medco.MedcoServiceProtocolName:
+		survey, _ := mcs.query()
+		if survey == nil {
+			return nil, errNoQuery
+		}
 		pi, err = medco.NewPipelineProcotol(tn)
 		medcoServ := pi.(*medco.PipelineProtocol)
 		medcoServ.MedcoServiceInstance = mcs
-		medcoServ.TargetSurvey = &mcs.survey
-	case medco.DeterministicSwitchingProtocolName:
-		pi, err = medco.NewDeterministSwitchingProtocol(tn)
-		detSwitch := pi.(*medco.DeterministicSwitchingProtocol)
-		detSwitch.SurveyPHKey = &mcs.survey.SurveyPHKey
-		if tn.IsRoot() {
-			groupingAttr := mcs.survey.PollProbabilisticGroupingAttributes()
-			detSwitch.TargetOfSwitch = &groupingAttr
-		}
+		medcoServ.TargetSurvey = survey
+	case SwitchingProtocolName:
+		pi, err = NewSwitchingProtocol(tn)
+		pi.(*SwitchingProtocol).MedcoServiceInstance = mcs
 	case medco.PrivateAggregateProtocolName:
+		survey, _ := mcs.query()
+		if survey == nil {
+			return nil, errNoQuery
+		}
 		pi, err = medco.NewPrivateAggregate(tn)
-		groups, groupedData := mcs.survey.PollLocallyAggregatedResponses()
+		groups, groupedData := survey.PollLocallyAggregatedResponses()
 		pi.(*medco.PrivateAggregateProtocol).GroupedData = &groupedData
 		pi.(*medco.PrivateAggregateProtocol).Groups = &groups
-	case medco.ProbabilisticSwitchingProtocolName:
-		pi, err = medco.NewProbabilisticSwitchingProtocol(tn)
-		probSwitch := pi.(*medco.ProbabilisticSwitchingProtocol)
-		probSwitch.SurveyPHKey = &mcs.survey.SurveyPHKey
+	case BudgetProtocolName:
+		pi, err = NewBudgetProtocol(tn)
+		budget := pi.(*BudgetProtocol)
+		budget.MedcoServiceInstance = mcs
 		if tn.IsRoot() {
-			groups := mcs.survey.PollCothorityAggregatedGroupsID()
-			probSwitch.TargetOfSwitch = libmedco.GroupingAttributesToDeterministicCipherVector(&groups)
-			probSwitch.TargetPublicKey = &mcs.survey.ClientPublic
+			survey, querier := mcs.query()
+			if survey == nil {
+				return nil, errNoQuery
+			}
+			budget.Announce = BudgetAnnounce{
+				SurveyID: survey.ID,
+				Querier:  querier,
+				Epsilon:  survey.SurveyDescription.Epsilon,
+			}
 		}
-	case medco.KeySwitchingProtocolName:
-		pi, err = medco.NewKeySwitchingProtocol(tn)
-		keySwitch := pi.(*medco.KeySwitchingProtocol)
+	case NoiseProtocolName:
+		pi, err = NewNoiseProtocol(tn)
+		noise := pi.(*NoiseProtocol)
 		if tn.IsRoot() {
-			coaggr := mcs.survey.PollCothorityAggregatedGroupsAttr()
-			keySwitch.TargetOfSwitch = &coaggr
-			keySwitch.TargetPublicKey = &mcs.survey.ClientPublic
+			survey, _ := mcs.query()
+			if survey == nil {
+				return nil, errNoQuery
+			}
+			desc := survey.SurveyDescription
+			noise.Announce = NoiseAnnounce{
+				Groups:      int32(survey.CothorityAggregatedGroupsCount()),
+				Attributes:  int32(desc.AggregatingAttributesCount),
+				Epsilon:     desc.Epsilon,
+				Sensitivity: desc.Sensitivity,
+			}
 		}
 	default:
 		return nil, errors.New("Service attempts to start an unknown protocol: " + tn.ProtocolName() + ".")
@@ -171,63 +295,220 @@ func (mcs *Service) NewProtocol(tn *sda.TreeNodeInstance, conf *sda.GenericConfi
 }
 
 func (mcs *Service) startProtocol(name string, targetSurvey libmedco.SurveyID) (sda.ProtocolInstance, error) {
-	tree := mcs.survey.Roster.GenerateNaryTreeWithRoot(2, mcs.ServerIdentity())
+	survey, err := mcs.getSurvey(targetSurvey)
+	if err != nil {
+		return nil, err
+	}
+	tree := survey.Roster.GenerateNaryTreeWithRoot(2, mcs.ServerIdentity())
 	tni := mcs.NewTreeNodeInstance(tree, tree.Root, name)
 	pi, err := mcs.NewProtocol(tni, nil)
+	if err != nil {
+		return nil, err
+	}
 	mcs.RegisterProtocolInstance(pi)
 	go pi.Dispatch()
 	go pi.Start()
-	return pi, err
+	return pi, nil
+}
+
+// getSurvey returns the survey with the given ID.
+func (mcs *Service) getSurvey(id libmedco.SurveyID) (*libmedco.Survey, error) {
+	mcs.surveyLock.Lock()
+	defer mcs.surveyLock.Unlock()
+	survey, ok := mcs.surveys[id]
+	if !ok {
+		return nil, errors.New("Unknown survey")
+	}
+	return survey, nil
+}
+
+// startQuery makes the survey with the given ID the queried one, if it is closed, with the key of the querier.
+func (mcs *Service) startQuery(id libmedco.SurveyID, querier abstract.Point) (*libmedco.Survey, error) {
+	mcs.surveyLock.Lock()
+	defer mcs.surveyLock.Unlock()
+	survey, ok := mcs.surveys[id]
+	if !ok {
+		return nil, errors.New("Unknown survey")
+	}
+	if !survey.Closed {
+		return nil, errors.New("Survey has to be closed first")
+	}
+	if querier == nil {
+		return nil, errors.New("No querier key")
+	}
+	mcs.queried = id
+	mcs.querier = querier
+	return survey, nil
+}
+
+// query returns the survey whose results the servers compute, or nil, and the key of the querier.
+func (mcs *Service) query() (*libmedco.Survey, abstract.Point) {
+	mcs.surveyLock.Lock()
+	defer mcs.surveyLock.Unlock()
+	return mcs.surveys[mcs.queried], mcs.querier
 }
 
 // Pipeline steps forward operations
 
-// DeterministicSwitchingPhase performs the private grouping on the currently collected data.
+// DeterministicSwitchingPhase performs the private grouping on the currently collected data. The switching runs
+// without the surveyLock, so that the servers keep accepting responses while it waits for the others.
 func (mcs *Service) DeterministicSwitchingPhase(targetSurvey libmedco.SurveyID) error {
+	mcs.groupLock.Lock()
+	defer mcs.groupLock.Unlock()
+	mcs.surveyLock.Lock()
+	survey, ok := mcs.surveys[targetSurvey]
+	var pending []libmedco.ClientResponse
+	if ok {
+		pending = append(pending, survey.ClientResponses...)
+	}
+	mcs.surveyLock.Unlock()
+	if !ok {
+		return errors.New("Unknown survey")
+	}
+	if len(pending) == 0 {
+		return nil
+	}
 
-	pi, err := mcs.startProtocol(medco.DeterministicSwitchingProtocolName, targetSurvey)
+	groupingAttr := make(map[libmedco.TempID]libmedco.CipherVector, len(pending))
+	for i, cr := range pending {
+		groupingAttr[libmedco.TempID(i)] = cr.ProbabilisticGroupingAttributes
+	}
+	switched, err := mcs.startSwitching(survey, SwitchDeterministic, nil, flatten(groupingAttr))
 	if err != nil {
 		return err
 	}
-	deterministicSwitchedResult := <-pi.(*medco.DeterministicSwitchingProtocol).FeedbackChannel
-	mcs.survey.PushDeterministicGroupingAttributes(*libmedco.DeterministicCipherVectorToGroupingAttributes(&deterministicSwitchedResult))
-	return err
+	deterministicSwitchedResult := make([]libmedco.GroupingAttributes, len(pending))
+	for id, cv := range unflatten(groupingAttr, switched) {
+		ga := make(libmedco.GroupingAttributes, len(cv))
+		for i, c := range cv {
+			ga[i] = libmedco.DeterministCipherText{Point: c.C}
+		}
+		deterministicSwitchedResult[id] = ga
+	}
+
+	mcs.surveyLock.Lock()
+	defer mcs.surveyLock.Unlock()
+	survey.PushGroupedClientResponses(deterministicSwitchedResult)
+	return mcs.saveSurvey(survey)
 }
 
 // AggregationPhase performs the per-group aggregation on the currently grouped data.
 func (mcs *Service) AggregationPhase(targetSurvey libmedco.SurveyID) error {
 
+	survey, err := mcs.getSurvey(targetSurvey)
+	if err != nil {
+		return err
+	}
 	pi, err := mcs.startProtocol(medco.PrivateAggregateProtocolName, targetSurvey)
 	if err != nil {
 		return err
 	}
 	cothorityAggregatedData := <-pi.(*medco.PrivateAggregateProtocol).FeedbackChannel
 
-	mcs.survey.PushCothorityAggregatedGroups(cothorityAggregatedData.Groups, cothorityAggregatedData.GroupedData)
+	survey.PushCothorityAggregatedGroups(cothorityAggregatedData.Groups, cothorityAggregatedData.GroupedData)
 
 	return err
 }
 
-// KeySwitchingPhase performs the switch to data querier key on the currently aggregated data.
+// KeySwitchingPhase adds the noise and performs the switch to the key of the querier, given with the query, on the
+// currently aggregated data.
 func (mcs *Service) KeySwitchingPhase(targetSurvey libmedco.SurveyID) error {
 
-	pi, err := mcs.startProtocol(medco.KeySwitchingProtocolName, targetSurvey)
+	survey, querier := mcs.query()
+	if survey == nil || survey.ID != targetSurvey {
+		return errNoQuery
+	}
+	if err := mcs.NoisePhase(targetSurvey); err != nil {
+		return err
+	}
+	coaggr := survey.PollCothorityAggregatedGroupsAttr()
+	switched, err := mcs.startSwitching(survey, SwitchKey, querier, flatten(coaggr))
 	if err != nil {
 		return err
 	}
-	keySwitchedAggregatedAttributes := <-pi.(*medco.KeySwitchingProtocol).FeedbackChannel
+	keySwitchedAggregatedAttributes := unflatten(coaggr, switched)
 
 	//TODO: extract this subphase because it is optional
 	keySwitchedAggregatedGroups := make(map[libmedco.TempID]libmedco.CipherVector)
-	if mcs.survey.SurveyDescription.GroupingAttributesCount > 0 {
-		pi, err = mcs.startProtocol(medco.ProbabilisticSwitchingProtocolName, targetSurvey)
+	if survey.SurveyDescription.GroupingAttributesCount > 0 {
+		groups := make(map[libmedco.TempID]libmedco.CipherVector)
+		for id, ga := range survey.PollCothorityAggregatedGroupsID() {
+			cv := make(libmedco.CipherVector, len(ga))
+			for i, dc := range ga {
+				cv[i] = libmedco.CipherText{K: network.Suite.Point().Null(), C: dc.Point}
+			}
+			groups[id] = cv
+		}
+		switched, err = mcs.startSwitching(survey, SwitchProbabilistic, querier, flatten(groups))
 		if err != nil {
 			return err
 		}
-		keySwitchedAggregatedGroups = <-pi.(*medco.ProbabilisticSwitchingProtocol).FeedbackChannel
+		keySwitchedAggregatedGroups = unflatten(groups, switched)
 	}
 
-	mcs.survey.PushQuerierKeyEncryptedData(keySwitchedAggregatedGroups, keySwitchedAggregatedAttributes)
+	survey.PushQuerierKeyEncryptedData(keySwitchedAggregatedGroups, keySwitchedAggregatedAttributes)
 
-	return err
+	return nil
+}
+
+// Survey storage
+
+// surveyFile returns the file of a survey. The services of all servers of a process share the path, so it is named
+// after the server, and after the hexadecimal ID of the survey, which comes from the client.
+func (mcs *Service) surveyFile(id libmedco.SurveyID) string {
+	return mcs.surveyPrefix() + hex.EncodeToString([]byte(id)) + ".bin"
+}
+
+// surveyPrefix returns the start of the names of the survey files of this server.
+func (mcs *Service) surveyPrefix() string {
+	return mcs.homePath + "/medco_survey_" + mcs.ServerIdentity().ID.String() + "_"
+}
+
+// saveSurvey stores the state of the survey, it has to be called with the surveyLock. The state is written to a
+// temporary file first, so that a crash doesn't leave half of it.
+func (mcs *Service) saveSurvey(survey *libmedco.Survey) error {
+	b, err := network.MarshalRegisteredType(survey.Storage())
+	if err != nil {
+		return err
+	}
+	file := mcs.surveyFile(survey.ID)
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// loadSurveys reads the states of all stored surveys. A survey that can't be read is logged and skipped.
+func (mcs *Service) loadSurveys() {
+	files, err := filepath.Glob(mcs.surveyPrefix() + "*.bin")
+	if err != nil {
+		log.Error("Couldn't list the surveys:", err)
+		return
+	}
+	for _, file := range files {
+		if err := mcs.loadSurvey(file); err != nil {
+			log.Error("Couldn't load survey", file, ":", err)
+		}
+	}
+}
+
+// loadSurvey reads the state of the survey stored in file.
+func (mcs *Service) loadSurvey(file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	_, msg, err := network.UnmarshalRegistered(b)
+	if err != nil {
+		return err
+	}
+	st, ok := msg.(*libmedco.SurveyStorage)
+	if !ok {
+		return errors.New("Not a survey")
+	}
+	survey := libmedco.NewSurveyFromStorage(st)
+	mcs.surveys[st.ID] = &survey
+	log.Lvl1(mcs.ServerIdentity(), "continues the survey", st.ID)
+	return nil
 }
@@ -33,7 +33,7 @@ func TestService(t *testing.T) {
 	// Send a request to the service
 	client := medco.NewMedcoClient(el.List[0])
 
-	surveyDesc := SurveyDescription{1, 10}
+	surveyDesc := SurveyDescription{GroupingAttributesCount: 1, AggregatingAttributesCount: 10}
 	surveyID, err := client.CreateSurvey(el, surveyDesc)
 	if err != nil {
 		t.Fatal("Service did not start.")
@@ -73,6 +73,16 @@ func TestService(t *testing.T) {
 		}
 	}
 
+	if _, _, err := client.GetSurveyResults(*surveyID); err == nil {
+		t.Fatal("Got results of an open survey")
+	}
+	if err := client.CloseSurvey(*surveyID); err != nil {
+		t.Fatal("Couldn't close the survey:", err)
+	}
+	if err := dataHolder[0].SendSurveyResultsData(*surveyID, []int64{0}, make([]int64, 10), el.Aggregate); err == nil {
+		t.Fatal("Closed survey accepted a response")
+	}
+
 	grp, aggr, err := client.GetSurveyResults(*surveyID)
 
 	if err != nil {
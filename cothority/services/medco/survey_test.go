@@ -0,0 +1,77 @@
+package medco
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/csanti/pbft-experiments/cothority/log"
+	"github.com/csanti/pbft-experiments/cothority/sda"
+	"github.com/csanti/pbft-experiments/cothority/services/medco/libmedco"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestService_SurveyStorage makes sure a new service continues the stored surveys with the responses grouped.
+func TestService_SurveyStorage(t *testing.T) {
+	local := sda.NewLocalTest()
+	defer local.CloseAll()
+	hosts, el, s := local.MakeHELS(1, sda.ServiceFactory.ServiceID(ServiceName))
+	service := s.(*Service)
+
+	id := libmedco.SurveyID("survey")
+	_, err := service.HandleSurveyCreationQuery(nil, &SurveyCreationQuery{&id, *el,
+		libmedco.SurveyDescription{GroupingAttributesCount: 1, AggregatingAttributesCount: 2, Filters: 1}})
+	assert.NotNil(t, err, "created a survey with filters and exact results")
+	_, err = service.HandleSurveyCreationQuery(nil, &SurveyCreationQuery{&id, *el,
+		libmedco.SurveyDescription{GroupingAttributesCount: 1, AggregatingAttributesCount: 2}})
+	log.ErrFatal(err)
+	_, err = service.HandleSurveyCreationQuery(nil, &SurveyCreationQuery{&id, *el,
+		libmedco.SurveyDescription{AggregatingAttributesCount: 3}})
+	assert.NotNil(t, err, "overwrote a survey")
+	other := libmedco.SurveyID("other/survey")
+	_, err = service.HandleSurveyCreationQuery(nil, &SurveyCreationQuery{&other, *el,
+		libmedco.SurveyDescription{AggregatingAttributesCount: 2}})
+	log.ErrFatal(err)
+	response := func(group int64, aggr []int64) libmedco.ClientResponse {
+		var grouping libmedco.CipherVector
+		if group >= 0 {
+			grouping = *libmedco.EncryptIntVector(el.Aggregate, []int64{group})
+		}
+		return libmedco.ClientResponse{
+			ProbabilisticGroupingAttributes: grouping,
+			AggregatingAttributes:           *libmedco.EncryptIntVector(el.Aggregate, aggr),
+		}
+	}
+	_, err = service.HandleSurveyResponseData(nil, &SurveyResponseQuery{id, []libmedco.ClientResponse{
+		response(1, []int64{1, 2}), response(2, []int64{5, 6})}})
+	log.ErrFatal(err)
+	_, err = service.HandleSurveyResponseData(nil, &SurveyResponseQuery{id, []libmedco.ClientResponse{
+		response(1, []int64{1, 2}), response(-1, []int64{7, 8})}})
+	log.ErrFatal(err)
+	_, err = service.HandleSurveyResponseData(nil, &SurveyResponseQuery{other, []libmedco.ClientResponse{
+		response(-1, []int64{3, 4})}})
+	log.ErrFatal(err)
+	assert.Empty(t, service.surveys[id].ClientResponses)
+	assert.Empty(t, service.surveys[id].BadServers)
+
+	reloaded := NewService(service.Context, service.homePath).(*Service)
+	assert.Equal(t, 2, len(reloaded.surveys))
+	if !assert.NotNil(t, reloaded.surveys[other]) {
+		return
+	}
+	_, aggr := reloaded.surveys[other].PollLocallyAggregatedResponses()
+	sum := aggr[libmedco.DefaultGroup]
+	assert.Equal(t, []int64{3, 4}, libmedco.DecryptIntVector(local.GetPrivate(hosts[0]), &sum))
+	survey := reloaded.surveys[id]
+	if !assert.NotNil(t, survey) {
+		return
+	}
+	assert.True(t, survey.SurveyPHKey.Equal(service.surveys[id].SurveyPHKey))
+	_, aggr = survey.PollLocallyAggregatedResponses()
+	var sums []string
+	for _, cv := range aggr {
+		sums = append(sums, fmt.Sprint(libmedco.DecryptIntVector(local.GetPrivate(hosts[0]), &cv)))
+	}
+	sort.Strings(sums)
+	assert.Equal(t, []string{"[2 4]", "[5 6]", "[7 8]"}, sums)
+}
@@ -0,0 +1,322 @@
+package medco
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/csanti/pbft-experiments/cothority/log"
+	"github.com/csanti/pbft-experiments/cothority/network"
+	"github.com/csanti/pbft-experiments/cothority/sda"
+	"github.com/csanti/pbft-experiments/cothority/services/medco/libmedco"
+	"gopkg.in/dedis/crypto.v0/abstract"
+)
+
+// SwitchingProtocolName is the name of the protocol switching ciphertexts with proofs.
+const SwitchingProtocolName = "MedcoSwitching"
+
+// The switchings the SwitchingProtocol performs.
+const (
+	// SwitchDeterministic replaces the ElGamal contributions to the collective key by Pohlig-Hellman contributions.
+	SwitchDeterministic int32 = iota
+	// SwitchProbabilistic replaces the Pohlig-Hellman contributions by an encryption to the target key.
+	SwitchProbabilistic
+	// SwitchKey replaces the contributions to the collective key by an encryption to the target key.
+	SwitchKey
+)
+
+// SwitchingTimeout is how long the root waits for the switchings of all servers.
+const SwitchingTimeout = 5 * time.Minute
+
+func init() {
+	network.RegisterPacketType(SwitchingAnnounce{})
+	network.RegisterPacketType(SwitchingReply{})
+}
+
+// SwitchingAnnounce holds the ciphertexts to switch and the switchings of the servers before.
+type SwitchingAnnounce struct {
+	// SurveyID is the survey whose Pohlig-Hellman keys the servers use.
+	SurveyID libmedco.SurveyID
+	Kind     int32
+	// Target is the key of the querier, for the probabilistic and the key switching.
+	Target abstract.Point
+	Input  libmedco.CipherVector
+	Hops   []SwitchingHop
+}
+
+// StructSwitchingAnnounce is the SwitchingAnnounce with the sender.
+type StructSwitchingAnnounce struct {
+	*sda.TreeNode
+	SwitchingAnnounce
+}
+
+// SwitchingHop is the switching of one server with the proofs of the kind of switching.
+type SwitchingHop struct {
+	Output        libmedco.CipherVector
+	Deterministic []libmedco.DeterministicSwitchingProof
+	Probabilistic []libmedco.ProbabilisticSwitchingProof
+	Key           []libmedco.KeySwitchingProof
+}
+
+// SwitchingReply sends the switchings of all servers back to the root.
+type SwitchingReply struct {
+	Hops []SwitchingHop
+}
+
+// StructSwitchingReply is the SwitchingReply with the sender.
+type StructSwitchingReply struct {
+	*sda.TreeNode
+	SwitchingReply
+}
+
+// SwitchingResult is the output of the switching, or the error if a switching doesn't verify.
+type SwitchingResult struct {
+	Output libmedco.CipherVector
+	Err    error
+}
+
+// SwitchingProtocol passes the ciphertexts along a line of all servers, every server switches the output of the one
+// before and proves it. The root verifies all proofs, records the servers whose proofs don't verify in the survey and
+// refuses to deliver their output.
+type SwitchingProtocol struct {
+	*sda.TreeNodeInstance
+	// FeedbackChannel gets the switched ciphertexts on the root.
+	FeedbackChannel chan SwitchingResult
+	// Announce is set on the root before it starts.
+	Announce SwitchingAnnounce
+	// PHKey and Store are the Pohlig-Hellman key and the store of the survey, set on the root before it starts.
+	PHKey abstract.Scalar
+	Store *libmedco.SurveyStore
+	// MedcoServiceInstance holds the Pohlig-Hellman keys of the surveys on the other servers.
+	MedcoServiceInstance *Service
+}
+
+// NewSwitchingProtocol is the constructor of the switching protocol.
+func NewSwitchingProtocol(tni *sda.TreeNodeInstance) (sda.ProtocolInstance, error) {
+	p := &SwitchingProtocol{
+		TreeNodeInstance: tni,
+		FeedbackChannel:  make(chan SwitchingResult, 1),
+	}
+	if err := p.RegisterHandlers(p.HandleAnnounce, p.HandleReply); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Start switches the ciphertexts of the root.
+func (p *SwitchingProtocol) Start() error {
+	return p.HandleAnnounce(StructSwitchingAnnounce{p.TreeNode(), p.Announce})
+}
+
+// HandleAnnounce switches the output of the server before and passes it to the next one, the last one sends all
+// switchings back.
+func (p *SwitchingProtocol) HandleAnnounce(msg StructSwitchingAnnounce) error {
+	a := msg.SwitchingAnnounce
+	previous := a.start()
+	if len(a.Hops) > 0 {
+		previous = a.Hops[len(a.Hops)-1].Output
+	}
+	phKey := p.PHKey
+	if !p.IsRoot() {
+		var err error
+		phKey, err = p.MedcoServiceInstance.surveyPHKey(a.SurveyID)
+		if err != nil {
+			return err
+		}
+	}
+	a.Hops = append(a.Hops, a.switchHop(previous, p.Private(), phKey))
+	p.Announce = a
+	if p.IsLeaf() {
+		return p.HandleReply(StructSwitchingReply{p.TreeNode(), SwitchingReply{a.Hops}})
+	}
+	return p.SendTo(p.Children()[0], &a)
+}
+
+// HandleReply passes the switchings to the root, which verifies them.
+func (p *SwitchingProtocol) HandleReply(msg StructSwitchingReply) error {
+	defer p.Done()
+	if !p.IsRoot() {
+		return p.SendTo(p.Parent(), &msg.SwitchingReply)
+	}
+	var servers []*network.ServerIdentity
+	for n := p.TreeNode(); n != nil; {
+		servers = append(servers, n.ServerIdentity)
+		if len(n.Children) == 0 {
+			break
+		}
+		n = n.Children[0]
+	}
+	output, err := p.Announce.verify(msg.Hops, servers, p.Store)
+	p.FeedbackChannel <- SwitchingResult{output, err}
+	return nil
+}
+
+// start returns the ciphertexts the first server switches. The key switching starts without ephemeral key and keeps
+// the original ones to remove the contributions.
+func (a *SwitchingAnnounce) start() libmedco.CipherVector {
+	if a.Kind != SwitchKey {
+		return a.Input
+	}
+	start := make(libmedco.CipherVector, len(a.Input))
+	for i, c := range a.Input {
+		start[i] = libmedco.CipherText{K: network.Suite.Point().Null(), C: c.C}
+	}
+	return start
+}
+
+// ephemeralKeys returns the ephemeral keys of the ciphertexts before the key switching.
+func (a *SwitchingAnnounce) ephemeralKeys() []abstract.Point {
+	keys := make([]abstract.Point, len(a.Input))
+	for i, c := range a.Input {
+		keys[i] = c.K
+	}
+	return keys
+}
+
+// switchHop switches the previous ciphertexts with the keys of a server and proves it.
+func (a *SwitchingAnnounce) switchHop(previous libmedco.CipherVector, private, phKey abstract.Scalar) SwitchingHop {
+	hop := SwitchingHop{Output: *libmedco.NewCipherVector(len(previous))}
+	switch a.Kind {
+	case SwitchDeterministic:
+		hop.Deterministic = hop.Output.DeterministicSwitchingWithProof(&previous, private, phKey)
+	case SwitchProbabilistic:
+		phContrib := network.Suite.Point().Mul(network.Suite.Point().Base(), phKey)
+		hop.Probabilistic = hop.Output.ProbabilisticSwitchingWithProof(&previous, phContrib, a.Target)
+	case SwitchKey:
+		ephemeral := a.ephemeralKeys()
+		hop.Key = hop.Output.KeySwitchingWithProof(&previous, &ephemeral, a.Target, private)
+	}
+	return hop
+}
+
+// verify checks the switchings of the servers in the order they switched and records the servers with a proof that
+// doesn't verify in the store. It returns the output of the last switching, or an error if any switching doesn't
+// verify, as its output is corrupted.
+func (a *SwitchingAnnounce) verify(hops []SwitchingHop, servers []*network.ServerIdentity, store *libmedco.SurveyStore) (libmedco.CipherVector, error) {
+	var failed error
+	if len(hops) != len(servers) {
+		failed = fmt.Errorf("got %d switchings from %d servers", len(hops), len(servers))
+		store.CheckProof(servers[len(servers)-1], failed)
+		if len(hops) > len(servers) {
+			hops = hops[:len(servers)]
+		}
+	}
+	previous := a.start()
+	for i, hop := range hops {
+		server := servers[i]
+		var err error
+		switch a.Kind {
+		case SwitchDeterministic:
+			err = libmedco.VerifyDeterministicSwitching(previous, hop.Output, hop.Deterministic, server.Public)
+			if err == nil && len(hop.Deterministic) > 0 {
+				contrib := hop.Deterministic[0].PHContrib
+				if !store.KnownPHContrib(server.ID, contrib).Equal(contrib) {
+					err = errors.New("changed its Pohlig-Hellman contribution")
+				}
+			}
+		case SwitchProbabilistic:
+			var phContrib abstract.Point
+			if len(hop.Probabilistic) > 0 {
+				phContrib = store.KnownPHContrib(server.ID, hop.Probabilistic[0].PHContrib)
+			}
+			err = libmedco.VerifyProbabilisticSwitching(previous, hop.Output, hop.Probabilistic, phContrib, a.Target)
+		case SwitchKey:
+			err = libmedco.VerifyKeySwitching(previous, hop.Output, hop.Key, a.ephemeralKeys(), a.Target, server.Public)
+		default:
+			err = fmt.Errorf("unknown switching %d", a.Kind)
+		}
+		if !store.CheckProof(server, err) {
+			log.Error("Proof of", server, "doesn't verify:", err)
+			if failed == nil {
+				failed = fmt.Errorf("switching of %s doesn't verify: %s", server, err)
+			}
+		}
+		previous = hop.Output
+	}
+	if failed != nil {
+		return nil, failed
+	}
+	return previous, nil
+}
+
+// startSwitching switches the ciphertexts on all servers of the survey and returns the result, or an error if a server
+// doesn't switch correctly or in time.
+func (mcs *Service) startSwitching(survey *libmedco.Survey, kind int32, target abstract.Point, input libmedco.CipherVector) (libmedco.CipherVector, error) {
+	if target == nil {
+		target = network.Suite.Point().Null()
+	}
+	tree := survey.Roster.GenerateNaryTreeWithRoot(1, mcs.ServerIdentity())
+	tni := mcs.NewTreeNodeInstance(tree, tree.Root, SwitchingProtocolName)
+	pi, err := mcs.NewProtocol(tni, nil)
+	if err != nil {
+		return nil, err
+	}
+	switching := pi.(*SwitchingProtocol)
+	switching.Announce = SwitchingAnnounce{SurveyID: survey.ID, Kind: kind, Target: target, Input: input}
+	switching.PHKey = survey.SurveyPHKey
+	switching.Store = survey.SurveyStore
+	mcs.RegisterProtocolInstance(pi)
+	go pi.Dispatch()
+	go pi.Start()
+	var output libmedco.CipherVector
+	select {
+	case result := <-switching.FeedbackChannel:
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		output = result.Output
+	case <-time.After(SwitchingTimeout):
+		return nil, errors.New("the servers didn't switch in time")
+	}
+	if len(output) != len(input) {
+		return nil, fmt.Errorf("switched %d ciphertexts instead of %d", len(output), len(input))
+	}
+	return output, nil
+}
+
+// surveyPHKey returns the Pohlig-Hellman key of the survey with the given ID.
+func (mcs *Service) surveyPHKey(id libmedco.SurveyID) (abstract.Scalar, error) {
+	survey, err := mcs.getSurvey(id)
+	if err != nil {
+		return nil, err
+	}
+	return survey.SurveyPHKey, nil
+}
+
+// tempIDs sorts the IDs of the vectors to switch.
+type tempIDs []libmedco.TempID
+
+func (ids tempIDs) Len() int           { return len(ids) }
+func (ids tempIDs) Less(i, j int) bool { return ids[i] < ids[j] }
+func (ids tempIDs) Swap(i, j int)      { ids[i], ids[j] = ids[j], ids[i] }
+
+// sortedIDs returns the IDs of the vectors in increasing order.
+func sortedIDs(vectors map[libmedco.TempID]libmedco.CipherVector) []libmedco.TempID {
+	var ids tempIDs
+	for id := range vectors {
+		ids = append(ids, id)
+	}
+	sort.Sort(ids)
+	return ids
+}
+
+// flatten puts the vectors in one vector, in the order of their IDs, so that they are switched together.
+func flatten(vectors map[libmedco.TempID]libmedco.CipherVector) libmedco.CipherVector {
+	var flat libmedco.CipherVector
+	for _, id := range sortedIDs(vectors) {
+		flat = append(flat, vectors[id]...)
+	}
+	return flat
+}
+
+// unflatten splits the switched vector back to vectors with the IDs and the lengths of the vectors before.
+func unflatten(vectors map[libmedco.TempID]libmedco.CipherVector, flat libmedco.CipherVector) map[libmedco.TempID]libmedco.CipherVector {
+	switched := make(map[libmedco.TempID]libmedco.CipherVector, len(vectors))
+	for _, id := range sortedIDs(vectors) {
+		n := len(vectors[id])
+		switched[id] = flat[:n]
+		flat = flat[n:]
+	}
+	return switched
+}
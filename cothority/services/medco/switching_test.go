@@ -0,0 +1,74 @@
+package medco
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/csanti/pbft-experiments/cothority/network"
+	"github.com/csanti/pbft-experiments/cothority/services/medco/libmedco"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/config"
+)
+
+// TestSwitching_CheatingServer makes sure the root finds the server that switched wrongly.
+func TestSwitching_CheatingServer(t *testing.T) {
+	var servers []*network.ServerIdentity
+	var privates, phKeys []abstract.Scalar
+	collective := network.Suite.Point().Null()
+	for i := 0; i < 3; i++ {
+		kp := config.NewKeyPair(network.Suite)
+		servers = append(servers, network.NewServerIdentity(kp.Public, "localhost:"+strconv.Itoa(2000+i)))
+		privates = append(privates, kp.Secret)
+		phKeys = append(phKeys, config.NewKeyPair(network.Suite).Secret)
+		collective.Add(collective, kp.Public)
+	}
+	querier := config.NewKeyPair(network.Suite)
+	switchAll := func(a *SwitchingAnnounce, cheater int) []SwitchingHop {
+		var hops []SwitchingHop
+		previous := a.start()
+		for i := range servers {
+			hop := a.switchHop(previous, privates[i], phKeys[i])
+			if i == cheater {
+				hop.Output[1].C.Add(hop.Output[1].C, network.Suite.Point().Base())
+			}
+			hops = append(hops, hop)
+			previous = hop.Output
+		}
+		return hops
+	}
+
+	a := &SwitchingAnnounce{
+		Kind:   SwitchKey,
+		Target: querier.Public,
+		Input:  *libmedco.EncryptIntVector(collective, []int64{1, 2, 3}),
+	}
+	store := libmedco.NewSurveyStore()
+	switched, err := a.verify(switchAll(a, -1), servers, store)
+	assert.Nil(t, err)
+	assert.Empty(t, store.BadServers)
+	assert.Equal(t, []int64{1, 2, 3}, libmedco.DecryptIntVector(querier.Secret, &switched))
+	switched, err = a.verify(switchAll(a, 1), servers, store)
+	assert.NotNil(t, err)
+	assert.Nil(t, switched)
+	if assert.Equal(t, 1, len(store.BadServers)) {
+		assert.Equal(t, servers[1], store.BadServers[0].Server)
+	}
+
+	d := &SwitchingAnnounce{
+		Kind:   SwitchDeterministic,
+		Target: network.Suite.Point().Null(),
+		Input:  *libmedco.EncryptIntVector(collective, []int64{4, 4}),
+	}
+	store = libmedco.NewSurveyStore()
+	switched, err = d.verify(switchAll(d, -1), servers, store)
+	assert.Nil(t, err)
+	assert.Empty(t, store.BadServers)
+	assert.True(t, switched[0].C.Equal(switched[1].C))
+	phKeys[2] = config.NewKeyPair(network.Suite).Secret
+	_, err = d.verify(switchAll(d, -1), servers, store)
+	assert.NotNil(t, err)
+	if assert.Equal(t, 1, len(store.BadServers)) {
+		assert.Equal(t, servers[2], store.BadServers[0].Server)
+	}
+}
@@ -1,7 +1,6 @@
 package skipchain
 
 import (
-	"bytes"
 	"errors"
 
 	"github.com/csanti/pbft-experiments/cothority/log"
@@ -119,6 +118,21 @@ func (c *Client) GetUpdateChain(parent *SkipBlock, latest SkipBlockID) (reply *G
 	return
 }
 
+// GetProof returns the shortest path of SkipBlocks from the known one to the
+// most current SkipBlock of the chain, checked with VerifyProof.
+func (c *Client) GetProof(known *SkipBlock) ([]*SkipBlock, error) {
+	h := known.Roster.RandomServerIdentity()
+	r, err := c.Send(h, &GetProof{known.Hash})
+	if err != nil {
+		return nil, err
+	}
+	reply := r.Msg.(GetProofReply)
+	if err := VerifyProof(known, reply.Proof); err != nil {
+		return nil, err
+	}
+	return reply.Proof, nil
+}
+
 // proposeSkipBlock sends a proposeSkipBlock to the service. If latest has
 // a Nil-Hash, it will be used as a
 // - rosterSkipBlock if data is nil, the Roster will be taken from 'el'
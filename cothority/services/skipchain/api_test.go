@@ -140,6 +140,53 @@ func TestClient_ProposeRoster(t *testing.T) {
 	}
 }
 
+func TestClient_GetProof(t *testing.T) {
+	l := sda.NewLocalTest()
+	_, el, _ := l.GenTree(4, true, true, true)
+	defer l.CloseAll()
+
+	c := NewClient()
+	genesis, err := c.CreateRoster(el, 2, 3, VerifyNone, nil)
+	log.ErrFatal(err)
+	latest := genesis
+	for i := 0; i < 9; i++ {
+		reply, err := c.ProposeRoster(latest, el)
+		log.ErrFatal(err)
+		latest = reply.Latest
+	}
+
+	proof, err := c.GetProof(genesis)
+	log.ErrFatal(err)
+	if !proof[len(proof)-1].Equal(latest) {
+		t.Fatal("Proof doesn't end at the latest block")
+	}
+	// 0 -> 4 -> 8 -> 9
+	if len(proof) != 4 {
+		t.Fatal("Proof should skip blocks but has", len(proof))
+	}
+
+	proof[1] = proof[1].Copy()
+	proof[1].BlsPublics = proof[0].BlsPublics[:1]
+	proof[1].BlsProofs = proof[0].BlsProofs[:1]
+	if VerifyProof(genesis, proof) == nil {
+		t.Fatal("Proof with changed roster verified")
+	}
+	if VerifyProof(latest, proof) == nil {
+		t.Fatal("Proof from another block verified")
+	}
+	if VerifyProof(nil, proof) == nil {
+		t.Fatal("Proof without known block verified")
+	}
+	proof[1] = nil
+	if VerifyProof(genesis, proof) == nil {
+		t.Fatal("Proof with an empty block verified")
+	}
+	proof[1] = &SkipBlock{}
+	if VerifyProof(genesis, proof) == nil {
+		t.Fatal("Proof with a block without SkipBlockFix verified")
+	}
+}
+
 type testData struct {
 	A int
 	B string
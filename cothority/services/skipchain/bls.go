@@ -0,0 +1,446 @@
+package skipchain
+
+/*
+The blocks and their forward links are signed with the BLS signatures of
+blsftcosi. The blsftcosi protocol runs on onet, so the service uses its own
+protocol on sda that aggregates the signatures and masks up the tree in the
+same format: the signature is followed by the mask of the signers, in the
+order of the BLS keys of the roster, and is verified with blsftcosi's Verify.
+
+Every node has a BLS key, stored with the service. The keys of a roster are
+collected with the same protocol and stored in the block of the roster, so
+they are signed with it. Every key comes with a proof of possession, the
+BLS signature of the key itself, so that no node can choose its key to cancel
+the keys of others in the aggregate.
+
+Like blsftcosi, the protocol tolerates failing nodes: the tree has two
+levels, the subleaders wait for their leaves only half of the timeout, and
+every node sends what it got when its timeout is over. Every node verifies
+the signatures of its children with the keys of their masks before it
+aggregates them, and leaves out the ones that don't verify. The root returns
+the signature of the nodes that answered, which has to fulfill the policy.
+*/
+
+import (
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"time"
+
+	"github.com/csanti/pbft-experiments/blsftcosi/protocol"
+	"github.com/csanti/pbft-experiments/cothority/log"
+	"github.com/csanti/pbft-experiments/cothority/network"
+	"github.com/csanti/pbft-experiments/cothority/sda"
+	"go.dedis.ch/kyber"
+	"go.dedis.ch/kyber/sign/bls"
+	"go.dedis.ch/kyber/util/random"
+)
+
+const skipchainBLS = "SkipchainBLS"
+
+// blsTimeout is how long the root waits for the subleaders.
+const blsTimeout = 20 * time.Second
+
+// blsProofPrefix is signed with the key for a proof of possession, so that
+// the proof can't be mistaken for a forward link.
+var blsProofPrefix = []byte("skipchain BLS proof of possession")
+
+func init() {
+	for _, msg := range []interface{}{BLSAnnounce{}, BLSResponse{}} {
+		network.RegisterPacketType(msg)
+	}
+	sda.ProtocolRegisterName(skipchainBLS, func(n *sda.TreeNodeInstance) (sda.ProtocolInstance, error) {
+		return newBLSSign(n, nil, nil)
+	})
+}
+
+// BLSAnnounce asks the nodes to verify Data and sign Msg with the keys in
+// Publics, which come with their proofs of possession, or to send their keys
+// if Msg is empty. A node waits Timeout for its children.
+type BLSAnnounce struct {
+	Msg     []byte
+	Data    []byte
+	Publics [][]byte
+	Proofs  [][]byte
+	Timeout time.Duration
+}
+
+// StructBLSAnnounce is the BLSAnnounce with the sender.
+type StructBLSAnnounce struct {
+	*sda.TreeNode
+	BLSAnnounce
+}
+
+// BLSResponse holds the aggregate signature and mask of a subtree, or the
+// keys of its nodes.
+type BLSResponse struct {
+	Signature []byte
+	Mask      []byte
+	Keys      []BLSKey
+}
+
+// StructBLSResponse is the BLSResponse with the sender.
+type StructBLSResponse struct {
+	*sda.TreeNode
+	BLSResponse
+}
+
+// BLSKey is the BLS key of the node at Index in the roster with its proof of
+// possession.
+type BLSKey struct {
+	Index  int
+	Public []byte
+	Proof  []byte
+}
+
+// blsSign collects the BLS signatures or keys of the tree.
+type blsSign struct {
+	*sda.TreeNodeInstance
+	private kyber.Scalar
+	verify  func(msg, data []byte) bool
+	// announce is set on the root before it starts
+	announce BLSAnnounce
+	// result holds the signature and mask, or the keys, on the root
+	result    chan *BLSResponse
+	responses chan StructBLSResponse
+}
+
+func newBLSSign(n *sda.TreeNodeInstance, private kyber.Scalar, verify func(msg, data []byte) bool) (sda.ProtocolInstance, error) {
+	p := &blsSign{
+		TreeNodeInstance: n,
+		private:          private,
+		verify:           verify,
+		result:           make(chan *BLSResponse, 1),
+	}
+	if err := p.RegisterHandler(p.HandleAnnounce); err != nil {
+		return nil, err
+	}
+	if err := p.RegisterChannel(&p.responses); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Start sends the announcement down the tree.
+func (p *blsSign) Start() error {
+	return p.HandleAnnounce(StructBLSAnnounce{p.TreeNode(), p.announce})
+}
+
+// HandleAnnounce passes the announcement to the children, which get half of
+// our timeout, and collects their responses. The leaves answer right away.
+func (p *blsSign) HandleAnnounce(msg StructBLSAnnounce) error {
+	p.announce = msg.BLSAnnounce
+	if p.IsLeaf() {
+		return p.respond(nil)
+	}
+	announce := msg.BLSAnnounce
+	announce.Timeout /= 2
+	for _, c := range p.Children() {
+		if err := p.SendTo(c, &announce); err != nil {
+			log.Lvl2("Couldn't announce to", c.ServerIdentity, err)
+		}
+	}
+	go func() {
+		if err := p.respond(p.collect()); err != nil {
+			log.Error(p.ServerIdentity(), "couldn't respond:", err)
+		}
+	}()
+	return nil
+}
+
+// collect returns the responses of the children that answered before the
+// timeout.
+func (p *blsSign) collect() []StructBLSResponse {
+	var replies []StructBLSResponse
+	timeout := time.After(p.announce.Timeout)
+	for len(replies) < len(p.Children()) {
+		select {
+		case r := <-p.responses:
+			replies = append(replies, r)
+		case <-timeout:
+			log.Lvl2(p.ServerIdentity(), "got", len(replies), "of",
+				len(p.Children()), "responses")
+			return replies
+		}
+	}
+	return replies
+}
+
+// respond adds our signature or key to the ones of the children and sends
+// them to the parent.
+func (p *blsSign) respond(replies []StructBLSResponse) error {
+	defer p.Done()
+	var reply *BLSResponse
+	var err error
+	if len(p.announce.Msg) == 0 {
+		reply, err = p.keys(replies)
+	} else {
+		reply, err = p.sign(replies)
+	}
+	if err != nil {
+		return err
+	}
+	if p.IsRoot() {
+		p.result <- reply
+		return nil
+	}
+	return p.SendTo(p.Parent(), reply)
+}
+
+// keys returns our key with the keys of the children.
+func (p *blsSign) keys(replies []StructBLSResponse) (*BLSResponse, error) {
+	reply := &BLSResponse{}
+	for _, r := range replies {
+		reply.Keys = append(reply.Keys, r.Keys...)
+	}
+	if p.private == nil {
+		return reply, nil
+	}
+	public, err := protocol.ThePairingSuite.G2().Point().Mul(p.private, nil).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	proof, err := bls.Sign(protocol.ThePairingSuite, p.private, blsProofMsg(public))
+	if err != nil {
+		return nil, err
+	}
+	index, _ := p.Roster().Search(p.ServerIdentity().ID)
+	reply.Keys = append(reply.Keys, BLSKey{Index: index, Public: public, Proof: proof})
+	return reply, nil
+}
+
+// sign returns the signatures and masks of the children aggregated with
+// ours, if we accept the data. The signature of a child that doesn't verify
+// with the keys of its mask is left out, so that one bad subtree doesn't
+// spoil the aggregate.
+func (p *blsSign) sign(replies []StructBLSResponse) (*BLSResponse, error) {
+	suite := protocol.ThePairingSuite
+	publics, err := blsKeys(p.announce.Publics, p.announce.Proofs)
+	if err != nil {
+		return nil, err
+	}
+	mask, err := protocol.NewMask(suite, publics, nil)
+	if err != nil {
+		return nil, err
+	}
+	aggregate := suite.G1().Point().Null()
+	masks := mask.Mask()
+	for _, r := range replies {
+		if len(r.Signature) == 0 {
+			continue
+		}
+		if err := verifyPartial(publics, masks, p.announce.Msg, r.BLSResponse); err != nil {
+			log.Lvl2("Invalid signature from", r.ServerIdentity, err)
+			continue
+		}
+		sig := suite.G1().Point()
+		if err := sig.UnmarshalBinary(r.Signature); err != nil {
+			log.Lvl2("Invalid signature from", r.ServerIdentity, err)
+			continue
+		}
+		if masks, err = protocol.AggregateMasks(masks, r.Mask); err != nil {
+			log.Lvl2("Invalid mask from", r.ServerIdentity, err)
+			continue
+		}
+		aggregate.Add(aggregate, sig)
+	}
+
+	if p.private != nil && p.verify != nil && p.verify(p.announce.Msg, p.announce.Data) {
+		public := suite.G2().Point().Mul(p.private, nil)
+		if own, err := protocol.NewMask(suite, publics, public); err != nil {
+			log.Lvl2(p.ServerIdentity(), "isn't a signer:", err)
+		} else {
+			if masks, err = protocol.AggregateMasks(masks, own.Mask()); err != nil {
+				return nil, err
+			}
+			s, err := bls.Sign(suite, p.private, p.announce.Msg)
+			if err != nil {
+				return nil, err
+			}
+			sig := suite.G1().Point()
+			if err := sig.UnmarshalBinary(s); err != nil {
+				return nil, err
+			}
+			aggregate.Add(aggregate, sig)
+		}
+	} else {
+		log.Lvl2(p.ServerIdentity(), "refuses to sign", p.announce.Msg)
+	}
+
+	signature, err := aggregate.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return &BLSResponse{Signature: signature, Mask: masks}, nil
+}
+
+// verifyPartial returns an error if the signature of a subtree doesn't verify
+// with the keys of its mask, or if its mask overlaps the signers we have.
+func verifyPartial(publics []kyber.Point, have []byte, msg []byte, r BLSResponse) error {
+	mask, err := protocol.NewMask(protocol.ThePairingSuite, publics, nil)
+	if err != nil {
+		return err
+	}
+	if err := mask.SetMask(r.Mask); err != nil {
+		return err
+	}
+	if mask.CountEnabled() == 0 {
+		return errors.New("signature without signers")
+	}
+	for i := range have {
+		if have[i]&r.Mask[i] != 0 {
+			return errors.New("signers are counted twice")
+		}
+	}
+	return bls.Verify(protocol.ThePairingSuite, mask.AggregatePublic, msg, r.Signature)
+}
+
+// blsPublics returns the keys of a roster as points.
+func blsPublics(keys [][]byte) ([]kyber.Point, error) {
+	var publics []kyber.Point
+	for _, k := range keys {
+		public := protocol.ThePairingSuite.G2().Point()
+		if err := public.UnmarshalBinary(k); err != nil {
+			return nil, err
+		}
+		publics = append(publics, public)
+	}
+	return publics, nil
+}
+
+// blsProofMsg returns the message signed for the proof of possession of the
+// key.
+func blsProofMsg(public []byte) []byte {
+	return append(append([]byte{}, blsProofPrefix...), public...)
+}
+
+// blsKeys returns the keys of a roster as points, if every key comes with
+// a valid proof of possession.
+func blsKeys(keys, proofs [][]byte) ([]kyber.Point, error) {
+	if len(proofs) != len(keys) {
+		return nil, errors.New("BLS keys without proofs of possession")
+	}
+	publics, err := blsPublics(keys)
+	if err != nil {
+		return nil, err
+	}
+	for i, public := range publics {
+		if err := bls.Verify(protocol.ThePairingSuite, public, blsProofMsg(keys[i]), proofs[i]); err != nil {
+			return nil, errors.New("wrong proof of possession: " + err.Error())
+		}
+	}
+	return publics, nil
+}
+
+// blsPolicy returns the policy a forward link signed by n nodes has to
+// fulfill, the same as in the blsftcosi simulation.
+func blsPolicy(n int) protocol.Policy {
+	return protocol.NewThresholdPolicy(n * 2 / 3)
+}
+
+// startBLS runs the protocol on the roster with us as root and returns the
+// result.
+func (s *Service) startBLS(roster *sda.Roster, announce BLSAnnounce) (*BLSResponse, error) {
+	// two levels, like the subtrees of blsftcosi
+	bf := int(math.Ceil(math.Sqrt(float64(len(roster.List)))))
+	tree := roster.GenerateNaryTreeWithRoot(bf, s.ServerIdentity())
+	if tree == nil {
+		return nil, errors.New("we're not in the roster")
+	}
+	pi, err := s.CreateProtocolService(skipchainBLS, tree)
+	if err != nil {
+		return nil, errors.New("Couldn't create new node: " + err.Error())
+	}
+	root := pi.(*blsSign)
+	root.private = s.blsPrivate
+	root.verify = s.bftVerify
+	root.announce = announce
+	root.announce.Timeout = blsTimeout
+	go pi.Start()
+	select {
+	case reply := <-root.result:
+		return reply, nil
+	case <-time.After(blsTimeout * 2):
+		return nil, errors.New("Timed out while waiting for BLS signature")
+	}
+}
+
+// collectBLSKeys returns the BLS keys of all members of the roster and their
+// proofs of possession, in the order of the roster.
+func (s *Service) collectBLSKeys(roster *sda.Roster) ([][]byte, [][]byte, error) {
+	reply, err := s.startBLS(roster, BLSAnnounce{})
+	if err != nil {
+		return nil, nil, err
+	}
+	keys := make([][]byte, len(roster.List))
+	proofs := make([][]byte, len(roster.List))
+	for _, k := range reply.Keys {
+		if k.Index < 0 || k.Index >= len(keys) {
+			return nil, nil, errors.New("got key of unknown node")
+		}
+		keys[k.Index] = k.Public
+		proofs[k.Index] = k.Proof
+	}
+	for i, k := range keys {
+		if len(k) == 0 {
+			return nil, nil, errors.New("missing BLS key of " + roster.List[i].String())
+		}
+	}
+	if _, err := blsKeys(keys, proofs); err != nil {
+		return nil, nil, err
+	}
+	return keys, proofs, nil
+}
+
+// signForwardLink signs the hash of the newest block with the roster of
+// block, which has to hold the BLS keys of the roster.
+func (s *Service) signForwardLink(block, newest *SkipBlock) ([]byte, error) {
+	if len(block.BlsPublics) == 0 {
+		return nil, errors.New("block has no BLS keys")
+	}
+	data, err := network.MarshalRegisteredType(newest)
+	if err != nil {
+		return nil, errors.New("Couldn't marshal block: " + err.Error())
+	}
+	reply, err := s.startBLS(block.Roster, BLSAnnounce{
+		Msg:     newest.Hash,
+		Data:    data,
+		Publics: block.BlsPublics,
+		Proofs:  block.BlsProofs,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the roster of block has to agree on the newest block
+	publics, err := blsKeys(block.BlsPublics, block.BlsProofs)
+	if err != nil {
+		return nil, err
+	}
+	link := &BlockLink{newest.Hash, append(reply.Signature, reply.Mask...)}
+	if err := link.VerifySignature(publics); err != nil {
+		return nil, err
+	}
+	return link.Signature, nil
+}
+
+// loadBLSKey reads the BLS key of the node, or creates and stores a new one.
+// The services of all hosts of a process share the path, so the file is named
+// after the node.
+func (s *Service) loadBLSKey() error {
+	file := s.path + "/skipchain_bls_" + s.ServerIdentity().ID.String() + ".key"
+	b, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	suite := protocol.ThePairingSuite
+	if len(b) > 0 {
+		s.blsPrivate = suite.G2().Scalar()
+		return s.blsPrivate.UnmarshalBinary(b)
+	}
+	s.blsPrivate, _ = bls.NewKeyPair(suite, random.New())
+	if b, err = s.blsPrivate.MarshalBinary(); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, b, 0600)
+}
@@ -17,6 +17,8 @@ func init() {
 		// Requests for data
 		&GetUpdateChain{},
 		&GetUpdateChainReply{},
+		&GetProof{},
+		&GetProofReply{},
 		// Data-structures
 		&ForwardSignature{},
 		&SkipBlockFix{},
@@ -39,6 +41,11 @@ var (
 	// VerifyShard makes sure that the child SkipChain will always be
 	// a part of its parent SkipChain
 	VerifyShard = VerifierID(uuid.NewV5(uuid.NamespaceURL, "Shard"))
+	// VerifyRoster makes sure that a new roster keeps two thirds of the
+	// previous one
+	VerifyRoster = VerifierID(uuid.NewV5(uuid.NamespaceURL, "Roster"))
+	// VerifyData makes sure that the data is of a registered type
+	VerifyData = VerifierID(uuid.NewV5(uuid.NamespaceURL, "Data"))
 	// VerifySSH makes sure that a given number of client-devices signed
 	// off on the changes
 	VerifySSH = VerifierID(uuid.NewV5(uuid.NamespaceURL, "SSH-ks"))
@@ -81,6 +88,18 @@ type GetUpdateChainReply struct {
 	Update []*SkipBlock
 }
 
+// GetProof - the client sends the hash of a known SkipBlock and gets back
+// the shortest path of forward links to the latest SkipBlock.
+type GetProof struct {
+	From SkipBlockID
+}
+
+// GetProofReply - returns the SkipBlocks of the path, starting with the
+// known SkipBlock. It can be checked with VerifyProof.
+type GetProofReply struct {
+	Proof []*SkipBlock
+}
+
 // SetChildrenSkipBlock adds a link to a child-SkipBlock in the
 // parent-SkipBlock
 type SetChildrenSkipBlock struct {
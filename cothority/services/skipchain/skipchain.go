@@ -10,8 +10,6 @@ import (
 
 	"strconv"
 
-	"time"
-
 	"io/ioutil"
 	"os"
 
@@ -19,21 +17,17 @@ import (
 
 	"github.com/csanti/pbft-experiments/cothority/log"
 	"github.com/csanti/pbft-experiments/cothority/network"
-	"github.com/csanti/pbft-experiments/cothority/protocols/bftcosi"
 	"github.com/csanti/pbft-experiments/cothority/protocols/manage"
 	"github.com/csanti/pbft-experiments/cothority/sda"
+	"go.dedis.ch/kyber"
 )
 
 // ServiceName can be used to refer to the name of this service
 const ServiceName = "Skipchain"
-const skipchainBFT = "SkipchainBFT"
 
 func init() {
 	sda.RegisterNewService(ServiceName, newSkipchainService)
 	skipchainSID = sda.ServiceFactory.ServiceID(ServiceName)
-	sda.ProtocolRegisterName(skipchainBFT, func(n *sda.TreeNodeInstance) (sda.ProtocolInstance, error) {
-		return bftcosi.NewBFTCoSiProtocol(n, nil, nil)
-	})
 	network.RegisterPacketType(&SkipBlockMap{})
 }
 
@@ -49,6 +43,8 @@ type Service struct {
 	path    string
 	// testVerify is set to true if a verification happened - only for testing
 	testVerify bool
+	// blsPrivate signs the forward links
+	blsPrivate kyber.Scalar
 }
 
 // SkipBlockMap holds the map to the skipblocks so it can be marshaled.
@@ -117,8 +113,13 @@ func (s *Service) ProposeSkipBlock(si *network.ServerIdentity, psbd *ProposeSkip
 		rand.Read(bl)
 		prop.BackLinkIds = []SkipBlockID{SkipBlockID(bl)}
 	}
+	var err error
 	if prop.Roster != nil {
 		prop.Aggregate = prop.Roster.Aggregate
+		prop.BlsPublics, prop.BlsProofs, err = s.collectBLSKeys(prop.Roster)
+		if err != nil {
+			return nil, errors.New("Couldn't get BLS keys: " + err.Error())
+		}
 	}
 	el, err := prop.GetResponsible(s)
 	if err != nil {
@@ -167,6 +168,31 @@ func (s *Service) GetUpdateChain(si *network.ServerIdentity, latestKnown *GetUpd
 	return reply, nil
 }
 
+// GetProof returns the shortest path from the given SkipBlock to the latest
+// one. Every block of the path follows the highest forward link of the
+// previous block, which skips the most blocks, so the path has O(log n)
+// blocks.
+func (s *Service) GetProof(si *network.ServerIdentity, req *GetProof) (network.Body, error) {
+	block, ok := s.getSkipBlockByID(req.From)
+	if !ok {
+		return nil, errors.New("Couldn't find skipblock")
+	}
+	proof := []*SkipBlock{block}
+	for len(block.ForwardLink) > 0 {
+		var next *SkipBlock
+		for h := len(block.ForwardLink) - 1; h >= 0 && next == nil; h-- {
+			next, _ = s.getSkipBlockByID(block.ForwardLink[h].Hash)
+		}
+		if next == nil {
+			return nil, errors.New("Missing block in forward-chain")
+		}
+		block = next
+		proof = append(proof, block)
+	}
+	log.Lvl3("Found proof of", len(proof), "blocks")
+	return &GetProofReply{proof}, nil
+}
+
 // SetChildrenSkipBlock creates a new SkipChain if that 'service' doesn't exist
 // yet.
 func (s *Service) SetChildrenSkipBlock(si *network.ServerIdentity, scsb *SetChildrenSkipBlock) (network.Body, error) {
@@ -209,8 +235,8 @@ func (s *Service) NewProtocol(tn *sda.TreeNodeInstance, conf *sda.GenericConfig)
 			return nil, err
 		}
 		pi.(*manage.Propagate).RegisterOnData(s.PropagateSkipBlock)
-	case skipchainBFT:
-		pi, err = bftcosi.NewBFTCoSiProtocol(tn, s.bftVerify, nil)
+	case skipchainBLS:
+		pi, err = newBLSSign(tn, s.blsPrivate, s.bftVerify)
 	}
 	return pi, err
 }
@@ -230,10 +256,8 @@ func (s *Service) PropagateSkipBlock(msg network.Body) {
 	log.Lvlf3("Stored skip block %+v in %x", *sb, s.Context.ServerIdentity().ID[0:8])
 }
 
-// signNewSkipBlock should start a BFT-signature on the newest block
-// which will propagate and update all forward-links of all blocks.
-// As a simple solution it verifies the validity of the block,
-// simulates a signature and propagates the latest and newest block.
+// signNewSkipBlock signs the newest block with the BLS keys of its roster,
+// adds the forward-links to it and propagates the latest and newest block.
 func (s *Service) signNewSkipBlock(latest, newest *SkipBlock) (*SkipBlock, *SkipBlock, error) {
 	log.Lvl4("Signing new block", newest, "on block", latest)
 	if newest != nil && newest.Roster == nil {
@@ -246,17 +270,21 @@ func (s *Service) signNewSkipBlock(latest, newest *SkipBlock) (*SkipBlock, *Skip
 			return nil, nil, errors.New("Didn't find parent block")
 		}
 		newest.Roster = parent.Roster
+		newest.BlsPublics = parent.BlsPublics
+		newest.BlsProofs = parent.BlsProofs
 	}
 	// Now verify if it's a valid block
 	if err := s.verifyNewSkipBlock(latest, newest); err != nil {
 		return nil, nil, errors.New("Verification of newest SkipBlock failed: " + err.Error())
 	}
 
-	// Sign it
-	err := s.startBFTSignature(newest)
+	// Sign it with the roster of the block, the forward links of blocks
+	// with the same roster reuse the signature
+	sig, err := s.signForwardLink(newest, newest)
 	if err != nil {
 		return nil, nil, err
 	}
+	newest.BlockSig = &BlockLink{newest.Hash, sig}
 	if err := newest.VerifySignatures(); err != nil {
 		log.Error("Couldn't verify signature: " + err.Error())
 		return nil, nil, err
@@ -268,8 +296,8 @@ func (s *Service) signNewSkipBlock(latest, newest *SkipBlock) (*SkipBlock, *Skip
 		newblocks[0] = newest
 	} else {
 		// Adjust forward-links if it's an additional block
-		var err error
-		newblocks, err = s.addForwardLinks(newest)
+		sigs := map[sda.RosterID][]byte{newest.Roster.ID: sig}
+		newblocks, err = s.addForwardLinks(newest, sigs)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -284,62 +312,6 @@ func (s *Service) signNewSkipBlock(latest, newest *SkipBlock) (*SkipBlock, *Skip
 	return latest, newblocks[0], nil
 }
 
-func (s *Service) startBFTSignature(block *SkipBlock) error {
-	log.Lvl3("Starting bftsignature with root-node=", s.ServerIdentity())
-	done := make(chan bool)
-	// create the message we want to sign for this round
-	msg := []byte(block.Hash)
-	el, err := block.GetResponsible(s)
-	if err != nil {
-		return err
-	}
-	switch len(el.List) {
-	case 0:
-		return errors.New("Found empty Roster")
-	case 1:
-		return errors.New("Need more than 1 entry for Roster")
-	}
-
-	// Start the protocol
-	tree := el.GenerateNaryTreeWithRoot(2, s.ServerIdentity())
-
-	node, err := s.CreateProtocolService(skipchainBFT, tree)
-	if err != nil {
-		return errors.New("Couldn't create new node: " + err.Error())
-	}
-
-	// Register the function generating the protocol instance
-	root := node.(*bftcosi.ProtocolBFTCoSi)
-	root.Msg = msg
-	data, err := network.MarshalRegisteredType(block)
-	if err != nil {
-		return errors.New("Couldn't marshal block: " + err.Error())
-	}
-	root.Data = data
-
-	// in testing-mode with more than one host and service per cothority-instance
-	// we might have the wrong verification-function, so set it again here.
-	root.VerificationFunction = s.bftVerify
-	// function that will be called when protocol is finished by the root
-	root.RegisterOnDone(func() {
-		done <- true
-	})
-	go node.Start()
-	select {
-	case <-done:
-		block.BlockSig = root.Signature()
-		if len(block.BlockSig.Exceptions) != 0 {
-			return errors.New("Not everybody signed off the new block")
-		}
-		if err := block.BlockSig.Verify(network.Suite, el.Publics()); err != nil {
-			return errors.New("Couldn't verify signature")
-		}
-	case <-time.After(time.Second * 60):
-		return errors.New("Timed out while waiting for signature")
-	}
-	return nil
-}
-
 func (s *Service) verifyNewSkipBlock(latest, newest *SkipBlock) error {
 	// Do some sanity-checks on the latest and newest skipblock
 	if latest != nil {
@@ -351,13 +323,16 @@ func (s *Service) verifyNewSkipBlock(latest, newest *SkipBlock) error {
 		}
 	}
 
-	// TODO: add a registration service for verifiers
+	if getVerifier(newest.VerifierID) == nil {
+		return errors.New("Unknown verifier")
+	}
 	return nil
 }
 
 // addForwardLinks checks if we have a valid link connecting the two
-// SkipBlocks with each other.
-func (s *Service) addForwardLinks(newest *SkipBlock) ([]*SkipBlock, error) {
+// SkipBlocks with each other. The links of blocks with the same roster share
+// the signature, sigs holds the ones already made.
+func (s *Service) addForwardLinks(newest *SkipBlock, sigs map[sda.RosterID][]byte) ([]*SkipBlock, error) {
 	height := len(newest.BackLinkIds)
 	blocks := make([]*SkipBlock, height+1)
 	blocks[0] = newest
@@ -375,6 +350,16 @@ func (s *Service) addForwardLinks(newest *SkipBlock) ([]*SkipBlock, error) {
 		for len(bc.ForwardLink) < h+1 {
 			fl := NewBlockLink()
 			fl.Hash = newest.Hash
+			sig, ok := sigs[bc.Roster.ID]
+			if !ok {
+				var err error
+				sig, err = s.signForwardLink(bc, newest)
+				if err != nil {
+					return nil, errors.New("Couldn't sign forward link: " + err.Error())
+				}
+				sigs[bc.Roster.ID] = sig
+			}
+			fl.Signature = sig
 			bc.ForwardLink = append(bc.ForwardLink, fl)
 		}
 		log.Lvl4("Block has now height of", len(bc.ForwardLink))
@@ -422,29 +407,11 @@ func (s *Service) bftVerify(msg []byte, data []byte) bool {
 		log.Lvlf2("Data skipBlock different from msg %x %x", msg, sb.Hash)
 		return false
 	}
-	switch sb.VerifierID {
-	case VerifyNone:
-		log.Lvl4("No verification - accepted")
-		return true
-	case VerifyShard:
-		if sb.ParentBlockID.IsNull() {
-			log.Lvl3("No parent skipblock to verify against")
-		} else {
-			sbParent, exists := s.getSkipBlockByID(sb.ParentBlockID)
-			if !exists {
-				log.Lvl3("Parent skipblock doesn't exist")
-			} else {
-				for _, e := range sb.Roster.List {
-					if i, _ := sbParent.Roster.Search(e.ID); i < 0 {
-						log.Lvl3("ServerIdentity in child doesn't exist in parent")
-						return false
-					}
-				}
-				return true
-			}
-		}
+	if err := s.verifyBlock(sb); err != nil {
+		log.Lvl2(s.ServerIdentity(), "refuses block", sb, err)
+		return false
 	}
-	return false
+	return true
 }
 
 // getSkipBlockByID returns the skip-block or false if it doesn't exist
@@ -512,8 +479,11 @@ func newSkipchainService(c *sda.Context, path string) sda.Service {
 	if err := s.tryLoad(); err != nil {
 		log.Error(err)
 	}
+	if err := s.loadBLSKey(); err != nil {
+		log.Error("Couldn't load BLS key:", err)
+	}
 	for _, msg := range []interface{}{s.ProposeSkipBlock, s.SetChildrenSkipBlock,
-		s.GetUpdateChain} {
+		s.GetUpdateChain, s.GetProof} {
 		if err := s.RegisterMessage(msg); err != nil {
 			log.Fatal("Registration error for msg", msg, err)
 		}
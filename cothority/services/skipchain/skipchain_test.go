@@ -11,7 +11,9 @@ import (
 	"fmt"
 
 	"github.com/csanti/pbft-experiments/cothority/log"
+	"github.com/csanti/pbft-experiments/cothority/network"
 	"github.com/csanti/pbft-experiments/cothority/sda"
+	"github.com/satori/go.uuid"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -317,6 +319,54 @@ func TestService_Verification(t *testing.T) {
 	service.SetChildrenSkipBlock(nil, scsb)
 }
 
+func TestService_Verifiers(t *testing.T) {
+	local := sda.NewLocalTest()
+	defer local.CloseAll()
+	_, el, service := makeHELS(local, 5)
+
+	sb := NewSkipBlock()
+	sb.Roster = el
+	sb.MaximumHeight = 1
+	sb.BaseHeight = 1
+	sb.VerifierID = VerifierID(uuid.NewV5(uuid.NamespaceURL, "unknown"))
+	if _, err := service.ProposeSkipBlock(nil, &ProposeSkipBlock{nil, sb}); err == nil {
+		t.Fatal("Accepted an unknown verifier")
+	}
+
+	log.Lvl1("Changing the roster")
+	sbRoot := makeGenesisRosterArgs(service, el, nil, VerifyRoster, 1, 1)
+	sb = NewSkipBlock()
+	sb.Roster = sda.NewRoster(el.List[0:2])
+	if _, err := service.ProposeSkipBlock(nil, &ProposeSkipBlock{sbRoot.Hash, sb}); err == nil {
+		t.Fatal("Accepted a roster replacing half of the old one")
+	}
+	sb.Roster = sda.NewRoster(el.List[0:4])
+	_, err := service.ProposeSkipBlock(nil, &ProposeSkipBlock{sbRoot.Hash, sb})
+	log.ErrFatal(err)
+
+	log.Lvl1("Checking the data")
+	schema := RegisterDataVerification("TestData", func(data network.Body) error {
+		if data.(testData).A < 0 {
+			return errors.New("negative A")
+		}
+		return nil
+	})
+	sb = NewSkipBlock()
+	sb.Roster = el
+	sb.MaximumHeight = 1
+	sb.BaseHeight = 1
+	sb.VerifierID = schema
+	sb.Data, err = network.MarshalRegisteredType(&testData{-1, "data"})
+	log.ErrFatal(err)
+	if _, err := service.ProposeSkipBlock(nil, &ProposeSkipBlock{nil, sb}); err == nil {
+		t.Fatal("Accepted data refused by the schema")
+	}
+	sb.Data, err = network.MarshalRegisteredType(&testData{1, "data"})
+	log.ErrFatal(err)
+	_, err = service.ProposeSkipBlock(nil, &ProposeSkipBlock{nil, sb})
+	log.ErrFatal(err)
+}
+
 func TestCopy(t *testing.T) {
 	// Test if copy is deep or only shallow
 	b1 := NewBlockLink()
@@ -396,6 +446,40 @@ func launchVerification(t *testing.T, services []*Service, n int, prev *SkipBloc
 }
 
 func TestService_ForwardSignature(t *testing.T) {
+	local := sda.NewLocalTest()
+	defer local.CloseAll()
+	_, el, service := makeHELS(local, 4)
+
+	sbRoot := makeGenesisRoster(service, el)
+	if len(sbRoot.BlsPublics) != len(el.List) {
+		t.Fatal("Didn't get the BLS keys of the roster")
+	}
+	sb := NewSkipBlock()
+	sb.Roster = el
+	psbr, err := service.ProposeSkipBlock(nil,
+		&ProposeSkipBlock{sbRoot.Hash, sb})
+	log.ErrFatal(err)
+	sbRoot = psbr.(*ProposedSkipBlockReply).Previous
+	log.ErrFatal(sbRoot.VerifySignatures())
+
+	publics, err := blsKeys(sbRoot.BlsPublics, sbRoot.BlsProofs)
+	log.ErrFatal(err)
+	proofs := append([][]byte{}, sbRoot.BlsProofs...)
+	proofs[0], proofs[1] = proofs[1], proofs[0]
+	if _, err := blsKeys(sbRoot.BlsPublics, proofs); err == nil {
+		t.Fatal("Keys with swapped proofs of possession verified")
+	}
+	fl := sbRoot.ForwardLink[0].Copy()
+	fl.Hash = sbRoot.Hash
+	if fl.VerifySignature(publics) == nil {
+		t.Fatal("Forward link to another block verified")
+	}
+	fl = sbRoot.ForwardLink[0].Copy()
+	fl.Signature = fl.Signature[:len(fl.Signature)-1]
+	fl.Signature = append(fl.Signature, 0)
+	if fl.VerifySignature(publics) == nil {
+		t.Fatal("Forward link without signers verified")
+	}
 }
 
 // makes a genesis Roster-block
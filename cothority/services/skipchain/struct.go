@@ -7,13 +7,13 @@ import (
 
 	"errors"
 
+	"github.com/csanti/pbft-experiments/blsftcosi/protocol"
 	"github.com/csanti/pbft-experiments/cothority/crypto"
 	"github.com/csanti/pbft-experiments/cothority/log"
 	"github.com/csanti/pbft-experiments/cothority/network"
-	"github.com/csanti/pbft-experiments/cothority/protocols/bftcosi"
 	"github.com/csanti/pbft-experiments/cothority/sda"
+	"go.dedis.ch/kyber"
 	"gopkg.in/dedis/crypto.v0/abstract"
-	"gopkg.in/dedis/crypto.v0/cosi"
 )
 
 // AppSkipBlock is the interface needed to add a new SkipBlockType with
@@ -73,6 +73,11 @@ type SkipBlockFix struct {
 	Data []byte
 	// Roster holds the roster-definition of that SkipBlock
 	Roster *sda.Roster
+	// BlsPublics are the BLS keys of the Roster, in the same order, which
+	// sign the forward links
+	BlsPublics [][]byte
+	// BlsProofs are the proofs of possession of the BlsPublics
+	BlsProofs [][]byte
 }
 
 // addSliceToHash hashes the whole SkipBlockFix plus a slice of bytes.
@@ -95,8 +100,9 @@ type SkipBlock struct {
 	*SkipBlockFix
 	// Hash is our Block-hash
 	Hash SkipBlockID
-	// BlockSig is the BFT-signature of the hash
-	BlockSig *bftcosi.BFTSignature
+	// BlockSig is the BLS signature of the hash by the roster of the
+	// block, the same as the forward links of blocks with that roster
+	BlockSig *BlockLink
 
 	// ForwardLink will be calculated once future SkipBlocks are
 	// available
@@ -113,31 +119,80 @@ func NewSkipBlock() *SkipBlock {
 		SkipBlockFix: &SkipBlockFix{
 			Data: make([]byte, 0),
 		},
-		BlockSig: &bftcosi.BFTSignature{
-			Sig: make([]byte, 0),
-			Msg: make([]byte, 0),
-		},
+		BlockSig: NewBlockLink(),
 	}
 }
 
-// VerifySignatures returns whether all signatures are correctly signed
-// by the aggregate public key of the roster. It needs the aggregate key.
+// VerifySignatures returns whether the block and its forward links are
+// signed by enough of the BLS keys of its roster.
 func (sb *SkipBlock) VerifySignatures() error {
-	if err := sb.BlockSig.Verify(network.Suite, sb.Roster.Publics()); err != nil {
+	publics, err := blsKeys(sb.BlsPublics, sb.BlsProofs)
+	if err != nil {
+		return err
+	}
+	if sb.BlockSig == nil || !sb.BlockSig.Hash.Equal(sb.Hash) {
+		return errors.New("block isn't signed")
+	}
+	if err := sb.BlockSig.VerifySignature(publics); err != nil {
 		log.Error(err.Error() + log.Stack())
 		return err
 	}
-	//for _, fl := range sb.ForwardLink {
-	//	if err := fl.VerifySignature(sb.Aggregate); err != nil {
-	//		return err
-	//	}
-	//}
+	for _, fl := range sb.ForwardLink {
+		if err := fl.VerifySignature(publics); err != nil {
+			return err
+		}
+	}
 	//if sb.ChildSL != nil && sb.ChildSL.Hash == nil {
 	//	return sb.ChildSL.VerifySignature(sb.Aggregate)
 	//}
 	return nil
 }
 
+// VerifyProof checks a path of SkipBlocks as returned by GetProof, starting
+// at the known SkipBlock. Every block has to be linked from the previous one
+// by a forward link signed by the roster of the previous block, and has to
+// match its hash, so that its own roster can be trusted for the next link.
+// It can't tell whether the last block is the latest one.
+func VerifyProof(known *SkipBlock, proof []*SkipBlock) error {
+	if known == nil || known.SkipBlockFix == nil {
+		return errors.New("no known block")
+	}
+	for i, sb := range proof {
+		if sb == nil || sb.SkipBlockFix == nil {
+			return fmt.Errorf("block %d of the proof is empty", i)
+		}
+	}
+	if len(proof) == 0 || !proof[0].Equal(known) {
+		return errors.New("proof doesn't start at the known block")
+	}
+	// the forward links of the known block are only in the proof, but its
+	// roster is the one we trust
+	prev, keys, proofs := proof[0], known.BlsPublics, known.BlsProofs
+	for _, next := range proof[1:] {
+		var link *BlockLink
+		for _, fl := range prev.ForwardLink {
+			if fl != nil && fl.Hash.Equal(next.Hash) {
+				link = fl
+			}
+		}
+		if link == nil {
+			return fmt.Errorf("block %s isn't linked from %s", next, prev)
+		}
+		publics, err := blsKeys(keys, proofs)
+		if err != nil {
+			return err
+		}
+		if err := link.VerifySignature(publics); err != nil {
+			return fmt.Errorf("forward link to %s: %s", next, err)
+		}
+		if !next.calculateHash().Equal(next.Hash) {
+			return fmt.Errorf("block %s doesn't match its hash", next)
+		}
+		prev, keys, proofs = next, next.BlsPublics, next.BlsProofs
+	}
+	return nil
+}
+
 // Equal returns bool if both hashes are equal
 func (sb *SkipBlock) Equal(other *SkipBlock) bool {
 	return bytes.Equal(sb.Hash, other.Hash)
@@ -148,12 +203,8 @@ func (sb *SkipBlock) Copy() *SkipBlock {
 	b := *sb
 	sbf := *b.SkipBlockFix
 	b.SkipBlockFix = &sbf
-	sigCopy := make([]byte, len(b.BlockSig.Sig))
-	copy(sigCopy, b.BlockSig.Sig)
-	b.BlockSig = &bftcosi.BFTSignature{
-		Sig:        sigCopy,
-		Msg:        b.BlockSig.Msg,
-		Exceptions: b.BlockSig.Exceptions,
+	if b.BlockSig != nil {
+		b.BlockSig = sb.BlockSig.Copy()
 	}
 	b.ForwardLink = make([]*BlockLink, len(sb.ForwardLink))
 	for i, fl := range sb.ForwardLink {
@@ -196,7 +247,9 @@ func (sb *SkipBlock) updateHash() SkipBlockID {
 	return sb.Hash
 }
 
-// BlockLink has the hash and a signature of a block
+// BlockLink has the hash and a signature of a block. The signature is the
+// BLS signature of the roster followed by the mask of the signers, as
+// produced by blsftcosi.
 type BlockLink struct {
 	Hash      SkipBlockID
 	Signature []byte
@@ -220,10 +273,12 @@ func (bl *BlockLink) Copy() *BlockLink {
 	}
 }
 
-// VerifySignature returns whether the BlockLink has been signed
-// correctly using the aggregate key given.
-func (bl *BlockLink) VerifySignature(publics []abstract.Point) error {
-	// TODO: enable real verification once we have signatures
-	//return nil
-	return cosi.VerifySignature(network.Suite, publics, bl.Hash, bl.Signature)
+// VerifySignature returns whether the BlockLink has been signed by enough
+// of the BLS keys of the signing roster.
+func (bl *BlockLink) VerifySignature(publics []kyber.Point) error {
+	if len(bl.Signature) < protocol.ThePairingSuite.G1().PointLen() {
+		return errors.New("forward link isn't signed")
+	}
+	return protocol.Verify(protocol.ThePairingSuite, publics, bl.Hash,
+		bl.Signature, blsPolicy(len(publics)))
 }
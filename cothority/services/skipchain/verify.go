@@ -0,0 +1,143 @@
+package skipchain
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/csanti/pbft-experiments/cothority/network"
+	"github.com/satori/go.uuid"
+)
+
+// Verifier returns an error if the proposed SkipBlock can't follow the last
+// one. last is nil for the first SkipBlock of a chain, or if the node joins
+// the chain with the proposed SkipBlock and doesn't know it. Every node of the
+// roster asked to sign the proposed SkipBlock calls the Verifier of its
+// VerifierID and only signs if it returns nil.
+type Verifier func(s *Service, last, proposed *SkipBlock) error
+
+// DataSchema returns an error if the data of a SkipBlock isn't valid for
+// the application.
+type DataSchema func(data network.Body) error
+
+var verifiers = struct {
+	funcs map[VerifierID]Verifier
+	sync.Mutex
+}{funcs: make(map[VerifierID]Verifier)}
+
+func init() {
+	registerVerifier(VerifyNone, func(*Service, *SkipBlock, *SkipBlock) error {
+		return nil
+	})
+	registerVerifier(VerifyShard, verifyShard)
+	registerVerifier(VerifyRoster, verifyRoster)
+	registerVerifier(VerifyData, dataVerifier(nil))
+}
+
+// RegisterVerification registers the verification of the application with
+// the given name and returns the VerifierID to put in its SkipBlocks. A
+// SkipBlock with a VerifierID that isn't registered is refused.
+func RegisterVerification(name string, v Verifier) VerifierID {
+	id := VerifierID(uuid.NewV5(uuid.NamespaceURL, name))
+	registerVerifier(id, v)
+	return id
+}
+
+// RegisterDataVerification registers a verification of data SkipBlocks: the
+// data has to be a registered type accepted by the schema.
+func RegisterDataVerification(name string, schema DataSchema) VerifierID {
+	return RegisterVerification(name, dataVerifier(schema))
+}
+
+func registerVerifier(id VerifierID, v Verifier) {
+	verifiers.Lock()
+	defer verifiers.Unlock()
+	verifiers.funcs[id] = v
+}
+
+func getVerifier(id VerifierID) Verifier {
+	verifiers.Lock()
+	defer verifiers.Unlock()
+	return verifiers.funcs[id]
+}
+
+// GetSkipBlock returns the stored SkipBlock with the given ID, so that a
+// Verifier can follow the chain.
+func (s *Service) GetSkipBlock(id SkipBlockID) (*SkipBlock, bool) {
+	return s.getSkipBlockByID(id)
+}
+
+// verifyBlock calls the Verifier of the SkipBlock with the last stored
+// SkipBlock of its chain.
+func (s *Service) verifyBlock(sb *SkipBlock) error {
+	v := getVerifier(sb.VerifierID)
+	if v == nil {
+		return errors.New("unknown verifier")
+	}
+	var last *SkipBlock
+	if sb.Index > 0 {
+		if len(sb.BackLinkIds) == 0 {
+			return errors.New("skipblock has no backlink")
+		}
+		last, _ = s.getSkipBlockByID(sb.BackLinkIds[0])
+	}
+	return v(s, last, sb)
+}
+
+// verifyShard makes sure the roster of the child SkipChain is part of the
+// roster of its parent.
+func verifyShard(s *Service, last, proposed *SkipBlock) error {
+	if proposed.ParentBlockID.IsNull() {
+		return errors.New("no parent skipblock to verify against")
+	}
+	parent, ok := s.getSkipBlockByID(proposed.ParentBlockID)
+	if !ok {
+		return errors.New("parent skipblock doesn't exist")
+	}
+	if proposed.Roster == nil {
+		return errors.New("child skipblock without roster")
+	}
+	for _, e := range proposed.Roster.List {
+		if i, _ := parent.Roster.Search(e.ID); i < 0 {
+			return errors.New("ServerIdentity in child doesn't exist in parent")
+		}
+	}
+	return nil
+}
+
+// verifyRoster accepts a new roster if it keeps two thirds of the old one.
+// The forward link to the new roster is signed by the old roster, so the
+// same threshold of the old roster has to agree on the change. New members
+// don't know the old roster and leave the check to it.
+func verifyRoster(s *Service, last, proposed *SkipBlock) error {
+	if proposed.Roster == nil || len(proposed.Roster.List) < 2 {
+		return errors.New("need a roster of more than one entry")
+	}
+	if last == nil {
+		return nil
+	}
+	kept := 0
+	for _, si := range last.Roster.List {
+		if i, _ := proposed.Roster.Search(si.ID); i >= 0 {
+			kept++
+		}
+	}
+	if kept < len(last.Roster.List)*2/3 {
+		return errors.New("roster changes more than a third of its members")
+	}
+	return nil
+}
+
+// dataVerifier returns a Verifier accepting data of a registered type that
+// the schema accepts, if it's not nil.
+func dataVerifier(schema DataSchema) Verifier {
+	return func(s *Service, last, proposed *SkipBlock) error {
+		_, msg, err := network.UnmarshalRegistered(proposed.Data)
+		if err != nil {
+			return errors.New("data isn't of a registered type: " + err.Error())
+		}
+		if schema == nil {
+			return nil
+		}
+		return schema(msg)
+	}
+}
@@ -42,6 +42,8 @@ func init() {
 // Main starts the host and will setup the protocol.
 func main() {
 	flag.Parse()
+	// Take DEBUG_JSON and DEBUG_PKG from the environment of the simulation
+	log.ParseEnv()
 	log.SetDebugVisible(debugVisible)
 	log.Lvl3("Flags are:", hostAddress, simul, log.DebugVisible, monitorAddress)
 
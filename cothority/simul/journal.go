@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/csanti/pbft-experiments/cothority/log"
+	"github.com/csanti/pbft-experiments/cothority/monitor"
+	"github.com/csanti/pbft-experiments/cothority/simul/platform"
+)
+
+// journal keeps track of the runconfigs of a simulation that already
+// finished. Every finished runconfig is appended as a json-line and synced to
+// disk, so that an interrupted sweep can be resumed with '-resume'.
+type journal struct {
+	sync.Mutex
+	file *os.File
+	done map[string]bool
+}
+
+// journalEntry is one line of the journal.
+type journalEntry struct {
+	Index  int
+	Config string
+}
+
+// openJournal opens the journal in 'name'. If resume is true, the entries
+// already present are read, else the journal is truncated.
+func openJournal(name string, resume bool) (*journal, error) {
+	j := &journal{done: make(map[string]bool)}
+	args := os.O_CREATE | os.O_RDWR | os.O_TRUNC
+	if resume {
+		args = os.O_CREATE | os.O_RDWR | os.O_APPEND
+	}
+	var err error
+	j.file, err = os.OpenFile(name, args, 0660)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := ioutil.ReadAll(j.file)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range bytes.Split(buf, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var e journalEntry
+		// A crash might leave us with a half-written last line
+		if err := json.Unmarshal(line, &e); err != nil {
+			log.Lvl2("Ignoring journal-line", string(line), err)
+			continue
+		}
+		j.done[e.key()] = true
+	}
+	if len(buf) > 0 && buf[len(buf)-1] != '\n' {
+		// Don't append to the half-written line
+		if _, err := j.file.Write([]byte("\n")); err != nil {
+			return nil, err
+		}
+	}
+	log.Lvl2("Journal", name, "has", len(j.done), "finished runs")
+	return j, nil
+}
+
+// isDone returns whether the runconfig at position i already finished.
+func (j *journal) isDone(i int, config string) bool {
+	j.Lock()
+	defer j.Unlock()
+	return j.done[journalEntry{i, config}.key()]
+}
+
+// markDone appends the runconfig at position i to the journal.
+func (j *journal) markDone(i int, config string) error {
+	j.Lock()
+	defer j.Unlock()
+	e := journalEntry{i, config}
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(buf, '\n')); err != nil {
+		return err
+	}
+	j.done[e.key()] = true
+	return j.file.Sync()
+}
+
+// Close closes the underlying file.
+func (j *journal) Close() error {
+	return j.file.Close()
+}
+
+func (e journalEntry) key() string {
+	return strconv.Itoa(e.Index) + "\n" + e.Config
+}
+
+// journalConfig returns the string used to identify a runconfig in the
+// journal.
+func journalConfig(rc platform.RunConfig) string {
+	return string(rc.Toml())
+}
+
+func journalFile(name string) string {
+	return "test_data/" + name + ".journal"
+}
+
+// resultOrder puts the results of tests running in parallel back in the
+// order of the tests, so that the rows of the CSV-file follow the runconfigs.
+type resultOrder struct {
+	// next holds the indexes of the tests still to write, in order
+	next []int
+	// finished holds the results of the tests that wait for the ones
+	// before them, nil if the test failed
+	finished map[int]*monitor.Stats
+}
+
+// result is the result of the test at position index.
+type result struct {
+	index int
+	stats *monitor.Stats
+}
+
+// newResultOrder returns a resultOrder for the tests at the given indexes,
+// in increasing order.
+func newResultOrder(indexes []int) *resultOrder {
+	return &resultOrder{
+		next:     indexes,
+		finished: make(map[int]*monitor.Stats),
+	}
+}
+
+// add stores the result of the test at position i, nil if it failed, and
+// returns the results that are ready to be written, in order.
+func (o *resultOrder) add(i int, stats *monitor.Stats) []result {
+	o.finished[i] = stats
+	var ready []result
+	for len(o.next) > 0 {
+		stats, ok := o.finished[o.next[0]]
+		if !ok {
+			break
+		}
+		ready = append(ready, result{o.next[0], stats})
+		delete(o.finished, o.next[0])
+		o.next = o.next[1:]
+	}
+	return ready
+}
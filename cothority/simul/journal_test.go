@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/csanti/pbft-experiments/cothority/log"
+	"github.com/csanti/pbft-experiments/cothority/monitor"
+	"github.com/csanti/pbft-experiments/cothority/simul/platform"
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	log.ErrFatal(err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "test.journal")
+
+	rc := platform.NewRunConfig()
+	rc.Put("hosts", "8")
+	rc.Put("bf", "2")
+	config := journalConfig(*rc)
+
+	j, err := openJournal(name, false)
+	log.ErrFatal(err)
+	if j.isDone(0, config) {
+		t.Fatal("Empty journal shouldn't have finished tests")
+	}
+	log.ErrFatal(j.markDone(0, config))
+	log.ErrFatal(j.Close())
+
+	// Simulate a crash while writing the next entry
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0660)
+	log.ErrFatal(err)
+	_, err = f.WriteString(`{"Index":1,"Con`)
+	log.ErrFatal(err)
+	log.ErrFatal(f.Close())
+
+	j, err = openJournal(name, true)
+	log.ErrFatal(err)
+	if !j.isDone(0, config) {
+		t.Fatal("Resumed journal should have the first test")
+	}
+	if j.isDone(1, config) {
+		t.Fatal("Half-written entry should be ignored")
+	}
+	rc.Put("hosts", "16")
+	if j.isDone(0, journalConfig(*rc)) {
+		t.Fatal("Changed config should not be marked as done")
+	}
+	log.ErrFatal(j.Close())
+
+	j, err = openJournal(name, false)
+	log.ErrFatal(err)
+	if j.isDone(0, config) {
+		t.Fatal("Journal should be truncated when not resuming")
+	}
+	log.ErrFatal(j.Close())
+}
+
+func TestResultOrder(t *testing.T) {
+	stats := make([]*monitor.Stats, 4)
+	for i := range stats {
+		stats[i] = &monitor.Stats{}
+	}
+	o := newResultOrder([]int{1, 2, 4, 5})
+	if len(o.add(2, stats[1])) != 0 {
+		t.Fatal("Test 2 has to wait for test 1")
+	}
+	if len(o.add(5, stats[3])) != 0 {
+		t.Fatal("Test 5 has to wait for test 4")
+	}
+	ready := o.add(1, stats[0])
+	if len(ready) != 2 || ready[0].index != 1 || ready[1].index != 2 ||
+		ready[1].stats != stats[1] {
+		t.Fatal("Tests 1 and 2 should be ready:", ready)
+	}
+	ready = o.add(4, nil)
+	if len(ready) != 2 || ready[0].stats != nil || ready[1].index != 5 {
+		t.Fatal("Failed test 4 should let test 5 through:", ready)
+	}
+}
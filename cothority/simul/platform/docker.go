@@ -0,0 +1,415 @@
+package platform
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/csanti/pbft-experiments/cothority/log"
+	"github.com/csanti/pbft-experiments/cothority/sda"
+)
+
+// Docker builds the simulation-binary into a container-image and starts one
+// container per server. All containers are connected through their own
+// docker-network, and the links can be shaped using 'tc netem' with the
+// 'Delay' and 'Bandwidth' fields of the run-file, and per link with the
+// 'Links' field.
+//
+// It sits between Localhost, where all hosts share the same machine and
+// loopback-interface, and Deterlab: every server has its own network-stack
+// and IP-address, so serialization- and port-binding-errors show up.
+//
+// Creates the following directory structure:
+// build/ - the binary and the Dockerfile for the image
+// remote/ - the simulation-files, mounted read-only into every container
+type Docker struct {
+	// Name of the simulation
+	Simulation string
+	// Number of servers, each one is a container
+	Servers int
+	// Image the simulation-image is based on - it needs 'tc' from iproute2
+	BaseImage string
+	// Latency in milliseconds added to every outgoing packet
+	Delay int
+	// Bandwidth in Mbit/s of every container, 0 is unlimited
+	Bandwidth int
+	// Links overrides Delay and Bandwidth between two servers, in both
+	// directions. It is a space-separated list of "a-b:delay[:bandwidth]",
+	// with the indexes of the servers, e.g. "0-1:100 2-3:20:10".
+	Links string
+	// The number of seconds to wait for closing the connection
+	CloseWait int
+
+	// Debug level 1 - 5
+	debug int
+	// Where to build the binary and the image
+	buildDir string
+	// Where the config-files are written to
+	deployDir string
+	// Name of the image, the network and the prefix of the containers
+	name string
+	// Subnet of the docker-network - the gateway is the local machine
+	subnet string
+	// Listening monitor port
+	monitorPort int
+	// All addresses of the servers
+	addresses []string
+
+	// the containers of the current run
+	run *dockerRun
+}
+
+// dockerRun waits for the containers of one run. Every run has its own, so
+// that the containers of a run that timed out can't change the result of
+// the next one.
+type dockerRun struct {
+	// WaitGroup for running containers
+	wg sync.WaitGroup
+	// errors go here, there is room for all containers, so that nobody
+	// blocks once the run is over
+	errChan chan error
+}
+
+// newDockerRun returns the run of n containers.
+func newDockerRun(n int) *dockerRun {
+	return &dockerRun{errChan: make(chan error, n+1)}
+}
+
+// dockerLink is the shaping of the link between two servers.
+type dockerLink struct {
+	a, b      int
+	delay     int
+	bandwidth int
+}
+
+// The label used to find all containers of a simulation
+const dockerLabel = "cothority-simul"
+
+// Configure sets up the directories and the names of the docker-resources
+func (d *Docker) Configure(pc *Config) {
+	pwd, _ := os.Getwd()
+	dockerDir := pwd + "/platform/docker"
+	d.name = "cothority-simul"
+	d.subnet = "10.253"
+	if pc.Slot > 0 {
+		dockerDir += strconv.Itoa(pc.Slot)
+		d.name += strconv.Itoa(pc.Slot)
+		d.subnet = "10." + strconv.Itoa(253-pc.Slot)
+	}
+	d.buildDir = dockerDir + "/build"
+	d.deployDir = dockerDir + "/remote"
+	d.debug = pc.Debug
+	d.monitorPort = pc.MonitorPort
+	if d.BaseImage == "" {
+		d.BaseImage = "debian:stable-slim"
+	}
+	if d.Simulation == "" {
+		log.Fatal("No simulation defined in simulation")
+	}
+	log.Lvl3("Docker: build-dir", d.buildDir, "deploy-dir", d.deployDir)
+}
+
+// Build compiles the binary for linux and creates the image
+func (d *Docker) Build(build string, arg ...string) error {
+	start := time.Now()
+	if err := os.RemoveAll(d.buildDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.buildDir, 0777); err != nil {
+		return err
+	}
+	src := "./cothority"
+	dst := d.buildDir + "/cothority"
+	res, err := Build(src, dst, runtime.GOARCH, "linux", arg...)
+	if err != nil {
+		log.Fatal("Error while building for docker (src", src, ", dst", dst, ":", res)
+	}
+
+	dockerfile := fmt.Sprintf(`FROM %s
+RUN apt-get update && apt-get install -y iproute2 && rm -rf /var/lib/apt/lists/*
+COPY cothority /cothority
+WORKDIR /simul
+`, d.BaseImage)
+	if err := ioutil.WriteFile(d.buildDir+"/Dockerfile", []byte(dockerfile), 0660); err != nil {
+		return err
+	}
+	out, err := exec.Command("docker", "build", "-t", d.name, d.buildDir).CombinedOutput()
+	if err != nil {
+		log.Lvl1(string(out))
+		return err
+	}
+	log.Lvl4("Docker: Results of image build:", string(out))
+	log.Lvl2("Docker: build finished in", time.Since(start))
+	return nil
+}
+
+// Cleanup removes all containers of the simulation and the network. Start
+// creates the network again.
+func (d *Docker) Cleanup() error {
+	log.Lvl3("Cleaning up")
+	out, err := exec.Command("docker", "ps", "-aq", "--filter",
+		"label="+dockerLabel+"="+d.name).Output()
+	if err != nil {
+		log.Lvl3("Couldn't list containers:", err)
+		return nil
+	}
+	if ids := strings.Fields(string(out)); len(ids) > 0 {
+		args := append([]string{"rm", "-f"}, ids...)
+		if err := exec.Command("docker", args...).Run(); err != nil {
+			log.Lvl3("Error removing containers", err)
+		}
+	}
+	if err := exec.Command("docker", "network", "rm", d.name).Run(); err != nil {
+		log.Lvl3("Error removing network", err)
+	}
+	return nil
+}
+
+// Deploy writes the simulation-files
+func (d *Docker) Deploy(rc RunConfig) error {
+	if err := os.RemoveAll(d.deployDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.deployDir, 0777); err != nil {
+		return err
+	}
+	// Servers, Delay and Bandwidth might change for every run
+	if _, err := toml.Decode(string(rc.Toml()), d); err != nil {
+		return err
+	}
+	if d.Servers < 1 || d.Servers > 250*250 {
+		return fmt.Errorf("can't run %d servers in docker", d.Servers)
+	}
+	if _, err := d.links(); err != nil {
+		return err
+	}
+	log.Lvl2("Docker: Deploying and writing config-files for", d.Servers, "servers")
+	sim, err := sda.NewSimulation(d.Simulation, string(rc.Toml()))
+	if err != nil {
+		return err
+	}
+	d.addresses = make([]string, d.Servers)
+	for i := range d.addresses {
+		d.addresses[i] = d.address(i)
+	}
+	sc, err := sim.Setup(d.deployDir, d.addresses)
+	if err != nil {
+		return err
+	}
+	sc.Config = string(rc.Toml())
+	if err := sc.Save(d.deployDir); err != nil {
+		return err
+	}
+	log.Lvl2("Docker: Done deploying")
+	return nil
+}
+
+// Start creates the docker-network and runs one container for every server.
+// Before starting the binary, the outgoing interface of the container is
+// shaped with 'tc netem'.
+func (d *Docker) Start(args ...string) error {
+	ex := "/cothority"
+	out, err := exec.Command("docker", "network", "create",
+		"--subnet", d.subnet+".0.0/16",
+		"--gateway", d.gateway(),
+		"--label", dockerLabel+"="+d.name, d.name).CombinedOutput()
+	if err != nil {
+		log.Lvl1(string(out))
+		return err
+	}
+	run := newDockerRun(len(d.addresses))
+	d.run = run
+	log.Lvl1("Starting", d.Servers, "containers of", d.name)
+	for index, address := range d.addresses {
+		cmdArgs := append(args, "-address", address,
+			"-monitor", d.gateway()+":"+strconv.Itoa(d.monitorPort),
+			"-simul", d.Simulation,
+			"-debug", strconv.Itoa(log.DebugVisible()),
+		)
+		command := "exec " + ex + " " + strings.Join(cmdArgs, " ")
+		if netem := d.netem(index); netem != "" {
+			command = netem + " && " + command
+		}
+		container := d.name + "-" + strconv.Itoa(index)
+		runArgs := []string{"run", "-d",
+			"--name", container,
+			"--label", dockerLabel + "=" + d.name,
+			"--network", d.name,
+			"--ip", address,
+			"--cap-add", "NET_ADMIN",
+			"-v", d.deployDir + ":/simul:ro",
+			d.name, "sh", "-c", command}
+		log.Lvl3("Docker args are", runArgs)
+		if out, err := exec.Command("docker", runArgs...).CombinedOutput(); err != nil {
+			log.Error("Couldn't start container", container, ":", string(out))
+			return err
+		}
+		run.wg.Add(1)
+		go func(c string) {
+			defer run.wg.Done()
+			out, err := exec.Command("docker", "wait", c).Output()
+			if err == nil && strings.TrimSpace(string(out)) != "0" {
+				err = fmt.Errorf("container %s exited with %s", c,
+					strings.TrimSpace(string(out)))
+			}
+			if err != nil {
+				log.Error("Error running container", c, ":", err)
+				run.errChan <- err
+			}
+			log.Lvl3("Container", c, "done")
+		}(container)
+	}
+	return nil
+}
+
+// Wait for all containers of the current run to finish
+func (d *Docker) Wait() error {
+	wait := d.CloseWait
+	if wait == 0 {
+		wait = 600
+	}
+	run := d.run
+	if run == nil {
+		return nil
+	}
+	go func() {
+		run.wg.Wait()
+		log.Lvl3("WaitGroup is 0")
+		run.errChan <- nil
+	}()
+
+	// if one of the containers fails, stop waiting and return the error:
+	select {
+	case err := <-run.errChan:
+		log.Lvl3("Finished waiting for containers:", err)
+		if err != nil {
+			if err := d.Cleanup(); err != nil {
+				log.Error("Couldn't cleanup running containers",
+					err)
+			}
+			return err
+		}
+	case <-time.After(time.Second * time.Duration(wait)):
+		log.Lvl1("Quitting after", wait, "seconds of waiting")
+		if err := d.Cleanup(); err != nil {
+			log.Error("Couldn't cleanup running containers", err)
+		}
+		return fmt.Errorf("containers didn't finish after %d seconds", wait)
+	}
+	log.Lvl2("Containers finished")
+	return nil
+}
+
+// address returns the address of the container of the server index. .0.1 is
+// the gateway.
+func (d *Docker) address(index int) string {
+	return fmt.Sprintf("%s.%d.%d", d.subnet, (index+2)/250, (index+2)%250)
+}
+
+// gateway returns the address of the local machine in the docker-network,
+// where the monitor is listening.
+func (d *Docker) gateway() string {
+	return d.subnet + ".0.1"
+}
+
+// netem returns the 'tc'-commands to shape the interface of the container
+// of the server index, or an empty string if neither Delay, Bandwidth nor
+// Links are given. Without links, all outgoing packets go through one netem.
+// With links, every link gets its own class, chosen by the destination
+// address, and the other packets go through the class with Delay and
+// Bandwidth.
+func (d *Docker) netem(index int) string {
+	links, err := d.links()
+	if err != nil {
+		log.Error(err)
+		return ""
+	}
+	var own []dockerLink
+	for _, l := range links {
+		if l.a == index || l.b == index {
+			own = append(own, l)
+		}
+	}
+	if len(own) == 0 {
+		if d.Delay <= 0 && d.Bandwidth <= 0 {
+			return ""
+		}
+		return "tc qdisc add dev eth0 root netem" + netemArgs(d.Delay, d.Bandwidth)
+	}
+	cmds := []string{
+		"tc qdisc add dev eth0 root handle 1: htb default 1",
+		"tc class add dev eth0 parent 1: classid 1:1 htb rate " + htbRate(d.Bandwidth),
+		"tc qdisc add dev eth0 parent 1:1 handle 10: netem" + netemArgs(d.Delay, 0),
+	}
+	for i, l := range own {
+		peer := l.a
+		if peer == index {
+			peer = l.b
+		}
+		class := strconv.Itoa(i + 2)
+		cmds = append(cmds,
+			"tc class add dev eth0 parent 1: classid 1:"+class+" htb rate "+htbRate(l.bandwidth),
+			"tc qdisc add dev eth0 parent 1:"+class+" handle "+strconv.Itoa(i+11)+": netem"+netemArgs(l.delay, 0),
+			"tc filter add dev eth0 protocol ip parent 1: prio 1 u32 match ip dst "+
+				d.address(peer)+"/32 flowid 1:"+class)
+	}
+	return strings.Join(cmds, " && ")
+}
+
+// netemArgs returns the arguments of netem for the delay in milliseconds and
+// the bandwidth in Mbit/s, leaving out the ones that are 0.
+func netemArgs(delay, bandwidth int) string {
+	var args string
+	if delay > 0 {
+		args += fmt.Sprintf(" delay %dms", delay)
+	}
+	if bandwidth > 0 {
+		args += fmt.Sprintf(" rate %dmbit", bandwidth)
+	}
+	return args
+}
+
+// htbRate returns the rate of an htb-class for the bandwidth in Mbit/s, or a
+// rate that doesn't limit anything if it is 0.
+func htbRate(bandwidth int) string {
+	if bandwidth <= 0 {
+		return "10gbit"
+	}
+	return strconv.Itoa(bandwidth) + "mbit"
+}
+
+// links parses the Links field.
+func (d *Docker) links() ([]dockerLink, error) {
+	var links []dockerLink
+	for _, field := range strings.Fields(d.Links) {
+		parts := strings.Split(field, ":")
+		ends := strings.Split(parts[0], "-")
+		if len(parts) < 2 || len(parts) > 3 || len(ends) != 2 {
+			return nil, fmt.Errorf("link %q isn't a-b:delay[:bandwidth]", field)
+		}
+		var values []int
+		for _, v := range append(ends, parts[1:]...) {
+			i, err := strconv.Atoi(v)
+			if err != nil || i < 0 {
+				return nil, fmt.Errorf("link %q has an invalid number %q", field, v)
+			}
+			values = append(values, i)
+		}
+		l := dockerLink{a: values[0], b: values[1], delay: values[2]}
+		if len(values) == 4 {
+			l.bandwidth = values[3]
+		}
+		if l.a == l.b || l.a >= d.Servers || l.b >= d.Servers {
+			return nil, fmt.Errorf("link %q doesn't join two of the %d servers", field, d.Servers)
+		}
+		links = append(links, l)
+	}
+	return links, nil
+}
@@ -0,0 +1,52 @@
+package platform
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDocker_Wait(t *testing.T) {
+	d := &Docker{Simulation: "test", CloseWait: 1}
+	d.Configure(&Config{})
+	assert.Nil(t, d.Wait())
+
+	// a container that doesn't finish in time fails the run
+	d.run = newDockerRun(1)
+	d.run.wg.Add(1)
+	assert.NotNil(t, d.Wait())
+
+	// the container of the old run failing later doesn't change the result
+	// of the next run
+	old := d.run
+	d.run = newDockerRun(1)
+	old.errChan <- errors.New("late failure")
+	old.wg.Done()
+	assert.Nil(t, d.Wait())
+}
+
+func TestDocker_Netem(t *testing.T) {
+	d := &Docker{Servers: 3, subnet: "10.253"}
+	assert.Equal(t, "", d.netem(0))
+	d.Delay = 50
+	assert.Equal(t, "tc qdisc add dev eth0 root netem delay 50ms", d.netem(0))
+	d.Bandwidth = 10
+	assert.Equal(t, "tc qdisc add dev eth0 root netem delay 50ms rate 10mbit", d.netem(0))
+
+	d.Links = "0-1:100:5"
+	assert.Equal(t, "tc qdisc add dev eth0 root handle 1: htb default 1 && "+
+		"tc class add dev eth0 parent 1: classid 1:1 htb rate 10mbit && "+
+		"tc qdisc add dev eth0 parent 1:1 handle 10: netem delay 50ms && "+
+		"tc class add dev eth0 parent 1: classid 1:2 htb rate 5mbit && "+
+		"tc qdisc add dev eth0 parent 1:2 handle 11: netem delay 100ms && "+
+		"tc filter add dev eth0 protocol ip parent 1: prio 1 u32 match ip dst 10.253.0.2/32 flowid 1:2",
+		d.netem(1))
+	assert.Equal(t, "tc qdisc add dev eth0 root netem delay 50ms rate 10mbit", d.netem(2))
+
+	for _, links := range []string{"0-1", "0-0:10", "0-3:10", "0-1:x"} {
+		d.Links = links
+		_, err := d.links()
+		assert.NotNil(t, err, links)
+	}
+}
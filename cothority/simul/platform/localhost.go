@@ -60,6 +60,10 @@ type Localhost struct {
 	// Listening monitor port
 	monitorPort int
 
+	// First port of the range reserved for our hosts, 0 if any free port
+	// will do
+	portBase int
+
 	// SimulationConfig holds all things necessary for the run
 	sc *sda.SimulationConfig
 }
@@ -68,14 +72,23 @@ type Localhost struct {
 func (d *Localhost) Configure(pc *Config) {
 	pwd, _ := os.Getwd()
 	d.runDir = pwd + "/platform/localhost"
+	if pc.Slot > 0 {
+		// Every slot gets its own directory, so that the config-files
+		// and the Cleanup of parallel runs don't interfere
+		d.runDir += strconv.Itoa(pc.Slot)
+	}
 	d.localDir = pwd
 	d.debug = pc.Debug
 	d.running = false
 	d.monitorPort = pc.MonitorPort
+	d.portBase = pc.PortBase
 	d.errChan = make(chan error)
 	if d.Simulation == "" {
 		log.Fatal("No simulation defined in simulation")
 	}
+	if err := os.MkdirAll(d.runDir, 0777); err != nil {
+		log.Fatal("Couldn't create run-directory:", err)
+	}
 	log.Lvl3(fmt.Sprintf("Localhost dirs: RunDir %s", d.runDir))
 	log.Lvl3("Localhost configured ...")
 }
@@ -135,6 +148,11 @@ func (d *Localhost) Deploy(rc RunConfig) error {
 		}
 	}
 
+	if d.portBase > 0 {
+		// Don't change the RunConfig of the caller
+		rc = *rc.Clone()
+		rc.Put("portbase", strconv.Itoa(d.portBase))
+	}
 	d.servers, _ = strconv.Atoi(rc.Get("servers"))
 	log.Lvl2("Localhost: Deploying and writing config-files for", d.servers, "servers")
 	sim, err := sda.NewSimulation(d.Simulation, string(rc.Toml()))
@@ -161,10 +179,6 @@ func (d *Localhost) Deploy(rc RunConfig) error {
 // Start will execute one cothority-binary for each server
 // configured
 func (d *Localhost) Start(args ...string) error {
-	if err := os.Chdir(d.runDir); err != nil {
-		return err
-	}
-	log.Lvl4("Localhost: chdir into", d.runDir)
 	ex := d.runDir + "/" + d.Simulation
 	d.running = true
 	log.Lvl1("Starting", d.servers, "applications of", ex)
@@ -180,6 +194,9 @@ func (d *Localhost) Start(args ...string) error {
 		cmdArgs = append(args, cmdArgs...)
 		log.Lvl3("CmdArgs are", cmdArgs)
 		cmd := exec.Command(ex, cmdArgs...)
+		// Set the directory per command instead of a chdir, as other
+		// slots might run in parallel
+		cmd.Dir = d.runDir
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
 		go func(i int, h string) {
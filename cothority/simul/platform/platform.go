@@ -1,6 +1,7 @@
 // Package platform contains interface and implementation to run SDA code
 // amongst multiple platforms. Such implementations include Localhost (run your
-// test locally) and Deterlab (similar to emulab).
+// test locally), Docker (one container per server) and Deterlab (similar to
+// emulab).
 package platform
 
 import (
@@ -9,6 +10,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -40,13 +42,20 @@ type Platform interface {
 type Config struct {
 	MonitorPort int
 	Debug       int
+	// Slot is the index of this platform when several of them run side by
+	// side - supported by Localhost and Docker.
+	Slot int
+	// PortBase, if != 0, is the first port of the range reserved for the
+	// hosts of this platform.
+	PortBase int
 }
 
 var deterlab = "deterlab"
 var localhost = "localhost"
+var docker = "docker"
 
 // NewPlatform returns the appropriate platform
-// [deterlab,localhost]
+// [deterlab,localhost,docker]
 func NewPlatform(t string) Platform {
 	var p Platform
 	switch t {
@@ -54,6 +63,8 @@ func NewPlatform(t string) Platform {
 		p = &Deterlab{}
 	case localhost:
 		p = &Localhost{}
+	case docker:
+		p = &Docker{}
 	}
 	return p
 }
@@ -178,11 +189,17 @@ func (r *RunConfig) Put(field, value string) {
 	r.fields[strings.ToLower(field)] = value
 }
 
-// Toml returns this config as bytes in a Toml format
+// Toml returns this config as bytes in a Toml format. The fields are sorted,
+// so that the same config always gives the same output.
 func (r *RunConfig) Toml() []byte {
+	var keys []string
+	for k := range r.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
 	var buf bytes.Buffer
-	for k, v := range r.fields {
-		fmt.Fprintf(&buf, "%s = %s\n", k, v)
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "%s = %s\n", k, r.fields[k])
 	}
 	return buf.Bytes()
 }
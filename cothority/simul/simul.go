@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 
 	"errors"
 	"math"
@@ -30,9 +31,22 @@ var simRange = ""
 var race = false
 var runWait = 180
 var experimentWait = 0
+var resume = false
+var retries = 10
+var parallel = 1
+var portBase = 20000
+
+// worker is a platform that can run a test on its own. On localhost
+// multiple workers can run in parallel.
+type worker struct {
+	platform    platform.Platform
+	monitorPort int
+}
+
+var workers []*worker
 
 func init() {
-	flag.StringVar(&platformDst, "platform", platformDst, "platform to deploy to [deterlab,localhost]")
+	flag.StringVar(&platformDst, "platform", platformDst, "platform to deploy to [deterlab,localhost,docker]")
 	flag.BoolVar(&nobuild, "nobuild", false, "Don't rebuild all helpers")
 	flag.BoolVar(&clean, "clean", false, "Only clean platform")
 	flag.StringVar(&build, "build", "", "List of packages to build")
@@ -42,6 +56,10 @@ func init() {
 	flag.StringVar(&simRange, "range", simRange, "Range of simulations to run. 0: or 3:4 or :4")
 	flag.IntVar(&runWait, "runwait", runWait, "How long to wait for each simulation to finish - overwrites .toml-value")
 	flag.IntVar(&experimentWait, "experimentwait", experimentWait, "How long to wait for the whole experiment to finish")
+	flag.BoolVar(&resume, "resume", false, "Resume an interrupted simulation, skipping the finished tests in the journal")
+	flag.IntVar(&retries, "retries", retries, "How many times to try a failing test")
+	flag.IntVar(&parallel, "parallel", parallel, "How many tests to run in parallel - only on localhost and docker")
+	flag.IntVar(&portBase, "portbase", portBase, "First port used by parallel tests on localhost")
 	log.RegisterFlags()
 }
 
@@ -65,10 +83,7 @@ func main() {
 		if len(runconfigs) == 0 {
 			log.Fatal("No tests found in", simulation)
 		}
-		deployP.Configure(&platform.Config{
-			MonitorPort: monitorPort,
-			Debug:       log.DebugVisible(),
-		})
+		createWorkers(simulation, runconfigs)
 
 		if clean {
 			err := deployP.Deploy(runconfigs[0])
@@ -96,33 +111,79 @@ func main() {
 	}
 }
 
+// createWorkers configures deployP and, if more than one test should run in
+// parallel, creates additional localhost-platforms. Every worker gets its own
+// monitor-port and, when running in parallel, its own range of ports.
+func createWorkers(simulation string, runconfigs []platform.RunConfig) {
+	n := parallel
+	if n > 1 && platformDst != "localhost" && platformDst != "docker" {
+		log.Warn("Parallel tests are only supported on localhost and docker")
+		n = 1
+	}
+	if n < 1 {
+		n = 1
+	}
+	// Reserve enough ports for the biggest test
+	portRange := 0
+	for _, rc := range runconfigs {
+		CheckHosts(rc)
+		if hosts, _ := rc.GetInt("hosts"); hosts > portRange {
+			portRange = hosts
+		}
+	}
+	if n > 1 && portBase+n*portRange > 65535 {
+		log.Fatal("Not enough ports for", n, "parallel tests of", portRange,
+			"hosts - reduce '-parallel' or '-portbase'")
+	}
+	workers = make([]*worker, n)
+	for i := range workers {
+		p := deployP
+		if i > 0 {
+			p = platform.NewPlatform(platformDst)
+			platform.ReadRunFile(p, simulation)
+		}
+		pc := &platform.Config{
+			MonitorPort: monitorPort + i,
+			Debug:       log.DebugVisible(),
+			Slot:        i,
+		}
+		if n > 1 {
+			pc.PortBase = portBase + i*portRange
+		}
+		p.Configure(pc)
+		workers[i] = &worker{platform: p, monitorPort: pc.MonitorPort}
+	}
+}
+
 // RunTests the given tests and puts the output into the
-// given file name. It outputs RunStats in a CSV format.
+// given file name. It outputs RunStats in a CSV format, one row per test in
+// the order of the runconfigs, also when they run in parallel.
+// Every finished test is written to a journal, so that the tests can be
+// resumed with '-resume' if the simulation is interrupted.
 func RunTests(name string, runconfigs []platform.RunConfig) {
 
 	if nobuild == false {
-		if race {
-			if err := deployP.Build(build, "-race"); err != nil {
-				log.Error("Couln't finish build without errors:",
-					err)
-			}
-		} else {
-			if err := deployP.Build(build); err != nil {
-				log.Error("Couln't finish build without errors:",
-					err)
+		for _, w := range workers {
+			if race {
+				if err := w.platform.Build(build, "-race"); err != nil {
+					log.Error("Couln't finish build without errors:",
+						err)
+				}
+			} else {
+				if err := w.platform.Build(build); err != nil {
+					log.Error("Couln't finish build without errors:",
+						err)
+				}
 			}
 		}
 	}
 
 	mkTestDir()
-	rs := make([]*monitor.Stats, len(runconfigs))
-	// Try 10 times to run the test
-	nTimes := 10
 	stopOnSuccess := true
 	var f *os.File
 	args := os.O_CREATE | os.O_RDWR | os.O_TRUNC
-	// If a range is given, we only append
-	if simRange != "" {
+	// If a range is given or we resume, we only append
+	if simRange != "" || resume {
 		args = os.O_CREATE | os.O_RDWR | os.O_APPEND
 	}
 	f, err := os.OpenFile(testFile(name), args, 0660)
@@ -138,71 +199,120 @@ func RunTests(name string, runconfigs []platform.RunConfig) {
 	if err != nil {
 		log.Fatal("error syncing test file:", err)
 	}
+	fi, err := f.Stat()
+	if err != nil {
+		log.Fatal("error reading test file:", err)
+	}
+	// Only write the header if the file is empty
+	header := fi.Size() == 0
+	var fMutex sync.Mutex
+
+	j, err := openJournal(journalFile(name), resume)
+	if err != nil {
+		log.Fatal("error opening journal:", err)
+	}
+	defer func() {
+		if err := j.Close(); err != nil {
+			log.Error("Couln't close journal", err)
+		}
+	}()
 
 	start, stop := getStartStop(len(runconfigs))
+	tests := make(chan int, len(runconfigs))
+	var indexes []int
 	for i, t := range runconfigs {
 		// Implement a simple range-argument that will skip checks not in range
 		if i < start || i > stop {
 			log.Lvl2("Skipping", t, "because of range")
 			continue
 		}
-		// Waiting for the document-branch to be merged, then uncomment this
-		//log.Lvl1("Starting run with parameters -", t.String())
-
-		// run test t nTimes times
-		// take the average of all successful runs
-		runs := make([]*monitor.Stats, 0, nTimes)
-		for r := 0; r < nTimes; r++ {
-			stats, err := RunTest(t)
-			if err != nil {
-				log.Error("Error running test, trying again:", err)
-				continue
-			}
-
-			runs = append(runs, stats)
-			if stopOnSuccess {
-				break
-			}
-		}
-
-		if len(runs) == 0 {
-			log.Lvl1("unable to get any data for test:", t)
+		if j.isDone(i, journalConfig(t)) {
+			log.Lvl1("Skipping", t.String(), "because it is already in the journal")
 			continue
 		}
-
-		s := monitor.AverageStats(runs)
-		if i == 0 {
-			s.WriteHeader(f)
-		}
-		rs[i] = s
-		rs[i].WriteValues(f)
-		err = f.Sync()
-		if err != nil {
-			log.Fatal("error syncing data to test file:", err)
-		}
+		tests <- i
+		indexes = append(indexes, i)
+	}
+	close(tests)
+	// the rows are written in the order of the runconfigs, a test that
+	// finishes early waits for the ones before it
+	order := newResultOrder(indexes)
+
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			for i := range tests {
+				t := runconfigs[i]
+				// run test t up to 'retries' times
+				// take the average of all successful runs
+				runs := make([]*monitor.Stats, 0, retries)
+				for r := 0; r < retries; r++ {
+					stats, err := RunTest(w, t)
+					if err != nil {
+						log.Error("Error running test, trying again:", err)
+						continue
+					}
+
+					runs = append(runs, stats)
+					if stopOnSuccess {
+						break
+					}
+				}
+
+				var s *monitor.Stats
+				if len(runs) == 0 {
+					log.Lvl1("unable to get any data for test:", t)
+				} else {
+					s = monitor.AverageStats(runs)
+				}
+
+				fMutex.Lock()
+				for _, r := range order.add(i, s) {
+					if r.stats == nil {
+						continue
+					}
+					if header {
+						r.stats.WriteHeader(f)
+						header = false
+					}
+					r.stats.WriteValues(f)
+					if err := f.Sync(); err != nil {
+						log.Fatal("error syncing data to test file:", err)
+					}
+					config := journalConfig(runconfigs[r.index])
+					if err := j.markDone(r.index, config); err != nil {
+						log.Fatal("error writing journal:", err)
+					}
+				}
+				fMutex.Unlock()
+			}
+		}(w)
 	}
+	wg.Wait()
 }
 
-// RunTest a single test - takes a test-file as a string that will be copied
-// to the deterlab-server
-func RunTest(rc platform.RunConfig) (*monitor.Stats, error) {
+// RunTest a single test on the platform of the worker - takes a test-file as
+// a string that will be copied to the deterlab-server
+func RunTest(w *worker, rc platform.RunConfig) (*monitor.Stats, error) {
 	done := make(chan struct{})
 	CheckHosts(rc)
 	rc.Delete("simulation")
 	rs := monitor.NewStats(rc.Map(), "hosts", "bf")
 	monitor := monitor.NewMonitor(rs)
 
-	if err := deployP.Deploy(rc); err != nil {
+	if err := w.platform.Deploy(rc); err != nil {
 		log.Error(err)
 		return rs, err
 	}
 
-	monitor.SinkPort = monitorPort
-	if err := deployP.Cleanup(); err != nil {
+	monitor.SinkPort = w.monitorPort
+	if err := w.platform.Cleanup(); err != nil {
 		log.Error(err)
 		return rs, err
 	}
-	monitor.SinkPort = monitorPort
+	monitor.SinkPort = w.monitorPort
 	go func() {
 		if err := monitor.Listen(); err != nil {
 			log.Fatal("Could not monitor.Listen():", err)
@@ -210,7 +320,7 @@ func RunTest(rc platform.RunConfig) (*monitor.Stats, error) {
 	}()
 	// Start monitor before so ssh tunnel can connect to the monitor
 	// in case of deterlab.
-	err := deployP.Start()
+	err := w.platform.Start()
 	if err != nil {
 		log.Error(err)
 		return rs, err
@@ -218,9 +328,9 @@ func RunTest(rc platform.RunConfig) (*monitor.Stats, error) {
 
 	go func() {
 		var err error
-		if err = deployP.Wait(); err != nil {
+		if err = w.platform.Wait(); err != nil {
 			log.Lvl3("Test failed:", err)
-			if err := deployP.Cleanup(); err != nil {
+			if err := w.platform.Cleanup(); err != nil {
 				log.Lvl3("Couldn't cleanup platform:", err)
 			}
 			done <- struct{}{}
@@ -0,0 +1,251 @@
+// Package erasure splits a message in Reed-Solomon shards, so that a leader
+// doesn't have to send the whole message to every node. Every node gets one
+// shard and the nodes exchange their shards, any DataShards of them are
+// enough to reconstruct the message.
+//
+// The shards are committed to with a Merkle tree: the Header holds the root
+// and every Shard holds the path to the root, so that a node can verify a
+// shard it got from another node before using it.
+package erasure
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// MaxShards is the biggest number of shards supported by the Reed-Solomon
+// code. With more nodes, some nodes get the same shard.
+const MaxShards = 256
+
+// Header describes how a message has been split and commits to all shards.
+type Header struct {
+	// Root of the Merkle tree of the shards
+	Root []byte
+	// Size of the message in bytes
+	Size         int
+	DataShards   int
+	ParityShards int
+}
+
+// Shard is one piece of the encoded message with its Merkle path.
+type Shard struct {
+	Index int
+	Data  []byte
+	Proof [][]byte
+}
+
+// Params returns the number of data and parity shards for n nodes, so that
+// the message can be reconstructed even if a third of the nodes don't send
+// their shard.
+func Params(n int) (dataShards, parityShards int) {
+	if n > MaxShards {
+		n = MaxShards
+	}
+	if n < 1 {
+		n = 1
+	}
+	parityShards = (n - 1) / 3
+	return n - parityShards, parityShards
+}
+
+// Encode splits msg in dataShards shards, adds parityShards shards and
+// returns the header committing to them together with all shards.
+func Encode(msg []byte, dataShards, parityShards int) (*Header, []*Shard, error) {
+	if len(msg) == 0 {
+		return nil, nil, errors.New("cannot encode an empty message")
+	}
+	enc, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the shards are copied so that msg is never changed
+	perShard := (len(msg) + dataShards - 1) / dataShards
+	data := make([][]byte, dataShards+parityShards)
+	for i := range data {
+		data[i] = make([]byte, perShard)
+		if i*perShard < len(msg) {
+			copy(data[i], msg[i*perShard:])
+		}
+	}
+	if err := enc.Encode(data); err != nil {
+		return nil, nil, err
+	}
+	tree := merkleTree(data)
+	h := &Header{
+		Root:         tree[len(tree)-1][0],
+		Size:         len(msg),
+		DataShards:   dataShards,
+		ParityShards: parityShards,
+	}
+	shards := make([]*Shard, len(data))
+	for i, d := range data {
+		shards[i] = &Shard{Index: i, Data: d, Proof: merkleProof(tree, i)}
+	}
+	return h, shards, nil
+}
+
+// Shards returns the total number of shards.
+func (h *Header) Shards() int {
+	return h.DataShards + h.ParityShards
+}
+
+// Check returns an error if the header doesn't describe a valid encoding,
+// so that a header received from another node can be used safely.
+func (h *Header) Check() error {
+	if h.DataShards <= 0 || h.ParityShards < 0 {
+		return fmt.Errorf("invalid number of shards %d+%d", h.DataShards,
+			h.ParityShards)
+	}
+	if h.Shards() > MaxShards {
+		return fmt.Errorf("%d shards are too many", h.Shards())
+	}
+	if h.Size <= 0 {
+		return fmt.Errorf("invalid message size %d", h.Size)
+	}
+	if len(h.Root) != sha256.Size {
+		return errors.New("invalid Merkle root")
+	}
+	return nil
+}
+
+// Verify returns an error if the shard is not part of the message committed
+// to by the header.
+func (h *Header) Verify(s *Shard) error {
+	if err := h.Check(); err != nil {
+		return err
+	}
+	if s.Index < 0 || s.Index >= h.Shards() {
+		return fmt.Errorf("shard %d out of range", s.Index)
+	}
+	// all shards have the same length
+	if len(s.Data) != (h.Size+h.DataShards-1)/h.DataShards {
+		return fmt.Errorf("shard %d has wrong length %d", s.Index, len(s.Data))
+	}
+	hash := leafHash(s.Index, s.Data)
+	index := s.Index
+	for _, sibling := range s.Proof {
+		if index%2 == 0 {
+			hash = nodeHash(hash, sibling)
+		} else {
+			hash = nodeHash(sibling, hash)
+		}
+		index /= 2
+	}
+	if index != 0 || !bytes.Equal(hash, h.Root) {
+		return fmt.Errorf("shard %d doesn't match the commitment", s.Index)
+	}
+	return nil
+}
+
+// Decoder collects verified shards until the message can be reconstructed.
+type Decoder struct {
+	header *Header
+	shards [][]byte
+	count  int
+}
+
+// NewDecoder returns a decoder for the message described by the header, or
+// an error if the header is not valid.
+func NewDecoder(h *Header) (*Decoder, error) {
+	if err := h.Check(); err != nil {
+		return nil, err
+	}
+	return &Decoder{header: h, shards: make([][]byte, h.Shards())}, nil
+}
+
+// Add verifies the shard and stores it. A shard that has already been
+// added is ignored.
+func (d *Decoder) Add(s *Shard) error {
+	if err := d.header.Verify(s); err != nil {
+		return err
+	}
+	if d.shards[s.Index] == nil {
+		d.shards[s.Index] = s.Data
+		d.count++
+	}
+	return nil
+}
+
+// Done returns true if enough shards have been added to reconstruct the
+// message.
+func (d *Decoder) Done() bool {
+	return d.count >= d.header.DataShards
+}
+
+// Message reconstructs the message from the added shards.
+func (d *Decoder) Message() ([]byte, error) {
+	if !d.Done() {
+		return nil, fmt.Errorf("got %d shards out of %d", d.count,
+			d.header.DataShards)
+	}
+	enc, err := reedsolomon.New(d.header.DataShards, d.header.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	if err := enc.ReconstructData(d.shards); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := enc.Join(&buf, d.shards, d.header.Size); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// merkleTree returns all levels of the tree over the shards, the leaves
+// first and the root last. Missing leaves are filled with empty hashes.
+func merkleTree(shards [][]byte) [][][]byte {
+	width := 1
+	for width < len(shards) {
+		width *= 2
+	}
+	level := make([][]byte, width)
+	for i := range level {
+		if i < len(shards) {
+			level[i] = leafHash(i, shards[i])
+		} else {
+			level[i] = make([]byte, sha256.Size)
+		}
+	}
+	tree := [][][]byte{level}
+	for len(level) > 1 {
+		next := make([][]byte, len(level)/2)
+		for i := range next {
+			next[i] = nodeHash(level[2*i], level[2*i+1])
+		}
+		tree = append(tree, next)
+		level = next
+	}
+	return tree
+}
+
+// merkleProof returns the siblings on the path from leaf i to the root.
+func merkleProof(tree [][][]byte, i int) [][]byte {
+	var proof [][]byte
+	for _, level := range tree[:len(tree)-1] {
+		proof = append(proof, level[i^1])
+		i /= 2
+	}
+	return proof
+}
+
+func leafHash(i int, data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	binary.Write(h, binary.LittleEndian, uint32(i))
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func nodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
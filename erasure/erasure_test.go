@@ -0,0 +1,92 @@
+package erasure
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	for _, n := range []int{1, 2, 4, 13, 300} {
+		msg := make([]byte, 10000+n)
+		rand.Read(msg)
+		data, parity := Params(n)
+		h, shards, err := Encode(msg, data, parity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(shards) != h.Shards() {
+			t.Fatalf("got %d shards instead of %d", len(shards), h.Shards())
+		}
+		// only the last shards arrive
+		d, err := NewDecoder(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := len(shards) - 1; !d.Done(); i-- {
+			if err := d.Add(shards[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := d.Message()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("%d nodes: reconstructed message differs", n)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	h, shards, err := Encode([]byte("a block that is split in shards"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range shards {
+		if err := h.Verify(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := *shards[1]
+	s.Data = append([]byte{}, s.Data...)
+	s.Data[0] ^= 1
+	if h.Verify(&s) == nil {
+		t.Fatal("modified shard passed verification")
+	}
+	s = *shards[1]
+	s.Index = 2
+	if h.Verify(&s) == nil {
+		t.Fatal("shard with wrong index passed verification")
+	}
+	d, err := NewDecoder(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Add(shards[0])
+	d.Add(shards[0])
+	if d.Done() {
+		t.Fatal("decoder done with one shard")
+	}
+	if _, err := d.Message(); err == nil {
+		t.Fatal("message reconstructed with one shard")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	h, _, err := Encode([]byte("a block that is split in shards"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []Header{
+		{Root: h.Root, Size: h.Size, DataShards: 0, ParityShards: 2},
+		{Root: h.Root, Size: h.Size, DataShards: 3, ParityShards: -1},
+		{Root: h.Root, Size: h.Size, DataShards: MaxShards, ParityShards: 1},
+		{Root: h.Root, Size: 0, DataShards: 3, ParityShards: 2},
+		{Size: h.Size, DataShards: 3, ParityShards: 2},
+	} {
+		if _, err := NewDecoder(&bad); err == nil {
+			t.Fatalf("invalid header %+v accepted", bad)
+		}
+	}
+}
@@ -9,10 +9,17 @@ import (
 	"math"
 	"fmt"
 	"encoding/json"
+	"encoding/binary"
 
 	"github.com/csanti/onet"
 	"github.com/csanti/onet/log"
 	"github.com/csanti/onet/network"
+	"github.com/csanti/onet/simul/monitor"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain/blkparser"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain/blockstore"
+	"github.com/csanti/pbft-experiments/erasure"
+	"github.com/csanti/pbft-experiments/timeline"
 	"go.dedis.ch/kyber"
 	"go.dedis.ch/kyber/sign/schnorr"
 
@@ -22,7 +29,7 @@ import (
 
 func init() {
 	log.SetDebugVisible(1)
-	network.RegisterMessages(PrePrepare{}, Prepare{}, Commit{}, Reply{})
+	network.RegisterMessages(PrePrepare{}, ShardExchange{}, GetTransactions{}, Transactions{}, Prepare{}, Commit{}, Reply{})
 	onet.GlobalProtocolRegister(DefaultProtocolName, NewProtocol)
 }
 
@@ -44,8 +51,24 @@ type PbftProtocol struct {
 	verificationFn  	VerificationFn
 	Timeout 			time.Duration
 	PubKeysMap			map[string]kyber.Point
+	// Erasure makes the leader send one shard of Msg to every node instead
+	// of the whole Msg, the nodes exchange the shards to reconstruct it
+	Erasure				bool
+	// Compact makes the leader send a compact block, the nodes rebuild Msg
+	// from their mempool and fetch the missing transactions from the leader
+	Compact				bool
+	block				*blockchain.TrBlock
+	// Certificate holds the verified commit messages, which prove that Msg
+	// has been committed
+	Certificate			[]Commit
+	// OnCommit is called on every node with Msg and the Certificate once
+	// enough commit messages are verified, so that the node can store the
+	// committed block
+	OnCommit			func(msg []byte, certificate []Commit)
 
 	ChannelPrePrepare   chan StructPrePrepare
+	ChannelShard		chan StructShardExchange
+	ChannelTransactions	chan StructTransactions
 	ChannelPrepare 		chan StructPrepare
 	ChannelCommit		chan StructCommit
 	ChannelReply		chan StructReply
@@ -55,15 +78,9 @@ type PbftProtocol struct {
 // Check that *PbftProtocol implements onet.ProtocolInstance
 var _ onet.ProtocolInstance = (*PbftProtocol)(nil)
 
-// NewProtocol initialises the structure for use in one round
+// NewProtocol initialises the structure for use in one round with an
+// always-true verification.
 func NewProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
-
-	pubKeysMap := make(map[string]kyber.Point)
-	for _, node := range n.Tree().List() {
-		//fmt.Println(node.ServerIdentity, node.ServerIdentity.Public, node.ServerIdentity.ID.String())
-		pubKeysMap[node.ServerIdentity.ID.String()] = node.ServerIdentity.Public
-	}
-
 	vf := func(msg, data []byte) bool {
 		// Simulate verification function by sleeping
 		b, _ := json.Marshal(msg)
@@ -74,6 +91,18 @@ func NewProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
 
 		return true 
 	}
+	return NewPbftProtocol(n, vf)
+}
+
+// NewPbftProtocol initialises the structure for use in one round, the
+// replicas only prepare Msg if vf accepts it.
+func NewPbftProtocol(n *onet.TreeNodeInstance, vf VerificationFn) (onet.ProtocolInstance, error) {
+
+	pubKeysMap := make(map[string]kyber.Point)
+	for _, node := range n.Tree().List() {
+		//fmt.Println(node.ServerIdentity, node.ServerIdentity.Public, node.ServerIdentity.ID.String())
+		pubKeysMap[node.ServerIdentity.ID.String()] = node.ServerIdentity.Public
+	}
 
 	t := &PbftProtocol{
 		TreeNodeInstance: 	n,
@@ -87,6 +116,7 @@ func NewProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
 
 	for _, channel := range []interface{}{
 		&t.ChannelPrePrepare,
+		&t.ChannelTransactions,
 		&t.ChannelPrepare,
 		&t.ChannelCommit,
 		&t.ChannelReply,
@@ -97,6 +127,16 @@ func NewProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
 		}
 	}
 
+	if err := t.RegisterHandler(t.handleGetTransactions); err != nil {
+		return nil, errors.New("couldn't register handler: " + err.Error())
+	}
+
+	// every node may send its shard before we get the pre-prepare
+	t.ChannelShard = make(chan StructShardExchange, t.nNodes)
+	if err := t.RegisterChannel(t.ChannelShard); err != nil {
+		return nil, errors.New("couldn't register channel: " + err.Error())
+	}
+
 	return t, nil
 }
 
@@ -113,13 +153,13 @@ func (pbft *PbftProtocol) Dispatch() error {
 
 	log.Lvl3(pbft.ServerIdentity(), "Started node")
 
-	nRepliesThreshold := int(math.Ceil(float64(pbft.nNodes - 1 ) * (float64(2)/float64(3)))) + 1
-	nRepliesThreshold = min(nRepliesThreshold, pbft.nNodes - 1)
+	nRepliesThreshold := Threshold(pbft.nNodes)
 
 	// Verification of the data
 	verifyChan := make(chan bool, 1)
 
 	var futureDigest []byte
+	var tl *timeline.Logger
 	if pbft.IsRoot() {
 
 		// send pre-prepare phase
@@ -130,13 +170,29 @@ func (pbft *PbftProtocol) Dispatch() error {
 			return err
 		}
 
-		go func() {
-			if errs := pbft.SendToChildrenInParallel(&PrePrepare{Msg:pbft.Msg, Digest:digest[:], Sig:sig, Sender:pbft.ServerIdentity().ID.String()}); len(errs) > 0 {
-				log.Lvl3(pbft.ServerIdentity(), "failed to send pre-prepare to all children")
+		msg := pbft.Msg
+		if pbft.Compact {
+			msg, err = pbft.compactBlock(digest[:])
+			if err != nil {
+				return err
 			}
-		}()
+		}
+
+		if pbft.Erasure {
+			if err := pbft.sendShards(msg, digest[:], sig); err != nil {
+				return err
+			}
+		} else {
+			go func() {
+				if errs := pbft.SendToChildrenInParallel(&PrePrepare{Msg:msg, Digest:digest[:], Sig:sig, Sender:pbft.ServerIdentity().ID.String(), Compact:pbft.Compact}); len(errs) > 0 {
+					log.Lvl3(pbft.ServerIdentity(), "failed to send pre-prepare to all children")
+				}
+			}()
+		}
 
 		futureDigest = digest[:]
+		tl = timeline.New(pbft.ServerIdentity().String(), DefaultProtocolName, futureDigest)
+		tl.Phase("preprepare").Lvl3("Sent pre-prepare", "erasure", pbft.Erasure, "compact", pbft.Compact)
 
 	} else {
 		// wait for pre-prepare message from leader
@@ -145,7 +201,23 @@ func (pbft *PbftProtocol) Dispatch() error {
 		if !channelOpen {
 			return nil
 		}
-		log.Lvl3(pbft.ServerIdentity(), "Received PrePrepare. Verifying...")
+		tl = timeline.New(pbft.ServerIdentity().String(), DefaultProtocolName, preprepare.Digest)
+		tl.Phase("preprepare").Lvl3("Received pre-prepare")
+		if preprepare.Shards != nil {
+			msg, err := pbft.reconstruct(preprepare.PrePrepare)
+			if err != nil {
+				return err
+			}
+			preprepare.Msg = msg
+		}
+		if preprepare.Compact {
+			msg, err := pbft.expand(preprepare.Msg)
+			if err != nil {
+				return err
+			}
+			preprepare.Msg = msg
+		}
+		tl.Phase("preprepare").Lvl3("Rebuilt the block, verifying")
 		go func() {
 			verifyChan <- pbft.verificationFn(preprepare.Msg, pbft.Data)
 		}()
@@ -168,6 +240,7 @@ func (pbft *PbftProtocol) Dispatch() error {
 		if !ok {
 			return fmt.Errorf("verification failed on node")
 		}
+		pbft.Msg = preprepare.Msg
 	}
 
 	// Sign message and broadcast
@@ -207,7 +280,7 @@ loop:
 	if !(nReceivedPrepareMessages >= nRepliesThreshold) {
 		errors.New("node didn't receive enough prepare messages. Stopping.")
 	} else {
-		log.Lvl2(pbft.ServerIdentity(), "Received enough prepare messages (> 2/3 + 1):", nReceivedPrepareMessages, "/", pbft.nNodes)
+		tl.Phase("prepare").Lvl2("Received enough prepare messages", "count", nReceivedPrepareMessages, "nodes", pbft.nNodes)
 	}
 
 	//digest := sha512.Sum512(pbft.Msg)
@@ -239,6 +312,7 @@ commitLoop:
 				return err
 			}
 			nReceivedCommitMessages++
+			pbft.Certificate = append(pbft.Certificate, commit.Commit)
 		case <-t:
 			// TODO
 			break commitLoop
@@ -246,10 +320,13 @@ commitLoop:
 	}
 
 	if !(nReceivedCommitMessages >= nRepliesThreshold) {
-		log.Lvl1(pbft.ServerIdentity(), "node didn't receive enough commit messages. Stopping.", nReceivedCommitMessages, " / ", nRepliesThreshold)
+		tl.Phase("commit").Lvl1("Didn't receive enough commit messages", "count", nReceivedCommitMessages, "threshold", nRepliesThreshold)
 		return errors.New("node didn't receive enough commit messages. Stopping.")
 	} else {
-		log.Lvl1(pbft.ServerIdentity(), "Received enough commit messages (> 2/3 + 1):", nReceivedCommitMessages, "/", pbft.nNodes)
+		tl.Phase("commit").Lvl1("Received enough commit messages", "count", nReceivedCommitMessages, "nodes", pbft.nNodes)
+	}
+	if pbft.OnCommit != nil {
+		pbft.OnCommit(pbft.Msg, pbft.Certificate)
 	}
 
 	receivedReplies := 0
@@ -279,6 +356,7 @@ replyLoop:
 			}
 		}
 
+		tl.Phase("reply").Lvl2("Collected the replies", "count", receivedReplies, "threshold", nRepliesThreshold)
 		pbft.FinalReply <- futureDigest[:]
 
 	} else {
@@ -295,6 +373,8 @@ replyLoop:
 func (pbft *PbftProtocol) Shutdown() error {
 	pbft.stoppedOnce.Do(func() {
 		close(pbft.ChannelPrePrepare)
+		close(pbft.ChannelShard)
+		close(pbft.ChannelTransactions)
 		close(pbft.ChannelPrepare)
 		close(pbft.ChannelCommit)
 		close(pbft.ChannelReply)
@@ -302,6 +382,199 @@ func (pbft *PbftProtocol) Shutdown() error {
 	return nil
 }
 
+// sendShards splits msg in one shard per child and sends every child the
+// pre-prepare with its shard.
+func (pbft *PbftProtocol) sendShards(msg, digest, sig []byte) error {
+	children := pbft.Children()
+	dataShards, parityShards := erasure.Params(len(children))
+	header, shards, err := erasure.Encode(msg, dataShards, parityShards)
+	if err != nil {
+		return err
+	}
+	for i, child := range children {
+		go func(child *onet.TreeNode, shard *erasure.Shard) {
+			err := pbft.SendTo(child, &PrePrepare{Digest:digest, Sig:sig, Sender:pbft.ServerIdentity().ID.String(),
+				Shards:header, Shard:shard, Compact:pbft.Compact})
+			if err != nil {
+				log.Lvl3(pbft.ServerIdentity(), "failed to send pre-prepare to", child.ServerIdentity)
+			}
+		}(child, shards[i % len(shards)])
+	}
+	return nil
+}
+
+// reconstruct sends the shard of the pre-prepare to all other nodes and
+// collects their shards until Msg can be reconstructed.
+func (pbft *PbftProtocol) reconstruct(preprepare PrePrepare) ([]byte, error) {
+	decoder, err := erasure.NewDecoder(preprepare.Shards)
+	if err != nil {
+		return nil, err
+	}
+	if err := decoder.Add(preprepare.Shard); err != nil {
+		return nil, err
+	}
+	for _, node := range pbft.List() {
+		if node.IsRoot() || node.ID.Equal(pbft.TreeNode().ID) {
+			continue
+		}
+		go func(node *onet.TreeNode) {
+			if err := pbft.SendTo(node, &ShardExchange{Shard:preprepare.Shard}); err != nil {
+				log.Lvl3(pbft.ServerIdentity(), "failed to send shard to", node.ServerIdentity)
+			}
+		}(node)
+	}
+
+	t := time.After(defaultTimeout)
+	for !decoder.Done() {
+		select {
+		case shard, channelOpen := <-pbft.ChannelShard:
+			if !channelOpen {
+				return nil, errors.New("protocol stopped")
+			}
+			if err := decoder.Add(shard.Shard); err != nil {
+				log.Lvl2(pbft.ServerIdentity(), "dropping shard:", err)
+			}
+		case <-t:
+			return nil, errors.New("didn't get enough shards to reconstruct the pre-prepare")
+		}
+	}
+	return decoder.Message()
+}
+// compactBlock returns the compact block of Msg, with the short IDs salted
+// by the digest.
+func (pbft *PbftProtocol) compactBlock(digest []byte) ([]byte, error) {
+	block := &blockchain.TrBlock{}
+	if err := json.Unmarshal(pbft.Msg, block); err != nil {
+		return nil, errors.New("compact mode needs a block: " + err.Error())
+	}
+	pbft.block = block
+	return blockchain.NewCompactBlock(block, binary.LittleEndian.Uint64(digest)).MarshalBinary()
+}
+
+// expand rebuilds the block from the compact block and the mempool of the
+// node, and fetches the missing transactions from the leader.
+func (pbft *PbftProtocol) expand(compact []byte) ([]byte, error) {
+	cb := &blockchain.CompactBlock{}
+	if err := cb.UnmarshalBinary(compact); err != nil {
+		return nil, err
+	}
+	txs, missing := cb.Reconstruct(blockchain.NodeMempool(pbft.ServerIdentity().ID.String()))
+	fetched := 0
+	if len(missing) > 0 {
+		log.Lvl3(pbft.ServerIdentity(), "fetching", len(missing), "transactions")
+		if err := pbft.SendTo(pbft.Root(), &GetTransactions{Indices:missing}); err != nil {
+			return nil, err
+		}
+		select {
+		case reply, channelOpen := <-pbft.ChannelTransactions:
+			if !channelOpen {
+				return nil, errors.New("protocol stopped")
+			}
+			var got []blkparser.Tx
+			if err := json.Unmarshal(reply.Txs, &got); err != nil {
+				return nil, err
+			}
+			if len(got) != len(missing) {
+				return nil, fmt.Errorf("asked for %d transactions but got %d", len(missing), len(got))
+			}
+			for i, index := range missing {
+				txs[index] = got[i]
+			}
+			fetched = len(reply.Txs)
+		case <-time.After(defaultTimeout):
+			return nil, errors.New("didn't get the missing transactions")
+		}
+	}
+	block, err := cb.Block(txs)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := block.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	monitor.RecordSingleMeasure("compact_missing", float64(len(missing)))
+	monitor.RecordSingleMeasure("compact_saved", float64(len(msg) - len(compact) - fetched))
+	return msg, nil
+}
+
+// handleGetTransactions sends the requested transactions of the compact
+// block to the node. Only the leader has the block.
+func (pbft *PbftProtocol) handleGetTransactions(msg StructGetTransactions) error {
+	if pbft.block == nil {
+		return errors.New("got a request for transactions without a block")
+	}
+	txs := make([]blkparser.Tx, len(msg.Indices))
+	for i, index := range msg.Indices {
+		if index < 0 || index >= len(pbft.block.Txs) {
+			return fmt.Errorf("no transaction %d in block", index)
+		}
+		txs[i] = pbft.block.Txs[index]
+	}
+	data, err := json.Marshal(txs)
+	if err != nil {
+		return err
+	}
+	return pbft.SendTo(msg.TreeNode, &Transactions{Txs:data})
+}
+
+// Threshold returns the number of prepare, commit and reply messages a node
+// of a roster of n nodes waits for.
+func Threshold(n int) int {
+	return min(int(math.Ceil(float64(n - 1) * (float64(2)/float64(3)))) + 1, n - 1)
+}
+
+// VerifyEntry returns a function checking the blocks stored by the
+// simulation, e.g. to sync them with blocksync: every block has to follow the
+// previous one and its certificate has to hold the commit messages of at
+// least Threshold members of the roster.
+func VerifyEntry(suite kyber.Group, roster *onet.Roster) func(prev, e *blockstore.Entry) error {
+	return func(prev, e *blockstore.Entry) error {
+		block := &blockchain.TrBlock{}
+		if err := json.Unmarshal(e.Block, block); err != nil {
+			return err
+		}
+		if block.HeaderHash != string(e.Hash) ||
+			block.HeaderHash != blockchain.HashHeader(block.Header) {
+			return errors.New("wrong header hash")
+		}
+		parent := "0"
+		if prev != nil {
+			parent = string(prev.Hash)
+		}
+		if block.Header.Parent != parent {
+			return errors.New("block doesn't follow the previous one")
+		}
+		var certificate []Commit
+		if err := json.Unmarshal(e.Signature, &certificate); err != nil {
+			return err
+		}
+		digest := sha512.Sum512(e.Block)
+		signers := make(map[string]bool)
+		for _, commit := range certificate {
+			var si *network.ServerIdentity
+			for _, member := range roster.List {
+				if member.ID.String() == commit.Sender {
+					si = member
+				}
+			}
+			if si == nil || signers[commit.Sender] {
+				return fmt.Errorf("commit of unknown or repeated sender %s", commit.Sender)
+			}
+			if !bytes.Equal(commit.Digest, digest[:]) {
+				return errors.New("commit of another block")
+			}
+			if err := schnorr.Verify(suite, si.Public, commit.Digest, commit.Sig); err != nil {
+				return err
+			}
+			signers[commit.Sender] = true
+		}
+		if len(signers) < Threshold(len(roster.List)) {
+			return fmt.Errorf("only %d commits in the certificate", len(signers))
+		}
+		return nil
+	}
+}
 
 func min(a, b int) int {
     if a < b {
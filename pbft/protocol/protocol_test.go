@@ -2,12 +2,22 @@ package protocol
 
 
 import (
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"math/rand"
 	"testing"
 	"time"
 
 	"github.com/csanti/onet"
 	"github.com/csanti/onet/log"
+	"github.com/csanti/onet/network"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain/blockstore"
+	"go.dedis.ch/kyber"
 	"go.dedis.ch/kyber/group/edwards25519"
+	"go.dedis.ch/kyber/sign/schnorr"
+	"go.dedis.ch/kyber/util/key"
 )
 
 var tSuite = edwards25519.NewBlakeSHA256Ed25519()
@@ -51,3 +61,146 @@ func TestNode(t *testing.T) {
 	}
 }
 
+
+
+func TestNodeErasure(t *testing.T) {
+
+	proposal := make([]byte, 100 * 1024)
+	rand.Read(proposal)
+	defaultTimeout := 5 * time.Second
+	nodes := []int{2, 4, 13}
+
+	for _, nbrNodes := range nodes {
+		local := onet.NewLocalTest(tSuite)
+		_, _, tree := local.GenBigTree(nbrNodes, nbrNodes, nbrNodes - 1, true)
+
+		pi, err := local.CreateProtocol(DefaultProtocolName, tree)
+		if err != nil {
+			local.CloseAll()
+			t.Fatal("Error in creation of protocol:", err)
+		}
+
+		protocol := pi.(*PbftProtocol)
+		protocol.Msg = proposal
+		protocol.Timeout = defaultTimeout
+		protocol.Erasure = true
+
+		err = protocol.Start()
+		if err != nil {
+			local.CloseAll()
+			t.Fatal(err)
+		}
+
+		select {
+		case <-protocol.FinalReply:
+		case <-time.After(defaultTimeout * 2):
+			local.CloseAll()
+			t.Fatal("Leader never got enough final replies, timed out")
+		}
+		local.CloseAll()
+	}
+}
+
+
+func TestNodeCompact(t *testing.T) {
+
+	txs := blockchain.NewGenerator(blockchain.Workload{WorkloadSeed: 1}).Transactions(200)
+	tl := blockchain.NewTransactionList(txs, len(txs))
+	block, err := blockchain.NewTrBlock(tl, blockchain.NewHeader(tl, "0", "0")).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultTimeout := 5 * time.Second
+
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	_, _, tree := local.GenBigTree(5, 5, 4, true)
+	// every node misses other transactions
+	for i, node := range tree.List() {
+		mempool := blockchain.NodeMempool(node.ServerIdentity.ID.String())
+		for j, tx := range txs {
+			if j % 5 != i {
+				mempool.Add(tx)
+			}
+		}
+	}
+
+	pi, err := local.CreateProtocol(DefaultProtocolName, tree)
+	if err != nil {
+		t.Fatal("Error in creation of protocol:", err)
+	}
+
+	protocol := pi.(*PbftProtocol)
+	protocol.Msg = block
+	protocol.Timeout = defaultTimeout
+	protocol.Compact = true
+
+	err = protocol.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-protocol.FinalReply:
+	case <-time.After(defaultTimeout * 2):
+		t.Fatal("Leader never got enough final replies, timed out")
+	}
+}
+
+
+func TestVerifyEntry(t *testing.T) {
+
+	var ids []*network.ServerIdentity
+	var privates []kyber.Scalar
+	for i := 0; i < 4; i++ {
+		kp := key.NewKeyPair(tSuite)
+		address := network.NewAddress(network.Local, fmt.Sprintf("localhost:%d", 2000 + i))
+		ids = append(ids, network.NewServerIdentity(kp.Public, address))
+		privates = append(privates, kp.Private)
+	}
+	roster := onet.NewRoster(ids)
+
+	txs := blockchain.NewGenerator(blockchain.Workload{WorkloadSeed: 1}).Transactions(10)
+	tl := blockchain.NewTransactionList(txs, len(txs))
+	block := blockchain.NewTrBlock(tl, blockchain.NewHeader(tl, "0", "0"))
+	data, err := block.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha512.Sum512(data)
+	entry := func(signers ...int) *blockstore.Entry {
+		var certificate []Commit
+		for _, i := range signers {
+			sig, err := schnorr.Sign(tSuite, privates[i], digest[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			certificate = append(certificate, Commit{Digest: digest[:], Sig: sig, Sender: ids[i].ID.String()})
+		}
+		sig, err := json.Marshal(certificate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &blockstore.Entry{Hash: []byte(block.HeaderHash), Block: data, Signature: sig}
+	}
+
+	verify := VerifyEntry(tSuite, roster)
+	if err := verify(nil, entry(0, 1, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if verify(nil, entry(0, 1)) == nil {
+		t.Fatal("Certificate below the threshold should fail")
+	}
+	if verify(nil, entry(0, 1, 1)) == nil {
+		t.Fatal("Repeated commit should fail")
+	}
+	if verify(&blockstore.Entry{Hash: []byte("other")}, entry(0, 1, 2)) == nil {
+		t.Fatal("Block not following the previous one should fail")
+	}
+	bad := entry(0, 1, 2)
+	bad.Block = append([]byte{}, data...)
+	bad.Block[len(bad.Block) - 2]++
+	if verify(nil, bad) == nil {
+		t.Fatal("Changed block should fail")
+	}
+}
@@ -1,7 +1,10 @@
 package protocol
 
 
-import "github.com/csanti/onet"
+import (
+	"github.com/csanti/onet"
+	"github.com/csanti/pbft-experiments/erasure"
+)
 
 // Name can be used from other packages to refer to this protocol.
 const DefaultProtocolName = "PBFT"
@@ -12,6 +15,11 @@ type PrePrepare struct {
 	Digest []byte
 	Sig []byte
 	Sender string
+	// with erasure coding Msg is empty and every node gets one shard
+	Shards *erasure.Header
+	Shard *erasure.Shard
+	// Compact is true if Msg is a compact block
+	Compact bool
 }
 
 type StructPrePrepare struct {
@@ -20,6 +28,40 @@ type StructPrePrepare struct {
 }
 
 
+// ShardExchange sends the shard a node got from the leader to all other nodes.
+type ShardExchange struct {
+	Shard *erasure.Shard
+}
+
+type StructShardExchange struct {
+	*onet.TreeNode
+	ShardExchange
+}
+
+
+// GetTransactions asks the leader for the transactions of the compact block
+// that are not in the mempool of the node.
+type GetTransactions struct {
+	Indices []int
+}
+
+type StructGetTransactions struct {
+	*onet.TreeNode
+	GetTransactions
+}
+
+
+// Transactions holds the requested transactions in JSON.
+type Transactions struct {
+	Txs []byte
+}
+
+type StructTransactions struct {
+	*onet.TreeNode
+	Transactions
+}
+
+
 type Prepare struct {
 	Digest []byte
 	Sig []byte
@@ -20,32 +20,216 @@ In the Node-method you can read the files that have been created by the
 */
 
 import (
+	"encoding/json"
 	"fmt"
 	"time"
 	"errors"
 	"math/rand"
+	"sync"
 
 	"github.com/BurntSushi/toml"
 	"github.com/csanti/onet"
 	"github.com/csanti/onet/log"
+	"github.com/csanti/onet/network"
 	"github.com/csanti/onet/simul/monitor"
 	"github.com/csanti/pbft-experiments/pbft/protocol"
+	"github.com/csanti/pbft-experiments/blocksync"
 	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain"
 	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain/blkparser"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/blockchain/blockstore"
+	"github.com/csanti/pbft-experiments/cothority/protocols/byzcoin/membership"
 )
 
 func init() {
 	onet.SimulationRegister("PBFTProtocol", NewSimulationProtocol)
+	onet.GlobalProtocolRegister(simulationProtocolName, newSimulationNode)
+}
+
+// simulationProtocolName is the PbftProtocol as run by the nodes of the
+// simulation.
+const simulationProtocolName = "PBFTSimulationProtocol"
+
+// stores holds the block store of every node of the simulation.
+var stores = struct {
+	nodes map[network.ServerIdentityID]*blockstore.Store
+	sync.Mutex
+}{nodes: make(map[network.ServerIdentityID]*blockstore.Store)}
+
+// nodeStore returns the block store of the node, or nil if it has none.
+func nodeStore(id network.ServerIdentityID) *blockstore.Store {
+	stores.Lock()
+	defer stores.Unlock()
+	return stores.nodes[id]
+}
+
+// followers holds the epochs every replica of the simulation learns from the
+// blocks, and the roster of all nodes, which may join.
+var followers = struct {
+	nodes  map[network.ServerIdentityID]*membership.Follower
+	roster *onet.Roster
+	sync.Mutex
+}{nodes: make(map[network.ServerIdentityID]*membership.Follower)}
+
+// nodeFollower returns the epochs of the node, or nil without epochs.
+func nodeFollower(id network.ServerIdentityID) *membership.Follower {
+	followers.Lock()
+	defer followers.Unlock()
+	return followers.nodes[id]
+}
+
+// replicas holds how every node of the simulation with a store and a fixed
+// roster catches up when it misses blocks.
+var replicas = struct {
+	nodes map[network.ServerIdentityID]*replica
+	sync.Mutex
+}{nodes: make(map[network.ServerIdentityID]*replica)}
+
+// replica syncs the store of a node from the stores of the other nodes.
+type replica struct {
+	config  *onet.SimulationConfig
+	verify  func(prev, e *blockstore.Entry) error
+	syncing bool
+	sync.Mutex
+}
+
+// nodeReplica returns the sync of the node, or nil if it can't sync.
+func nodeReplica(id network.ServerIdentityID) *replica {
+	replicas.Lock()
+	defer replicas.Unlock()
+	return replicas.nodes[id]
+}
+
+// catchUp syncs the store of the node in the background, unless a sync is
+// already running. The block that showed the gap is fetched with the others
+// if the nodes that committed it stored it already, else with the next one.
+func catchUp(id network.ServerIdentityID) {
+	r := nodeReplica(id)
+	if r == nil {
+		log.Lvl2(id, "can't sync, the rosters of the stored epochs are unknown")
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	if r.syncing {
+		return
+	}
+	r.syncing = true
+	go func() {
+		roster := r.config.Roster
+		tree := roster.GenerateNaryTreeWithRoot(len(roster.List)-1, r.config.Server.ServerIdentity)
+		if err := syncBlocks(r.config, tree, r.verify); err != nil {
+			log.Error(id, "couldn't catch up:", err)
+		}
+		r.Lock()
+		r.syncing = false
+		r.Unlock()
+	}()
+}
+
+// newSimulationNode returns a PbftProtocol whose replicas only prepare a
+// block with valid roster changes and that stores the committed blocks in
+// the store of the node, if it has one.
+func newSimulationNode(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	vf := func(msg, data []byte) bool { return true }
+	follower := nodeFollower(n.ServerIdentity().ID)
+	if n.IsRoot() {
+		// the leader proposes the changes of its own schedule
+		follower = nil
+	}
+	if follower != nil {
+		vf = func(msg, data []byte) bool {
+			if err := verifyChanges(follower, n.Roster(), msg); err != nil {
+				log.Lvl2(n.ServerIdentity(), "refuses block:", err)
+				return false
+			}
+			return true
+		}
+	}
+	pi, err := protocol.NewPbftProtocol(n, vf)
+	if err != nil {
+		return nil, err
+	}
+	store := nodeStore(n.ServerIdentity().ID)
+	if store == nil && follower == nil {
+		return pi, nil
+	}
+	roster := n.Roster()
+	pi.(*protocol.PbftProtocol).OnCommit = func(msg []byte, certificate []protocol.Commit) {
+		block := &blockchain.TrBlock{}
+		if err := json.Unmarshal(msg, block); err != nil {
+			log.Error(n.ServerIdentity(), "couldn't read committed block:", err)
+			return
+		}
+		if follower != nil {
+			if err := follower.Commit(block.Header.RosterChanges); err != nil {
+				log.Error(n.ServerIdentity(), "couldn't commit roster changes:", err)
+			}
+		}
+		if store == nil {
+			return
+		}
+		err := storeBlock(store, roster, block, msg, certificate)
+		if err == errGap {
+			log.Lvl2(n.ServerIdentity(), "missed blocks before", block.HeaderHash)
+			catchUp(n.ServerIdentity().ID)
+		} else if err != nil {
+			log.Error(n.ServerIdentity(), "couldn't store block:", err)
+		}
+	}
+	return pi, nil
+}
+
+// verifyChanges returns an error if the block isn't of the epoch of the
+// replica, isn't signed by its members or has roster changes that the
+// replica can't accept. Only nodes of the simulation may join.
+func verifyChanges(follower *membership.Follower, roster *onet.Roster, msg []byte) error {
+	block := &blockchain.TrBlock{}
+	if err := json.Unmarshal(msg, block); err != nil {
+		return err
+	}
+	for _, c := range block.Header.RosterChanges {
+		if c.Join && !isNode(c.Member) {
+			return errors.New("unknown node " + c.Member + " joins")
+		}
+	}
+	var signers []string
+	for _, si := range roster.List {
+		signers = append(signers, si.ID.String())
+	}
+	return follower.Verify(block.Header.Epoch, signers, block.Header.RosterChanges)
+}
+
+// isNode returns whether the member is a node of the simulation.
+func isNode(member string) bool {
+	followers.Lock()
+	defer followers.Unlock()
+	if followers.roster == nil {
+		return false
+	}
+	for _, si := range followers.roster.List {
+		if si.ID.String() == member {
+			return true
+		}
+	}
+	return false
 }
 
 // SimulationProtocol implements onet.Simulation.
 type SimulationProtocol struct {
 	onet.SimulationBFTree
+	blockchain.Workload
 	NNodes				int
 	FailingSubleaders	int
 	FailingLeafs		int
 	LoadBlock           bool
 	BlockSize			int // in bytes
+	Erasure				bool // send the block in Reed-Solomon shards
+	Compact				bool // send a compact block, nodes rebuild it from their mempool
+	CompactMissRate		float64 // fraction of the block's transactions missing in a mempool
+	StorePath			string // every node stores the committed blocks in StorePath.<index>, the leader continues its stored chain and replicas that miss blocks catch up
+	EpochLength			int // blocks per epoch, the roster changes at every boundary; 0 keeps the roster
+	StartMembers		int // nodes in the roster of the first epoch, the others join one per epoch
+	Leave				bool // the oldest member after the leader leaves every epoch
 }
 
 // NewSimulationProtocol is used internally to register the simulation (see the init()
@@ -112,6 +296,46 @@ func (s *SimulationProtocol) Node(config *onet.SimulationConfig) error {
 		log.Fatal("Didn't find this node in roster")
 	}
 	log.Lvl3("Initializing node-index", index)
+	if s.Compact && !s.LoadBlock {
+		// every node generates the transactions of the block, as if it got
+		// them by gossip, but misses some of them
+		mempool := blockchain.NodeMempool(config.Server.ServerIdentity.ID.String())
+		miss := rand.New(rand.NewSource(int64(index)))
+		for _, tx := range blockchain.NewGenerator(s.Workload).GenesisBlock(s.BlockSize) {
+			if miss.Float64() >= s.CompactMissRate {
+				mempool.Add(tx)
+			}
+		}
+		log.Lvl3("Node", index, "has", mempool.Len(), "transactions in its mempool")
+	}
+	if s.StorePath != "" {
+		// the store stays open as long as the node runs
+		store, err := blockstore.Open(fmt.Sprintf("%s.%d", s.StorePath, index))
+		if err != nil {
+			return err
+		}
+		stores.Lock()
+		stores.nodes[config.Server.ServerIdentity.ID] = store
+		stores.Unlock()
+		blocksync.RegisterStore(config.Server.ServerIdentity.ID.String(), store)
+		if s.EpochLength == 0 {
+			replicas.Lock()
+			replicas.nodes[config.Server.ServerIdentity.ID] = &replica{
+				config: config,
+				verify: protocol.VerifyEntry(config.Server.Suite(), config.Roster),
+			}
+			replicas.Unlock()
+		}
+	}
+	if s.EpochLength > 0 {
+		// every replica follows the epochs starting like the leader
+		id := config.Server.ServerIdentity.ID
+		follower := membership.NewFollower(id.String(), newSchedule(config, s.StartMembers))
+		followers.Lock()
+		followers.nodes[id] = follower
+		followers.roster = config.Roster
+		followers.Unlock()
+	}
 	return s.SimulationBFTree.Node(config)
 }
 
@@ -122,6 +346,7 @@ var defaultTimeout = 120 * time.Second
 func (s *SimulationProtocol) Run(config *onet.SimulationConfig) error {
 	log.SetDebugVisible(1)
 
+	var block *blockchain.TrBlock
 	var binaryBlock []byte
 
 	if s.LoadBlock {
@@ -133,7 +358,7 @@ func (s *SimulationProtocol) Run(config *onet.SimulationConfig) error {
 
 		log.Lvl1("Run got", len(transactions), "transactions")
 		
-		block, err := GetBlock(3000, transactions, "0", "0", 0)
+		block, err = GetBlock(3000, transactions, "0", "0", 0)
 		if err != nil {
 			return err
 		}
@@ -142,11 +367,37 @@ func (s *SimulationProtocol) Run(config *onet.SimulationConfig) error {
 			return err
 		}
 	} else {
-		log.Lvl1("LoadBlock is false, generating random block of size ", s.BlockSize)
-		binaryBlock = make([]byte, s.BlockSize)
-		rand.Read(binaryBlock)
+		log.Lvl1("LoadBlock is false, generating block of size", s.BlockSize)
+		transactions := blockchain.NewGenerator(s.Workload).GenesisBlock(s.BlockSize)
+		var err error
+		block, err = GetBlock(len(transactions), transactions, "0", "0", 0)
+		if err != nil {
+			return err
+		}
+		binaryBlock, err = block.MarshalBinary()
+		if err != nil {
+			return err
+		}
 	}
 	
+	store := nodeStore(config.Server.ServerIdentity.ID)
+	if store != nil {
+		if r := nodeReplica(config.Server.ServerIdentity.ID); r != nil {
+			// catch up with the nodes that committed blocks we missed
+			if err := syncBlocks(config, config.Tree, r.verify); err != nil {
+				return err
+			}
+		} else {
+			log.Lvl1("Not syncing, the rosters of the stored epochs are unknown")
+		}
+		log.Lvl1("Continuing the stored chain at height", store.Len())
+	}
+
+	var schedule *membership.Schedule
+	if s.EpochLength > 0 {
+		schedule = newSchedule(config, s.StartMembers)
+	}
+
 	size := config.Tree.Size()
 	log.Lvl1("Size is:", size, "rounds:", s.Rounds)
 	log.Lvl1("Simulating for", s.Hosts, "nodes in ", s.Rounds, "round")
@@ -158,14 +409,54 @@ func (s *SimulationProtocol) Run(config *onet.SimulationConfig) error {
 			fullRound = monitor.NewTimeMeasure("fullRound")
 		}
 
-		pi, err := config.Overlay.CreateProtocol(protocol.DefaultProtocolName, config.Tree, onet.NilServiceID)
+		if store != nil {
+			// every round commits a new block on top of the stored ones
+			var err error
+			block, binaryBlock, err = nextBlock(store, block)
+			if err != nil {
+				return err
+			}
+		}
+
+		tree := config.Tree
+		var changes []membership.Change
+		if schedule != nil {
+			var err error
+			tree, changes, err = s.epoch(config, schedule, round)
+			if err != nil {
+				return err
+			}
+			block, binaryBlock, err = epochBlock(block, schedule.Current().Number, changes)
+			if err != nil {
+				return err
+			}
+		}
+
+		pi, err := config.Overlay.CreateProtocol(simulationProtocolName, tree, onet.NilServiceID)
 		if err != nil {
 			return err
 		}
 
 		pbftPprotocol := pi.(*protocol.PbftProtocol)
+		if schedule != nil {
+			// the leader commits the changes when it commits the block, like
+			// the replicas, so that a timeout doesn't leave it in another
+			// epoch. They take effect at the next boundary.
+			onCommit := pbftPprotocol.OnCommit
+			agreed := changes
+			pbftPprotocol.OnCommit = func(msg []byte, certificate []protocol.Commit) {
+				if onCommit != nil {
+					onCommit(msg, certificate)
+				}
+				if err := schedule.Commit(agreed); err != nil {
+					log.Error("Couldn't commit roster changes:", err)
+				}
+			}
+		}
 		pbftPprotocol.Msg = binaryBlock
 		pbftPprotocol.Timeout = defaultTimeout
+		pbftPprotocol.Erasure = s.Erasure
+		pbftPprotocol.Compact = s.Compact
 
 		err = pbftPprotocol.Start()
 		if err != nil {
@@ -198,3 +489,151 @@ func GetBlock(size int, transactions []blkparser.Tx, lastBlock string, lastKeyBl
 	trblock := blockchain.NewTrBlock(trlist, header)
 	return trblock, nil
 }
+
+// syncBlocks fetches the blocks missing in the store of the root of the tree
+// from the stores of the other nodes.
+func syncBlocks(config *onet.SimulationConfig, tree *onet.Tree, verify func(prev, e *blockstore.Entry) error) error {
+	pi, err := config.Overlay.CreateProtocol(blocksync.Name, tree, onet.NilServiceID)
+	if err != nil {
+		return err
+	}
+	p := pi.(*blocksync.Sync)
+	p.Verify = verify
+	if err := p.Start(); err != nil {
+		return err
+	}
+	return <-p.Finished
+}
+
+// nextBlock returns the transactions of block in a block following the last
+// stored block.
+func nextBlock(store *blockstore.Store, block *blockchain.TrBlock) (*blockchain.TrBlock, []byte, error) {
+	parent, err := lastHash(store)
+	if err != nil {
+		return nil, nil, err
+	}
+	next := blockchain.NewTrBlock(block.TransactionList, blockchain.NewHeader(block.TransactionList, parent, "0"))
+	data, err := next.MarshalBinary()
+	return next, data, err
+}
+
+// errGap is returned by storeBlock if the block doesn't follow the last
+// stored block.
+var errGap = errors.New("block doesn't follow the stored chain")
+
+// storeBlock stores the committed block with its certificate of commit
+// messages as signature and the roster indexes of their senders as mask. It
+// is called on every node once the block is committed.
+func storeBlock(store *blockstore.Store, roster *onet.Roster, block *blockchain.TrBlock, data []byte, certificate []protocol.Commit) error {
+	parent, err := lastHash(store)
+	if err != nil {
+		return err
+	}
+	if block.Header.Parent != parent {
+		return errGap
+	}
+	sig, err := json.Marshal(certificate)
+	if err != nil {
+		return err
+	}
+	mask := make([]byte, (len(roster.List)+7)/8)
+	for _, commit := range certificate {
+		for i, si := range roster.List {
+			if si.ID.String() == commit.Sender {
+				mask[i/8] |= 1 << uint(i%8)
+			}
+		}
+	}
+	return store.Append(&blockstore.Entry{
+		Height:    store.Len(),
+		Hash:      []byte(block.HeaderHash),
+		Block:     data,
+		Signature: sig,
+		Mask:      mask,
+	})
+}
+
+// lastHash returns the hash of the last stored block, the parent of the next
+// one, or "0" for an empty store.
+func lastHash(store *blockstore.Store) (string, error) {
+	last, err := store.Last()
+	if err != nil || last == nil {
+		return "0", err
+	}
+	return string(last.Hash), nil
+}
+
+// newSchedule returns the epochs starting with the first members of the
+// roster, all of them if members is 0.
+func newSchedule(config *onet.SimulationConfig, members int) *membership.Schedule {
+	if members <= 0 || members > len(config.Roster.List) {
+		members = len(config.Roster.List)
+	}
+	var ids []string
+	for _, si := range config.Roster.List[:members] {
+		ids = append(ids, si.ID.String())
+	}
+	return membership.NewSchedule(ids)
+}
+
+// epoch starts a new epoch at the boundary and returns the tree of the
+// current epoch. At the first block of an epoch the next node of the roster
+// asks to join and, with Leave, the oldest member after the root asks to
+// leave.
+func (s *SimulationProtocol) epoch(config *onet.SimulationConfig, schedule *membership.Schedule, round int) (*onet.Tree, []membership.Change, error) {
+	if round%s.EpochLength != 0 {
+		return s.epochTree(config, schedule.Current()), nil, nil
+	}
+	if round > 0 {
+		e, err := schedule.NewEpoch(uint64(round))
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Lvl1("Starting epoch", e.Number, "with", len(e.Members), "members")
+	}
+	current := schedule.Current()
+	var changes []membership.Change
+	for _, si := range config.Roster.List {
+		if current.Index(si.ID.String()) < 0 {
+			changes = append(changes, membership.Change{Join: true, Member: si.ID.String()})
+			break
+		}
+	}
+	root := config.Tree.Root.ServerIdentity.ID.String()
+	if s.Leave {
+		for _, m := range current.Members {
+			if m != root {
+				changes = append(changes, membership.Change{Join: false, Member: m})
+				break
+			}
+		}
+	}
+	// drop the changes that would leave the roster too small
+	for len(changes) > 0 && schedule.Validate(changes) != nil {
+		changes = changes[:len(changes)-1]
+	}
+	return s.epochTree(config, current), changes, nil
+}
+
+// epochTree returns the tree of the members of the epoch with the root of
+// the simulation.
+func (s *SimulationProtocol) epochTree(config *onet.SimulationConfig, e *membership.Epoch) *onet.Tree {
+	var list []*network.ServerIdentity
+	for _, si := range config.Roster.List {
+		if e.Index(si.ID.String()) >= 0 {
+			list = append(list, si)
+		}
+	}
+	return onet.NewRoster(list).GenerateNaryTreeWithRoot(s.BF, config.Tree.Root.ServerIdentity)
+}
+
+// epochBlock returns the block with the epoch and the roster changes in its
+// header, which the roster agrees on by signing the block.
+func epochBlock(block *blockchain.TrBlock, epoch uint64, changes []membership.Change) (*blockchain.TrBlock, []byte, error) {
+	header := *block.Header
+	header.Epoch = epoch
+	header.RosterChanges = changes
+	next := blockchain.NewTrBlock(block.TransactionList, &header)
+	data, err := next.MarshalBinary()
+	return next, data, err
+}
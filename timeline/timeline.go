@@ -0,0 +1,83 @@
+// Package timeline logs the phases of the consensus protocols of onet
+// through cothority/log, with its fields attached:
+//	tl := timeline.New(p.ServerIdentity().String(), "pbft", digest)
+//	tl.Phase("commit").Lvl2("Received enough commit messages", "count", n)
+// prints
+//	Received enough commit messages count=12 node=... phase=commit
+//	protocol=pbft round=1a2b3c4d5e6f7a8b ts=1476273487123456
+// The round is the start of the digest of the block, so it is the same on all
+// nodes, and ts is the time in microseconds. Sorting the lines of all nodes
+// with the same round by ts gives the timeline of the round.
+//
+// The environment-variables DEBUG_JSON and DEBUG_PKG of cothority/log select
+// JSON-lines and the debug-level per package, like "pbft=3,blsftcosi=1".
+package timeline
+
+import (
+	"encoding/hex"
+	"time"
+
+	"github.com/csanti/onet/log"
+	clog "github.com/csanti/pbft-experiments/cothority/log"
+)
+
+func init() {
+	clog.ParseEnv()
+}
+
+// FieldTime is the time of the message in microseconds since the epoch.
+const FieldTime = "ts"
+
+// Logger adds the node, the protocol, the round and the phase to every
+// message.
+type Logger struct {
+	ctx *clog.Context
+}
+
+// New returns a Logger for the round deciding on the block with the given
+// digest.
+func New(node, protocol string, digest []byte) *Logger {
+	ctx := clog.NewContext(node, protocol).With(clog.FieldRound, Round(digest))
+	return &Logger{ctx.CallerSkip(1)}
+}
+
+// Round returns the name of the round deciding on the block with the digest.
+func Round(digest []byte) string {
+	if len(digest) > 8 {
+		digest = digest[:8]
+	}
+	return hex.EncodeToString(digest)
+}
+
+// Phase returns a Logger for the phase of the round.
+func (l *Logger) Phase(phase string) *Logger {
+	return &Logger{l.ctx.With(clog.FieldPhase, phase)}
+}
+
+// With returns a Logger with the key set to value.
+func (l *Logger) With(key string, value interface{}) *Logger {
+	return &Logger{l.ctx.With(key, value)}
+}
+
+// Lvl1 prints the message with the fields of the Logger and the additional
+// key/value-pairs in kv.
+func (l *Logger) Lvl1(msg string, kv ...interface{}) { l.now().Lvl1(msg, kv...) }
+
+// Lvl2 is like Lvl1 but at level 2
+func (l *Logger) Lvl2(msg string, kv ...interface{}) { l.now().Lvl2(msg, kv...) }
+
+// Lvl3 is like Lvl1 but at level 3
+func (l *Logger) Lvl3(msg string, kv ...interface{}) { l.now().Lvl3(msg, kv...) }
+
+// Error is like Lvl1 but prints an error
+func (l *Logger) Error(msg string, kv ...interface{}) { l.now().Error(msg, kv...) }
+
+// now returns the context with the time of the message. The global
+// debug-level follows the one of onet/log, so that the -debug flag of the
+// simulation still applies.
+func (l *Logger) now() *clog.Context {
+	if lvl := log.DebugVisible(); lvl != clog.DebugVisible() {
+		clog.SetDebugVisible(lvl)
+	}
+	return l.ctx.With(FieldTime, time.Now().UnixNano()/int64(time.Microsecond))
+}
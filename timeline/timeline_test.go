@@ -0,0 +1,21 @@
+package timeline
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRound(t *testing.T) {
+	assert.Equal(t, "0102", Round([]byte{1, 2}))
+	assert.Equal(t, "0102030405060708", Round([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9}))
+}
+
+func TestLogger_now(t *testing.T) {
+	l := New("node1", "pbft", []byte{0xab}).Phase("commit")
+	fields := l.now().Fields()
+	assert.Equal(t, "node=node1 phase=commit protocol=pbft round=ab",
+		strings.Split(fields.String(), " ts=")[0])
+	assert.NotNil(t, fields[FieldTime])
+}